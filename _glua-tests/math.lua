@@ -10,3 +10,51 @@ local ok, msg = pcall(function()
   math.min()
 end)
 assert(not ok and string.find(msg, "wrong number of arguments"))
+
+-- integer subtype
+assert(math.type(1) == "integer")
+assert(math.type(1.0) == "float")
+assert(math.type(4 / 2) == "float")
+assert(math.type("1") == nil)
+assert(math.type(#"abc") == "integer")
+assert(math.type("10" + 1) == "integer")
+
+local big = 9007199254740993
+assert(big + 1 == 9007199254740994)
+assert(big ~= 2^53)
+assert(big > 2^53 and 2^53 < big)
+assert(tostring(big) == "9007199254740993")
+assert(string.format("%d", big) == "9007199254740993")
+assert(string.format("%5.1f", 1) == "  1.0")
+
+assert(1 == 1.0)
+assert(math.type(math.maxinteger + 1) == "float")
+assert(math.type(-math.mininteger) == "float")
+assert(-7 % 3 == 2 and 7 % -3 == -2)
+assert(math.type(7 % 3) == "integer")
+
+local t = {}
+t[1.0] = "a"
+t[2^60] = "b"
+assert(t[1] == "a" and t[1152921504606846976] == "b")
+for k in pairs(t) do
+  assert(math.type(k) == "integer")
+end
+
+for i = 1, 3 do
+  assert(math.type(i) == "integer")
+end
+local n = 0
+for i = math.maxinteger - 2, math.maxinteger do
+  n = n + 1
+end
+assert(n == 3)
+for i = 1, 2, 0.5 do
+  assert(math.type(i) == "float")
+end
+
+assert(math.tointeger(3.0) == 3 and math.type(math.tointeger(3.0)) == "integer")
+assert(math.tointeger(3.5) == nil and math.tointeger("3") == nil)
+assert(math.type(math.floor(3.7)) == "integer" and math.floor(3.7) == 3)
+assert(math.type(math.floor(2^70)) == "float")
+assert(math.max(1, 2.5) == 2.5 and math.type(math.max(3, 2.5)) == "integer")
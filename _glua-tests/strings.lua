@@ -11,3 +11,58 @@ assert(ret1 == 1)
 assert(ret2 == 3)
 assert(ret3 == "aaa")
 assert(ret4 == 4)
+
+-- string.pack, string.unpack and string.packsize
+local function bytes(s) return table.concat({s:byte(1, -1)}, ",") end
+assert(bytes(string.pack("<i4", 0x01020304)) == "4,3,2,1")
+assert(bytes(string.pack(">i4", 0x01020304)) == "1,2,3,4")
+assert(bytes(string.pack("<i3", -2)) == "254,255,255")
+assert(string.unpack("<i3", "\254\255\255") == -2)
+assert(string.unpack("<I3", "\254\255\255") == 0xFFFFFE)
+assert(bytes(string.pack(">I16", 1)) == "0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,1")
+assert(string.unpack(">i16", string.pack(">i16", -3)) == -3)
+assert(string.unpack("<i9", string.pack("<i9", -1)) == -1)
+assert(bytes(string.pack("!<b i4", 1, 2)) == "1,0,0,0,2,0,0,0")
+assert(bytes(string.pack("<b x h", 1, 2)) == "1,0,2,0")
+assert(bytes(string.pack("<i2 I2", 3.0, -0.0)) == "3,0,0,0")
+assert(string.packsize("!b i4") == 8)
+assert(string.packsize("!2 b d") == 10)
+assert(string.packsize("b Xi4 i2") == 3)
+assert(string.packsize("!b Xi4 i2") == 6)
+assert(string.packsize("") == 0)
+
+local packed = string.pack("s1 z c5", "ab", "cd", "ef")
+assert(bytes(packed) == "2,97,98,99,100,0,101,102,0,0,0")
+local a, b, c, pos = string.unpack("s1 z c5", packed)
+assert(a == "ab" and b == "cd" and c == "ef\0\0\0" and pos == 12)
+local f, d, n = string.unpack("<f d n", string.pack("<f d n", 1.5, -2.25, 3))
+assert(f == 1.5 and d == -2.25 and n == 3 and math.type(n) == "float")
+assert(string.unpack("<i2", "\1\0\2\0", 3) == 2)
+assert(string.unpack("<i2", "\1\0\2\0", -2) == 2)
+assert(select("#", string.unpack("<i2 i2", "\1\0\2\0")) == 3)
+
+for _, case in ipairs({
+  {string.pack, {"i17", 1}, "integral size %(17%) out of limits %[1,16%]"},
+  {string.pack, {"c", ""}, "missing size for format option 'c'"},
+  {string.pack, {"y", 1}, "invalid format option 'y'"},
+  {string.pack, {"!3 i4", 1}, "format asks for alignment not power of 2"},
+  {string.pack, {"i4 X", 1}, "invalid next option for option 'X'"},
+  {string.pack, {"Xc1", "a"}, "invalid next option for option 'X'"},
+  {string.pack, {"i1", 128}, "integer overflow"},
+  {string.pack, {"i4", 1.5}, "number has no integer representation"},
+  {string.pack, {"I4", -0.5}, "number has no integer representation"},
+  {string.pack, {"I1", 256}, "unsigned overflow"},
+  {string.pack, {"s1", string.rep("x", 256)}, "string length does not fit in given size"},
+  {string.pack, {"c2", "abc"}, "string longer than given size"},
+  {string.pack, {"z", "a\0b"}, "string contains zeros"},
+  {string.packsize, {"s"}, "variable%-length format"},
+  {string.packsize, {"z"}, "variable%-length format"},
+  {string.unpack, {"i4", "abc"}, "data string too short"},
+  {string.unpack, {"s1", "\5ab"}, "data string too short"},
+  {string.unpack, {"z", "abc"}, "unfinished string for format 'z'"},
+  {string.unpack, {"i4", "abcd", 6}, "initial position out of bounds"},
+  {string.unpack, {"i9", "\0\0\0\0\0\0\0\0\1"}, "9%-byte integer does not fit into Lua Integer"},
+}) do
+  local ok, msg = pcall(case[1], unpack(case[2]))
+  assert(not ok and string.find(msg, case[3]), msg)
+end
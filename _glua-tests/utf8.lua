@@ -0,0 +1,64 @@
+local s = "h\195\169llo, \228\184\150\231\149\140 \240\159\152\128"
+
+-- char and codepoint
+assert(utf8.char() == "")
+assert(utf8.char(72, 233, 0x4e16, 0x1F600) == "H\195\169\228\184\150\240\159\152\128")
+assert(utf8.char(0x7FFFFFFF) == "\253\191\191\191\191\191")
+assert(utf8.codepoint(s) == 104)
+assert(select("#", utf8.codepoint(s, 1, -1)) == 11)
+assert(select(11, utf8.codepoint(s, 1, -1)) == 0x1F600)
+assert(select("#", utf8.codepoint("abc", 4, 3)) == 0)
+assert(utf8.codepoint(utf8.char(0x7FFFFFFF), 1, 1, true) == 0x7FFFFFFF)
+
+local ok, msg = pcall(utf8.char, -1)
+assert(not ok and string.find(msg, "value out of range"))
+ok, msg = pcall(utf8.codepoint, "abc", 4)
+assert(not ok and string.find(msg, "out of bounds"))
+ok, msg = pcall(utf8.codepoint, "\244\144\128\128")
+assert(not ok and string.find(msg, "invalid UTF%-8 code"))
+assert(utf8.codepoint("\244\144\128\128", 1, 1, true) == 0x110000)
+
+-- len
+assert(utf8.len(s) == 11 and #s == 19)
+assert(utf8.len("") == 0)
+assert(utf8.len(s, 9) == 4)
+assert(utf8.len(s, -4) == 1)
+local n, pos = utf8.len("abc\228")
+assert(n == nil and pos == 4)
+n, pos = utf8.len("\192\128")
+assert(n == nil and pos == 1)
+assert(utf8.len("\237\160\128") == nil)
+assert(utf8.len("\237\160\128", 1, -1, true) == 1)
+ok, msg = pcall(utf8.len, "abc", 5)
+assert(not ok and string.find(msg, "initial position out of bounds"))
+
+-- offset
+assert(utf8.offset(s, 3) == 4)
+assert(utf8.offset(s, -1) == 16)
+assert(utf8.offset(s, 0, 3) == 2)
+assert(utf8.offset(s, 12) == 20)
+assert(utf8.offset(s, 13) == nil)
+assert(utf8.offset("abc", -4) == nil)
+ok, msg = pcall(utf8.offset, s, 1, 3)
+assert(not ok and string.find(msg, "continuation byte"))
+
+-- codes
+local codes = {}
+for p, c in utf8.codes(s) do
+  table.insert(codes, p .. ":" .. c)
+end
+assert(table.concat(codes, " ") == "1:104 2:233 4:108 5:108 6:111 7:44 8:32 9:19990 12:30028 15:32 16:128512")
+for p, c in utf8.codes("\237\160\128", true) do
+  assert(p == 1 and c == 0xD800)
+end
+ok, msg = pcall(function() for _ in utf8.codes("a\128") do end end)
+assert(not ok and string.find(msg, "invalid UTF%-8 code"))
+ok, msg = pcall(function() for _ in utf8.codes("\237\160\128") do end end)
+assert(not ok and string.find(msg, "invalid UTF%-8 code"))
+
+-- charpattern
+local chars = {}
+for c in s:gmatch(utf8.charpattern) do
+  table.insert(chars, c)
+end
+assert(#chars == 11 and chars[2] == "\195\169" and chars[11] == "\240\159\152\128")
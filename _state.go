@@ -10,7 +10,6 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 	"unsafe"
 
 	"github.com/hsfzxjy/gopher-lua/parse"
@@ -27,12 +26,27 @@ type ApiError struct {
 	Type       ApiErrorType
 	Object     LValue
 	StackTrace string
-	// Underlying error. This attribute is set only if the Type is ApiErrorFile or ApiErrorSyntax
+	// Underlying error. This attribute is set only if the Type is ApiErrorFile or ApiErrorSyntax,
+	// or if the error has been raised by RaiseGoError
 	Cause error
+	// Active functions when the error was raised, innermost first
+	Frames []StackFrame
+}
+
+// StackFrame describes an active function of a stack traceback.
+type StackFrame struct {
+	// Name is the name of the function as it appears in tracebacks
+	Name string
+	// Source is the chunk name of a Lua function, "[G]" for a Go function
+	Source string
+	// CurrentLine is the line being executed, or -1 for a Go function
+	CurrentLine int
+	LineDefined int
+	IsG         bool
 }
 
 func newApiError(code ApiErrorType, object LValue) *ApiError {
-	return &ApiError{code, object, "", nil}
+	return &ApiError{Type: code, Object: object}
 }
 
 func newApiErrorS(code ApiErrorType, message string) *ApiError {
@@ -40,7 +54,7 @@ func newApiErrorS(code ApiErrorType, message string) *ApiError {
 }
 
 func newApiErrorE(code ApiErrorType, err error) *ApiError {
-	return &ApiError{code, LString(err.Error()).AsLValue(), "", err}
+	return &ApiError{Type: code, Object: LString(err.Error()).AsLValue(), Cause: err}
 }
 
 func (e *ApiError) Error() string {
@@ -50,6 +64,10 @@ func (e *ApiError) Error() string {
 	return e.Object.String()
 }
 
+func (e *ApiError) Unwrap() error {
+	return e.Cause
+}
+
 type ApiErrorType int
 
 const (
@@ -109,6 +127,22 @@ type Options struct {
 
 	// If `LaxGC` is set, objects are not guaranteed to be finalized for better performance.
 	LaxGC bool
+
+	// Maximum number of bytes the state and its threads may allocate. Exceeding it raises
+	// a "not enough memory" error. A value of 0 means no limit. See `LState.SetMemoryLimit`.
+	MemoryLimit int
+	// Maximum number of VM instructions the state and its threads may execute before an
+	// "instruction limit exceeded" error is raised. A value of 0 means no limit. See
+	// `LState.SetInstructionBudget`.
+	InstructionLimit int64
+	// If `ChannelCopy` is set, the channel library sends tables, functions and userdata
+	// as copies made by `CopyValue` with these options, so that states running on
+	// different goroutines can exchange them. The receiving state copies the value
+	// again into itself; Go code receiving from the channel does so with `CopyValue`.
+	ChannelCopy *CopyOptions
+	// Version of the Lua language compiled by `Load` and implemented by the standard
+	// libraries. The zero value is `Lua51`.
+	LanguageVersion LanguageVersion
 }
 
 /* }}} */
@@ -141,6 +175,8 @@ type callFrame struct {
 	NArgs      int
 	NRet       int
 	TailCall   int
+	// set while a Go function waits for a call made with CallK or PCallK
+	cont *continuation
 }
 
 // FramesPerSegment should be a power of 2 constant for performance reasons. It will allow the go compiler to change
@@ -580,13 +616,18 @@ func (rg *registry) IsFull() bool {
 /* Global {{{ */
 
 func newGlobal() *Global {
-	return &Global{
+	g := &Global{
 		MainThread: nil,
-		Registry:   newLTable(0, 32),
-		Global:     newLTable(0, 64),
 		builtinMts: make(map[int]LValue),
+		customData: newCustomDataRegistry(),
+		finalizers: newFinalizerSet(),
 		tempFiles:  make([]*os.File, 0, 10),
+		weakTables: make(weakTableSet),
 	}
+	g.mem.g = g
+	g.Registry = g.mem.newTable(0, 32)
+	g.Global = g.mem.newTable(0, 64)
+	return g
 }
 
 /* }}} */
@@ -596,11 +637,14 @@ func newGlobal() *Global {
 func panicWithTraceback(L *LState) {
 	err := newApiError(ApiErrorRun, L.Get(-1))
 	err.StackTrace = L.stackTrace(0)
+	err.Frames = L.stackFrames()
+	err.Cause = L.G.goErrors.get(err.Object)
 	panic(err)
 }
 
 func panicWithoutTraceback(L *LState) {
 	err := newApiError(ApiErrorRun, L.Get(-1))
+	err.Cause = L.G.goErrors.get(err.Object)
 	panic(err)
 }
 
@@ -616,7 +660,6 @@ func newLState(options Options) *LState {
 		currentFrame: nil,
 		wrapped:      false,
 		uvcache:      nil,
-		hasErrorFunc: false,
 		mainLoop:     mainLoop,
 		ctx:          nil,
 	}
@@ -627,6 +670,14 @@ func newLState(options Options) *LState {
 	}
 	ls.reg = newRegistry(ls, options.RegistrySize, options.RegistryGrowStep, options.RegistryMaxSize, options.LaxGC)
 	ls.Env = ls.G.Global
+	ls.G.CurrentThread = ls
+	ls.G.mem.limit = int64(options.MemoryLimit)
+	ls.G.mem.charge(memThreadSize + options.RegistrySize*memArrayEntry)
+	ls.G.budget.remaining = -1
+	ls.G.budget.reset()
+	if options.InstructionLimit > 0 {
+		ls.SetInstructionBudget(options.InstructionLimit)
+	}
 	return ls
 }
 
@@ -666,23 +717,18 @@ func (ls *LState) printCallStack() {
 	println("-------------------------")
 }
 
-func (ls *LState) closeAllUpvalues() { // +inline-start
-	for cf := ls.currentFrame; cf != nil; cf = cf.Parent {
-		if !cf.Fn.IsG {
-			ls.closeUpvalues(cf.LocalBase)
-		}
-	}
-} // +inline-end
-
 func (ls *LState) raiseError(level int, format string, args ...interface{}) {
-	if !ls.hasErrorFunc {
-		ls.closeAllUpvalues()
-	}
 	message := format
 	args = AnysNormalize(args)
 	if len(args) > 0 {
 		message = fmt.Sprintf(format, args...)
 	}
+	ls.raiseMessage(level, message, nil)
+}
+
+// raiseMessage raises message as an error, associated with the Go error
+// cause if it is not nil.
+func (ls *LState) raiseMessage(level int, message string, cause error) {
 	if level > 0 {
 		message = fmt.Sprintf("%v %v", ls.where(level-1, true), message)
 	}
@@ -690,7 +736,11 @@ func (ls *LState) raiseError(level int, format string, args ...interface{}) {
 		// if the registry is full then it won't be possible to push a value, in this case, force a larger size
 		ls.reg.forceResize(ls.reg.Top() + 1)
 	}
-	ls.reg.Push(LString(message).AsLValue())
+	lv := LString(message).AsLValue()
+	if cause != nil {
+		ls.G.goErrors.set(lv, cause)
+	}
+	ls.reg.Push(lv)
 	ls.Panic(ls)
 }
 
@@ -764,6 +814,25 @@ func (ls *LState) stackTrace(level int) string {
 	return fmt.Sprintf("%s\n%s", header, strings.Join(buf, "\n"))
 }
 
+// stackFrames returns the active functions, innermost first.
+func (ls *LState) stackFrames() []StackFrame {
+	var frames []StackFrame
+	for cf := ls.currentFrame; cf != nil; cf = cf.Parent {
+		name, _ := ls.frameFuncName(cf)
+		frame := StackFrame{Name: name, Source: "[G]", CurrentLine: -1, IsG: cf.Fn.IsG}
+		if !cf.Fn.IsG {
+			proto := cf.Fn.Proto
+			frame.Source = proto.SourceName
+			frame.LineDefined = proto.LineDefined
+			if cf.Pc > 0 && cf.Pc <= len(proto.DbgSourcePositions) {
+				frame.CurrentLine = proto.DbgSourcePositions[cf.Pc-1]
+			}
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
 func (ls *LState) formattedFrameFuncName(fr *callFrame) string {
 	name, ischunk := ls.frameFuncName(fr)
 	if ischunk {
@@ -780,6 +849,22 @@ func (ls *LState) rawFrameFuncName(fr *callFrame) string {
 	return name
 }
 
+// currentFuncName returns the name of the running function. Go functions
+// called through the IsFast path run without a frame of their own, so their
+// name is looked up from the calling instruction instead.
+func (ls *LState) currentFuncName() string {
+	if ls.fastCallLBase > 0 && ls.currentFrame != nil && !ls.currentFrame.Fn.IsG {
+		pc := ls.currentFrame.Pc - 1
+		for _, call := range ls.currentFrame.Fn.Proto.DbgCalls {
+			if call.Pc == pc {
+				return call.Name
+			}
+		}
+		return "?"
+	}
+	return ls.rawFrameFuncName(ls.currentFrame)
+}
+
 func (ls *LState) frameFuncName(fr *callFrame) (string, bool) {
 	frame := fr.Parent
 	if frame == nil {
@@ -891,6 +976,55 @@ func (ls *LState) closeUpvalues(idx int) { // +inline-start
 	}
 } // +inline-end
 
+// markToBeClosed marks register idx, which holds a <close> variable of the
+// running function, to be closed when the variable goes out of scope.
+func (ls *LState) markToBeClosed(idx int) {
+	v := ls.reg.Get(idx)
+	if LVIsFalse(v) {
+		return
+	}
+	if ls.metaOp1(v, "__close").EqualsLNil() {
+		cf := ls.currentFrame
+		name, _ := cf.Fn.Proto.localName(idx-cf.LocalBase+1, cf.Pc-1)
+		ls.RaiseError("variable '%s' got a non-closable value", name)
+	}
+	ls.tbcVars = append(ls.tbcVars, idx)
+}
+
+// closeVars calls the __close metamethods of the to-be-closed variables held
+// by registers at or above idx, in the reverse order of their declaration.
+func (ls *LState) closeVars(idx int) {
+	for n := len(ls.tbcVars); n > 0 && ls.tbcVars[n-1] >= idx; n = len(ls.tbcVars) {
+		v := ls.reg.Get(ls.tbcVars[n-1])
+		ls.tbcVars = ls.tbcVars[:n-1]
+		ls.reg.Push(ls.metaOp1(v, "__close"))
+		ls.reg.Push(v)
+		ls.reg.Push(LNil)
+		ls.Call(2, 0)
+	}
+}
+
+// closeVarsOnError closes the to-be-closed variables held by registers at or
+// above idx while err unwinds the stack, passing the error object to the
+// __close metamethods. An error raised by a metamethod replaces err.
+func (ls *LState) closeVarsOnError(idx int, err *ApiError) *ApiError {
+	for n := len(ls.tbcVars); n > 0 && ls.tbcVars[n-1] >= idx; n = len(ls.tbcVars) {
+		v := ls.reg.Get(ls.tbcVars[n-1])
+		ls.tbcVars = ls.tbcVars[:n-1]
+		if LVIsFalse(v) {
+			// cleared by a failing error handler
+			continue
+		}
+		ls.reg.Push(ls.metaOp1(v, "__close"))
+		ls.reg.Push(v)
+		ls.reg.Push(err.Object)
+		if cerr := ls.PCall(2, 0, nil); cerr != nil {
+			err = cerr.(*ApiError)
+		}
+	}
+	return err
+}
+
 func (ls *LState) findUpvalue(idx int) *Upvalue {
 	var prev *Upvalue
 	var next *Upvalue
@@ -926,8 +1060,8 @@ func (ls *LState) metatable(lvalue LValue, rawget bool) LValue {
 	case LTUserData:
 		metatable = lvalue.MustLUserData().Metatable
 	default:
-		if entry, ok := cdr.Entry(typ); ok {
-			return entry.metatable.AsLValue()
+		if entry, ok := ls.customDataEntry(typ); ok {
+			metatable = entry.Metatable()
 		} else if table, ok := ls.G.builtinMts[int(lvalue.Type())]; ok {
 			metatable = table
 		}
@@ -1043,11 +1177,11 @@ func (ls *LState) initCallFrame(cf *callFrame) { // +inline-start
 			if CompatVarArg {
 				ls.reg.SetTop(cf.LocalBase + nargs + np + 1)
 				if (proto.IsVarArg & VarArgNeedsArg) != 0 {
-					argtb := newLTable(nvarargs, 0)
+					argtb := ls.G.mem.newTable(nvarargs, 0)
 					for i := 0; i < nvarargs; i++ {
 						argtb.RawSetInt(i+1, ls.reg.Get(cf.LocalBase+np+i))
 					}
-					argtb.RawSetString("n", LNumber(nvarargs).AsLValue())
+					argtb.RawSetString("n", LInteger(nvarargs).AsLValue())
 					//ls.reg.Set(cf.LocalBase+nargs+np, argtb)
 					ls.reg.array[cf.LocalBase+nargs+np] = argtb.AsLValue()
 				} else {
@@ -1067,7 +1201,7 @@ func (ls *LState) pushCallFrame(cf callFrame, fn LValue, meta bool) { // +inline
 		ls.reg.Insert(fn, cf.LocalBase)
 	}
 	if cf.Fn == nil {
-		ls.RaiseError("attempt to call a non-function object")
+		ls.RaiseError("attempt to call a non-function object%s", ls.varInfo(fn))
 	}
 	if ls.stack.IsFull() {
 		ls.RaiseError("stack overflow")
@@ -1075,15 +1209,31 @@ func (ls *LState) pushCallFrame(cf callFrame, fn LValue, meta bool) { // +inline
 	newcf := ls.stack.Push(cf)
 	// +inline-call ls.initCallFrame newcf
 	ls.currentFrame = newcf
+	if ls.hook != nil {
+		ls.hookCall()
+	}
 } // +inline-end
 
 func (ls *LState) callR(nargs, nret, rbase int) {
+	ls.nonYieldableCalls++
+	ls.call(nargs, nret, rbase)
+	ls.nonYieldableCalls--
+}
+
+// call calls the function below the nargs arguments on the top of the stack.
+// It returns false if the coroutine has yielded before the call returned.
+func (ls *LState) call(nargs, nret, rbase int) bool {
+	parent := ls.Parent
 	base := ls.reg.Top() - nargs - 1
 	if rbase < 0 {
 		rbase = base
 	}
 	lv := ls.reg.Get(base)
 	fn, meta := ls.metaCall(lv)
+	if p := ls.G.profiler; p != nil && parent == nil && !ls.isStarted() {
+		// the host starts running the state, which was idle until now
+		p.ticks.Store(0)
+	}
 	ls.pushCallFrame(callFrame{
 		Fn:         fn,
 		Pc:         0,
@@ -1098,13 +1248,17 @@ func (ls *LState) callR(nargs, nret, rbase int) {
 	if ls.G.MainThread == nil {
 		ls.G.MainThread = ls
 		ls.G.CurrentThread = ls
-		ls.mainLoop(ls, nil)
+		ls.runMainLoop(nil)
 	} else {
-		ls.mainLoop(ls, ls.currentFrame)
+		ls.runMainLoop(ls.currentFrame)
+	}
+	if parent != nil && ls.Parent == nil {
+		return false
 	}
 	if nret != MultRet {
 		ls.reg.SetTop(rbase + nret)
 	}
+	return true
 }
 
 func (ls *LState) getFieldSlow(obj LValue, key LValue, istable bool) LValue {
@@ -1114,7 +1268,7 @@ func (ls *LState) getFieldSlow(obj LValue, key LValue, istable bool) LValue {
 		metaindex := ls.metaOp1(curobj, "__index")
 		if metaindex.EqualsLNil() {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key.String())
+				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'%s", curobj.Type().String(), key.String(), ls.varInfo(curobj))
 			}
 			return LValue{}
 		}
@@ -1162,7 +1316,7 @@ func (ls *LState) getFieldStringSlow(obj LValue, key string, istable bool) LValu
 		metaindex := ls.metaOp1(curobj, "__index")
 		if metaindex.EqualsLNil() {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key)
+				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'%s", curobj.Type().String(), key, ls.varInfo(curobj))
 			}
 			return LValue{}
 		}
@@ -1211,7 +1365,7 @@ func (ls *LState) deleteField(obj LValue, key LValue) {
 		metaindex := ls.metaOp1(curobj, "__newindex")
 		if metaindex.EqualsLNil() {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key.String())
+				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'%s", curobj.Type().String(), key.String(), ls.varInfo(curobj))
 			}
 			return
 		}
@@ -1242,6 +1396,9 @@ func (ls *LState) setField(obj LValue, key LValue, value LValue) {
 			*setter = value
 			return
 		}
+		if tb.weak != nil && tb.weakReplace(key, value) {
+			return
+		}
 	}
 	ls.setFieldSlow(obj, key, value)
 }
@@ -1257,7 +1414,7 @@ func (ls *LState) setFieldSlow(obj LValue, key LValue, value LValue) {
 		metaindex := ls.metaOp1(curobj, "__newindex")
 		if metaindex.EqualsLNil() {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key.String())
+				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'%s", curobj.Type().String(), key.String(), ls.varInfo(curobj))
 			}
 			ls.RawSet(tb, key, value)
 			return
@@ -1280,6 +1437,9 @@ func (ls *LState) setFieldSlow(obj LValue, key LValue, value LValue) {
 				*setter = value
 				return
 			}
+			if tb.weak != nil && tb.weakReplace(key, value) {
+				return
+			}
 		}
 	}
 	ls.RaiseError("too many recursions in settable")
@@ -1301,11 +1461,14 @@ func (ls *LState) setFieldString(obj LValue, key string, value LValue) {
 				*setter = value
 				return
 			}
+			if tb.weak != nil && tb.weakReplace(vkey, value) {
+				return
+			}
 		}
 		metaindex := ls.metaOp1(curobj, "__newindex")
 		if metaindex.EqualsLNil() {
 			if !istable {
-				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'", curobj.Type().String(), key)
+				ls.RaiseError("attempt to index a non-table object(%v) with key '%s'%s", curobj.Type().String(), key, ls.varInfo(curobj))
 			}
 			tb.RawSetString(key, value)
 			return
@@ -1364,12 +1527,16 @@ func (ls *LState) IsClosed() bool {
 }
 
 func (ls *LState) Close() {
+	// errors raised by finalizers are ignored when the state is closed
+	ls.runFinalizers(ls.G.finalizers, ls.G.finalizers.takeAll())
 	atomic.AddInt32(&ls.stop, 1)
+	ls.closeLoop()
 	for _, file := range ls.G.tempFiles {
 		// ignore errors in these operations
 		file.Close()
 		os.Remove(file.Name())
 	}
+	ls.G.customData.unregisterAll()
 	ls.stack.FreeAll()
 	ls.stack = nil
 }
@@ -1526,33 +1693,56 @@ func (ls *LState) Remove(index int) {
 /* object allocation {{{ */
 
 func (ls *LState) NewTable() *LTable {
-	return newLTable(defaultArrayCap, defaultHashCap)
+	return ls.G.mem.newTable(defaultArrayCap, defaultHashCap)
 }
 
 func (ls *LState) CreateTable(acap, hcap int) *LTable {
-	return newLTable(acap, hcap)
+	return ls.G.mem.newTable(acap, hcap)
 }
 
 // NewThread returns a new LState that shares with the original state all global objects.
 // If the original state has context.Context, the new state has a new child context of the original state and this function returns its cancel function.
 func (ls *LState) NewThread() (*LState, context.CancelFunc) {
+	ls.G.mem.charge(memThreadSize + ls.Options.RegistrySize*memArrayEntry)
 	thread := newLState(ls.Options)
 	thread.G = ls.G
 	thread.Env = ls.Env
 	var f context.CancelFunc = nil
 	if ls.ctx != nil {
-		thread.mainLoop = mainLoopWithContext
 		thread.ctx, f = context.WithCancel(ls.ctx)
 		thread.ctxCancelFn = f
 	}
+	ls.inheritHook(thread)
+	thread.updateMainLoop()
 	return thread, f
 }
 
+// NewFunctionFromProto creates a function from a compiled function, with the
+// global environment of the state. If its first upvalue is _ENV, as in the
+// main function of a chunk compiled for Lua 5.2 or later, it is set to the
+// environment; the other upvalues are left nil.
 func (ls *LState) NewFunctionFromProto(proto *FunctionProto) *LFunction {
-	return newLFunctionL(proto, ls.Env, int(proto.NumUpvalues))
+	ls.G.mem.charge(memFunctionSize + int(proto.NumUpvalues)*memUpvalueSize)
+	return newProtoFunction(proto, ls.Env)
+}
+
+// newProtoFunction creates a function of proto with the environment env,
+// setting its _ENV upvalue to env like the load function of Lua 5.2.
+func newProtoFunction(proto *FunctionProto, env *LTable) *LFunction {
+	fn := newLFunctionL(proto, env, int(proto.NumUpvalues))
+	if proto.hasEnvUpvalue() {
+		fn.Upvalues[0] = &Upvalue{}
+		fn.Upvalues[0].Close()
+		fn.Upvalues[0].SetValue(env.AsLValue())
+	}
+	return fn
 }
 
 func (ls *LState) NewUserData() *LUserData {
+	if ls.G.finalizers.npend.Load() != 0 {
+		ls.finalizePending()
+	}
+	ls.G.mem.charge(memUserDataSize)
 	return &LUserData{
 		Env:       ls.currentEnv(),
 		Metatable: LNil,
@@ -1560,16 +1750,19 @@ func (ls *LState) NewUserData() *LUserData {
 }
 
 func (ls *LState) NewFunction(fn LGFunction) *LFunction {
+	ls.G.mem.charge(memFunctionSize)
 	return newLFunctionG(fn, ls.currentEnv(), 0)
 }
 
 func (ls *LState) NewFunctionSpec(spec LGFunctionSpec) *LFunction {
+	ls.G.mem.charge(memFunctionSize)
 	fn := newLFunctionG(spec.Fn, ls.currentEnv(), 0)
 	fn.IsFast = spec.IsFast
 	return fn
 }
 
 func (ls *LState) NewClosure(fn LGFunction, upvalues ...LValue) *LFunction {
+	ls.G.mem.charge(memFunctionSize + len(upvalues)*memUpvalueSize)
 	cl := newLFunctionG(fn, ls.currentEnv(), len(upvalues))
 	for i, lv := range upvalues {
 		cl.Upvalues[i] = &Upvalue{}
@@ -1588,24 +1781,17 @@ func (ls *LState) ToBool(n int) bool {
 }
 
 func (ls *LState) ToInt(n int) int {
-	if lv, ok := ls.Get(n).AsLNumber(); ok {
-		return int(lv)
-	}
-	if lv, ok := ls.Get(n).AsLString(); ok {
-		if num, err := parseNumber(string(lv)); err == nil {
-			return int(num)
-		}
-	}
-	return 0
+	return int(ls.ToInt64(n))
 }
 
 func (ls *LState) ToInt64(n int) int64 {
-	if lv, ok := ls.Get(n).AsLNumber(); ok {
-		return int64(lv)
+	if lv, ok := ls.Get(n).asInt64(); ok {
+		return lv
 	}
 	if lv, ok := ls.Get(n).AsLString(); ok {
-		if num, err := parseNumber(string(lv)); err == nil {
-			return int64(num)
+		if num, err := parseNumberValue(string(lv)); err == nil {
+			v, _ := num.asInt64()
+			return v
 		}
 	}
 	return 0
@@ -1616,7 +1802,7 @@ func (ls *LState) ToNumber(n int) LNumber {
 }
 
 func (ls *LState) ToString(n int) string {
-	return LVAsString(ls.Get(n))
+	return ls.lvAsString(ls.Get(n))
 }
 
 func (ls *LState) ToTable(n int) *LTable {
@@ -1660,14 +1846,25 @@ func (ls *LState) RaiseError(format string, args ...interface{}) {
 	ls.raiseError(1, format, args...)
 }
 
+// RaiseGoError raises err as a Lua error. The error message is err.Error()
+// with position information. Lua code catching it with pcall sees the
+// message; the error returned by PCall when it is not caught, or when it is
+// rethrown with error(), has err as its Cause and unwraps to it.
+func (ls *LState) RaiseGoError(err error) {
+	if aerr, ok := err.(*ApiError); ok {
+		if str, ok := aerr.Object.AsLString(); ok {
+			ls.raiseMessage(0, string(str), aerr)
+		}
+		ls.Error(aerr.Object, 0)
+	}
+	ls.raiseMessage(1, err.Error(), err)
+}
+
 // This function is equivalent to lua_error( http://www.lua.org/manual/5.1/manual.html#lua_error ).
 func (ls *LState) Error(lv LValue, level int) {
 	if str, ok := lv.AsLString(); ok {
-		ls.raiseError(level, string(str))
+		ls.raiseMessage(level, string(str), ls.G.goErrors.get(lv))
 	} else {
-		if !ls.hasErrorFunc {
-			ls.closeAllUpvalues()
-		}
 		ls.Push(lv)
 		ls.Panic(ls)
 	}
@@ -1913,7 +2110,7 @@ func (ls *LState) Concat(values ...LValue) string {
 	}
 	ret := stringConcat(ls, len(values), ls.reg.Top()-1)
 	ls.reg.SetTop(top)
-	return LVAsString(ret)
+	return ls.lvAsString(ret)
 }
 
 func (ls *LState) LessThan(lhs, rhs LValue) bool {
@@ -1945,11 +2142,17 @@ func (ls *LState) Load(reader io.Reader, name string) (*LFunction, error) {
 	if err != nil {
 		return nil, newApiErrorE(ApiErrorSyntax, err)
 	}
-	proto, err := Compile(chunk, name)
+	proto, err := CompileVersion(chunk, name, ls.Options.LanguageVersion)
 	if err != nil {
 		return nil, newApiErrorE(ApiErrorSyntax, err)
 	}
-	return newLFunctionL(proto, ls.currentEnv(), 0), nil
+	if !ls.G.mem.reserve(memFunctionSize + chunkSize(proto)) {
+		return nil, newApiErrorS(ApiErrorRun, errNotEnoughMemory)
+	}
+	if c := ls.G.coverage; c != nil {
+		c.add(proto)
+	}
+	return newProtoFunction(proto, ls.currentEnv()), nil
 }
 
 func (ls *LState) Call(nargs, nret int) {
@@ -1957,19 +2160,32 @@ func (ls *LState) Call(nargs, nret int) {
 }
 
 func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
+	_, err = ls.pcall(nargs, nret, errfunc, false)
+	return err
+}
+
+// pcall is PCall. If yieldable is true, the coroutine may yield during the
+// call; pcall then returns false and leaves the stack as the yield left it.
+func (ls *LState) pcall(nargs, nret int, errfunc *LFunction, yieldable bool) (returned bool, err error) {
 	err = nil
 	sp := ls.stack.Sp()
 	base := ls.reg.Top() - nargs - 1
+	nonYieldableCalls := ls.nonYieldableCalls
 	oldpanic := ls.Panic
 	ls.Panic = panicWithoutTraceback
-	if errfunc != nil {
-		ls.hasErrorFunc = true
-	}
 	defer func() {
 		ls.Panic = oldpanic
-		ls.hasErrorFunc = false
 		rcv := recover()
+		if _, ok := rcv.(yieldUnwind); ok {
+			panic(rcv)
+		}
+		if rcv == nil && !returned {
+			return
+		}
 		if rcv != nil {
+			// an error raised by a function on the IsFast path skips its cleanup
+			ls.fastCallLBase = 0
+			ls.nonYieldableCalls = nonYieldableCalls
 			if _, ok := rcv.(*ApiError); !ok {
 				err = newApiErrorS(ApiErrorPanic, fmt.Sprint(rcv))
 				if ls.Options.IncludeGoStackTrace {
@@ -1980,7 +2196,11 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 			} else {
 				err = rcv.(*ApiError)
 			}
+			if err.(*ApiError).Frames == nil {
+				err.(*ApiError).Frames = ls.stackFrames()
+			}
 			if errfunc != nil {
+				frames := err.(*ApiError).Frames
 				ls.Push(errfunc.AsLValue())
 				ls.Push(err.(*ApiError).Object)
 				ls.Panic = panicWithoutTraceback
@@ -1998,6 +2218,7 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 						} else {
 							err = rcv.(*ApiError)
 							err.(*ApiError).StackTrace = ls.stackTrace(0)
+							err.(*ApiError).Frames = ls.stackFrames()
 						}
 						ls.stack.SetSp(sp)
 						ls.currentFrame = ls.stack.Last()
@@ -2006,11 +2227,18 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 				}()
 				ls.Call(1, 1)
 				err = newApiError(ApiErrorError, ls.Get(-1))
+				err.(*ApiError).Frames = frames
+				err.(*ApiError).Cause = ls.G.goErrors.get(err.(*ApiError).Object)
 			} else if len(err.(*ApiError).StackTrace) == 0 {
 				err.(*ApiError).StackTrace = ls.stackTrace(0)
 			}
 			ls.stack.SetSp(sp)
 			ls.currentFrame = ls.stack.Last()
+			// unwind the frames above base
+			if n := len(ls.tbcVars); n > 0 && ls.tbcVars[n-1] >= base {
+				err = ls.closeVarsOnError(base, err.(*ApiError))
+			}
+			ls.closeUpvalues(base)
 			ls.reg.SetTop(base)
 		}
 		ls.stack.SetSp(sp)
@@ -2019,7 +2247,12 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err error) {
 		}
 	}()
 
-	ls.Call(nargs, nret)
+	if yieldable {
+		returned = ls.call(nargs, nret, -1)
+	} else {
+		ls.Call(nargs, nret)
+		returned = true
+	}
 
 	return
 }
@@ -2060,9 +2293,17 @@ func (ls *LState) SetMetatable(obj LValue, mt LValue) {
 
 	switch v := obj; v.Type() {
 	case LTTable:
-		v.MustLTable().Metatable = mt
+		tb := v.MustLTable()
+		tb.Metatable = mt
+		if tb.setWeakMode(weakModeOf(mt)) {
+			ls.G.weakTables[tb.weak.self] = struct{}{}
+		}
 	case LTUserData:
-		v.MustLUserData().Metatable = mt
+		ud := v.MustLUserData()
+		ud.Metatable = mt
+		if hasGCMetamethod(mt) {
+			markUserData(ls.G.finalizers, ud)
+		}
 	default:
 		ls.G.builtinMts[int(obj.Type())] = mt
 	}
@@ -2169,30 +2410,19 @@ func (ls *LState) XMoveTo(other *LState, n int) {
 
 /* GopherLua original APIs {{{ */
 
-// Set maximum memory size. This function can only be called from the main thread.
+// Set maximum memory size in megabytes. This function can only be called from the main thread.
+// Exceeding it raises a "not enough memory" error, see `SetMemoryLimit`.
 func (ls *LState) SetMx(mx int) {
 	if ls.Parent != nil {
 		ls.RaiseError("sub threads are not allowed to set a memory limit")
 	}
-	go func() {
-		limit := uint64(mx * 1024 * 1024) //MB
-		var s runtime.MemStats
-		for atomic.LoadInt32(&ls.stop) == 0 {
-			runtime.ReadMemStats(&s)
-			if s.Alloc >= limit {
-				fmt.Println("out of memory", s.Alloc, limit, mx)
-				println(ls.stackTrace(0))
-				os.Exit(3)
-			}
-			time.Sleep(100 * time.Millisecond)
-		}
-	}()
+	ls.SetMemoryLimit(mx * 1024 * 1024)
 }
 
 // SetContext set a context ctx to this LState. The provided ctx must be non-nil.
 func (ls *LState) SetContext(ctx context.Context) {
-	ls.mainLoop = mainLoopWithContext
 	ls.ctx = ctx
+	ls.updateMainLoop()
 }
 
 // Context returns the LState's context. To change the context, use WithContext.
@@ -2203,8 +2433,8 @@ func (ls *LState) Context() context.Context {
 // RemoveContext removes the context associated with this LState and returns this context.
 func (ls *LState) RemoveContext() context.Context {
 	oldctx := ls.ctx
-	ls.mainLoop = mainLoop
 	ls.ctx = nil
+	ls.updateMainLoop()
 	return oldctx
 }
 
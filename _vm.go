@@ -16,72 +16,97 @@ const (
 	retCFChanged
 )
 
-func mainLoop(L *LState, baseframe *callFrame) {
+// runMainLoop runs the main loop of L until baseframe returns. A loop returns
+// true when it stops to let L switch to the one selected by reloadMainLoop,
+// which is then entered from here rather than from the stopped loop, so that
+// switching does not grow the Go stack.
+func (ls *LState) runMainLoop(baseframe *callFrame) {
+	for ls.mainLoop(ls, baseframe) {
+	}
+}
+
+func mainLoop(L *LState, baseframe *callFrame) bool {
 	var inst uint32
 
 	if L.stack.IsEmpty() {
-		return
+		return false
 	}
 
 	L.currentFrame = L.stack.Last()
 	if L.currentFrame.Fn.IsG {
 		callGFunction(L, false)
-		return
+		return false
 	}
 
 	var (
-		cf   = L.currentFrame
-		code = cf.Fn.Proto.Code
-		ret  int
-		jt   = &jumpTable
+		cf     = L.currentFrame
+		code   = cf.Fn.Proto.Code
+		ret    int
+		jt     = &jumpTable
+		posted = &L.G.posted
 	)
 
 	for {
 		inst = code[cf.Pc]
 		cf.Pc++
+		if posted.pending.Load() && L.runPosted() {
+			// resume at the instruction that has not been executed
+			cf.Pc--
+			return true
+		}
 		ret = jt[int(inst>>26)](L, inst, baseframe)
 		if ret == retOK {
 			continue
 		}
 		switch ret {
 		case retFail:
-			return
+			return false
 		case retFnChanged:
 			code = cf.Fn.Proto.Code
 		case retCFChanged:
 			cf = L.currentFrame
 			code = cf.Fn.Proto.Code
 		}
+		if L.mainLoopChanged {
+			L.mainLoopChanged = false
+			return true
+		}
 	}
 }
 
-func mainLoopWithContext(L *LState, baseframe *callFrame) {
+func mainLoopWithContext(L *LState, baseframe *callFrame) bool {
 	var inst uint32
 
 	if L.stack.IsEmpty() {
-		return
+		return false
 	}
 
 	L.currentFrame = L.stack.Last()
 	if L.currentFrame.Fn.IsG {
 		callGFunction(L, false)
-		return
+		return false
 	}
 
 	var (
-		cf   = L.currentFrame
-		code = cf.Fn.Proto.Code
-		ret  int
-		jt   = &jumpTable
+		cf     = L.currentFrame
+		code   = cf.Fn.Proto.Code
+		ret    int
+		jt     = &jumpTable
+		posted = &L.G.posted
 	)
 
 	for {
 		inst = code[cf.Pc]
 		cf.Pc++
+		if posted.pending.Load() && L.runPosted() {
+			// resume at the instruction that has not been executed
+			cf.Pc--
+			return true
+		}
 		select {
 		case <-L.ctx.Done():
-			L.RaiseError(L.ctx.Err().Error())
-			return
+			L.RaiseGoError(L.ctx.Err())
+			return false
 		default:
 			ret = jt[int(inst>>26)](L, inst, baseframe)
 			if ret == retOK {
@@ -89,13 +114,92 @@ func mainLoopWithContext(L *LState, baseframe *callFrame) {
 			}
 			switch ret {
 			case retFail:
-				return
+				return false
 			case retFnChanged:
 				code = cf.Fn.Proto.Code
 			case retCFChanged:
 				cf = L.currentFrame
 				code = cf.Fn.Proto.Code
 			}
+			if L.mainLoopChanged {
+				L.mainLoopChanged = false
+				return true
+			}
+		}
+	}
+}
+
+func mainLoopWithHooks(L *LState, baseframe *callFrame) bool {
+	var inst uint32
+
+	if L.stack.IsEmpty() {
+		return false
+	}
+
+	L.currentFrame = L.stack.Last()
+	if L.currentFrame.Fn.IsG {
+		callGFunction(L, false)
+		return false
+	}
+
+	var (
+		cf     = L.currentFrame
+		code   = cf.Fn.Proto.Code
+		ret    int
+		jt     = &jumpTable
+		budget = &L.G.budget
+		posted = &L.G.posted
+	)
+
+	for {
+		inst = code[cf.Pc]
+		cf.Pc++
+		if posted.pending.Load() && L.runPosted() {
+			// resume at the instruction that has not been executed
+			cf.Pc--
+			return true
+		}
+		if budget.countdown <= 0 {
+			if L.interrupt() {
+				// resume at the instruction that has not been executed
+				cf.Pc--
+				return false
+			}
+		}
+		budget.countdown--
+		if L.tracing() {
+			L.traceExec(cf)
+		}
+		if p := L.G.profiler; p != nil && p.ticks.Load() != 0 {
+			p.sample(L)
+		}
+		if c := L.G.coverage; c != nil {
+			L.traceCoverage(c, cf)
+		}
+		if L.ctx != nil {
+			select {
+			case <-L.ctx.Done():
+				L.RaiseGoError(L.ctx.Err())
+				return false
+			default:
+			}
+		}
+		ret = jt[int(inst>>26)](L, inst, baseframe)
+		if ret == retOK {
+			continue
+		}
+		switch ret {
+		case retFail:
+			return false
+		case retFnChanged:
+			code = cf.Fn.Proto.Code
+		case retCFChanged:
+			cf = L.currentFrame
+			code = cf.Fn.Proto.Code
+		}
+		if L.mainLoopChanged {
+			L.mainLoopChanged = false
+			return true
 		}
 	}
 }
@@ -146,7 +250,25 @@ func switchToParentThread(L *LState, nargs int, haserror bool, kill bool) {
 
 func callGFunction(L *LState, tailcall bool) bool {
 	frame := L.currentFrame
-	gfnret := frame.Fn.GFunction(L)
+	return finishGFunction(L, frame, frame.Fn.GFunction(L), tailcall)
+}
+
+// finishGFunction returns the gfnret results of the Go function of frame, the
+// current frame, or yields them if gfnret is negative. It returns true if the
+// coroutine has yielded or returned.
+func finishGFunction(L *LState, frame *callFrame, gfnret int, tailcall bool) bool {
+	if gfnret < 0 && L.nonYieldableCalls > 0 && L.Parent != nil {
+		L.RaiseError("attempt to yield across a Go-call boundary")
+	}
+	if L.hook != nil && gfnret >= 0 {
+		L.hookReturn()
+		if tailcall {
+			// the Lua function replaced by this one returns as well
+			L.currentFrame = frame.Parent
+			L.hookReturn()
+			L.currentFrame = frame
+		}
+	}
 	if tailcall {
 		L.currentFrame = L.RemoveCallerFrame()
 	}
@@ -161,7 +283,7 @@ func callGFunction(L *LState, tailcall bool) bool {
 		wantret = gfnret
 	}
 
-	if tailcall && L.Parent != nil && L.stack.Sp() == 1 {
+	if L.Parent != nil && L.stack.Sp() == 1 {
 		switchToParentThread(L, wantret, false, true)
 		return true
 	}
@@ -190,6 +312,7 @@ func threadRun(L *LState) {
 
 	defer func() {
 		if rcv := recover(); rcv != nil {
+			L.fastCallLBase = 0
 			var lv LValue
 			if v, ok := rcv.(*ApiError); ok {
 				lv = v.Object
@@ -210,7 +333,53 @@ func threadRun(L *LState) {
 			}
 		}
 	}()
-	L.mainLoop(L, nil)
+	if L.interruptTop > 0 {
+		// discard the values passed to resume a thread suspended by an interrupt
+		L.reg.SetTop(L.interruptTop - 1)
+		L.interruptTop = 0
+	} else if L.hook != nil && L.stack.Sp() == 1 && L.currentFrame.Pc == 0 {
+		// the body of the coroutine is entered
+		L.hookCall()
+	}
+	L.updateMainLoop()
+	status := ResumeYield
+	for {
+		if !threadStep(L, status) {
+			return
+		}
+		status = ResumeError
+	}
+}
+
+// threadStep runs the thread from its last frame until it yields or returns.
+// The frame of a Go function whose Go stack has been discarded by a yield
+// is completed by calling its continuation with status. threadStep returns
+// true if an error has been caught by such a frame, whose continuation is
+// then to be called with ResumeError.
+func threadStep(L *LState, status ResumeState) (caught bool) {
+	nonYieldableCalls := L.nonYieldableCalls
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			if _, ok := rcv.(yieldUnwind); ok {
+				return
+			}
+			L.nonYieldableCalls = nonYieldableCalls
+			if !L.recoverContinuation(rcv) {
+				panic(rcv)
+			}
+			caught = true
+		}
+	}()
+	for L.Parent != nil && !L.stack.IsEmpty() {
+		L.currentFrame = L.stack.Last()
+		if L.currentFrame.cont != nil {
+			L.callContinuation(status)
+			status = ResumeYield
+		} else {
+			L.runMainLoop(nil)
+		}
+	}
+	return false
 }
 
 type instFunc func(*LState, uint32, *callFrame) int
@@ -399,7 +568,7 @@ func init() {
 			RA := lbase + A
 			B := int(inst & 0x1ff)    //GETB
 			C := int(inst>>9) & 0x1ff //GETC
-			v := newLTable(B, C)
+			v := L.G.mem.newTable(B, C)
 			// +inline-call reg.Set RA v
 			return 0
 		},
@@ -431,7 +600,10 @@ func init() {
 			RA := lbase + A
 			B := int(inst & 0x1ff) //GETB
 			unaryv := L.rkValue(B)
-			if nm, ok := unaryv.AsLNumber(); ok {
+			wrap := L.Options.LanguageVersion >= Lua53
+			if i, ok := unaryv.AsLInteger(); ok && (i != math.MinInt64 || wrap) {
+				// +inline-call reg.Set RA -i
+			} else if nm, ok := unaryv.AsLNumber(); ok {
 				// +inline-call reg.Set RA -nm
 			} else {
 				op := L.metaOp1(unaryv, "__unm")
@@ -441,13 +613,17 @@ func init() {
 					L.Call(1, 1)
 					// +inline-call reg.Set RA reg.Pop()
 				} else if str, ok1 := unaryv.AsLString(); ok1 {
-					if num, err := parseNumber(string(str)); err == nil {
-						// +inline-call reg.Set RA -num
+					if num, err := parseNumberValue(string(str)); err == nil {
+						if i, ok := num.AsLInteger(); ok && (i != math.MinInt64 || wrap) {
+							// +inline-call reg.Set RA -i
+						} else {
+							// +inline-call reg.Set RA -LVAsNumber(num)
+						}
 					} else {
-						L.RaiseError("__unm undefined")
+						L.RaiseError("__unm undefined%s", L.varInfo(unaryv))
 					}
 				} else {
-					L.RaiseError("__unm undefined")
+					L.RaiseError("__unm undefined%s", L.varInfo(unaryv))
 				}
 			}
 			return 0
@@ -476,7 +652,7 @@ func init() {
 			switch lv := L.rkValue(B); lv.Type() {
 			case LTString:
 				lv := lv.MustLString()
-				// +inline-call reg.SetNumber RA LNumber(len(lv))
+				// +inline-call reg.Set RA LInteger(len(lv))
 			default:
 				op := L.metaOp1(lv, "__len")
 				if op.Type() == LTFunction {
@@ -484,20 +660,46 @@ func init() {
 					reg.Push(lv)
 					L.Call(1, 1)
 					ret := reg.Pop()
-					if ret.Type() == LTNumber {
-						v, _ := ret.AsLNumber()
-						// +inline-call reg.SetNumber RA v
-					} else {
-						// +inline-call reg.Set RA ret
-					}
+					// +inline-call reg.Set RA ret
 				} else if lv.Type() == LTTable {
-					// +inline-call reg.SetNumber RA LNumber(lv.MustLTable().Len())
+					// +inline-call reg.Set RA LInteger(lv.MustLTable().Len())
 				} else {
 					L.RaiseError("__len undefined")
 				}
 			}
 			return 0
 		},
+		opArith,   // OP_IDIV
+		opBitwise, // OP_BAND
+		opBitwise, // OP_BOR
+		opBitwise, // OP_BXOR
+		opBitwise, // OP_SHL
+		opBitwise, // OP_SHR
+		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_BNOT
+			reg := L.reg
+			cf := L.currentFrame
+			lbase := cf.LocalBase
+			A := int(inst>>18) & 0xff //GETA
+			RA := lbase + A
+			B := int(inst & 0x1ff) //GETB
+			unaryv := L.rkValue(B)
+			if i, ok := bitwiseOperand(unaryv); ok {
+				// +inline-call reg.Set RA ^i
+			} else {
+				op := L.metaOp1(unaryv, "__bnot")
+				if op.Type() == LTFunction {
+					reg.Push(op)
+					reg.Push(unaryv)
+					L.Call(1, 1)
+					// +inline-call reg.Set RA reg.Pop()
+				} else if _, ok := arithOperand(unaryv); ok {
+					L.RaiseError("number has no integer representation%s", L.varInfo(unaryv))
+				} else {
+					L.RaiseError("__bnot undefined%s", L.varInfo(unaryv))
+				}
+			}
+			return 0
+		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_CONCAT
 			reg := L.reg
 			cf := L.currentFrame
@@ -557,9 +759,9 @@ func init() {
 			rhs := L.rkValue(C)
 			ret := false
 
-			if v1, ok1 := lhs.AsLNumber(); ok1 {
-				if v2, ok2 := rhs.AsLNumber(); ok2 {
-					ret = v1 <= v2
+			if lhs.isNumber() {
+				if rhs.isNumber() {
+					ret = numberLessEqual(lhs, rhs)
 				} else {
 					L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
 				}
@@ -641,7 +843,7 @@ func init() {
 				callable, meta = L.metaCall(lv)
 			}
 
-			if callable != nil && callable.IsFast {
+			if callable != nil && callable.IsFast && L.hook == nil {
 				if callFastGFunction(L, callable, RA, nret, false) {
 					return retFail
 				} else {
@@ -655,9 +857,10 @@ func init() {
 					L.RaiseError("stack overflow")
 				}
 				if callable == nil {
-					L.RaiseError("attempt to call a non-function object")
+					L.RaiseError("attempt to call a non-function object%s", L.varInfo(lv))
 				}
 				newcf := L.stack.PushEmpty()
+				newcf.cont = nil
 				newcf.Fn = callable
 				newcf.Pc = 0
 				newcf.Base = RA
@@ -673,10 +876,15 @@ func init() {
 				}
 				// +inline-call L.initCallFrame newcf
 				L.currentFrame = newcf
+				if L.hook != nil {
+					L.hookCall()
+				}
 			}
 			if callable.IsG {
 				if callGFunction(L, false) {
 					return retFail
+				} else if L.mainLoopChanged {
+					return retCFChanged
 				} else {
 					return 0
 				}
@@ -704,7 +912,7 @@ func init() {
 				callable, meta = L.metaCall(lv)
 			}
 			if callable == nil {
-				L.RaiseError("attempt to call a non-function object")
+				L.RaiseError("attempt to call a non-function object%s", L.varInfo(lv))
 				return 0
 			}
 			// +inline-call L.closeUpvalues lbase
@@ -745,6 +953,9 @@ func init() {
 				// +inline-call L.reg.CopyRange base RA -1 reg.Top()-RA-1
 				cf.Base = base
 				cf.LocalBase = base + (cf.LocalBase - lbase + 1)
+				if L.hook != nil {
+					L.hookCall()
+				}
 				return retFnChanged
 			}
 			return 0
@@ -757,6 +968,9 @@ func init() {
 			RA := lbase + A
 			B := int(inst & 0x1ff) //GETB
 			// +inline-call L.closeUpvalues lbase
+			if n := len(L.tbcVars); n != 0 && L.tbcVars[n-1] >= lbase {
+				L.closeVars(lbase)
+			}
 			nret := B - 1
 			if B == 0 {
 				nret = reg.Top() - RA
@@ -765,6 +979,9 @@ func init() {
 			if cf.NRet == MultRet {
 				n = nret
 			}
+			if L.hook != nil {
+				L.hookReturn()
+			}
 
 			if L.Parent != nil && L.stack.Sp() == 1 {
 				// +inline-call copyReturnValues L reg.Top() RA n B
@@ -785,7 +1002,21 @@ func init() {
 			lbase := cf.LocalBase
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
-			if init, ok1 := reg.Get(RA).AsLNumber(); ok1 {
+			if idx, ok1 := reg.Get(RA).AsLInteger(); ok1 {
+				// integer loops are set up by OP_FORPREP
+				limit := reg.Get(RA + 1).mustLIntegerUnchecked()
+				step := reg.Get(RA + 2).mustLIntegerUnchecked()
+				next := idx + step
+				if (step > 0 && next >= idx && next <= limit) || (step <= 0 && next <= idx && next >= limit) {
+					v := LInteger(next).AsLValue()
+					// +inline-call reg.Set RA v
+					Sbx := int(inst&0x3ffff) - opMaxArgSbx //GETSBX
+					cf.Pc += Sbx
+					// +inline-call reg.Set RA+3 v
+				} else {
+					reg.SetTop(RA + 1)
+				}
+			} else if init, ok1 := reg.Get(RA).AsLNumber(); ok1 {
 				if limit, ok2 := reg.Get(RA + 1).AsLNumber(); ok2 {
 					if step, ok3 := reg.Get(RA + 2).AsLNumber(); ok3 {
 						init += step
@@ -816,7 +1047,10 @@ func init() {
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
 			Sbx := int(inst&0x3ffff) - opMaxArgSbx //GETSBX
-			if init, ok1 := reg.Get(RA).AsLNumber(); ok1 {
+			if start, limit, step, ok := forPrepInteger(reg.Get(RA), reg.Get(RA+1), reg.Get(RA+2)); ok {
+				// +inline-call reg.Set RA LInteger(start-step)
+				// +inline-call reg.Set RA+1 LInteger(limit)
+			} else if init, ok1 := reg.Get(RA).AsLNumber(); ok1 {
 				if step, ok2 := reg.Get(RA + 2).AsLNumber(); ok2 {
 					// +inline-call reg.SetNumber RA LNumber(init-step)
 				} else {
@@ -878,6 +1112,9 @@ func init() {
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
 			// +inline-call L.closeUpvalues RA
+			if n := len(L.tbcVars); n != 0 && L.tbcVars[n-1] >= RA {
+				L.closeVars(RA)
+			}
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_CLOSURE
@@ -888,6 +1125,7 @@ func init() {
 			RA := lbase + A
 			Bx := int(inst & 0x3ffff) //GETBX
 			proto := cf.Fn.Proto.FunctionPrototypes[Bx]
+			L.G.mem.charge(memFunctionSize + int(proto.NumUpvalues)*memUpvalueSize)
 			closure := newLFunctionL(proto, cf.Fn.Env, int(proto.NumUpvalues))
 			// +inline-call reg.Set RA closure
 			for i := 0; i < int(proto.NumUpvalues); i++ {
@@ -922,13 +1160,19 @@ func init() {
 			// +inline-call reg.CopyRange RA cf.Base+nparams+1 cf.LocalBase nwant
 			return 0
 		},
+		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_TBC
+			cf := L.currentFrame
+			A := int(inst>>18) & 0xff //GETA
+			L.markToBeClosed(cf.LocalBase + A)
+			return 0
+		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_NOP
 			return 0
 		},
 	}
 }
 
-func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW
+func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV
 	reg := L.reg
 	cf := L.currentFrame
 	lbase := cf.LocalBase
@@ -939,11 +1183,9 @@ func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SU
 	C := int(inst>>9) & 0x1ff //GETC
 	lhs := L.rkValue(B)
 	rhs := L.rkValue(C)
-	v1, ok1 := lhs.AsLNumber()
-	v2, ok2 := rhs.AsLNumber()
-	if ok1 && ok2 {
-		v := numberArith(L, opcode, LNumber(v1), LNumber(v2))
-		// +inline-call reg.SetNumber RA v
+	if lhs.isNumber() && rhs.isNumber() {
+		v := L.arithNumbers(opcode, lhs, rhs)
+		// +inline-call reg.Set RA v
 	} else {
 		v := objectArith(L, opcode, lhs, rhs)
 		// +inline-call reg.Set RA v
@@ -961,7 +1203,89 @@ func luaModulo(lhs, rhs LNumber) LNumber {
 	return LNumber(v)
 }
 
-func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
+// arithNumbers performs an arithmetic operation on two numbers with the
+// semantics of the language version of L. In Lua 5.3 and later, an integer
+// floor division or modulo by zero is an error.
+func (L *LState) arithNumbers(opcode int, lhs, rhs LValue) LValue {
+	if L.Options.LanguageVersion < Lua53 {
+		return numberArith(opcode, lhs, rhs, false)
+	}
+	if integerDivisionByZero(opcode, lhs, rhs) {
+		if opcode == OP_IDIV {
+			L.RaiseError("attempt to perform 'n//0'")
+		}
+		L.RaiseError("attempt to perform 'n%0'")
+	}
+	return numberArith(opcode, lhs, rhs, true)
+}
+
+// integerDivisionByZero reports whether opcode is a floor division or a
+// modulo of two integers by zero.
+func integerDivisionByZero(opcode int, lhs, rhs LValue) bool {
+	if opcode != OP_IDIV && opcode != OP_MOD {
+		return false
+	}
+	_, ok := lhs.AsLInteger()
+	i, ok2 := rhs.AsLInteger()
+	return ok && ok2 && i == 0
+}
+
+// numberArith performs an arithmetic operation on two numbers. Operations on
+// two integers other than division and exponentiation produce an integer,
+// unless the result overflows or the operation is a floor division or modulo
+// by zero, in which case the float result is produced. If wrap is true, as in
+// Lua 5.3 and later, integer results wrap around on overflow instead; the
+// division by zero is then checked by arithNumbers.
+func numberArith(opcode int, lhs, rhs LValue, wrap bool) LValue {
+	if i1, ok1 := lhs.AsLInteger(); ok1 {
+		if i2, ok2 := rhs.AsLInteger(); ok2 {
+			if v, ok := integerArith(opcode, i1, i2, wrap); ok {
+				return v.AsLValue()
+			}
+		}
+	}
+	v1, _ := lhs.AsLNumber()
+	v2, _ := rhs.AsLNumber()
+	return floatArith(opcode, v1, v2).AsLValue()
+}
+
+func integerArith(opcode int, lhs, rhs LInteger, wrap bool) (LInteger, bool) {
+	switch opcode {
+	case OP_ADD:
+		v := lhs + rhs
+		return v, wrap || (v > lhs) == (rhs > 0)
+	case OP_SUB:
+		v := lhs - rhs
+		return v, wrap || (v < lhs) == (rhs > 0)
+	case OP_MUL:
+		if lhs == 0 || rhs == 0 {
+			return 0, true
+		}
+		v := lhs * rhs
+		return v, wrap || v/rhs == lhs && !(lhs == -1 && rhs == math.MinInt64) && !(rhs == -1 && lhs == math.MinInt64)
+	case OP_MOD:
+		if rhs == 0 {
+			return 0, false
+		}
+		v := lhs % rhs
+		if v != 0 && (v^rhs) < 0 {
+			v += rhs
+		}
+		return v, true
+	case OP_IDIV:
+		if rhs == 0 {
+			return 0, false
+		}
+		v := lhs / rhs
+		if lhs%rhs != 0 && (lhs^rhs) < 0 {
+			v--
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+func floatArith(opcode int, lhs, rhs LNumber) LNumber {
 	switch opcode {
 	case OP_ADD:
 		return lhs + rhs
@@ -977,10 +1301,46 @@ func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
 		flhs := float64(lhs)
 		frhs := float64(rhs)
 		return LNumber(math.Pow(flhs, frhs))
+	case OP_IDIV:
+		return LNumber(math.Floor(float64(lhs / rhs)))
 	}
 	panic("should not reach here")
 }
 
+// forPrepInteger prepares an integer numeric for loop. It fails if the loop
+// has to run on floats, i.e. if init or step is not an integer, or if the
+// limit cannot be clamped to an integer.
+func forPrepInteger(init, limit, step LValue) (LInteger, LInteger, LInteger, bool) {
+	i, ok1 := init.AsLInteger()
+	s, ok2 := step.AsLInteger()
+	if !ok1 || !ok2 || !limit.isNumber() {
+		return 0, 0, 0, false
+	}
+	if (s > 0 && i < math.MinInt64+s) || (s < 0 && i > math.MaxInt64+s) {
+		// init-step would overflow
+		return 0, 0, 0, false
+	}
+	if l, ok := limit.AsLInteger(); ok {
+		return i, l, s, true
+	}
+	f := float64(limit.mustLNumberUnchecked())
+	if math.IsNaN(f) {
+		return 0, 0, 0, false
+	}
+	if s > 0 {
+		f = math.Floor(f)
+	} else {
+		f = math.Ceil(f)
+	}
+	switch {
+	case f >= 1<<63:
+		return i, math.MaxInt64, s, true
+	case f < -(1 << 63):
+		return i, math.MinInt64, s, true
+	}
+	return i, LInteger(f), s, true
+}
+
 func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 	event := ""
 	switch opcode {
@@ -996,6 +1356,8 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		event = "__mod"
 	case OP_POW:
 		event = "__pow"
+	case OP_IDIV:
+		event = "__idiv"
 	}
 	op := L.metaOp2(lhs, rhs, event)
 	if _, ok := op.AsLFunction(); ok {
@@ -1005,23 +1367,154 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		L.Call(2, 1)
 		return L.reg.Pop()
 	}
+	operands := [2]LValue{lhs, rhs}
 	if str, ok := lhs.AsLString(); ok {
-		if lnum, err := parseNumber(string(str)); err == nil {
-			lhs = lnum.AsLValue()
+		if lnum, err := parseNumberValue(string(str)); err == nil {
+			lhs = lnum
 		}
 	}
 	if str, ok := rhs.AsLString(); ok {
-		if rnum, err := parseNumber(string(str)); err == nil {
-			rhs = rnum.AsLValue()
+		if rnum, err := parseNumberValue(string(str)); err == nil {
+			rhs = rnum
 		}
 	}
-	if v1, ok1 := lhs.AsLNumber(); ok1 {
-		if v2, ok2 := rhs.AsLNumber(); ok2 {
-			return numberArith(L, opcode, LNumber(v1), LNumber(v2)).AsLValue()
+	if lhs.isNumber() && rhs.isNumber() {
+		return L.arithNumbers(opcode, lhs, rhs)
+	}
+	culprit := operands[0]
+	if lhs.isNumber() {
+		culprit = operands[1]
+	}
+	L.RaiseError("cannot perform %v operation between %v and %v%s",
+		strings.TrimLeft(event, "_"), lhs.Type().String(), rhs.Type().String(), L.varInfo(culprit))
+
+	return LValue{}
+}
+
+func opBitwise(L *LState, inst uint32, baseframe *callFrame) int { //OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR
+	reg := L.reg
+	cf := L.currentFrame
+	lbase := cf.LocalBase
+	A := int(inst>>18) & 0xff //GETA
+	RA := lbase + A
+	opcode := int(inst >> 26) //GETOPCODE
+	B := int(inst & 0x1ff)    //GETB
+	C := int(inst>>9) & 0x1ff //GETC
+	lhs := L.rkValue(B)
+	rhs := L.rkValue(C)
+	if i1, ok1 := bitwiseOperand(lhs); ok1 {
+		if i2, ok2 := bitwiseOperand(rhs); ok2 {
+			v := integerBitwise(opcode, i1, i2)
+			// +inline-call reg.Set RA v
+			return 0
+		}
+	}
+	v := objectBitwise(L, opcode, lhs, rhs)
+	// +inline-call reg.Set RA v
+	return 0
+}
+
+// arithOperand converts lv, a number or a string convertible to a number, to a
+// number.
+func arithOperand(lv LValue) (LValue, bool) {
+	if lv.isNumber() {
+		return lv, true
+	}
+	if str, ok := lv.AsLString(); ok {
+		if num, err := parseNumberValue(string(str)); err == nil {
+			return num, true
 		}
 	}
-	L.RaiseError(fmt.Sprintf("cannot perform %v operation between %v and %v",
-		strings.TrimLeft(event, "_"), lhs.Type().String(), rhs.Type().String()))
+	return LNil, false
+}
+
+// bitwiseOperand converts lv, a number or a string convertible to a number, to
+// the integer a bitwise operation operates on. It fails if the number has no
+// exact integer representation.
+func bitwiseOperand(lv LValue) (LInteger, bool) {
+	if i, ok := lv.AsLInteger(); ok {
+		return i, true
+	}
+	num, ok := arithOperand(lv)
+	if !ok {
+		return 0, false
+	}
+	if i, ok := num.AsLInteger(); ok {
+		return i, true
+	}
+	n, _ := num.AsLNumber()
+	f := float64(n)
+	if f != math.Floor(f) || f < -(1<<63) || f >= 1<<63 {
+		return 0, false
+	}
+	return LInteger(f), true
+}
+
+func integerBitwise(opcode int, lhs, rhs LInteger) LInteger {
+	switch opcode {
+	case OP_BAND:
+		return lhs & rhs
+	case OP_BOR:
+		return lhs | rhs
+	case OP_BXOR:
+		return lhs ^ rhs
+	case OP_SHL:
+		return shiftLeft(lhs, rhs)
+	case OP_SHR:
+		return shiftLeft(lhs, -rhs)
+	}
+	panic("should not reach here")
+}
+
+// shiftLeft shifts x left by n bits, or logically right by -n bits if n is
+// negative. Shifting by 64 bits or more produces 0.
+func shiftLeft(x, n LInteger) LInteger {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n >= 0:
+		return LInteger(uint64(x) << uint64(n))
+	}
+	return LInteger(uint64(x) >> uint64(-n))
+}
+
+func objectBitwise(L *LState, opcode int, lhs, rhs LValue) LValue {
+	event := ""
+	switch opcode {
+	case OP_BAND:
+		event = "__band"
+	case OP_BOR:
+		event = "__bor"
+	case OP_BXOR:
+		event = "__bxor"
+	case OP_SHL:
+		event = "__shl"
+	case OP_SHR:
+		event = "__shr"
+	}
+	op := L.metaOp2(lhs, rhs, event)
+	if _, ok := op.AsLFunction(); ok {
+		L.reg.Push(op)
+		L.reg.Push(lhs)
+		L.reg.Push(rhs)
+		L.Call(2, 1)
+		return L.reg.Pop()
+	}
+	_, lnum := arithOperand(lhs)
+	_, rnum := arithOperand(rhs)
+	if lnum && rnum {
+		culprit := lhs
+		if _, ok := bitwiseOperand(lhs); ok {
+			culprit = rhs
+		}
+		L.RaiseError("number has no integer representation%s", L.varInfo(culprit))
+	}
+	culprit := lhs
+	if lnum {
+		culprit = rhs
+	}
+	L.RaiseError("cannot perform %v operation between %v and %v%s",
+		strings.TrimLeft(event, "_"), lhs.Type().String(), rhs.Type().String(), L.varInfo(culprit))
 
 	return LValue{}
 }
@@ -1042,21 +1535,30 @@ func stringConcat(L *LState, total, last int) LValue {
 				total--
 				i--
 			} else {
-				L.RaiseError("cannot perform concat operation between %v and %v", lhs.Type().String(), rhs.Type().String())
+				culprit := lhs
+				if LVCanConvToString(lhs) {
+					culprit = rhs
+				}
+				L.RaiseError("cannot perform concat operation between %v and %v%s", lhs.Type().String(), rhs.Type().String(), L.varInfo(culprit))
 				return LValue{}
 			}
 		} else {
 			buf := make([]string, total+1)
-			buf[total] = LVAsString(rhs)
+			buf[total] = L.lvAsString(rhs)
 			for total > 0 {
 				lhs = L.reg.Get(i)
 				if !LVCanConvToString(lhs) {
 					break
 				}
-				buf[total-1] = LVAsString(lhs)
+				buf[total-1] = L.lvAsString(lhs)
 				i--
 				total--
 			}
+			n := 0
+			for _, s := range buf {
+				n += len(s)
+			}
+			L.G.mem.chargeString(n)
 			rhs = LString(strings.Join(buf, "")).AsLValue()
 		}
 	}
@@ -1065,9 +1567,9 @@ func stringConcat(L *LState, total, last int) LValue {
 
 func lessThan(L *LState, lhs, rhs LValue) bool {
 	// optimization for numbers
-	if v1, ok1 := lhs.AsLNumber(); ok1 {
-		if v2, ok2 := rhs.AsLNumber(); ok2 {
-			return v1 < v2
+	if lhs.isNumber() {
+		if rhs.isNumber() {
+			return numberLessThan(lhs, rhs)
 		}
 		L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
 	}
@@ -1085,6 +1587,57 @@ func lessThan(L *LState, lhs, rhs LValue) bool {
 	return ret
 }
 
+// numberLessThan compares two numbers by their mathematical values. Mixed
+// comparisons are exact, as in Lua 5.3.
+func numberLessThan(lhs, rhs LValue) bool {
+	i1, isInt1 := lhs.AsLInteger()
+	i2, isInt2 := rhs.AsLInteger()
+	switch {
+	case isInt1 && isInt2:
+		return i1 < i2
+	case isInt1:
+		// i < f <=> i < ceil(f)
+		f := float64(rhs.mustLNumberUnchecked())
+		if fi, ok := floatToInteger(math.Ceil(f)); ok {
+			return int64(i1) < fi
+		}
+		return f > 0
+	case isInt2:
+		// f < i <=> floor(f) < i
+		f := float64(lhs.mustLNumberUnchecked())
+		if fi, ok := floatToInteger(math.Floor(f)); ok {
+			return fi < int64(i2)
+		}
+		return f < 0
+	}
+	return lhs.mustLNumberUnchecked() < rhs.mustLNumberUnchecked()
+}
+
+// numberLessEqual is like numberLessThan for the <= operator.
+func numberLessEqual(lhs, rhs LValue) bool {
+	i1, isInt1 := lhs.AsLInteger()
+	i2, isInt2 := rhs.AsLInteger()
+	switch {
+	case isInt1 && isInt2:
+		return i1 <= i2
+	case isInt1:
+		// i <= f <=> i <= floor(f)
+		f := float64(rhs.mustLNumberUnchecked())
+		if fi, ok := floatToInteger(math.Floor(f)); ok {
+			return int64(i1) <= fi
+		}
+		return f > 0
+	case isInt2:
+		// f <= i <=> ceil(f) <= i
+		f := float64(lhs.mustLNumberUnchecked())
+		if fi, ok := floatToInteger(math.Ceil(f)); ok {
+			return fi <= int64(i2)
+		}
+		return f < 0
+	}
+	return lhs.mustLNumberUnchecked() <= rhs.mustLNumberUnchecked()
+}
+
 func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	lt := lhs.Type()
 	if lt != rhs.Type() {
@@ -1096,9 +1649,7 @@ func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	case LTNil:
 		ret = true
 	case LTNumber:
-		v1, _ := lhs.AsLNumber()
-		v2, _ := rhs.AsLNumber()
-		ret = v1 == v2
+		ret = numberEquals(lhs, rhs)
 	case LTBool:
 		ret = bool(lhs.MustLBool()) == bool(rhs.MustLBool())
 	case LTString:
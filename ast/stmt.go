@@ -22,7 +22,9 @@ type LocalAssignStmt struct {
 	StmtBase
 
 	Names []string
-	Exprs []Expr
+	// Attribs holds the attribute of each name, "const", "close" or "".
+	Attribs []string
+	Exprs   []Expr
 }
 
 type FuncCallStmt struct {
@@ -0,0 +1,379 @@
+package lua
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+)
+
+/* event loop {{{ */
+
+// eventLoop schedules the tasks of the async library. Tasks are threads
+// resumed by RunLoop; a task suspended by async.sleep waits for a timer, and
+// one suspended by async.wait for a goroutine receiving from a channel.
+//
+// The goroutines of the pending waits only run while RunLoop does: they are
+// stopped when it returns and started again by the next call, and a value
+// received in between is kept in its wait.
+type eventLoop struct {
+	ready   []asyncResume
+	timers  timerHeap
+	events  chan *asyncWaiter
+	waits   map[*asyncWaiter]struct{}
+	current *asyncTask
+	running bool
+	// closed to stop the goroutines of the waits
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type asyncTask struct {
+	th *LState
+	fn *LFunction
+	// set while the task waits for a timer or a channel
+	suspended bool
+}
+
+// asyncResume resumes task with values.
+type asyncResume struct {
+	task   *asyncTask
+	values []LValue
+}
+
+// asyncWaiter is a task waiting for a value from ch.
+type asyncWaiter struct {
+	task *asyncTask
+	ch   chan LValue
+	// set by the goroutine of the wait once it has received from ch
+	values []LValue
+}
+
+// asyncTimer resumes task, or spawns a task running fn, when it expires.
+type asyncTimer struct {
+	when   time.Time
+	period time.Duration
+	task   *asyncTask
+	fn     *LFunction
+	// position in the heap, -1 once the timer is stopped or has expired
+	index int
+}
+
+type timerHeap []*asyncTimer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	t := x.(*asyncTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
+
+func (ls *LState) eventLoop() *eventLoop {
+	if ls.G.loop == nil {
+		ls.G.loop = &eventLoop{events: make(chan *asyncWaiter), waits: make(map[*asyncWaiter]struct{})}
+	}
+	return ls.G.loop
+}
+
+// Spawn creates a task running fn with args, which is started by RunLoop.
+func (ls *LState) Spawn(fn *LFunction, args ...LValue) *LState {
+	th, _ := ls.NewThread()
+	loop := ls.eventLoop()
+	loop.ready = append(loop.ready, asyncResume{task: &asyncTask{th: th, fn: fn}, values: args})
+	return th
+}
+
+// RunLoop runs the tasks created by Spawn or the async library until they
+// have all returned. It returns the error of the first task that fails, or
+// the error of the context of the state if it is done; the other tasks are
+// then left to a later call to RunLoop. Close drops them.
+func (ls *LState) RunLoop() error {
+	loop := ls.eventLoop()
+	if loop.running {
+		return errors.New("event loop already running")
+	}
+	loop.running = true
+	loop.stop = make(chan struct{})
+	defer func() {
+		loop.disarm()
+		loop.running = false
+	}()
+	for w := range loop.waits {
+		if w.values != nil {
+			ls.wakeWaiter(w)
+		} else {
+			loop.arm(w)
+		}
+	}
+	var done <-chan struct{}
+	if ls.ctx != nil {
+		done = ls.ctx.Done()
+	}
+	var wakeup *time.Timer
+	defer func() {
+		if wakeup != nil {
+			wakeup.Stop()
+		}
+	}()
+	for {
+		if done != nil {
+			select {
+			case <-done:
+				return ls.ctx.Err()
+			default:
+			}
+		}
+		if len(loop.ready) > 0 {
+			r := loop.ready[0]
+			loop.ready = loop.ready[1:]
+			if err := ls.resumeTask(r); err != nil {
+				return err
+			}
+			continue
+		}
+		if loop.timers.Len() > 0 && !loop.timers[0].when.After(time.Now()) {
+			ls.expireTimer(heap.Pop(&loop.timers).(*asyncTimer))
+			continue
+		}
+		if loop.timers.Len() == 0 && len(loop.waits) == 0 {
+			return nil
+		}
+		var timeout <-chan time.Time
+		if loop.timers.Len() > 0 {
+			d := time.Until(loop.timers[0].when)
+			if wakeup == nil {
+				wakeup = time.NewTimer(d)
+			} else {
+				wakeup.Reset(d)
+			}
+			timeout = wakeup.C
+		}
+		select {
+		case w := <-loop.events:
+			ls.wakeWaiter(w)
+		case <-timeout:
+		case <-done:
+			return ls.ctx.Err()
+		}
+	}
+}
+
+// arm starts the goroutine of w, which receives from its channel until the
+// loop is disarmed.
+func (loop *eventLoop) arm(w *asyncWaiter) {
+	stop := loop.stop
+	loop.wg.Add(1)
+	go func() {
+		defer loop.wg.Done()
+		select {
+		case v, ok := <-w.ch:
+			w.values = []LValue{LBool(ok).AsLValue(), v}
+			select {
+			case loop.events <- w:
+			case <-stop:
+				// kept in w for the next call to RunLoop
+			}
+		case <-stop:
+		}
+	}()
+}
+
+// disarm stops the goroutines of the waits and waits for them to return.
+func (loop *eventLoop) disarm() {
+	if loop.stop != nil {
+		close(loop.stop)
+		loop.stop = nil
+		loop.wg.Wait()
+	}
+}
+
+// wakeWaiter schedules the task of w, which has received a value.
+func (ls *LState) wakeWaiter(w *asyncWaiter) {
+	loop := ls.G.loop
+	delete(loop.waits, w)
+	// values sent as copies are copied into L here, on the goroutine of RunLoop
+	for i, v := range w.values {
+		w.values[i] = receivedValue(ls, v)
+	}
+	loop.ready = append(loop.ready, asyncResume{task: w.task, values: w.values})
+}
+
+// closeLoop stops the pending waits and drops the tasks of the loop.
+func (ls *LState) closeLoop() {
+	if loop := ls.G.loop; loop != nil {
+		loop.disarm()
+		loop.waits = make(map[*asyncWaiter]struct{})
+		loop.ready = nil
+		loop.timers = nil
+	}
+}
+
+func (ls *LState) resumeTask(r asyncResume) error {
+	loop := ls.G.loop
+	task := r.task
+	task.suspended = false
+	loop.current = task
+	st, err, _ := ls.Resume(task.th, task.fn, r.values...)
+	loop.current = nil
+	switch {
+	case st == ResumeError:
+		return err
+	case st == ResumeYield && !task.suspended:
+		// yielded by coroutine.yield: let the other tasks run
+		loop.ready = append(loop.ready, asyncResume{task: task})
+	}
+	return nil
+}
+
+func (ls *LState) expireTimer(t *asyncTimer) {
+	loop := ls.G.loop
+	if t.task != nil {
+		loop.ready = append(loop.ready, asyncResume{task: t.task})
+		return
+	}
+	if t.period > 0 {
+		// ticks missed by a busy loop are dropped
+		t.when = t.when.Add(t.period)
+		if now := time.Now(); t.when.Before(now) {
+			t.when = now.Add(t.period)
+		}
+		heap.Push(&loop.timers, t)
+	}
+	ls.Spawn(t.fn)
+}
+
+// currentTask returns the task running L, raising an error if L is not a
+// task or can not yield.
+func (loop *eventLoop) currentTask(L *LState, name string) *asyncTask {
+	task := loop.current
+	if task == nil || task.th != L {
+		L.RaiseError("async.%s must be called from a task", name)
+	}
+	if L.nonYieldableCalls > 0 {
+		L.RaiseError("attempt to yield across a Go-call boundary")
+	}
+	return task
+}
+
+func secondsDuration(sec LNumber) time.Duration {
+	if sec <= 0 {
+		return 0
+	}
+	return time.Duration(float64(sec) * float64(time.Second))
+}
+
+/* }}} */
+
+/* async library {{{ */
+
+const asyncTimerClass = "ASYNC_TIMER*"
+
+// OpenAsync opens the async library, which runs tasks on the event loop of
+// RunLoop. It is not opened by OpenLibs.
+func OpenAsync(L *LState) int {
+	mod := L.RegisterModule(AsyncLibName, asyncFuncs)
+	mt := L.NewTypeMetatable(asyncTimerClass)
+	mt.RawSetString("__index", L.SetFuncs(L.NewTable(), asyncTimerMethods).AsLValue())
+	L.Push(mod)
+	return 1
+}
+
+var asyncFuncs = map[string]LGFunction{
+	"spawn":  asyncSpawn,
+	"sleep":  asyncSleep,
+	"wait":   asyncWait,
+	"timer":  asyncNewTimer,
+	"ticker": asyncNewTicker,
+}
+
+func asyncSpawn(L *LState) int {
+	fn := L.CheckFunction(1)
+	args := make([]LValue, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+	L.Push(L.Spawn(fn, args...).AsLValue())
+	return 1
+}
+
+func asyncSleep(L *LState) int {
+	d := secondsDuration(L.OptNumber(1, 0))
+	loop := L.eventLoop()
+	task := loop.currentTask(L, "sleep")
+	task.suspended = true
+	heap.Push(&loop.timers, &asyncTimer{when: time.Now().Add(d), task: task})
+	return L.Yield()
+}
+
+func asyncWait(L *LState) int {
+	ch := L.CheckChannel(1)
+	loop := L.eventLoop()
+	task := loop.currentTask(L, "wait")
+	task.suspended = true
+	w := &asyncWaiter{task: task, ch: ch}
+	loop.waits[w] = struct{}{}
+	loop.arm(w)
+	return L.Yield()
+}
+
+func newAsyncTimer(L *LState, period time.Duration) int {
+	d := secondsDuration(L.CheckNumber(1))
+	fn := L.CheckFunction(2)
+	if period > 0 {
+		period = d
+		if period == 0 {
+			L.ArgError(1, "non-positive interval")
+		}
+	}
+	t := &asyncTimer{when: time.Now().Add(d), period: period, fn: fn}
+	heap.Push(&L.eventLoop().timers, t)
+	ud := L.NewUserData()
+	ud.Value = t
+	ud.Metatable = L.GetTypeMetatable(asyncTimerClass)
+	L.Push(ud.AsLValue())
+	return 1
+}
+
+func asyncNewTimer(L *LState) int {
+	return newAsyncTimer(L, 0)
+}
+
+func asyncNewTicker(L *LState) int {
+	return newAsyncTimer(L, 1)
+}
+
+var asyncTimerMethods = map[string]LGFunction{
+	"stop": asyncTimerStop,
+}
+
+func asyncTimerStop(L *LState) int {
+	ud := L.CheckUserData(1)
+	t, ok := ud.Value.(*asyncTimer)
+	if !ok {
+		L.ArgError(1, "timer expected")
+	}
+	active := t.index >= 0
+	if active {
+		heap.Remove(&L.eventLoop().timers, t.index)
+	}
+	L.Push(LBool(active).AsLValue())
+	return 1
+}
+
+/* }}} */
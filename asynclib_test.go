@@ -0,0 +1,206 @@
+package lua
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newAsyncState() *LState {
+	L := NewState()
+	L.Push(L.NewFunction(OpenAsync).AsLValue())
+	L.Push(LString(AsyncLibName).AsLValue())
+	L.Call(1, 0)
+	return L
+}
+
+func TestAsyncSleep(t *testing.T) {
+	L := newAsyncState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	log = {}
+	async.spawn(function(name)
+		async.sleep(0.03)
+		table.insert(log, name)
+	end, "slow")
+	async.spawn(function()
+		async.sleep(0.01)
+		table.insert(log, "fast")
+		async.sleep()
+		table.insert(log, "again")
+	end)
+	async.spawn(function()
+		table.insert(log, "first")
+		coroutine.yield()
+		table.insert(log, "second")
+	end)
+	`)
+	start := time.Now()
+	errorIfNotNil(t, L.RunLoop())
+	errorIfFalse(t, time.Since(start) >= 30*time.Millisecond, "returned after %v", time.Since(start))
+	errorIfScriptFail(t, L, `assert(table.concat(log, ",") == "first,second,fast,again,slow")`)
+
+	errorIfScriptNotFail(t, L, `async.sleep(1)`, "async.sleep must be called from a task")
+	errorIfScriptFail(t, L, `
+	async.spawn(function()
+		local ok, err = pcall(table.sort, {2, 1}, function() async.sleep() end)
+		assert(not ok and string.find(err, "yield across", 1, true))
+		assert(pcall(async.sleep, 0))
+	end)
+	`)
+	errorIfNotNil(t, L.RunLoop())
+}
+
+func TestAsyncWait(t *testing.T) {
+	L := newAsyncState()
+	defer L.Close()
+	ch := make(chan LValue)
+	L.SetGlobal("ch", LChannel(ch).AsLValue())
+	errorIfScriptFail(t, L, `
+	local inner = channel.make()
+	got = {}
+	async.spawn(function()
+		local ok, v = async.wait(ch)
+		table.insert(got, v)
+		ok, v = async.wait(inner)
+		table.insert(got, v)
+		ok, v = async.wait(inner)
+		table.insert(got, tostring(ok))
+	end)
+	async.spawn(function()
+		async.sleep(0.01)
+		inner:send("from task")
+		inner:close()
+	end)
+	`)
+	go func() {
+		ch <- LString("from go").AsLValue()
+	}()
+	errorIfNotNil(t, L.RunLoop())
+	errorIfScriptFail(t, L, `assert(table.concat(got, ",") == "from go,from task,false")`)
+}
+
+func TestAsyncTimer(t *testing.T) {
+	L := newAsyncState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	ticks, fired = 0, false
+	local ticker
+	ticker = async.ticker(0.005, function()
+		ticks = ticks + 1
+		if ticks == 3 then
+			assert(ticker:stop())
+			assert(not ticker:stop())
+		end
+	end)
+	local cancelled = async.timer(0.01, function() fired = true end)
+	async.timer(0, function()
+		assert(cancelled:stop())
+	end)
+	`)
+	errorIfNotNil(t, L.RunLoop())
+	errorIfScriptFail(t, L, `assert(ticks == 3 and not fired)`)
+	errorIfScriptNotFail(t, L, `async.ticker(0, print)`, "non-positive interval")
+}
+
+func TestAsyncError(t *testing.T) {
+	L := newAsyncState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	async.spawn(function() async.sleep(0.01) error("task failed") end)
+	async.spawn(function() async.sleep(1) end)
+	`)
+	err := L.RunLoop()
+	errorIfNil(t, err)
+	errorIfFalse(t, err.(*ApiError).Object.String() == "<string>:2: task failed", "unexpected error %v", err)
+}
+
+func TestAsyncCancel(t *testing.T) {
+	L := newAsyncState()
+	defer L.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+	L.SetGlobal("ch", LChannel(make(chan LValue)).AsLValue())
+	errorIfScriptFail(t, L, `
+	async.spawn(function() async.wait(ch) end)
+	async.spawn(function() async.sleep(10) end)
+	`)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	errorIfNotEqual(t, context.Canceled, L.RunLoop())
+}
+
+func TestAsyncCancelResume(t *testing.T) {
+	L := newAsyncState()
+	defer L.Close()
+	L.SetGlobal("ch", LChannel(make(chan LValue)).AsLValue())
+	errorIfScriptFail(t, L, `
+	async.spawn(function() got = select(2, async.wait(ch)) end)
+	async.spawn(function() async.sleep(0.05) end)
+	`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	errorIfNotEqual(t, context.Canceled, L.RunLoop())
+
+	// the wait is resumed by the next run
+	L.RemoveContext()
+	errorIfScriptFail(t, L, `async.spawn(function() ch:send(1) end)`)
+	done := make(chan error, 1)
+	go func() { done <- L.RunLoop() }()
+	select {
+	case err := <-done:
+		errorIfNotNil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunLoop did not return")
+	}
+	errorIfScriptFail(t, L, `assert(got == 1)`)
+}
+
+func TestAsyncWaitAcrossRuns(t *testing.T) {
+	L := newAsyncState()
+	defer L.Close()
+	ch := make(chan LValue)
+	L.SetGlobal("ch", LChannel(ch).AsLValue())
+	L.SetGlobal("handoff", L.NewFunction(func(L *LState) int {
+		// received by the goroutine of the wait, which can not deliver it
+		// before the loop returns
+		ch <- LString("x").AsLValue()
+		return 0
+	}).AsLValue())
+	errorIfScriptFail(t, L, `
+	async.spawn(function()
+		local ok, v = async.wait(ch)
+		got = v
+	end)
+	async.spawn(function()
+		handoff()
+		error("task failed")
+	end)
+	`)
+	errorIfNil(t, L.RunLoop())
+	errorIfNotNil(t, L.RunLoop())
+	errorIfScriptFail(t, L, `assert(got == "x")`)
+}
+
+func TestAsyncWaitStopped(t *testing.T) {
+	L := newAsyncState()
+	defer L.Close()
+	ch := make(chan LValue, 1)
+	L.SetGlobal("ch", LChannel(ch).AsLValue())
+	errorIfScriptFail(t, L, `
+	async.spawn(function() got = select(2, async.wait(ch)) end)
+	async.spawn(function() error("task failed") end)
+	`)
+	errorIfNil(t, L.RunLoop())
+	// the goroutine of the wait has been stopped and leaves the value to
+	// other receivers
+	ch <- LString("x").AsLValue()
+	time.Sleep(10 * time.Millisecond)
+	errorIfNotEqual(t, 1, len(ch))
+	<-ch
+	go func() { ch <- LString("y").AsLValue() }()
+	errorIfNotNil(t, L.RunLoop())
+	errorIfScriptFail(t, L, `assert(got == "y")`)
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strings"
 	"sync"
@@ -20,7 +21,7 @@ func (ls *LState) CheckAny(n int) LValue {
 
 func (ls *LState) CheckInt(n int) int {
 	v := ls.Get(n)
-	if intv, ok := v.AsLNumber(); ok {
+	if intv, ok := v.asInt64(); ok {
 		return int(intv)
 	}
 	ls.TypeError(n, LTNumber)
@@ -29,13 +30,54 @@ func (ls *LState) CheckInt(n int) int {
 
 func (ls *LState) CheckInt64(n int) int64 {
 	v := ls.Get(n)
-	if intv, ok := v.AsLNumber(); ok {
-		return int64(intv)
+	if intv, ok := v.asInt64(); ok {
+		return intv
 	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
 
+// checkInteger returns the n-th argument as an integer. Unlike CheckInt64, it
+// raises an argument error for a float with no integer representation
+// instead of truncating it.
+func (ls *LState) checkInteger(n int) int64 {
+	if i, ok := ls.Get(n).AsLInteger(); ok {
+		return int64(i)
+	}
+	i, ok := floatToInteger(float64(ls.CheckNumber(n)))
+	if !ok {
+		ls.ArgError(n, "number has no integer representation")
+	}
+	return i
+}
+
+// checkSigned is checkInteger for a signed integer of the given number of
+// bits, raising an argument error if the argument does not fit in it.
+func (ls *LState) checkSigned(n int, bits int) int64 {
+	i := ls.checkInteger(n)
+	if bits < 64 && (i < -1<<(bits-1) || i >= 1<<(bits-1)) {
+		ls.ArgError(n, "number out of range")
+	}
+	return i
+}
+
+// checkUnsigned is checkSigned for an unsigned integer. A 64-bit integer also
+// accepts the floats beyond math.MaxInt64 that uint64 values are converted
+// to.
+func (ls *LState) checkUnsigned(n int, bits int) uint64 {
+	lv := ls.Get(n)
+	if _, ok := lv.AsLInteger(); !ok && lv.isNumber() && bits == 64 {
+		if f := float64(lv.MustLNumber()); f >= 1<<63 && f < 1<<64 && f == math.Trunc(f) {
+			return uint64(f)
+		}
+	}
+	i := ls.checkInteger(n)
+	if i < 0 || bits < 64 && i >= 1<<bits {
+		ls.ArgError(n, "number out of range")
+	}
+	return uint64(i)
+}
+
 func (ls *LState) CheckNumber(n int) LNumber {
 	v := ls.Get(n)
 	if lv, ok := v.AsLNumber(); ok {
@@ -55,7 +97,7 @@ func (ls *LState) CheckString(n int) string {
 	if lv, ok := v.AsLString(); ok {
 		return string(lv)
 	} else if LVCanConvToString(v) {
-		return LVAsString(v)
+		return ls.lvAsString(v)
 	}
 	ls.TypeError(n, LTString)
 	return ""
@@ -147,7 +189,7 @@ func (ls *LState) OptInt(n int, d int) int {
 	if v.EqualsLNil() {
 		return d
 	}
-	if intv, ok := v.AsLNumber(); ok {
+	if intv, ok := v.asInt64(); ok {
 		return int(intv)
 	}
 	ls.TypeError(n, LTNumber)
@@ -159,8 +201,8 @@ func (ls *LState) OptInt64(n int, d int64) int64 {
 	if v.EqualsLNil() {
 		return d
 	}
-	if intv, ok := v.AsLNumber(); ok {
-		return int64(intv)
+	if intv, ok := v.asInt64(); ok {
+		return intv
 	}
 	ls.TypeError(n, LTNumber)
 	return 0
@@ -243,11 +285,11 @@ func (ls *LState) OptUserData(n int, d *LUserData) *LUserData {
 /* error operations {{{ */
 
 func (ls *LState) ArgError(n int, message string) {
-	ls.RaiseError("bad argument #%v to %v (%v)", n, ls.rawFrameFuncName(ls.currentFrame), message)
+	ls.RaiseError("bad argument #%v to %v (%v)", n, ls.currentFuncName(), message)
 }
 
 func (ls *LState) TypeError(n int, typ LValueType) {
-	ls.RaiseError("bad argument #%v to %v (%v expected, got %v)", n, ls.rawFrameFuncName(ls.currentFrame), typ.String(), ls.Get(n).Type().String())
+	ls.RaiseError("bad argument #%v to %v (%v expected, got %v)", n, ls.currentFuncName(), typ.String(), ls.Get(n).Type().String())
 }
 
 /* }}} */
@@ -443,6 +485,9 @@ func (ls *LState) ToStringMeta(lv LValue) LValue {
 		ls.Call(1, 1)
 		return ls.reg.Pop()
 	} else {
+		if lv.isNumber() {
+			return LString(ls.lvAsString(lv)).AsLValue()
+		}
 		return LString(lv.String()).AsLValue()
 	}
 }
@@ -484,7 +529,7 @@ func (ls *LState) OptChannel(n int, ch chan LValue) chan LValue {
 //
 
 func NewTable() *LTable {
-	return (*LState)(nil).NewTable()
+	return newLTable(defaultArrayCap, defaultHashCap)
 }
 
 func NewGFunction(fn LGFunction) *LFunction {
@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"math"
 	"os"
 	"testing"
 )
@@ -23,12 +24,34 @@ func TestCheckInt64(t *testing.T) {
 	errorIfGFuncNotFail(t, L, func(L *LState) int {
 		L.Push(LNumber(10).AsLValue())
 		errorIfNotEqual(t, int64(10), L.CheckInt64(2))
+		L.Push(LInteger(math.MaxInt64 - 1).AsLValue())
+		errorIfNotEqual(t, int64(math.MaxInt64-1), L.CheckInt64(3))
 		L.Push(LString("aaa").AsLValue())
-		L.CheckInt64(3)
+		L.CheckInt64(4)
 		return 0
 	}, "number expected, got string")
 }
 
+func TestLInteger(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	id := LInteger(1<<62 + 1)
+	L.SetGlobal("id", id.AsLValue())
+	errorIfScriptFail(t, L, `
+	assert(math.type(id) == "integer")
+	next_id = id + 1
+	float_id = id + 0.0
+	`)
+	v, ok := L.GetGlobal("next_id").AsLInteger()
+	errorIfFalse(t, ok, "next_id should be an integer")
+	errorIfNotEqual(t, id+1, v)
+	_, ok = L.GetGlobal("float_id").AsLInteger()
+	errorIfFalse(t, !ok, "float_id should be a float")
+	errorIfNotEqual(t, LNumber(id), L.GetGlobal("float_id").MustLNumber())
+	errorIfFalse(t, LInteger(1).AsLValue().Equals(LNumber(1).AsLValue()), "1 should equal 1.0")
+	errorIfNotEqual(t, "4611686018427387905", id.AsLValue().String())
+}
+
 func TestCheckNumber(t *testing.T) {
 	L := NewState()
 	defer L.Close()
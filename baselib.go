@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"runtime"
 	"strconv"
 	"strings"
 )
@@ -14,9 +13,15 @@ import (
 func OpenBase(L *LState) int {
 	global := L.Get(GlobalsIndex).MustLTable()
 	L.SetGlobal("_G", global.AsLValue())
-	L.SetGlobal("_VERSION", LString(LuaVersion).AsLValue())
+	L.SetGlobal("_VERSION", LString(L.Options.LanguageVersion.String()).AsLValue())
 	L.SetGlobal("_GOPHER_LUA_VERSION", LString(PackageName+" "+PackageVersion).AsLValue())
 	basemod := L.RegisterModule("_G", baseFuncs)
+	if L.Options.LanguageVersion >= Lua52 {
+		L.SetFuncs(global, baseFuncs52)
+		// environments are replaced by _ENV
+		global.RawSetString("getfenv", LNil)
+		global.RawSetString("setfenv", LNil)
+	}
 	global.RawSetString("ipairs", L.NewClosure(baseIpairs, L.NewFunction(ipairsaux).AsLValue()).AsLValue())
 	global.RawSetString("pairs", L.NewClosure(basePairs, L.NewFunction(pairsaux).AsLValue()).AsLValue())
 	L.Push(basemod)
@@ -55,6 +60,11 @@ var baseFuncs = map[string]LGFunction{
 	"newproxy": baseNewProxy,
 }
 
+// baseFuncs52 are the basic functions added by Lua 5.2.
+var baseFuncs52 = map[string]LGFunction{
+	"rawlen": baseRawLen,
+}
+
 func baseAssert(L *LState) int {
 	if !L.ToBool(1) {
 		L.RaiseError(L.OptString(2, "assertion failed!"))
@@ -64,7 +74,18 @@ func baseAssert(L *LState) int {
 }
 
 func baseCollectGarbage(L *LState) int {
-	runtime.GC()
+	switch L.OptString(1, "collect") {
+	case "collect", "step":
+		collectGarbage()
+		L.G.sweepWeakTables()
+		L.G.mem.remeasure()
+		if err := L.finalizePending(); err != nil {
+			L.RaiseError("error in __gc metamethod (%v)", err.Error())
+		}
+	case "count":
+		L.Push(LNumber(float64(L.G.mem.used) / 1024).AsLValue())
+		return 1
+	}
 	return 0
 }
 
@@ -141,8 +162,8 @@ func ipairsaux(L *LState) int {
 		return 0
 	} else {
 		L.Pop(1)
-		L.Push(LNumber(i).AsLValue())
-		L.Push(LNumber(i).AsLValue())
+		L.Push(LInteger(i).AsLValue())
+		L.Push(LInteger(i).AsLValue())
 		L.Push(v)
 		return 2
 	}
@@ -152,7 +173,7 @@ func baseIpairs(L *LState) int {
 	tb := L.CheckTable(1)
 	L.Push(L.Get(UpvalueIndex(1)))
 	L.Push(tb.AsLValue())
-	L.Push(LNumber(0).AsLValue())
+	L.Push(LInteger(0).AsLValue())
 	return 3
 }
 
@@ -167,7 +188,27 @@ func loadaux(L *LState, reader io.Reader, chunkname string) int {
 	}
 }
 
+// loadaux52 loads a chunk like loadaux, with the mode and env arguments of
+// Lua 5.2 at modeidx and modeidx+1.
+func loadaux52(L *LState, reader io.Reader, chunkname string, modeidx int) int {
+	if mode := L.OptString(modeidx, "bt"); !strings.Contains(mode, "t") {
+		L.Push(LNil)
+		L.Push(LString(fmt.Sprintf("attempt to load a text chunk (mode is '%s')", mode)).AsLValue())
+		return 2
+	}
+	n := loadaux(L, reader, chunkname)
+	if fn, ok := L.Get(-n).AsLFunction(); ok && L.GetTop() >= modeidx+1+n && len(fn.Upvalues) > 0 {
+		fn.Upvalues[0].SetValue(L.Get(modeidx + 1))
+	}
+	return n
+}
+
 func baseLoad(L *LState) int {
+	if L.Options.LanguageVersion >= Lua52 {
+		if chunk, ok := L.Get(1).AsLString(); ok {
+			return loadaux52(L, strings.NewReader(string(chunk)), L.OptString(2, "<string>"), 3)
+		}
+	}
 	fn := L.CheckFunction(1)
 	chunkname := L.OptString(2, "?")
 	top := L.GetTop()
@@ -192,6 +233,10 @@ func baseLoad(L *LState) int {
 			return 2
 		}
 	}
+	L.SetTop(top)
+	if L.Options.LanguageVersion >= Lua52 {
+		return loadaux52(L, strings.NewReader(strings.Join(buf, "")), chunkname, 3)
+	}
 	return loadaux(L, strings.NewReader(strings.Join(buf, "")), chunkname)
 }
 
@@ -212,6 +257,9 @@ func baseLoadFile(L *LState) int {
 		}
 		defer reader.(*os.File).Close()
 	}
+	if L.Options.LanguageVersion >= Lua52 {
+		return loadaux52(L, reader, chunkname, 2)
+	}
 	return loadaux(L, reader, chunkname)
 }
 
@@ -266,18 +314,16 @@ func basePCall(L *LState) int {
 		return 2
 	}
 	nargs := L.GetTop() - 1
-	if err := L.PCall(nargs, MultRet, nil); err != nil {
-		L.Push(LFalse.AsLValue())
-		if aerr, ok := err.(*ApiError); ok {
-			L.Push(aerr.Object)
-		} else {
-			L.Push(LString(err.Error()).AsLValue())
-		}
+	return L.PCallK(nargs, MultRet, nil, finishPCall)
+}
+
+func finishPCall(L *LState, status ResumeState) int {
+	if status == ResumeError {
+		L.Insert(LFalse.AsLValue(), L.GetTop())
 		return 2
-	} else {
-		L.Insert(LTrue.AsLValue(), 1)
-		return L.GetTop()
 	}
+	L.Insert(LTrue.AsLValue(), 1)
+	return L.GetTop()
 }
 
 func basePrint(L *LState) int {
@@ -306,6 +352,18 @@ func baseRawEqual(L *LState) int {
 	return 1
 }
 
+func baseRawLen(L *LState) int {
+	switch lv := L.Get(1); lv.Type() {
+	case LTTable:
+		L.Push(LInteger(lv.MustLTable().Len()).AsLValue())
+	case LTString:
+		L.Push(LInteger(len(lv.MustLString())).AsLValue())
+	default:
+		L.ArgError(1, "table or string expected")
+	}
+	return 1
+}
+
 func baseRawGet(L *LState) int {
 	L.Push(L.RawGet(L.CheckTable(1), L.CheckAny(2)))
 	return 1
@@ -335,7 +393,7 @@ func baseSelect(L *LState) int {
 		if string(v.MustLString()) != "#" {
 			L.ArgError(1, "invalid string '"+string(v.MustLString())+"'")
 		}
-		L.Push(LNumber(L.GetTop() - 1).AsLValue())
+		L.Push(LInteger(L.GetTop() - 1).AsLValue())
 		return 1
 	}
 	return 0
@@ -423,7 +481,7 @@ func baseToNumber(L *LState) int {
 			if v, err := strconv.ParseInt(str, base, LNumberBit); err != nil {
 				L.Push(LNil)
 			} else {
-				L.Push(LNumber(v).AsLValue())
+				L.Push(LInteger(v).AsLValue())
 			}
 		}
 	default:
@@ -462,19 +520,22 @@ func baseXPCall(L *LState) int {
 	errfunc := L.CheckFunction(2)
 
 	top := L.GetTop()
+	nargs := 0
+	if L.Options.LanguageVersion >= Lua52 {
+		nargs = top - 2
+	}
 	L.Push(fn.AsLValue())
-	if err := L.PCall(0, MultRet, errfunc); err != nil {
-		L.Push(LFalse.AsLValue())
-		if aerr, ok := err.(*ApiError); ok {
-			L.Push(aerr.Object)
-		} else {
-			L.Push(LString(err.Error()).AsLValue())
+	for i := 3; i < 3+nargs; i++ {
+		L.Push(L.Get(i))
+	}
+	return L.PCallK(nargs, MultRet, errfunc, func(L *LState, status ResumeState) int {
+		if status == ResumeError {
+			L.Insert(LFalse.AsLValue(), L.GetTop())
+			return 2
 		}
-		return 2
-	} else {
 		L.Insert(LTrue.AsLValue(), top+1)
 		return L.GetTop() - top
-	}
+	})
 }
 
 /* }}} */
@@ -540,6 +601,8 @@ func loRequire(L *LState) int {
 	}
 	messages := []string{}
 	var modasfunc LValue
+	// a Lua 5.2 searcher returns a value passed to the loader with the name
+	var extra LValue
 	for i := 1; ; i++ {
 		loader := L.RawGetInt(loaders, i)
 		if loader.EqualsLNil() {
@@ -547,7 +610,8 @@ func loRequire(L *LState) int {
 		}
 		L.Push(loader)
 		L.Push(LString(name).AsLValue())
-		L.Call(1, 1)
+		L.Call(1, 2)
+		extra = L.reg.Pop()
 		ret := L.reg.Pop()
 		switch ret.Type() {
 		case LTFunction:
@@ -561,7 +625,12 @@ loopbreak:
 	L.SetField(loaded, name, loopdetection.AsLValue())
 	L.Push(modasfunc)
 	L.Push(LString(name).AsLValue())
-	L.Call(1, 1)
+	nargs := 1
+	if L.Options.LanguageVersion >= Lua52 {
+		L.Push(extra)
+		nargs = 2
+	}
+	L.Call(nargs, 1)
 	ret := L.reg.Pop()
 	modv := L.GetField(loaded, name)
 	if !ret.EqualsLNil() && modv.Equals(loopdetection.AsLValue()) {
@@ -0,0 +1,311 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+/* reflection based binding {{{ */
+
+// BindCustomData builds a metatable that exposes the Go type T to Lua. It is
+// meant to be passed to RegisterCustomData[T] or RegisterStateCustomData[T].
+//
+// Exported fields of T, including promoted fields of embedded structs, are
+// readable and writable as properties. A field is exposed under the name given
+// by its `lua:"name"` struct tag, or under its Go name otherwise; a tag of
+// `lua:"-"` hides the field. Exported methods of *T are callable with the
+// colon syntax (obj:Method(...)) under their Go name. If *T implements
+// fmt.Stringer, String is also used as __tostring.
+//
+// Arguments and return values are converted automatically. A method whose
+// last result is an error raises that error as a Lua error when it is non-nil.
+// Struct results of a custom data type get the __gc metamethod of its
+// metatable, pointer results do not.
+func BindCustomData[T any]() *LTable {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	b := bindingOf(typ)
+
+	mt := NewTable()
+	methods := NewTable()
+	for name, m := range b.methods {
+		methods.RawSetString(name, NewGFunction(m).AsLValue())
+	}
+	mt.RawSetString("__index", NewGFunction(func(L *LState) int {
+		self := checkBoundSelf(L, typ)
+		key := L.CheckString(2)
+		if field, ok := b.fields[key]; ok {
+			fv, err := self.FieldByIndexErr(field.Index)
+			if err != nil {
+				L.Push(LNil)
+				return 1
+			}
+			L.Push(reflectToLValue(L, fv))
+			return 1
+		}
+		L.Push(methods.RawGetString(key))
+		return 1
+	}).AsLValue())
+	mt.RawSetString("__newindex", NewGFunction(func(L *LState) int {
+		self := checkBoundSelf(L, typ)
+		key := L.CheckString(2)
+		field, ok := b.fields[key]
+		if !ok {
+			L.RaiseError("cannot set unknown field '%v' of %v", key, typ.String())
+		}
+		fv, err := self.FieldByIndexErr(field.Index)
+		if err != nil {
+			L.RaiseError("cannot set field '%v' of %v: %v", key, typ.String(), err.Error())
+		}
+		fv.Set(checkReflectArg(L, 3, field.Type))
+		return 0
+	}).AsLValue())
+	if b.stringer {
+		mt.RawSetString("__tostring", NewGFunction(func(L *LState) int {
+			self := checkBoundSelf(L, typ)
+			L.Push(LString(self.Addr().Interface().(fmt.Stringer).String()).AsLValue())
+			return 1
+		}).AsLValue())
+	}
+	return mt
+}
+
+type typeBinding struct {
+	fields   map[string]reflect.StructField
+	methods  map[string]LGFunction
+	stringer bool
+}
+
+var typeBindings sync.Map // reflect.Type -> *typeBinding
+
+func bindingOf(typ reflect.Type) *typeBinding {
+	if b, ok := typeBindings.Load(typ); ok {
+		return b.(*typeBinding)
+	}
+	b := &typeBinding{
+		fields:  make(map[string]reflect.StructField),
+		methods: make(map[string]LGFunction),
+	}
+	if typ.Kind() == reflect.Struct {
+		structFields(typ, func(field reflect.StructField, tag luaTag) {
+			b.fields[tag.name] = field
+		})
+	}
+	ptyp := reflect.PointerTo(typ)
+	for i := 0; i < ptyp.NumMethod(); i++ {
+		m := ptyp.Method(i)
+		b.methods[m.Name] = bindMethod(typ, m)
+	}
+	b.stringer = ptyp.Implements(reflect.TypeOf((*fmt.Stringer)(nil)).Elem())
+	actual, _ := typeBindings.LoadOrStore(typ, b)
+	return actual.(*typeBinding)
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func bindMethod(typ reflect.Type, m reflect.Method) LGFunction {
+	ftyp := m.Type
+	nin := ftyp.NumIn()
+	nout := ftyp.NumOut()
+	returnsError := nout > 0 && ftyp.Out(nout-1) == errorType
+	return func(L *LState) int {
+		self := checkBoundSelf(L, typ)
+		args := make([]reflect.Value, 0, nin)
+		args = append(args, self.Addr())
+		for i := 1; i < nin; i++ {
+			if ftyp.IsVariadic() && i == nin-1 {
+				elem := ftyp.In(i).Elem()
+				for n := i + 1; n <= L.GetTop(); n++ {
+					args = append(args, checkReflectArg(L, n, elem))
+				}
+				break
+			}
+			args = append(args, checkReflectArg(L, i+1, ftyp.In(i)))
+		}
+		rets := m.Func.Call(args)
+		if returnsError {
+			if err := rets[nout-1]; !err.IsNil() {
+				L.RaiseGoError(err.Interface().(error))
+			}
+			rets = rets[:nout-1]
+		}
+		for _, ret := range rets {
+			L.Push(reflectToLValue(L, ret))
+		}
+		return len(rets)
+	}
+}
+
+// checkBoundSelf returns the addressable struct value of the first argument,
+// raising an argument error if it is not a custom data of typ.
+func checkBoundSelf(L *LState, typ reflect.Type) reflect.Value {
+	lv := L.Get(1)
+	if entry, ok := L.customDataEntry(lv.Type()); ok && entry.typInfo == reflectTypInfo(typ) {
+		return reflect.NewAt(typ, lv.dataptr).Elem()
+	}
+	L.ArgError(1, typ.String()+" expected, got "+lv.Type().String())
+	return reflect.Value{}
+}
+
+// reflectTypInfo returns the runtime type descriptor of typ, which is the
+// same pointer a custom data entry records for the type.
+func reflectTypInfo(typ reflect.Type) unsafe.Pointer {
+	return (*[2]unsafe.Pointer)(unsafe.Pointer(&typ))[1]
+}
+
+/* }}} */
+
+/* conversions {{{ */
+
+var (
+	lvalueType    = reflect.TypeOf(LValue{})
+	lgfuncType    = reflect.TypeOf(LGFunction(nil))
+	ltablePtrType = reflect.TypeOf((*LTable)(nil))
+	lfuncPtrType  = reflect.TypeOf((*LFunction)(nil))
+	ludataPtrType = reflect.TypeOf((*LUserData)(nil))
+	lstatePtrType = reflect.TypeOf((*LState)(nil))
+)
+
+// reflectToLValue converts a Go value to an LValue. Pointers to (and values
+// of) custom data types visible to L are converted to custom data, values that
+// have no Lua counterpart are wrapped in an LUserData. A struct value is
+// copied into a new allocation, which is marked for finalization like the
+// values of CustomDataHelper.New; a pointer stays owned by Go code and is
+// never finalized.
+func reflectToLValue(L *LState, rv reflect.Value) LValue {
+	if !rv.IsValid() {
+		return LNil
+	}
+	switch rv.Type() {
+	case lvalueType:
+		return rv.Interface().(LValue)
+	case ltablePtrType, lfuncPtrType, ludataPtrType, lstatePtrType:
+		if rv.IsNil() {
+			return LNil
+		}
+		return rv.Interface().(interface{ AsLValue() LValue }).AsLValue()
+	case lgfuncType:
+		if rv.IsNil() {
+			return LNil
+		}
+		return L.NewFunction(rv.Interface().(LGFunction)).AsLValue()
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return LBool(rv.Bool()).AsLValue()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return LInteger(rv.Int()).AsLValue()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return uintToLValue(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return LNumber(rv.Float()).AsLValue()
+	case reflect.String:
+		return LString(rv.String()).AsLValue()
+	case reflect.Interface:
+		if rv.IsNil() {
+			return LNil
+		}
+		return reflectToLValue(L, rv.Elem())
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return LNil
+		}
+		if entry, ok := L.customDataEntryOf(reflectTypInfo(rv.Type().Elem())); ok {
+			return LValue{dataptr: rv.UnsafePointer(), data: uintptr(entry.typ) + maxUintptr}
+		}
+	case reflect.Struct:
+		if entry, ok := L.customDataEntryOf(reflectTypInfo(rv.Type())); ok {
+			if rv.CanAddr() {
+				return LValue{dataptr: rv.Addr().UnsafePointer(), data: uintptr(entry.typ) + maxUintptr}
+			}
+			cp := reflect.New(rv.Type())
+			cp.Elem().Set(rv)
+			lv := LValue{dataptr: cp.UnsafePointer(), data: uintptr(entry.typ) + maxUintptr}
+			if entry.hasGC.Load() {
+				markCustomData(L.G.finalizers, lv, cp.Interface())
+			}
+			return lv
+		}
+	}
+	ud := L.NewUserData()
+	ud.Value = rv.Interface()
+	return ud.AsLValue()
+}
+
+// uintToLValue converts v to an integer, or to a float if it does not fit.
+func uintToLValue(v uint64) LValue {
+	if v > math.MaxInt64 {
+		return LNumber(v).AsLValue()
+	}
+	return LInteger(v).AsLValue()
+}
+
+// checkReflectArg converts the n-th argument to typ, raising an argument error
+// in the style of the Check* functions if it cannot be converted.
+func checkReflectArg(L *LState, n int, typ reflect.Type) reflect.Value {
+	lv := L.Get(n)
+	switch typ {
+	case lvalueType:
+		return reflect.ValueOf(lv)
+	case ltablePtrType:
+		return reflect.ValueOf(L.CheckTable(n))
+	case lfuncPtrType:
+		return reflect.ValueOf(L.CheckFunction(n))
+	case ludataPtrType:
+		return reflect.ValueOf(L.CheckUserData(n))
+	case lstatePtrType:
+		return reflect.ValueOf(L.CheckThread(n))
+	}
+	rv := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Bool:
+		rv.SetBool(L.CheckBool(n))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		rv.SetInt(L.checkSigned(n, typ.Bits()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		rv.SetUint(L.checkUnsigned(n, typ.Bits()))
+	case reflect.Float32, reflect.Float64:
+		rv.SetFloat(float64(L.CheckNumber(n)))
+	case reflect.String:
+		rv.SetString(L.CheckString(n))
+	case reflect.Interface:
+		if lv.EqualsLNil() {
+			return rv
+		}
+		var v any = lv.AsAny()
+		if ud, ok := lv.AsLUserData(); ok {
+			v = ud.Value
+		}
+		if v == nil || !reflect.TypeOf(v).Implements(typ) {
+			L.ArgError(n, typ.String()+" expected, got "+lv.Type().String())
+		}
+		rv.Set(reflect.ValueOf(v))
+	case reflect.Pointer, reflect.Struct:
+		ptyp := typ
+		if typ.Kind() == reflect.Struct {
+			ptyp = reflect.PointerTo(typ)
+		}
+		if typ.Kind() == reflect.Pointer && lv.EqualsLNil() {
+			return rv
+		}
+		if entry, ok := L.customDataEntry(lv.Type()); ok && entry.typInfo == reflectTypInfo(ptyp.Elem()) {
+			p := reflect.NewAt(ptyp.Elem(), lv.dataptr)
+			if typ.Kind() == reflect.Struct {
+				return p.Elem()
+			}
+			return p
+		}
+		fallthrough
+	default:
+		if ud, ok := lv.AsLUserData(); ok && ud.Value != nil && reflect.TypeOf(ud.Value).AssignableTo(typ) {
+			rv.Set(reflect.ValueOf(ud.Value))
+			return rv
+		}
+		L.ArgError(n, typ.String()+" expected, got "+lv.Type().String())
+	}
+	return rv
+}
+
+/* }}} */
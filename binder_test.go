@@ -0,0 +1,140 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type bindPoint struct {
+	X, Y int
+}
+
+type bindAccount struct {
+	Owner   string  `lua:"owner"`
+	Balance float64 `lua:"balance"`
+	Secret  string  `lua:"-"`
+	Origin  bindPoint
+	hidden  int
+}
+
+func (a *bindAccount) Deposit(amount float64) float64 {
+	a.Balance += amount
+	return a.Balance
+}
+
+func (a *bindAccount) Withdraw(amount float64) (float64, error) {
+	if amount > a.Balance {
+		return a.Balance, errors.New("insufficient funds")
+	}
+	a.Balance -= amount
+	return a.Balance, nil
+}
+
+func (a *bindAccount) Tags(prefix string, tags ...string) int {
+	return len(tags)
+}
+
+func (a *bindAccount) Move(p *bindPoint) bindPoint {
+	a.Origin = *p
+	return a.Origin
+}
+
+func (a *bindAccount) String() string {
+	return fmt.Sprintf("account(%s)", a.Owner)
+}
+
+func TestBindCustomData(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	RegisterStateCustomData[bindPoint](L, BindCustomData[bindPoint]())
+	accounts := RegisterStateCustomData[bindAccount](L, BindCustomData[bindAccount]())
+
+	acc := &bindAccount{Owner: "alice", Balance: 10, Secret: "s"}
+	L.SetGlobal("acc", accounts.AsLValue(acc))
+	errorIfScriptFail(t, L, `
+	assert(acc.owner == "alice")
+	assert(acc.balance == 10)
+	assert(acc.Secret == nil)
+	assert(acc.hidden == nil)
+	assert(acc:Deposit(5) == 15)
+	acc.owner = "bob"
+	assert(tostring(acc) == "account(bob)")
+	assert(acc:Tags("x", "a", "b", "c") == 3)
+	acc.Origin.X = 3
+	assert(acc.Origin.X == 3)
+	local p = acc:Move(acc.Origin)
+	assert(p.X == 3 and p.Y == 0)
+	local ok, err = pcall(function() return acc:Withdraw(100) end)
+	assert(not ok and err:find("insufficient funds"))
+	assert(acc:Withdraw(5) == 10)
+	`)
+	errorIfNotEqual(t, "bob", acc.Owner)
+	errorIfNotEqual(t, float64(10), acc.Balance)
+	errorIfNotEqual(t, 3, acc.Origin.X)
+
+	errorIfScriptNotFail(t, L, `acc.balance = "x"`, `number expected, got string`)
+	errorIfScriptNotFail(t, L, `acc.unknown = 1`, `cannot set unknown field 'unknown'`)
+	errorIfScriptNotFail(t, L, `acc:Deposit()`, `bad argument #2 to Deposit \(number expected, got nil\)`)
+	errorIfScriptNotFail(t, L, `acc.Deposit({})`, `bad argument #1 to Deposit \(lua.bindAccount expected, got table\)`)
+}
+
+type bindHandle struct {
+	ID int
+}
+
+func (h *bindHandle) Next() bindHandle {
+	return bindHandle{ID: h.ID + 1}
+}
+
+func TestBindCustomDataFinalizer(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var handles *CustomDataHelper[bindHandle]
+	var closed []int
+	mt := BindCustomData[bindHandle]()
+	mt.RawSetString("__gc", L.NewFunction(func(L *LState) int {
+		closed = append(closed, handles.Must(L.Get(1)).ID)
+		return 0
+	}).AsLValue())
+	handles = RegisterStateCustomData[bindHandle](L, mt)
+	root := &bindHandle{ID: 1}
+	L.SetGlobal("root", handles.AsLValue(root))
+	errorIfScriptFail(t, L, `
+	do
+		local h = root:Next()
+		assert(h.ID == 2)
+	end
+	collectgarbage()
+	`)
+	errorIfFalse(t, len(closed) == 1 && closed[0] == 2, "unexpected finalized handles: %v", closed)
+}
+
+type bindSized struct {
+	Small int8
+	U     uint32
+	Big   uint64
+}
+
+func TestBindCustomDataIntegerRange(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	sized := RegisterStateCustomData[bindSized](L, BindCustomData[bindSized]())
+	obj := &bindSized{}
+	L.SetGlobal("obj", sized.AsLValue(obj))
+	errorIfScriptFail(t, L, `
+	obj.Small = -128
+	obj.U = 4294967295
+	obj.Big = 2^63
+	`)
+	errorIfNotEqual(t, int8(-128), obj.Small)
+	errorIfNotEqual(t, uint32(4294967295), obj.U)
+	errorIfNotEqual(t, uint64(1)<<63, obj.Big)
+
+	errorIfScriptNotFail(t, L, `obj.Small = 300`, `number out of range`)
+	errorIfScriptNotFail(t, L, `obj.Small = 1.5`, `number has no integer representation`)
+	errorIfScriptNotFail(t, L, `obj.U = -1`, `number out of range`)
+	errorIfScriptNotFail(t, L, `obj.U = 2^32`, `number out of range`)
+	errorIfNotEqual(t, int8(-128), obj.Small)
+	errorIfNotEqual(t, uint32(4294967295), obj.U)
+}
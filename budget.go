@@ -0,0 +1,157 @@
+package lua
+
+import (
+	"math"
+)
+
+/* instruction budget {{{ */
+
+// InterruptAction tells the VM how to proceed after an InterruptHook returns.
+type InterruptAction int
+
+const (
+	// InterruptContinue resumes execution. If the instruction budget is
+	// exhausted and the hook did not refill it, the script is aborted.
+	InterruptContinue InterruptAction = iota
+	// InterruptAbort raises an "execution interrupted" error.
+	InterruptAbort
+	// InterruptYield suspends the running coroutine as if it had called
+	// coroutine.yield() with no values. Values passed to the next resume
+	// are discarded. A coroutine running a Go function such as pcall can
+	// not be suspended; it continues until the next call of the hook.
+	InterruptYield
+)
+
+// InterruptHook is called on the running thread every interval instructions
+// and when the instruction budget is exhausted. It may refill the budget with
+// SetInstructionBudget.
+type InterruptHook func(L *LState) InterruptAction
+
+// instructionBudget is shared by the threads of a Global.
+type instructionBudget struct {
+	remaining int64 // instructions left, -1 if unlimited
+	interval  int64 // instructions between two hook calls, 0 if none
+	hook      InterruptHook
+	// instructions between the last event and the next one, and instructions
+	// left before the next one
+	period    int64
+	countdown int64
+}
+
+func (b *instructionBudget) active() bool {
+	return b.remaining >= 0 || (b.hook != nil && b.interval > 0)
+}
+
+// consume deducts the instructions executed since the last event from the
+// remaining budget.
+func (b *instructionBudget) consume() {
+	if b.remaining > 0 {
+		b.remaining = max(b.remaining-(b.period-b.countdown), 0)
+	}
+	b.period = b.countdown
+}
+
+func (b *instructionBudget) reset() {
+	p := int64(math.MaxInt64)
+	if b.hook != nil && b.interval > 0 {
+		p = b.interval
+	}
+	if b.remaining >= 0 && b.remaining < p {
+		p = b.remaining
+	}
+	b.period, b.countdown = p, p
+}
+
+// SetInstructionBudget sets the number of VM instructions the state and its
+// threads may still execute. Once they are used up the interrupt hook is
+// called, and the script is aborted with an "instruction limit exceeded"
+// error unless the hook refills the budget. A negative n removes the limit.
+func (ls *LState) SetInstructionBudget(n int64) {
+	if n < 0 {
+		n = -1
+	}
+	ls.G.budget.consume()
+	ls.G.budget.remaining = n
+	ls.G.budget.reset()
+	ls.reloadMainLoop()
+}
+
+// InstructionBudget returns the number of instructions left in the budget,
+// or -1 if it is unlimited.
+func (ls *LState) InstructionBudget() int64 {
+	b := &ls.G.budget
+	if b.remaining <= 0 {
+		return b.remaining
+	}
+	return max(b.remaining-(b.period-b.countdown), 0)
+}
+
+// SetInterruptHook sets a hook called every interval instructions executed by
+// the state and its threads, and when the instruction budget is exhausted.
+// An interval of 0 calls it only on exhaustion. A nil hook removes it.
+func (ls *LState) SetInterruptHook(interval int, hook InterruptHook) {
+	if interval < 0 {
+		interval = 0
+	}
+	ls.G.budget.consume()
+	ls.G.budget.interval = int64(interval)
+	ls.G.budget.hook = hook
+	ls.G.budget.reset()
+	ls.reloadMainLoop()
+}
+
+func (ls *LState) updateMainLoop() {
+	switch {
+	case ls.G.budget.active() || ls.tracing() || ls.G.profiler != nil || ls.G.coverage != nil:
+		ls.mainLoop = mainLoopWithHooks
+	case ls.ctx != nil:
+		ls.mainLoop = mainLoopWithContext
+	default:
+		ls.mainLoop = mainLoop
+	}
+}
+
+// interrupt is called by mainLoopWithHooks when the countdown of the budget
+// reaches 0. It reports whether the thread has been suspended.
+func (ls *LState) interrupt() bool {
+	b := &ls.G.budget
+	b.consume()
+	action := InterruptContinue
+	if b.hook != nil {
+		action = b.hook(ls)
+	}
+	if action == InterruptYield && ls.nonYieldableCalls > 0 {
+		// a coroutine can not be suspended while it runs a Go function that
+		// has not called Lua with CallK or PCallK
+		action = InterruptContinue
+	}
+	b.reset()
+	switch action {
+	case InterruptContinue:
+		if b.remaining == 0 {
+			ls.RaiseError("instruction limit exceeded")
+		}
+	case InterruptAbort:
+		ls.RaiseError("execution interrupted")
+	case InterruptYield:
+		if ls.Parent == nil {
+			ls.RaiseError("can not yield from outside of a coroutine")
+		}
+		ls.yieldInterrupted()
+		return true
+	}
+	return false
+}
+
+// yieldInterrupted suspends the thread between two instructions.
+func (ls *LState) yieldInterrupted() {
+	parent := ls.Parent
+	ls.G.CurrentThread = parent
+	ls.Parent = nil
+	if !ls.wrapped {
+		parent.Push(LTrue.AsLValue())
+	}
+	ls.interruptTop = ls.reg.Top() + 1
+}
+
+/* }}} */
@@ -0,0 +1,122 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestInstructionLimit(t *testing.T) {
+	L := NewState(Options{InstructionLimit: 10000})
+	defer L.Close()
+	errorIfScriptNotFail(t, L, `while true do end`, "instruction limit exceeded")
+	errorIfScriptNotFail(t, L, `pcall(function() while true do end end) while true do end`, "instruction limit exceeded")
+
+	L.SetInstructionBudget(-1)
+	errorIfScriptFail(t, L, `for i = 1, 100000 do end`)
+	errorIfNotEqual(t, int64(-1), L.InstructionBudget())
+}
+
+func TestInterruptHookRefill(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	refills := 0
+	L.SetInstructionBudget(1000)
+	L.SetInterruptHook(0, func(L *LState) InterruptAction {
+		errorIfNotEqual(t, int64(0), L.InstructionBudget())
+		if refills < 5 {
+			refills++
+			L.SetInstructionBudget(1000)
+		}
+		return InterruptContinue
+	})
+	errorIfScriptNotFail(t, L, `while true do end`, "instruction limit exceeded")
+	errorIfNotEqual(t, 5, refills)
+
+	L.SetInstructionBudget(-1)
+	L.SetInterruptHook(100, func(L *LState) InterruptAction { return InterruptAbort })
+	errorIfScriptNotFail(t, L, `while true do end`, "execution interrupted")
+	L.SetInterruptHook(0, nil)
+	errorIfScriptFail(t, L, `for i = 1, 1000 do end`)
+}
+
+func TestInterruptHookChangeKeepsBudget(t *testing.T) {
+	L := NewState(Options{InstructionLimit: 10000})
+	defer L.Close()
+	L.SetGlobal("rehook", L.NewFunction(func(L *LState) int {
+		L.SetInterruptHook(0, nil)
+		return 0
+	}).AsLValue())
+	errorIfScriptNotFail(t, L, `
+	for i = 1, 1000000 do
+		if i % 100 == 0 then rehook() end
+	end
+	`, "instruction limit exceeded")
+
+	L.SetInstructionBudget(10000)
+	L.SetGlobal("rebudget", L.NewFunction(func(L *LState) int {
+		L.SetInstructionBudget(L.InstructionBudget())
+		return 0
+	}).AsLValue())
+	errorIfScriptNotFail(t, L, `
+	for i = 1, 1000000 do
+		if i % 100 == 0 then rebudget() end
+	end
+	`, "instruction limit exceeded")
+}
+
+func TestInterruptHookYield(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetInterruptHook(1000, func(L *LState) InterruptAction { return InterruptYield })
+	errorIfScriptFail(t, L, `
+	local n = 0
+	local co = coroutine.create(function()
+		for i = 1, 10000 do n = n + 1 end
+		return "done"
+	end)
+	local slices = 0
+	while true do
+		local ok, v = coroutine.resume(co, "ignored")
+		assert(ok)
+		slices = slices + 1
+		if v == "done" then break end
+		assert(v == nil)
+	end
+	assert(n == 10000 and slices > 10, slices)
+	`)
+
+	errorIfScriptFail(t, L, `function spin() for i = 1, 5000 do end return 1 end`)
+	th, _ := L.NewThread()
+	fn := L.GetGlobal("spin").MustLFunction()
+	yields := 0
+	for {
+		st, err, values := L.Resume(th, fn)
+		errorIfNotNil(t, err)
+		if st == ResumeOK {
+			errorIfNotEqual(t, LInteger(1).AsLValue(), values[0])
+			break
+		}
+		yields++
+	}
+	errorIfFalse(t, yields > 0, "thread was never suspended")
+
+	// a coroutine is suspended inside pcall, but not inside a metamethod
+	errorIfScriptFail(t, L, `
+	local n = 0
+	local mt = {__index = function() for i = 1, 5000 do n = n + 1 end return "meta" end}
+	local co = coroutine.create(function()
+		local ok, v = pcall(function()
+			for i = 1, 10000 do n = n + 1 end
+			return setmetatable({}, mt).x
+		end)
+		return ok and v
+	end)
+	local slices = 0
+	while coroutine.status(co) ~= "dead" do
+		local ok, v = coroutine.resume(co)
+		assert(ok)
+		slices = slices + 1
+		if v == "meta" then break end
+	end
+	assert(n == 15000 and slices > 10, slices)
+	`)
+}
@@ -10,9 +10,49 @@ func checkChannel(L *LState, idx int) reflect.Value {
 }
 
 func checkGoroutineSafe(L *LState, idx int) LValue {
-	v := L.CheckAny(2)
-	if !isGoroutineSafe(v) {
-		L.ArgError(2, "can not send a function, userdata, thread or table that has a metatable")
+	return goroutineSafeArg(L, idx, L.CheckAny(idx))
+}
+
+// channelCopy is a value sent as a copy, see Options.ChannelCopy. It is sent
+// in a userdata, which the receiving state replaces with a copy of value.
+type channelCopy struct {
+	value LValue
+}
+
+// goroutineSafeArg returns the argument v to send on a channel, or a copy of it.
+func goroutineSafeArg(L *LState, idx int, v LValue) LValue {
+	opts := L.Options.ChannelCopy
+	if opts == nil {
+		if !isGoroutineSafe(v) {
+			L.ArgError(idx, "can not send a function, userdata, thread or table that has a metatable")
+		}
+		return v
+	}
+	switch v.Type() {
+	case LTTable, LTFunction, LTUserData, LTThread:
+	default:
+		return v
+	}
+	// the copy is no longer reachable from L, which may run on while the
+	// receiver reads it
+	cp, err := CopyValue(L, v, *opts)
+	if err != nil {
+		L.ArgError(idx, err.Error())
+	}
+	ud := L.NewUserData()
+	ud.Value = &channelCopy{value: cp}
+	return ud.AsLValue()
+}
+
+// receivedValue returns the value v received from a channel, copying it into L
+// if it has been sent as a copy.
+func receivedValue(L *LState, v LValue) LValue {
+	if ud, ok := v.AsLUserData(); ok {
+		if _, ok := ud.Value.(*channelCopy); ok {
+			// the sender has already applied its policies to the copy
+			cp, _ := CopyValue(L, v, CopyOptions{Metatables: true, Functions: CopyConvert, UserData: CopyConvert})
+			return cp
+		}
 	}
 	return v
 }
@@ -63,11 +103,7 @@ func channelSelect(L *LState) int {
 				L.ArgError(i+1, "invalid select case")
 			}
 			cas.Chan = reflect.ValueOf((chan LValue)(ch))
-			v := tbl.RawGetInt(3)
-			if !isGoroutineSafe(v) {
-				L.ArgError(i+1, "can not send a function, userdata, thread or table that has a metatable")
-			}
-			cas.Send = reflect.ValueOf(v)
+			cas.Send = reflect.ValueOf(goroutineSafeArg(L, i+1, tbl.RawGetInt(3)))
 		case "|<-":
 			ch, ok := tbl.RawGetInt(2).AsLChannel()
 			if !ok {
@@ -103,6 +139,7 @@ func channelSelect(L *LState) int {
 		if lv.IsEmpty() {
 			lv = LValue{}
 		}
+		lv = receivedValue(L, lv)
 	}
 	tbl := L.Get(pos + 1).MustLTable()
 	last := tbl.RawGetInt(tbl.Len())
@@ -160,7 +197,7 @@ func channelReceive(L *LState) int {
 	}
 	if ok {
 		L.Push(LTrue.AsLValue())
-		L.Push(v.Interface().(LValue))
+		L.Push(receivedValue(L, v.Interface().(LValue)))
 	} else {
 		L.Push(LFalse.AsLValue())
 		L.Push(LNil)
@@ -3,11 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"runtime/pprof"
 
 	"github.com/chzyer/readline"
 	lua "github.com/hsfzxjy/gopher-lua"
+	"github.com/hsfzxjy/gopher-lua/debugger"
 	"github.com/hsfzxjy/gopher-lua/parse"
 )
 
@@ -16,12 +19,16 @@ func main() {
 }
 
 func mainAux() int {
-	var opt_e, opt_l, opt_p string
+	var opt_e, opt_l, opt_p, opt_lp, opt_cover, opt_dap, opt_lua string
 	var opt_i, opt_v, opt_dt, opt_dc bool
 	var opt_m int
 	flag.StringVar(&opt_e, "e", "", "")
 	flag.StringVar(&opt_l, "l", "", "")
 	flag.StringVar(&opt_p, "p", "", "")
+	flag.StringVar(&opt_lp, "lp", "", "")
+	flag.StringVar(&opt_cover, "cover", "", "")
+	flag.StringVar(&opt_dap, "dap", "", "")
+	flag.StringVar(&opt_lua, "lua", "5.1", "")
 	flag.IntVar(&opt_m, "mx", 0, "")
 	flag.BoolVar(&opt_i, "i", false, "")
 	flag.BoolVar(&opt_v, "v", false, "")
@@ -33,10 +40,14 @@ Available options are:
   -e stat  execute string 'stat'
   -l name  require library 'name'
   -mx MB   memory limit(default: unlimited)
+  -lua ver language version, 5.1(default), 5.2, 5.3 or 5.4
   -dt      dump AST trees
   -dc      dump VM codes
   -i       enter interactive mode after executing 'script'
   -p file  write cpu profiles to the file
+  -lp file write Lua profiles to the file
+  -cover file  write the line coverage of the scripts to the file in the LCOV format
+  -dap addr  debug 'script' with a Debug Adapter Protocol client on addr, or on stdio if addr is '-'
   -v       show version information`)
 	}
 	flag.Parse()
@@ -49,17 +60,55 @@ Available options are:
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
+	var version lua.LanguageVersion
+	switch opt_lua {
+	case "5.1":
+		version = lua.Lua51
+	case "5.2":
+		version = lua.Lua52
+	case "5.3":
+		version = lua.Lua53
+	case "5.4":
+		version = lua.Lua54
+	default:
+		fmt.Println("unsupported language version: " + opt_lua)
+		return 1
+	}
+	if len(opt_dap) != 0 {
+		return runDAP(opt_dap, version, opt_m)
+	}
 	if len(opt_e) == 0 && !opt_i && !opt_v && flag.NArg() == 0 {
 		opt_i = true
 	}
 
 	status := 0
 
-	L := lua.NewState(lua.Options{LaxGC: true})
+	L := lua.NewState(lua.Options{LaxGC: true, LanguageVersion: version})
 	defer L.Close()
 	if opt_m > 0 {
 		L.SetMx(opt_m)
 	}
+	if len(opt_lp) != 0 {
+		f, err := os.Create(opt_lp)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		defer f.Close()
+		L.StartProfile(f)
+		defer L.StopProfile()
+	}
+	if len(opt_cover) != 0 {
+		f, err := os.Create(opt_cover)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		defer f.Close()
+		coverage := lua.NewCoverage()
+		L.SetCoverage(coverage)
+		defer coverage.WriteLCOV(f)
+	}
 
 	if opt_v || opt_i {
 		fmt.Println(lua.PackageCopyRight)
@@ -93,7 +142,7 @@ Available options are:
 				fmt.Println(parse.Dump(chunk))
 			}
 			if opt_dc {
-				proto, err3 := lua.Compile(chunk, script)
+				proto, err3 := lua.CompileVersion(chunk, script, version)
 				if err3 != nil {
 					fmt.Println(err3.Error())
 					return 1
@@ -120,6 +169,95 @@ Available options are:
 	return status
 }
 
+// runs the script under a Debug Adapter Protocol session
+func runDAP(addr string, version lua.LanguageVersion, mx int) int {
+	var conn io.ReadWriter
+	var output, pipe *os.File
+	if addr == "-" {
+		// the protocol owns stdout, the output of the script is forwarded
+		// to the client
+		r, w, err := os.Pipe()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		conn = struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}
+		stdout := os.Stdout
+		os.Stdout = w
+		defer func() { os.Stdout = stdout }()
+		output, pipe = r, w
+	} else {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "waiting for a debugger on %s\n", ln.Addr())
+		c, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		defer c.Close()
+		conn = c
+	}
+
+	L := lua.NewState(lua.Options{LaxGC: true, LanguageVersion: version})
+	defer L.Close()
+	if mx > 0 {
+		L.SetMx(mx)
+	}
+	d := debugger.New(L)
+	served := make(chan error, 1)
+	go func() { served <- d.Serve(conn) }()
+	forwarded := make(chan struct{})
+	if output != nil {
+		go func() {
+			defer close(forwarded)
+			defer output.Close()
+			buf := make([]byte, 4096)
+			for {
+				n, err := output.Read(buf)
+				if n > 0 {
+					d.Output("stdout", string(buf[:n]))
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	<-d.Configured()
+	script := d.Program()
+	if nargs := flag.NArg(); nargs > 0 {
+		script = flag.Arg(0)
+		argtb := L.NewTable()
+		for i := 1; i < nargs; i++ {
+			L.RawSet(argtb, lua.LNumber(i).AsLValue(), lua.LString(flag.Arg(i)).AsLValue())
+		}
+		L.SetGlobal("arg", argtb.AsLValue())
+	}
+	status := 0
+	if err := L.DoFile(script); err != nil {
+		d.Output("stderr", err.Error()+"\n")
+		status = 1
+	}
+	if pipe != nil {
+		pipe.Close()
+		<-forwarded
+	}
+	d.Exit(status)
+	if err := <-served; err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	return status
+}
+
 // do read/eval/print/loop
 func doREPL(L *lua.LState) {
 	rl, err := readline.New("> ")
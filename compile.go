@@ -125,17 +125,21 @@ func isVarArgReturnExpr(expr ast.Expr) bool {
 	return false
 }
 
-func lnumberValue(expr ast.Expr) (LNumber, bool) {
+func numberConstValue(expr ast.Expr) (LValue, bool) {
 	if ex, ok := expr.(*ast.NumberExpr); ok {
-		lv, err := parseNumber(ex.Value)
-		if err != nil {
-			lv = LNumber(math.NaN())
-		}
-		return lv, true
+		return parseNumberLiteral(ex.Value), true
 	} else if ex, ok := expr.(*constLValueExpr); ok {
-		return ex.Value.MustLNumber(), true
+		return ex.Value, true
+	}
+	return LNil, false
+}
+
+func parseNumberLiteral(number string) LValue {
+	lv, err := parseNumberValue(number)
+	if err != nil {
+		return LNumber(math.NaN()).AsLValue()
 	}
-	return 0, false
+	return lv
 }
 
 /* utilities }}} */
@@ -364,10 +368,12 @@ type codeBlock struct {
 	LastLine       int
 	labels         map[string]*gotoLabelDesc
 	firstGotoIndex int
+	// attributes of the local variables, indexed by register
+	attribs map[int]string
 }
 
 func newCodeBlock(localvars *varNamePool, blabel int, parent *codeBlock, pos ast.PositionHolder, firstGotoIndex int) *codeBlock {
-	bl := &codeBlock{localvars, blabel, parent, false, 0, 0, map[string]*gotoLabelDesc{}, firstGotoIndex}
+	bl := &codeBlock{localvars, blabel, parent, false, 0, 0, map[string]*gotoLabelDesc{}, firstGotoIndex, map[int]string{}}
 	if pos != nil {
 		bl.LineStart = pos.Line()
 		bl.LastLine = pos.LastLine()
@@ -410,6 +416,7 @@ type funcContext struct {
 	labelPc         map[int]int
 	gotosCount      int
 	unresolvedGotos map[int]*gotoLabelDesc
+	version         LanguageVersion
 }
 
 func newFuncContext(sourcename string, parent *funcContext) *funcContext {
@@ -426,6 +433,9 @@ func newFuncContext(sourcename string, parent *funcContext) *funcContext {
 		unresolvedGotos: map[int]*gotoLabelDesc{},
 	}
 	fc.Blocks = []*codeBlock{fc.Block}
+	if parent != nil {
+		fc.version = parent.version
+	}
 	return fc
 }
 
@@ -522,7 +532,7 @@ func (fc *funcContext) GetLabelPc(label int) int {
 func (fc *funcContext) ConstIndex(value LValue) int {
 	ctype := value.Type()
 	for i, lv := range fc.Proto.Constants {
-		if lv.Type() == ctype && lv.Equals(value) {
+		if lv.Type() == ctype && lv.Equals(value) && lv.isLInteger() == value.isLInteger() {
 			return i
 		}
 	}
@@ -562,6 +572,18 @@ func (fc *funcContext) FindLocalVar(name string) int {
 	return idx
 }
 
+// HasToBeClosedVars returns true if a <close> variable is in scope.
+func (fc *funcContext) HasToBeClosedVars() bool {
+	for block := fc.Block; block != nil; block = block.Parent {
+		for _, attrib := range block.attribs {
+			if attrib == "close" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (fc *funcContext) LocalVars() []varNamePoolValue {
 	result := make([]varNamePoolValue, 0, 32)
 	for _, block := range fc.Blocks {
@@ -690,8 +712,14 @@ func compileAssignStmtLeft(context *funcContext, stmt *ast.AssignStmt) (int, []*
 	reg := context.RegTop()
 	acs := make([]*assigncontext, 0, len(stmt.Lhs))
 	for _, lhs := range stmt.Lhs {
+		if ident, ok := lhs.(*ast.IdentExpr); ok {
+			if env := envIndexExpr(context, ident); env != nil {
+				lhs = env
+			}
+		}
 		switch st := lhs.(type) {
 		case *ast.IdentExpr:
+			checkAssignable(context, st)
 			identtype := getIdentRefType(context, context, st)
 			ec := &expcontext{identtype, regNotDefined, 0}
 			switch identtype {
@@ -864,8 +892,41 @@ func compileLocalAssignStmt(context *funcContext, stmt *ast.LocalAssignStmt) { /
 	}
 
 	compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
-	for _, name := range stmt.Names {
-		context.RegisterLocalVar(name)
+	closevar := -1
+	for i, name := range stmt.Names {
+		idx := context.RegisterLocalVar(name)
+		if i >= len(stmt.Attribs) || stmt.Attribs[i] == "" {
+			continue
+		}
+		attrib := stmt.Attribs[i]
+		if context.version < Lua54 {
+			raiseCompileError(context, sline(stmt), "attribute '<%s>' is not supported by %s", attrib, context.version.String())
+		}
+		context.Block.attribs[idx] = attrib
+		if attrib == "close" {
+			if closevar > -1 {
+				raiseCompileError(context, sline(stmt), "multiple to-be-closed variables in local list")
+			}
+			closevar = idx
+		}
+	}
+	if closevar > -1 {
+		// the variable is closed wherever the upvalues of the block are
+		context.Block.RefUpvalue = true
+		context.Code.AddABC(OP_TBC, closevar, 0, 0, sline(stmt))
+	}
+} // }}}
+
+// checkAssignable raises a compile error if ex names a <const> or <close>
+// local variable.
+func checkAssignable(context *funcContext, ex *ast.IdentExpr) { // {{{
+	for current := context; current != nil; current = current.Parent {
+		if idx, block := current.FindLocalVarAndBlock(ex.Value); idx > -1 {
+			if block.attribs[idx] != "" {
+				raiseCompileError(context, sline(ex), "attempt to assign to const variable '%s'", ex.Value)
+			}
+			return
+		}
 	}
 } // }}}
 
@@ -888,7 +949,10 @@ func compileReturnStmt(context *funcContext, stmt *ast.ReturnStmt) { // {{{
 				reg += compileExpr(context, reg, ex, ecnone(0))
 			} else {
 				reg += compileExpr(context, reg, ex, ecnone(-2))
-				code.SetOpCode(code.LastPC(), OP_TAILCALL)
+				// to-be-closed variables are closed after the call returns
+				if !context.HasToBeClosedVars() {
+					code.SetOpCode(code.LastPC(), OP_TAILCALL)
+				}
 			}
 			code.AddABC(OP_RETURN, a, 0, 0, sline(stmt))
 			return
@@ -1019,9 +1083,11 @@ func compileRepeatStmt(context *funcContext, stmt *ast.RepeatStmt) { // {{{
 } // }}}
 
 func compileBreakStmt(context *funcContext, stmt *ast.BreakStmt) { // {{{
+	refUpvalue := false
 	for block := context.Block; block != nil; block = block.Parent {
+		refUpvalue = refUpvalue || block.RefUpvalue
 		if label := block.BreakLabel; label != labelNoJump {
-			if block.RefUpvalue {
+			if refUpvalue {
 				context.Code.AddABC(OP_CLOSE, block.Parent.LocalVars.LastIndex(), 0, 0, sline(stmt))
 			}
 			context.Code.AddASbx(OP_JMP, 0, label, sline(stmt))
@@ -1132,7 +1198,8 @@ func compileLabelStmt(context *funcContext, stmt *ast.LabelStmt, isLastStmt bool
 } // }}}
 
 func compileGotoStmt(context *funcContext, stmt *ast.GotoStmt) { // {{{
-	context.Code.AddABC(OP_CLOSE, 0, 0, 0, sline(stmt))
+	// the variables of the blocks the goto leaves are closed by lowering A
+	context.Code.AddABC(OP_CLOSE, context.BlockLocalVarsCount(), 0, 0, sline(stmt))
 	context.Code.AddASbx(OP_JMP, 0, labelNoJump, sline(stmt))
 	label := newLabelDesc(-1, stmt.Label, context.Code.LastPC(), sline(stmt), context.BlockLocalVarsCount())
 	context.AddUnresolvedGoto(label)
@@ -1152,11 +1219,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 		code.AddABx(OP_LOADK, sreg, context.ConstIndex(LString(ex.Value).AsLValue()), sline(ex))
 		return sused
 	case *ast.NumberExpr:
-		num, err := parseNumber(ex.Value)
-		if err != nil {
-			num = LNumber(math.NaN())
-		}
-		code.AddABx(OP_LOADK, sreg, context.ConstIndex(num.AsLValue()), sline(ex))
+		code.AddABx(OP_LOADK, sreg, context.ConstIndex(parseNumberLiteral(ex.Value)), sline(ex))
 		return sused
 	case *constLValueExpr:
 		code.AddABx(OP_LOADK, sreg, context.ConstIndex(ex.Value), sline(ex))
@@ -1171,6 +1234,9 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 		code.AddABC(OP_LOADBOOL, sreg, 1, 0, sline(ex))
 		return sused
 	case *ast.IdentExpr:
+		if env := envIndexExpr(context, ex); env != nil {
+			return compileExpr(context, reg, env, ec)
+		}
 		switch getIdentRefType(context, context, ex) {
 		case ecGlobal:
 			code.AddABx(OP_GETGLOBAL, sreg, context.ConstIndex(LString(ex.Value).AsLValue()), sline(ex))
@@ -1212,7 +1278,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 	case *ast.StringConcatOpExpr:
 		compileStringConcatOpExpr(context, reg, ex, ec)
 		return sused
-	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr:
+	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr, *ast.UnaryBNotOpExpr:
 		compileUnaryOpExpr(context, reg, ex, ec)
 		return sused
 	case *ast.RelationalOpExpr:
@@ -1267,25 +1333,46 @@ func compileExprWithMVPropagation(context *funcContext, expr ast.Expr, reg *int,
 	compileExprWithPropagation(context, expr, reg, save, context.Code.PropagateMV)
 } // }}}
 
-func constFold(exp ast.Expr) ast.Expr { // {{{
+func constFold(context *funcContext, exp ast.Expr) ast.Expr { // {{{
 	switch expr := exp.(type) {
 	case *ast.ArithmeticOpExpr:
-		lvalue, lisconst := lnumberValue(constFold(expr.Lhs))
-		rvalue, risconst := lnumberValue(constFold(expr.Rhs))
+		switch expr.Operator {
+		case "//", "&", "|", "~", "<<", ">>":
+			checkLua53Operator(context, expr.Operator, sline(expr))
+		}
+		lvalue, lisconst := numberConstValue(constFold(context, expr.Lhs))
+		rvalue, risconst := numberConstValue(constFold(context, expr.Rhs))
 		if lisconst && risconst {
+			if context.version >= Lua53 && (expr.Operator == "%" && integerDivisionByZero(OP_MOD, lvalue, rvalue) ||
+				expr.Operator == "//" && integerDivisionByZero(OP_IDIV, lvalue, rvalue)) {
+				// raised when the expression is evaluated
+				return expr
+			}
 			switch expr.Operator {
 			case "+":
-				return &constLValueExpr{Value: (lvalue + rvalue).AsLValue()}
+				return &constLValueExpr{Value: numberArith(OP_ADD, lvalue, rvalue, context.version >= Lua53)}
 			case "-":
-				return &constLValueExpr{Value: (lvalue - rvalue).AsLValue()}
+				return &constLValueExpr{Value: numberArith(OP_SUB, lvalue, rvalue, context.version >= Lua53)}
 			case "*":
-				return &constLValueExpr{Value: (lvalue * rvalue).AsLValue()}
+				return &constLValueExpr{Value: numberArith(OP_MUL, lvalue, rvalue, context.version >= Lua53)}
 			case "/":
-				return &constLValueExpr{Value: (lvalue / rvalue).AsLValue()}
+				return &constLValueExpr{Value: numberArith(OP_DIV, lvalue, rvalue, context.version >= Lua53)}
 			case "%":
-				return &constLValueExpr{Value: luaModulo(lvalue, rvalue).AsLValue()}
+				return &constLValueExpr{Value: numberArith(OP_MOD, lvalue, rvalue, context.version >= Lua53)}
 			case "^":
-				return &constLValueExpr{Value: LNumber(math.Pow(float64(lvalue), float64(rvalue))).AsLValue()}
+				return &constLValueExpr{Value: numberArith(OP_POW, lvalue, rvalue, context.version >= Lua53)}
+			case "//":
+				return &constLValueExpr{Value: numberArith(OP_IDIV, lvalue, rvalue, context.version >= Lua53)}
+			case "&":
+				return constBitwise(expr, OP_BAND, lvalue, rvalue)
+			case "|":
+				return constBitwise(expr, OP_BOR, lvalue, rvalue)
+			case "~":
+				return constBitwise(expr, OP_BXOR, lvalue, rvalue)
+			case "<<":
+				return constBitwise(expr, OP_SHL, lvalue, rvalue)
+			case ">>":
+				return constBitwise(expr, OP_SHR, lvalue, rvalue)
 			default:
 				panic(fmt.Sprintf("unknown binop: %v", expr.Operator))
 			}
@@ -1293,9 +1380,21 @@ func constFold(exp ast.Expr) ast.Expr { // {{{
 			return expr
 		}
 	case *ast.UnaryMinusOpExpr:
-		expr.Expr = constFold(expr.Expr)
-		if value, ok := lnumberValue(expr.Expr); ok {
-			return &constLValueExpr{Value: LNumber(-value).AsLValue()}
+		expr.Expr = constFold(context, expr.Expr)
+		if value, ok := numberConstValue(expr.Expr); ok {
+			if i, ok := value.AsLInteger(); ok && (i != math.MinInt64 || context.version >= Lua53) {
+				return &constLValueExpr{Value: LInteger(-i).AsLValue()}
+			}
+			return &constLValueExpr{Value: LNumber(-LVAsNumber(value)).AsLValue()}
+		}
+		return expr
+	case *ast.UnaryBNotOpExpr:
+		checkLua53Operator(context, "~", sline(expr))
+		expr.Expr = constFold(context, expr.Expr)
+		if value, ok := numberConstValue(expr.Expr); ok {
+			if i, ok := bitwiseOperand(value); ok {
+				return &constLValueExpr{Value: LInteger(^i).AsLValue()}
+			}
 		}
 		return expr
 	default:
@@ -1304,6 +1403,25 @@ func constFold(exp ast.Expr) ast.Expr { // {{{
 	}
 } // }}}
 
+// constBitwise folds a bitwise operation on two number constants, unless one
+// of them has no integer representation, which is an error at run time.
+func constBitwise(expr *ast.ArithmeticOpExpr, opcode int, lhs, rhs LValue) ast.Expr { // {{{
+	if i1, ok1 := bitwiseOperand(lhs); ok1 {
+		if i2, ok2 := bitwiseOperand(rhs); ok2 {
+			return &constLValueExpr{Value: integerBitwise(opcode, i1, i2).AsLValue()}
+		}
+	}
+	return expr
+} // }}}
+
+// checkLua53Operator raises a compile error if op, a bitwise operator or the
+// floor division, is used before Lua 5.3.
+func checkLua53Operator(context *funcContext, op string, line int) { // {{{
+	if context.version < Lua53 {
+		raiseCompileError(context, line, "operator '%s' is not supported by %s", op, context.version.String())
+	}
+} // }}}
+
 func compileFunctionExpr(context *funcContext, funcexpr *ast.FunctionExpr, ec *expcontext) { // {{{
 	context.Proto.LineDefined = sline(funcexpr)
 	context.Proto.LastLineDefined = eline(funcexpr)
@@ -1319,7 +1437,7 @@ func compileFunctionExpr(context *funcContext, funcexpr *ast.FunctionExpr, ec *e
 		context.RegisterLocalVar(name)
 	}
 	if funcexpr.ParList.HasVargs {
-		if CompatVarArg {
+		if CompatVarArg && context.version == Lua51 {
 			context.Proto.IsVarArg = VarArgHasArg | VarArgNeedsArg
 			if context.Parent != nil {
 				context.RegisterLocalVar("arg")
@@ -1412,7 +1530,7 @@ func compileTableExpr(context *funcContext, reg int, ex *ast.TableExpr, ec *expc
 } // }}}
 
 func compileArithmeticOpExpr(context *funcContext, reg int, expr *ast.ArithmeticOpExpr, ec *expcontext) { // {{{
-	exp := constFold(expr)
+	exp := constFold(context, expr)
 	if ex, ok := exp.(*constLValueExpr); ok {
 		exp.SetLine(sline(expr))
 		compileExpr(context, reg, ex, ec)
@@ -1439,6 +1557,18 @@ func compileArithmeticOpExpr(context *funcContext, reg int, expr *ast.Arithmetic
 		op = OP_MOD
 	case "^":
 		op = OP_POW
+	case "//":
+		op = OP_IDIV
+	case "&":
+		op = OP_BAND
+	case "|":
+		op = OP_BOR
+	case "~":
+		op = OP_BXOR
+	case "<<":
+		op = OP_SHL
+	case ">>":
+		op = OP_SHR
 	}
 	context.Code.AddABC(op, a, b, c, sline(expr))
 } // }}}
@@ -1470,7 +1600,7 @@ func compileUnaryOpExpr(context *funcContext, reg int, expr ast.Expr, ec *expcon
 	var operandexpr ast.Expr
 	switch ex := expr.(type) {
 	case *ast.UnaryMinusOpExpr:
-		exp := constFold(ex)
+		exp := constFold(context, ex)
 		if lvexpr, ok := exp.(*constLValueExpr); ok {
 			exp.SetLine(sline(expr))
 			compileExpr(context, reg, lvexpr, ec)
@@ -1479,6 +1609,16 @@ func compileUnaryOpExpr(context *funcContext, reg int, expr ast.Expr, ec *expcon
 		ex, _ = exp.(*ast.UnaryMinusOpExpr)
 		operandexpr = ex.Expr
 		opcode = OP_UNM
+	case *ast.UnaryBNotOpExpr:
+		exp := constFold(context, ex)
+		if lvexpr, ok := exp.(*constLValueExpr); ok {
+			exp.SetLine(sline(expr))
+			compileExpr(context, reg, lvexpr, ec)
+			return
+		}
+		ex, _ = exp.(*ast.UnaryBNotOpExpr)
+		operandexpr = ex.Expr
+		opcode = OP_BNOT
 	case *ast.UnaryNotOpExpr:
 		switch ex.Expr.(type) {
 		case *ast.TrueExpr:
@@ -1737,6 +1877,10 @@ func loadRk(context *funcContext, reg *int, expr ast.Expr, cnst LValue) int { //
 
 func getIdentRefType(context *funcContext, current *funcContext, expr *ast.IdentExpr) expContextType { // {{{
 	if current == nil {
+		if context.version >= Lua52 && expr.Value == "_ENV" {
+			// an upvalue of the main chunk
+			return ecUpvalue
+		}
 		return ecGlobal
 	} else if current.FindLocalVar(expr.Value) > -1 {
 		if current == context {
@@ -1747,6 +1891,23 @@ func getIdentRefType(context *funcContext, current *funcContext, expr *ast.Ident
 	return getIdentRefType(context, current.Parent, expr)
 } // }}}
 
+// envIndexExpr returns the expression _ENV.name that the global variable ex
+// stands for since Lua 5.2, or nil if ex is not a global variable of such a
+// chunk.
+func envIndexExpr(context *funcContext, ex *ast.IdentExpr) *ast.AttrGetExpr { // {{{
+	if context.version < Lua52 || getIdentRefType(context, context, ex) != ecGlobal {
+		return nil
+	}
+	env := &ast.IdentExpr{Value: "_ENV"}
+	key := &ast.StringExpr{Value: ex.Value}
+	attr := &ast.AttrGetExpr{Object: env, Key: key}
+	for _, node := range []ast.PositionHolder{env, key, attr} {
+		node.SetLine(sline(ex))
+		node.SetLastLine(eline(ex))
+	}
+	return attr
+} // }}}
+
 func getExprName(context *funcContext, expr ast.Expr) string { // {{{
 	switch ex := expr.(type) {
 	case *ast.IdentExpr:
@@ -1840,6 +2001,13 @@ func patchCode(context *funcContext) { // {{{
 } // }}}
 
 func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) { // {{{
+	return CompileVersion(chunk, name, Lua51)
+} // }}}
+
+// CompileVersion compiles chunk for the given version of the language. The
+// main function of a chunk compiled for Lua 5.2 or later has the upvalue
+// _ENV, which must be set to its environment.
+func CompileVersion(chunk []ast.Stmt, name string, version LanguageVersion) (proto *FunctionProto, err error) { // {{{
 	defer func() {
 		if rcv := recover(); rcv != nil {
 			if _, ok := rcv.(*CompileError); ok {
@@ -1857,6 +2025,10 @@ func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) {
 		funcexpr.SetLastLine(eline(chunk[len(chunk)-1]) + 1)
 	}
 	context := newFuncContext(name, nil)
+	context.version = version
+	if version >= Lua52 {
+		context.Upvalues.Register("_ENV")
+	}
 	compileFunctionExpr(context, funcexpr, ecnone(0))
 	proto = context.Proto
 	return
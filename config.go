@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"fmt"
 	"os"
 )
 
@@ -18,6 +19,38 @@ const LNumberBit = 64
 const LNumberScanFormat = "%f"
 const LuaVersion = "Lua 5.1"
 
+// LanguageVersion is a version of the Lua language, see Options.LanguageVersion.
+type LanguageVersion int
+
+const (
+	// Lua51 is Lua 5.1, the default.
+	Lua51 LanguageVersion = iota
+	// Lua52 is Lua 5.2: global variables are fields of the _ENV upvalue of the
+	// chunk instead of the environment of the function.
+	Lua52
+	// Lua53 is Lua 5.3, which adds the bitwise operators and floor division
+	// to Lua 5.2. Integer arithmetic wraps around on overflow, and floats are
+	// converted to strings with a trailing ".0" when they have an integral value.
+	Lua53
+	// Lua54 is Lua 5.4, which adds the <const> and <close> attributes of local
+	// variables to Lua 5.3.
+	Lua54
+)
+
+func (v LanguageVersion) String() string {
+	switch v {
+	case Lua51:
+		return LuaVersion
+	case Lua52:
+		return "Lua 5.2"
+	case Lua53:
+		return "Lua 5.3"
+	case Lua54:
+		return "Lua 5.4"
+	}
+	return fmt.Sprintf("LanguageVersion(%d)", int(v))
+}
+
 var LuaPath = "LUA_PATH"
 var LuaLDir string
 var LuaPathDefault string
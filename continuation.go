@@ -0,0 +1,143 @@
+package lua
+
+import (
+	"fmt"
+)
+
+/* continuations {{{ */
+
+// KFunction is the continuation of a Go function that calls Lua with CallK
+// or PCallK. It is called with the results of the call on the top of the
+// stack and returns the number of results of the Go function, like an
+// LGFunction. status is ResumeOK if the call has returned without
+// yielding, ResumeYield if the coroutine has yielded during the call and
+// has been resumed, and ResumeError if a call made with PCallK has failed,
+// in which case the error object is on the top of the stack instead.
+type KFunction func(L *LState, status ResumeState) int
+
+// continuation is a call made with CallK or PCallK by the Go function of a
+// frame.
+type continuation struct {
+	k         KFunction
+	protected bool
+	errfunc   *LFunction
+	// register of the function called, where the results are placed
+	base int
+}
+
+// yieldUnwind is panicked to discard the Go stack of the functions waiting
+// for a call made with CallK or PCallK when the coroutine yields during it.
+// threadRun recovers it.
+type yieldUnwind struct{}
+
+// CallK calls a function like Call, then returns k(L, ResumeOK). The
+// function called may yield the running coroutine, even when it is called
+// by a Go function itself called by Lua: CallK then does not return, the
+// Go stack of the calling function being discarded, and k is called in its
+// place, with the status ResumeYield, when the call returns after the
+// coroutine has been resumed. A Go function must therefore return the
+// result of CallK, and keep the state it needs after the call in k.
+func (ls *LState) CallK(nargs, nret int, k KFunction) int {
+	frame := ls.continuationFrame()
+	if frame == nil {
+		ls.Call(nargs, nret)
+		return k(ls, ResumeOK)
+	}
+	frame.cont = &continuation{k: k}
+	if !ls.call(nargs, nret, -1) {
+		panic(yieldUnwind{})
+	}
+	frame.cont = nil
+	return k(ls, ResumeOK)
+}
+
+// PCallK is CallK in protected mode, like PCall. If the call fails, before
+// or after a yield, the stack is restored and the continuation is called
+// with the status ResumeError and the error object, processed by errfunc if
+// it is not nil, on the top of the stack.
+func (ls *LState) PCallK(nargs, nret int, errfunc *LFunction, k KFunction) int {
+	frame := ls.continuationFrame()
+	if frame != nil {
+		frame.cont = &continuation{k: k, protected: true, errfunc: errfunc, base: ls.reg.Top() - nargs - 1}
+	}
+	returned, err := ls.pcall(nargs, nret, errfunc, frame != nil)
+	if err == nil && !returned {
+		panic(yieldUnwind{})
+	}
+	if frame != nil {
+		frame.cont = nil
+	}
+	if err != nil {
+		ls.Push(err.(*ApiError).Object)
+		return k(ls, ResumeError)
+	}
+	return k(ls, ResumeOK)
+}
+
+// continuationFrame returns the frame of the running Go function, or nil if
+// it has none and can not wait for a yielding call.
+func (ls *LState) continuationFrame() *callFrame {
+	cf := ls.currentFrame
+	if cf == nil || !cf.Fn.IsG || ls.fastCallLBase != 0 {
+		return nil
+	}
+	return cf
+}
+
+// callContinuation completes the current frame, whose Go function has been
+// discarded by a yield, by calling its continuation.
+func (ls *LState) callContinuation(status ResumeState) {
+	frame := ls.currentFrame
+	k := frame.cont.k
+	frame.cont = nil
+	// a Go function called by a tail call returns to the caller of the Lua
+	// function it replaces, see OP_TAILCALL
+	tailcall := frame.ReturnBase != frame.Base
+	finishGFunction(ls, frame, k(ls, status), tailcall)
+}
+
+// recoverContinuation catches the error rcv in the innermost frame waiting
+// for a call made with PCallK whose Go function has been discarded, if any.
+// It unwinds the stack to that frame, closing its to-be-closed variables and
+// upvalues, and pushes the error object.
+func (ls *LState) recoverContinuation(rcv any) bool {
+	var frame *callFrame
+	for cf := ls.currentFrame; cf != nil; cf = cf.Parent {
+		if cf.cont != nil && cf.cont.protected {
+			frame = cf
+			break
+		}
+	}
+	if frame == nil {
+		return false
+	}
+	ls.fastCallLBase = 0
+	var lv LValue
+	if err, ok := rcv.(*ApiError); ok {
+		lv = err.Object
+	} else {
+		lv = LString(fmt.Sprint(rcv)).AsLValue()
+	}
+	if errfunc := frame.cont.errfunc; errfunc != nil {
+		ls.Push(errfunc.AsLValue())
+		ls.Push(lv)
+		if err := ls.PCall(1, 1, nil); err != nil {
+			lv = err.(*ApiError).Object
+		} else {
+			lv = ls.reg.Pop()
+		}
+	}
+	ls.stack.SetSp(frame.Idx + 1)
+	ls.currentFrame = frame
+	// unwind the frames above the call like pcall does
+	base := frame.cont.base
+	if n := len(ls.tbcVars); n > 0 && ls.tbcVars[n-1] >= base {
+		lv = ls.closeVarsOnError(base, newApiError(ApiErrorRun, lv)).Object
+	}
+	ls.closeUpvalues(base)
+	ls.reg.SetTop(base)
+	ls.Push(lv)
+	return true
+}
+
+/* }}} */
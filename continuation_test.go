@@ -0,0 +1,143 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestCallK(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var statuses []ResumeState
+	L.SetGlobal("gocall", L.NewFunction(func(L *LState) int {
+		// gocall(f, x) returns "go", f(x) + 1
+		L.Push(LString("go").AsLValue())
+		L.Push(L.Get(1))
+		L.Push(L.Get(2))
+		return L.CallK(1, 1, func(L *LState, status ResumeState) int {
+			statuses = append(statuses, status)
+			L.Push(LNumber(L.CheckNumber(-1) + 1).AsLValue())
+			L.Remove(-2)
+			return 2
+		})
+	}).AsLValue())
+	errorIfScriptFail(t, L, `
+	local a, b = gocall(function(x) return x * 2 end, 10)
+	assert(a == "go" and b == 21)
+
+	local co = coroutine.wrap(function(x)
+		local a, b = gocall(function(x) return coroutine.yield(x) * 2 end, x)
+		assert(a == "go")
+		return "done", b
+	end)
+	assert(co(5) == 5)
+	local done, b = co(10)
+	assert(done == "done" and b == 21)
+
+	-- the Go function is the body of the coroutine, and is tail called
+	co = coroutine.wrap(gocall)
+	assert(co(coroutine.yield, 1) == 1)
+	local a, b = co(3)
+	assert(a == "go" and b == 4)
+	co = coroutine.wrap(function() return gocall(coroutine.yield, 1) end)
+	assert(co() == 1)
+	local a, b = co(6)
+	assert(a == "go" and b == 7)
+
+	-- nested continuations
+	co = coroutine.wrap(function()
+		return gocall(function(x)
+			local _, y = gocall(coroutine.yield, x)
+			return y
+		end, 1)
+	end)
+	assert(co() == 1)
+	local a, b = co(2)
+	assert(a == "go" and b == 4)
+	`)
+	errorIfFalse(t, len(statuses) == 6, "unexpected statuses %v", statuses)
+	errorIfNotEqual(t, ResumeOK, statuses[0])
+	for _, status := range statuses[1:] {
+		errorIfNotEqual(t, ResumeYield, status)
+	}
+}
+
+func TestPCallK(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("gopcall", L.NewFunction(func(L *LState) int {
+		// gopcall(f, ...) returns the status and the results or error of f
+		return L.PCallK(L.GetTop()-1, MultRet, nil, func(L *LState, status ResumeState) int {
+			L.Insert(LNumber(status).AsLValue(), 1)
+			return L.GetTop()
+		})
+	}).AsLValue())
+	L.SetGlobal("OK", LNumber(ResumeOK).AsLValue())
+	L.SetGlobal("YIELD", LNumber(ResumeYield).AsLValue())
+	L.SetGlobal("ERROR", LNumber(ResumeError).AsLValue())
+	errorIfScriptFail(t, L, `
+	local status, err = gopcall(error, "e", 0)
+	assert(status == ERROR and err == "e")
+	local status, a, b = gopcall(function(...) return ... end, 1, 2)
+	assert(status == OK and a == 1 and b == 2)
+
+	local co = coroutine.wrap(function()
+		local status, err = gopcall(function()
+			local x = coroutine.yield("yielded")
+			error({x})
+		end)
+		assert(status == ERROR and err[1] == "value")
+		status, err = gopcall(function() return coroutine.yield() end)
+		return status, err
+	end)
+	assert(co() == "yielded")
+	co("value")
+	local status, v = co("last")
+	assert(status == YIELD and v == "last")
+	`)
+}
+
+func TestYieldablePCall(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local log = {}
+	local co = coroutine.create(function()
+		local ok, v = pcall(function()
+			local x = coroutine.yield(1)
+			return x * 2
+		end)
+		table.insert(log, tostring(ok) .. " " .. v)
+		ok, v = pcall(function()
+			coroutine.yield(2)
+			error("boom", 0)
+		end)
+		table.insert(log, tostring(ok) .. " " .. v)
+		ok, v = xpcall(function()
+			coroutine.yield(3)
+			error("boom", 0)
+		end, function(e) return "handled " .. e end)
+		table.insert(log, tostring(ok) .. " " .. v)
+		return pcall(function() return coroutine.yield(4) end)
+	end)
+	for i = 1, 4 do
+		local ok, v = coroutine.resume(co, 21)
+		assert(ok and v == i)
+	end
+	local ok, pok, v = coroutine.resume(co, "end")
+	assert(ok and pok and v == "end" and coroutine.status(co) == "dead")
+	assert(table.concat(log, ",") == "true 42,false boom,false handled boom")
+	`)
+
+	errorIfScriptFail(t, L, `
+	local co = coroutine.wrap(function()
+		table.sort({3, 2, 1}, function(a, b) coroutine.yield() return a < b end)
+	end)
+	local ok, err = pcall(co)
+	assert(not ok and string.find(err, "attempt to yield across a Go-call boundary", 1, true))
+
+	local t = setmetatable({}, {__index = function(t, k) return coroutine.yield(k) end})
+	co = coroutine.wrap(function() return t.x end)
+	ok, err = pcall(co)
+	assert(not ok and string.find(err, "attempt to yield across a Go-call boundary", 1, true))
+	`)
+}
@@ -0,0 +1,177 @@
+package lua
+
+import (
+	"fmt"
+)
+
+/* copying values between states {{{ */
+
+// CopyPolicy tells CopyValue what to do with a value that belongs to its
+// state and can not be shared with another one.
+type CopyPolicy int
+
+const (
+	// CopyReject makes CopyValue fail.
+	CopyReject CopyPolicy = iota
+	// CopyNil replaces the value with nil.
+	CopyNil
+	// CopyConvert converts the value to a value of the destination state, see
+	// CopyOptions.
+	CopyConvert
+)
+
+// CopyOptions controls CopyValue.
+type CopyOptions struct {
+	// Metatables tells whether the metatables of tables and userdata are
+	// copied. If not, the copies have no metatable.
+	Metatables bool
+	// Functions is the policy for functions. A converted Lua function is a new
+	// closure of the same prototype in the destination state, whose upvalues
+	// are copies of the upvalues of the original, shared by the copies of the
+	// closures that share them; a converted Go function calls the same
+	// LGFunction.
+	Functions CopyPolicy
+	// UserData is the policy for userdata. A converted userdata is a new
+	// userdata holding the same Go value; its __gc metamethod, if any, is not
+	// called, the original userdata being the owner of the value. Threads are
+	// never converted, and are rejected unless the policy is CopyNil.
+	UserData CopyPolicy
+}
+
+// CopyValue returns a copy of v, a value of any state, that belongs to dst.
+// Strings, numbers, booleans and channels are shared; tables are copied deeply,
+// the copy preserving cycles and shared subtables. Functions, userdata and
+// threads are handled as opts tells. The state v belongs to must not modify
+// the values copied during the call.
+func CopyValue(dst *LState, v LValue, opts CopyOptions) (LValue, error) {
+	c := &valueCopier{dst: dst, opts: opts, copies: make(map[[2]uintptr]LValue), upvalues: make(map[*Upvalue]*Upvalue)}
+	return c.copy(v)
+}
+
+type valueCopier struct {
+	dst    *LState
+	opts   CopyOptions
+	copies map[[2]uintptr]LValue
+	// copies of the upvalues of the Lua functions, so that the copies of
+	// closures sharing an upvalue share its copy
+	upvalues map[*Upvalue]*Upvalue
+}
+
+func (c *valueCopier) copy(v LValue) (LValue, error) {
+	switch v.Type() {
+	case LTTable, LTFunction, LTUserData, LTThread:
+	default:
+		return v, nil
+	}
+	if cp, ok := c.copies[v.asComparable()]; ok {
+		return cp, nil
+	}
+	if ud, ok := v.AsLUserData(); ok {
+		if sent, ok := ud.Value.(*channelCopy); ok {
+			return c.copy(sent.value)
+		}
+	}
+	switch v.Type() {
+	case LTTable:
+		return c.copyTable(v)
+	case LTFunction:
+		return c.copyFunction(v)
+	case LTUserData:
+		return c.copyUserData(v)
+	default:
+		if c.opts.UserData == CopyNil {
+			return LNil, nil
+		}
+		return LNil, fmt.Errorf("can not copy a %s", v.Type().String())
+	}
+}
+
+func (c *valueCopier) copyTable(v LValue) (LValue, error) {
+	tb := v.MustLTable()
+	cp := c.dst.CreateTable(len(tb.array), 0)
+	c.copies[v.asComparable()] = cp.AsLValue()
+	var err error
+	for key, value := tb.Next(LNil); !key.EqualsLNil(); key, value = tb.Next(key) {
+		var ckey, cvalue LValue
+		if ckey, err = c.copy(key); err != nil {
+			return LNil, err
+		}
+		if cvalue, err = c.copy(value); err != nil {
+			return LNil, err
+		}
+		if !ckey.EqualsLNil() {
+			cp.RawSet(ckey, cvalue)
+		}
+	}
+	if c.opts.Metatables && !tb.Metatable.EqualsLNil() {
+		mt, err := c.copy(tb.Metatable)
+		if err != nil {
+			return LNil, err
+		}
+		c.dst.SetMetatable(cp.AsLValue(), mt)
+	}
+	return cp.AsLValue(), nil
+}
+
+func (c *valueCopier) copyFunction(v LValue) (LValue, error) {
+	switch c.opts.Functions {
+	case CopyNil:
+		return LNil, nil
+	case CopyReject:
+		return LNil, fmt.Errorf("can not copy a function")
+	}
+	fn := v.MustLFunction()
+	var cp *LFunction
+	if fn.IsG {
+		cp = c.dst.NewClosure(fn.GFunction, make([]LValue, len(fn.Upvalues))...)
+		cp.IsFast = fn.IsFast
+	} else {
+		cp = c.dst.NewFunctionFromProto(fn.Proto)
+		for i := range cp.Upvalues {
+			cp.Upvalues[i] = &Upvalue{}
+			cp.Upvalues[i].Close()
+		}
+	}
+	c.copies[v.asComparable()] = cp.AsLValue()
+	for i, uv := range fn.Upvalues {
+		if uv == nil {
+			continue
+		}
+		if !fn.IsG {
+			if cuv, ok := c.upvalues[uv]; ok {
+				cp.Upvalues[i] = cuv
+				continue
+			}
+			c.upvalues[uv] = cp.Upvalues[i]
+		}
+		value, err := c.copy(uv.Value())
+		if err != nil {
+			return LNil, err
+		}
+		cp.Upvalues[i].SetValue(value)
+	}
+	return cp.AsLValue(), nil
+}
+
+func (c *valueCopier) copyUserData(v LValue) (LValue, error) {
+	switch c.opts.UserData {
+	case CopyNil:
+		return LNil, nil
+	case CopyReject:
+		return LNil, fmt.Errorf("can not copy a userdata")
+	}
+	ud := v.MustLUserData()
+	cp := c.dst.NewUserData()
+	cp.Value = ud.Value
+	c.copies[v.asComparable()] = cp.AsLValue()
+	if c.opts.Metatables && !ud.Metatable.EqualsLNil() {
+		mt, err := c.copy(ud.Metatable)
+		if err != nil {
+			return LNil, err
+		}
+		cp.Metatable = mt
+	}
+	return cp.AsLValue(), nil
+}
+
+/* }}} */
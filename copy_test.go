@@ -0,0 +1,122 @@
+package lua
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCopyValue(t *testing.T) {
+	src := NewState()
+	defer src.Close()
+	dst := NewState()
+	defer dst.Close()
+	errorIfScriptFail(t, src, `
+	local mt = {__index = function(t, k) return k .. "!" end}
+	local shared = setmetatable({n = 1}, mt)
+	value = {1, 2, "three", sub = shared, again = shared, [shared] = true}
+	value.self = value
+	local counter = 10
+	value.inc = function() counter = counter + 1; return counter end
+	value.print = print
+	`)
+	v := src.GetGlobal("value")
+
+	_, err := CopyValue(dst, v, CopyOptions{})
+	errorIfFalse(t, err != nil && err.Error() == "can not copy a function", "unexpected error %v", err)
+
+	cp, err := CopyValue(dst, v, CopyOptions{Functions: CopyNil})
+	errorIfNotNil(t, err)
+	dst.SetGlobal("value", cp)
+	errorIfScriptFail(t, dst, `
+	assert(#value == 3 and value[3] == "three")
+	assert(value.self == value and value.sub == value.again and value[value.sub])
+	assert(value.inc == nil and value.print == nil)
+	assert(getmetatable(value.sub) == nil and value.sub.x == nil)
+	value.sub.n = 2
+	`)
+	errorIfScriptFail(t, src, `assert(value.sub.n == 1)`)
+
+	cp, err = CopyValue(dst, v, CopyOptions{Metatables: true, Functions: CopyConvert})
+	errorIfNotNil(t, err)
+	dst.SetGlobal("value", cp)
+	errorIfScriptFail(t, dst, `
+	assert(value.sub.x == "x!")
+	assert(value.inc() == 11 and value.inc() == 12)
+	assert(value.print ~= print and tostring(value.print):find("^function"))
+	`)
+	errorIfScriptFail(t, src, `assert(value.inc() == 11)`)
+
+	ud := src.NewUserData()
+	ud.Value = 42
+	cp, err = CopyValue(dst, ud.AsLValue(), CopyOptions{UserData: CopyConvert})
+	errorIfNotNil(t, err)
+	errorIfNotEqual(t, 42, cp.MustLUserData().Value)
+	th, _ := src.NewThread()
+	_, err = CopyValue(dst, th.AsLValue(), CopyOptions{UserData: CopyConvert})
+	errorIfNil(t, err)
+	cp, err = CopyValue(dst, th.AsLValue(), CopyOptions{UserData: CopyNil})
+	errorIfNotNil(t, err)
+	errorIfFalse(t, cp.EqualsLNil(), "thread copied as %v", cp)
+}
+
+func TestCopyValueSharedUpvalues(t *testing.T) {
+	src := NewState()
+	defer src.Close()
+	dst := NewState()
+	defer dst.Close()
+	errorIfScriptFail(t, src, `
+	local n = 0
+	local inc = function() n = n + 1 end
+	local get = function() return n end
+	value = {inc, get}
+	`)
+	cp, err := CopyValue(dst, src.GetGlobal("value"), CopyOptions{Functions: CopyConvert})
+	errorIfNotNil(t, err)
+	dst.SetGlobal("value", cp)
+	errorIfScriptFail(t, dst, `
+	local inc, get = value[1], value[2]
+	inc()
+	inc()
+	assert(get() == 2, get())
+	`)
+	errorIfScriptFail(t, src, `assert(value[2]() == 0)`)
+}
+
+func TestChannelCopy(t *testing.T) {
+	ch := make(chan LValue)
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("ch", LChannel(ch).AsLValue())
+	errorIfScriptNotFail(t, L, `ch:send(setmetatable({}, {}))`, "can not send a function")
+
+	opts := Options{ChannelCopy: &CopyOptions{Metatables: true, Functions: CopyConvert}}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(ch)
+		L := NewState(opts)
+		defer L.Close()
+		L.SetGlobal("ch", LChannel(ch).AsLValue())
+		errorIfScriptFail(t, L, `
+		local t = setmetatable({1, {2}}, {__len = function() return 10 end})
+		t.t = t
+		ch:send(t)
+		channel.select({"<-|", ch, t})
+		t[1] = "changed"
+		ch:send(t)
+		`)
+	}()
+	receiver := NewState(opts)
+	defer receiver.Close()
+	receiver.SetGlobal("ch", LChannel(ch).AsLValue())
+	errorIfScriptFail(t, receiver, `
+	local ok, t = ch:receive()
+	assert(ok and t.t == t and t[2][1] == 2 and #t == 10)
+	local _, u = channel.select({"|<-", ch})
+	assert(u ~= t and u[1] == 1)
+	_, u = ch:receive()
+	assert(u[1] == "changed" and t[1] == 1)
+	`)
+	wg.Wait()
+}
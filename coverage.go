@@ -0,0 +1,166 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+/* line coverage {{{ */
+
+// Coverage records the lines executed by the states it is set to with
+// SetCoverage. The executable lines of a chunk are those of its
+// instructions, except the return the compiler adds at the end of every
+// function; they are registered when the chunk is loaded. A Coverage may be
+// shared by states running on different goroutines.
+type Coverage struct {
+	mu     sync.Mutex
+	files  map[string]map[int]int64
+	protos map[*FunctionProto]struct{}
+}
+
+// FileCoverage is the coverage of the chunks loaded from a source.
+type FileCoverage struct {
+	Source string
+	// Lines maps each executable line to the number of times it has been
+	// executed.
+	Lines      map[int]int64
+	LinesFound int
+	LinesHit   int
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{
+		files:  make(map[string]map[int]int64),
+		protos: make(map[*FunctionProto]struct{}),
+	}
+}
+
+// SetCoverage makes the state and its threads record their executed lines
+// in c. A nil c stops recording.
+func (ls *LState) SetCoverage(c *Coverage) {
+	ls.G.coverage = c
+	ls.reloadMainLoop()
+}
+
+func (c *Coverage) file(source string) map[int]int64 {
+	lines, ok := c.files[source]
+	if !ok {
+		lines = make(map[int]int64)
+		c.files[source] = lines
+	}
+	return lines
+}
+
+// addProto registers the executable lines of proto and its nested
+// functions. It is called with c.mu held.
+func (c *Coverage) addProto(proto *FunctionProto) {
+	if _, ok := c.protos[proto]; ok {
+		return
+	}
+	c.protos[proto] = struct{}{}
+	lines := c.file(proto.SourceName)
+	positions := proto.DbgSourcePositions
+	if len(positions) > 0 {
+		positions = positions[:len(positions)-1]
+	}
+	for _, line := range positions {
+		if _, ok := lines[line]; !ok && line > 0 {
+			lines[line] = 0
+		}
+	}
+	for _, p := range proto.FunctionPrototypes {
+		c.addProto(p)
+	}
+}
+
+func (c *Coverage) add(proto *FunctionProto) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addProto(proto)
+}
+
+func (c *Coverage) hit(proto *FunctionProto, line int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addProto(proto)
+	lines := c.files[proto.SourceName]
+	if _, ok := lines[line]; ok {
+		lines[line]++
+	}
+}
+
+// traceCoverage is called by mainLoopWithHooks before each instruction of cf
+// is executed.
+func (ls *LState) traceCoverage(c *Coverage, cf *callFrame) {
+	if line, ok := ls.coverLines.next(cf); ok {
+		c.hit(cf.Fn.Proto, line)
+	}
+}
+
+// Merge adds the lines recorded by o to c.
+func (c *Coverage) Merge(o *Coverage) {
+	if c == o {
+		return
+	}
+	files := o.Files()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fc := range files {
+		lines := c.file(fc.Source)
+		for line, hits := range fc.Lines {
+			lines[line] += hits
+		}
+	}
+}
+
+// Files returns the coverage of every source, sorted by name.
+func (c *Coverage) Files() []FileCoverage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files := make([]FileCoverage, 0, len(c.files))
+	for source, lines := range c.files {
+		fc := FileCoverage{Source: source, Lines: make(map[int]int64, len(lines)), LinesFound: len(lines)}
+		for line, hits := range lines {
+			fc.Lines[line] = hits
+			if hits > 0 {
+				fc.LinesHit++
+			}
+		}
+		files = append(files, fc)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Source < files[j].Source })
+	return files
+}
+
+// Percent returns the percentage of executable lines that have been
+// executed, or 100 if there are none.
+func (fc FileCoverage) Percent() float64 {
+	if fc.LinesFound == 0 {
+		return 100
+	}
+	return float64(fc.LinesHit) * 100 / float64(fc.LinesFound)
+}
+
+// WriteLCOV writes the coverage in the LCOV tracefile format.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "TN:")
+	for _, fc := range c.Files() {
+		fmt.Fprintf(bw, "SF:%s\n", fc.Source)
+		lines := make([]int, 0, len(fc.Lines))
+		for line := range fc.Lines {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		for _, line := range lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, fc.Lines[line])
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", fc.LinesFound, fc.LinesHit)
+	}
+	return bw.Flush()
+}
+
+/* }}} */
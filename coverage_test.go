@@ -0,0 +1,58 @@
+package lua
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCoverage(t *testing.T) {
+	c := NewCoverage()
+	script := `local function f(x)
+	if x then
+		return 1
+	end
+	return 2
+end
+f(ARG)
+`
+	for _, arg := range []LValue{LFalse.AsLValue(), LFalse.AsLValue()} {
+		L := NewState()
+		L.SetCoverage(c)
+		L.SetGlobal("ARG", arg)
+		fn, err := L.Load(strings.NewReader(script), "script.lua")
+		errorIfNotNil(t, err)
+		L.Push(fn.AsLValue())
+		errorIfNotNil(t, L.PCall(0, 0, nil))
+		L.Close()
+	}
+	files := c.Files()
+	errorIfNotEqual(t, 1, len(files))
+	fc := files[0]
+	errorIfNotEqual(t, "script.lua", fc.Source)
+	errorIfNotEqual(t, int64(2), fc.Lines[2])
+	errorIfNotEqual(t, int64(0), fc.Lines[3])
+	errorIfNotEqual(t, int64(2), fc.Lines[5])
+	errorIfNotEqual(t, int64(2), fc.Lines[7])
+	errorIfFalse(t, fc.LinesFound == 5 && fc.LinesHit == 4, "unexpected summary: %d/%d", fc.LinesHit, fc.LinesFound)
+
+	other := NewCoverage()
+	L := NewState()
+	defer L.Close()
+	L.SetCoverage(other)
+	L.SetGlobal("ARG", LTrue.AsLValue())
+	fn, err := L.Load(strings.NewReader(script), "script.lua")
+	errorIfNotNil(t, err)
+	L.Push(fn.AsLValue())
+	errorIfNotNil(t, L.PCall(0, 0, nil))
+	c.Merge(other)
+	fc = c.Files()[0]
+	errorIfNotEqual(t, int64(1), fc.Lines[3])
+	errorIfNotEqual(t, 100.0, fc.Percent())
+
+	var buf bytes.Buffer
+	errorIfNotNil(t, c.WriteLCOV(&buf))
+	lcov := buf.String()
+	errorIfFalse(t, strings.HasPrefix(lcov, "TN:\nSF:script.lua\n") && strings.Contains(lcov, "DA:3,1\n") &&
+		strings.HasSuffix(lcov, "end_of_record\n"), "unexpected LCOV output:\n%s", lcov)
+}
@@ -2,6 +2,8 @@ package lua
 
 import (
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -9,12 +11,28 @@ type CustomDataHelper[T any] struct {
 	entry *customDataEntry
 }
 
+// AsLValue wraps raw as a custom data value. raw may point anywhere, such as
+// into a slice or a struct, and is never finalized; see New.
 func (h *CustomDataHelper[T]) AsLValue(raw *T) LValue {
 	return LValue{dataptr: unsafe.Pointer(raw), data: uintptr(h.entry.typ) + maxUintptr}
 }
 
+// New allocates a copy of v and returns it along with its custom data value.
+// If the metatable of T has a __gc field, the copy is marked for finalization
+// by L: once it is unreachable, its __gc metamethod is called on the
+// goroutine of L at a safe point, or when L is closed.
+func (h *CustomDataHelper[T]) New(L *LState, v T) (*T, LValue) {
+	raw := new(T)
+	*raw = v
+	lv := h.AsLValue(raw)
+	if h.entry.hasGC.Load() {
+		markCustomData(L.G.finalizers, lv, raw)
+	}
+	return raw, lv
+}
+
 func (h *CustomDataHelper[T]) As(lv LValue) (*T, bool) {
-	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) || lv.data != uintptr(h.entry.typ)+maxUintptr {
+	if lv.isNumber() || lv.data != uintptr(h.entry.typ)+maxUintptr {
 		return nil, false
 	}
 	return (*T)(lv.dataptr), true
@@ -27,10 +45,40 @@ func (h *CustomDataHelper[T]) Must(lv LValue) *T {
 	panic("not a custom data with type " + strconv.Itoa(int(h.entry.typ)))
 }
 
+// Type returns the LValueType assigned to T at registration.
+func (h *CustomDataHelper[T]) Type() LValueType {
+	return h.entry.typ
+}
+
+// Metatable returns the metatable shared by all values of T, or nil.
+func (h *CustomDataHelper[T]) Metatable() *LTable {
+	return h.entry.metatable.Load()
+}
+
+// SetMetatable replaces the metatable shared by all values of T.
+func (h *CustomDataHelper[T]) SetMetatable(metatable *LTable) {
+	h.entry.setMetatable(metatable)
+}
+
+// Unregister removes T from the registry it was registered in. Values created
+// by this helper are reported as LTUnknown afterwards and lose their
+// metatable. Unregister is safe to call more than once.
+func (h *CustomDataHelper[T]) Unregister() {
+	h.entry.registry.unregister(h.entry)
+}
+
 type customDataEntry struct {
 	typInfo   unsafe.Pointer
-	metatable *LTable
+	metatable atomic.Pointer[LTable]
+	registry  *customDataRegistry
 	typ       LValueType
+	dead      atomic.Bool
+	hasGC     atomic.Bool
+}
+
+func (c *customDataEntry) setMetatable(metatable *LTable) {
+	c.hasGC.Store(metatable != nil && hasGCMetamethod(metatable.AsLValue()))
+	c.metatable.Store(metatable)
 }
 
 func (c *customDataEntry) PackAny(data unsafe.Pointer) any {
@@ -38,41 +86,207 @@ func (c *customDataEntry) PackAny(data unsafe.Pointer) any {
 	return *(*any)(unsafe.Pointer(&a))
 }
 
-type customDataRegistry struct {
-	entries []*customDataEntry
-	nextTyp LValueType
+func (c *customDataEntry) Metatable() LValue {
+	if mt := c.metatable.Load(); mt != nil {
+		return mt.AsLValue()
+	}
+	return LValue{}
+}
+
+// customDataTypes indexes the live entries by their type. LValue methods have
+// no owning state, so they resolve custom types through this index. The slot
+// of an entry is the low customDataSlotBits of its type and is recycled once
+// the entry is unregistered; the bits above count the registrations made in
+// the slot, so that values of an unregistered type never resolve to the entry
+// that reuses its slot. The slice is replaced copy-on-write under
+// customDataTypesMu and read without locking.
+var (
+	customDataTypesMu   sync.Mutex
+	customDataTypes     atomic.Pointer[[]*customDataEntry]
+	customDataNextGens  []int // generation of the next type of each slot
+	customDataFreeSlots []int
+)
+
+const (
+	customDataSlotBits = 16
+	customDataSlotMask = 1<<customDataSlotBits - 1
+	// customDataGenMask keeps the type numbers below maxUintptr.
+	customDataGenMask = 1<<(strconv.IntSize-2-customDataSlotBits) - 1
+)
+
+func lookupCustomDataEntry(typ LValueType) (*customDataEntry, bool) {
+	if typ <= LTUnknown {
+		return nil, false
+	}
+	entries := customDataTypes.Load()
+	if entries == nil {
+		return nil, false
+	}
+	idx := int(typ-LTUnknown-1) & customDataSlotMask
+	if idx >= len(*entries) {
+		return nil, false
+	}
+	entry := (*entries)[idx]
+	if entry == nil || entry.typ != typ || entry.dead.Load() {
+		return nil, false
+	}
+	return entry, true
 }
 
-var cdr = &customDataRegistry{
-	entries: make([]*customDataEntry, 0, 32),
-	nextTyp: LTUnknown + 1,
+// storeCustomDataSlot replaces the entry in slot idx, growing the index if
+// needed. customDataTypesMu must be held.
+func storeCustomDataSlot(idx int, entry *customDataEntry) {
+	var entries []*customDataEntry
+	if old := customDataTypes.Load(); old != nil {
+		entries = make([]*customDataEntry, len(*old), max(len(*old), idx+1))
+		copy(entries, *old)
+	}
+	if idx == len(entries) {
+		entries = append(entries, nil)
+	}
+	entries[idx] = entry
+	customDataTypes.Store(&entries)
 }
 
-func (cd *customDataRegistry) MaxTyp() LValueType {
-	return cd.nextTyp
+func publishCustomDataEntry(entry *customDataEntry) {
+	customDataTypesMu.Lock()
+	defer customDataTypesMu.Unlock()
+	var idx int
+	if n := len(customDataFreeSlots); n > 0 {
+		idx = customDataFreeSlots[n-1]
+		customDataFreeSlots = customDataFreeSlots[:n-1]
+	} else {
+		idx = len(customDataNextGens)
+		if idx > customDataSlotMask {
+			panic("too many custom data types")
+		}
+		customDataNextGens = append(customDataNextGens, 0)
+	}
+	gen := customDataNextGens[idx]
+	customDataNextGens[idx] = (gen + 1) & customDataGenMask
+	entry.typ = LTUnknown + 1 + LValueType(gen<<customDataSlotBits|idx)
+	storeCustomDataSlot(idx, entry)
 }
 
+// unpublishCustomDataEntry removes a dead entry from the index and frees its
+// slot, dropping the references the index holds to its metatable and registry.
+func unpublishCustomDataEntry(entry *customDataEntry) {
+	entry.metatable.Store(nil)
+	entry.hasGC.Store(false)
+	customDataTypesMu.Lock()
+	defer customDataTypesMu.Unlock()
+	idx := int(entry.typ-LTUnknown-1) & customDataSlotMask
+	storeCustomDataSlot(idx, nil)
+	customDataFreeSlots = append(customDataFreeSlots, idx)
+}
+
+type customDataRegistry struct {
+	mu      sync.Mutex
+	entries map[LValueType]*customDataEntry
+	byTyp   map[unsafe.Pointer]*customDataEntry
+}
+
+func newCustomDataRegistry() *customDataRegistry {
+	return &customDataRegistry{
+		entries: make(map[LValueType]*customDataEntry),
+		byTyp:   make(map[unsafe.Pointer]*customDataEntry),
+	}
+}
+
+// cdr holds the custom data types registered by RegisterCustomData, which are
+// visible to every LState in the process.
+var cdr = newCustomDataRegistry()
+
+// Entry returns the live entry for typ if it was registered in this registry.
 func (cd *customDataRegistry) Entry(typ LValueType) (*customDataEntry, bool) {
-	if typ >= cd.nextTyp {
-		return nil, false
+	if entry, ok := lookupCustomDataEntry(typ); ok && entry.registry == cd {
+		return entry, true
 	}
-	if typ <= LTUnknown {
+	return nil, false
+}
+
+func (cd *customDataRegistry) register(typInfo unsafe.Pointer, metatable *LTable) *customDataEntry {
+	entry := &customDataEntry{typInfo: typInfo, registry: cd}
+	entry.setMetatable(metatable)
+	publishCustomDataEntry(entry)
+	cd.mu.Lock()
+	cd.entries[entry.typ] = entry
+	cd.byTyp[typInfo] = entry
+	cd.mu.Unlock()
+	return entry
+}
+
+// EntryOf returns the most recent live entry registered for a Go type.
+func (cd *customDataRegistry) EntryOf(typInfo unsafe.Pointer) (*customDataEntry, bool) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	entry, ok := cd.byTyp[typInfo]
+	return entry, ok
+}
+
+func (cd *customDataRegistry) unregister(entry *customDataEntry) {
+	cd.mu.Lock()
+	delete(cd.entries, entry.typ)
+	if cd.byTyp[entry.typInfo] == entry {
+		delete(cd.byTyp, entry.typInfo)
+	}
+	cd.mu.Unlock()
+	if entry.dead.CompareAndSwap(false, true) {
+		unpublishCustomDataEntry(entry)
+	}
+}
+
+func (cd *customDataRegistry) unregisterAll() {
+	cd.mu.Lock()
+	entries := make([]*customDataEntry, 0, len(cd.entries))
+	for _, entry := range cd.entries {
+		entries = append(entries, entry)
+	}
+	clear(cd.entries)
+	clear(cd.byTyp)
+	cd.mu.Unlock()
+	for _, entry := range entries {
+		if entry.dead.CompareAndSwap(false, true) {
+			unpublishCustomDataEntry(entry)
+		}
+	}
+}
+
+// customDataEntry returns the entry for typ if it is visible to this state,
+// that is, if it was registered process-wide or in the state's Global.
+func (ls *LState) customDataEntry(typ LValueType) (*customDataEntry, bool) {
+	entry, ok := lookupCustomDataEntry(typ)
+	if !ok || (entry.registry != cdr && entry.registry != ls.G.customData) {
 		return nil, false
 	}
-	idx := int(typ - LTUnknown - 1)
-	return cd.entries[idx], true
+	return entry, true
 }
 
-func RegisterCustomData[T any](metatable *LTable) *CustomDataHelper[T] {
+// customDataEntryOf returns the entry of a Go type visible to this state,
+// preferring registrations made in the state's Global.
+func (ls *LState) customDataEntryOf(typInfo unsafe.Pointer) (*customDataEntry, bool) {
+	if entry, ok := ls.G.customData.EntryOf(typInfo); ok {
+		return entry, true
+	}
+	return cdr.EntryOf(typInfo)
+}
+
+func customDataTypInfo[T any]() unsafe.Pointer {
 	var dummy T
 	var i = any(dummy)
-	var typInfo = (*struct{ typ, _ unsafe.Pointer })(unsafe.Pointer(&i)).typ
-	entry := &customDataEntry{
-		typInfo,
-		metatable,
-		cdr.nextTyp,
-	}
-	cdr.entries = append(cdr.entries, entry)
-	cdr.nextTyp++
-	return &CustomDataHelper[T]{entry}
+	return (*struct{ typ, _ unsafe.Pointer })(unsafe.Pointer(&i)).typ
+}
+
+// RegisterCustomData registers T as a custom data type known to every LState
+// in the process. It is safe to call from concurrent goroutines.
+func RegisterCustomData[T any](metatable *LTable) *CustomDataHelper[T] {
+	return &CustomDataHelper[T]{cdr.register(customDataTypInfo[T](), metatable)}
+}
+
+// RegisterStateCustomData registers T as a custom data type known only to L
+// and the threads sharing its Global, with a metatable of its own. The
+// registration is dropped when L is closed. It is safe to call from
+// concurrent goroutines.
+func RegisterStateCustomData[T any](L *LState, metatable *LTable) *CustomDataHelper[T] {
+	return &CustomDataHelper[T]{L.G.customData.register(customDataTypInfo[T](), metatable)}
 }
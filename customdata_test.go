@@ -2,6 +2,7 @@ package lua
 
 import (
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -46,3 +47,97 @@ func TestCustomData(t *testing.T) {
 	errorIfFalse(t, *c == 3, "c must be 3")
 	errorIfFalse(t, cstr == "3", "cstr must be 3")
 }
+
+type tenantHandle struct{ name string }
+
+func TestStateCustomData(t *testing.T) {
+	L1 := NewState()
+	defer L1.Close()
+	L2 := NewState()
+	defer L2.Close()
+
+	mt1 := NewTable()
+	mt1.RawSetString("__index", NewGFunction(func(L *LState) int {
+		L.Push(LString("tenant1").AsLValue())
+		return 1
+	}).AsLValue())
+	h1 := RegisterStateCustomData[tenantHandle](L1, mt1)
+	mt2 := NewTable()
+	mt2.RawSetString("__index", NewGFunction(func(L *LState) int {
+		L.Push(LString("tenant2").AsLValue())
+		return 1
+	}).AsLValue())
+	h2 := RegisterStateCustomData[tenantHandle](L2, mt2)
+	errorIfFalse(t, h1.Type() != h2.Type(), "types must differ between states")
+
+	v := tenantHandle{"x"}
+	L1.SetGlobal("h", h1.AsLValue(&v))
+	L2.SetGlobal("h", h2.AsLValue(&v))
+	errorIfScriptFail(t, L1, `assert(h.name == "tenant1")`)
+	errorIfScriptFail(t, L2, `assert(h.name == "tenant2")`)
+
+	// a value registered in L1 has no metatable in L2
+	errorIfFalse(t, L2.GetMetatable(h1.AsLValue(&v)).EqualsLNil(), "metatable must not leak across states")
+	errorIfNotEqual(t, v, h1.AsLValue(&v).AsAny())
+
+	h1.Unregister()
+	errorIfNotEqual(t, LTUnknown, h1.AsLValue(&v).Type())
+	errorIfScriptNotFail(t, L1, `return h.name`, "attempt to index")
+	h1.Unregister()
+}
+
+func TestStateCustomDataClose(t *testing.T) {
+	L := NewState()
+	h := RegisterStateCustomData[tenantHandle](L, nil)
+	v := tenantHandle{}
+	errorIfNotEqual(t, h.Type(), h.AsLValue(&v).Type())
+	L.Close()
+	errorIfNotEqual(t, LTUnknown, h.AsLValue(&v).Type())
+}
+
+func TestStateCustomDataSlotReuse(t *testing.T) {
+	L1 := NewState(Options{SkipOpenLibs: true})
+	h1 := RegisterStateCustomData[tenantHandle](L1, NewTable())
+	v := tenantHandle{}
+	old := h1.AsLValue(&v)
+	L1.Close()
+	entries := customDataTypes.Load()
+	slot := int(h1.Type()-LTUnknown-1) & customDataSlotMask
+	errorIfFalse(t, (*entries)[slot] == nil, "closed state must not keep its entries")
+	errorIfFalse(t, h1.Metatable() == nil, "closed state must not keep its metatables")
+
+	L2 := NewState(Options{SkipOpenLibs: true})
+	defer L2.Close()
+	h2 := RegisterStateCustomData[tenantHandle](L2, NewTable())
+	errorIfNotEqual(t, slot, int(h2.Type()-LTUnknown-1)&customDataSlotMask)
+	errorIfFalse(t, h1.Type() != h2.Type(), "a recycled slot must get a new type")
+	errorIfNotEqual(t, LTUnknown, old.Type())
+	_, ok := h2.As(old)
+	errorIfFalse(t, !ok, "a value of an unregistered type must not match the new type")
+}
+
+func TestCustomDataConcurrentRegister(t *testing.T) {
+	const n = 16
+	var wg sync.WaitGroup
+	types := make([]LValueType, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			L := NewState(Options{SkipOpenLibs: true})
+			defer L.Close()
+			h := RegisterStateCustomData[tenantHandle](L, NewTable())
+			v := tenantHandle{}
+			types[i] = h.Type()
+			if h.AsLValue(&v).Type() != h.Type() {
+				t.Errorf("type mismatch for %v", h.Type())
+			}
+		}(i)
+	}
+	wg.Wait()
+	seen := map[LValueType]bool{}
+	for _, typ := range types {
+		errorIfFalse(t, !seen[typ], "type %v registered twice", int(typ))
+		seen[typ] = true
+	}
+}
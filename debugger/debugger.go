@@ -0,0 +1,685 @@
+// Package debugger implements a Debug Adapter Protocol server for gopher-lua
+// states.
+//
+// A Debugger installs a line hook on a state and serves a single DAP session.
+// While the script is stopped, the goroutine running it waits in the hook and
+// executes the inspection requests of the client, so the state is never
+// accessed concurrently.
+//
+// New installs the hook right away and must be called from the goroutine
+// running the state. Attach may be called from any goroutine: it has the hook
+// installed by the running script before its next instruction, which lets a
+// host attach on demand to a script that is already running.
+//
+// Coroutines are not reported as separate DAP threads: the client sees a
+// single thread whose stack is the one of the coroutine that stopped, and
+// stepping over or out of a function stays on the coroutine it started in.
+package debugger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	lua "github.com/hsfzxjy/gopher-lua"
+)
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+// stop is the state of a stopped script. It is owned by the goroutine
+// serving the session until the script is resumed.
+type stop struct {
+	L      *lua.LState
+	calls  chan func()
+	resume chan struct{}
+	frames []*lua.Debug
+	refs   []func() []variable
+}
+
+type Debugger struct {
+	L *lua.LState
+
+	mu          sync.Mutex
+	breakpoints map[string]map[int]bool // lines by absolute source path
+	bplines     map[int]int             // number of breakpoints by line
+	paths       map[string]string       // absolute paths by chunk name
+	mode        stepMode
+	entry       bool
+	stepThread  *lua.LState
+	stepDepth   int
+	pauseReq    bool
+	detached    bool
+	stopped     *stop
+	program     string
+
+	configured chan struct{}
+	configure  sync.Once
+
+	wmu sync.Mutex
+	w   io.Writer
+	seq int
+}
+
+// New attaches a debugger to L. It must be called on the goroutine running
+// L, or while L is idle; see the package documentation. Threads created by L
+// afterwards are debugged too.
+func New(L *lua.LState) *Debugger {
+	d := newDebugger(L)
+	L.SetHook(d.hook, lua.HookMaskLine, 0)
+	return d
+}
+
+// Attach attaches a debugger to L from any goroutine. The hook is installed
+// by the thread running L before its next instruction, on L and on that
+// thread if it is a coroutine of L; if L is idle, when it runs again. The
+// session can be served right away.
+func Attach(L *lua.LState) *Debugger {
+	d := newDebugger(L)
+	L.Post(func(th *lua.LState) {
+		L.SetHook(d.hook, lua.HookMaskLine, 0)
+		if th != L {
+			th.SetHook(d.hook, lua.HookMaskLine, 0)
+		}
+	})
+	return d
+}
+
+func newDebugger(L *lua.LState) *Debugger {
+	return &Debugger{
+		L:           L,
+		breakpoints: make(map[string]map[int]bool),
+		bplines:     make(map[int]int),
+		paths:       make(map[string]string),
+		configured:  make(chan struct{}),
+	}
+}
+
+// Configured returns a channel closed when the client has set its initial
+// breakpoints, or when the session ends. Hosts should wait for it before
+// running the scripts to debug.
+func (d *Debugger) Configured() <-chan struct{} {
+	return d.configured
+}
+
+// Program returns the program of the launch request, if any.
+func (d *Debugger) Program() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.program
+}
+
+// Output sends text to the debug console of the client. category is
+// "console", "stdout" or "stderr".
+func (d *Debugger) Output(category, text string) {
+	d.event("output", map[string]any{"category": category, "output": text})
+}
+
+// Exit tells the client that the debugged program has exited.
+func (d *Debugger) Exit(code int) {
+	d.event("exited", map[string]any{"exitCode": code})
+	d.event("terminated", nil)
+}
+
+// Serve runs a session over conn until the client disconnects or conn is
+// closed. The script is then resumed and the hook removed.
+func (d *Debugger) Serve(conn io.ReadWriter) error {
+	d.wmu.Lock()
+	d.w = conn
+	d.wmu.Unlock()
+	defer d.detach()
+	r := bufio.NewReader(conn)
+	for {
+		content, err := readMessage(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(content, &req); err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if d.handle(&req) {
+			return nil
+		}
+	}
+}
+
+func (d *Debugger) detach() {
+	d.mu.Lock()
+	d.detached = true
+	s := d.stopped
+	d.stopped = nil
+	d.mu.Unlock()
+	d.configure.Do(func() { close(d.configured) })
+	if s != nil {
+		close(s.resume)
+	}
+}
+
+func (d *Debugger) send(msg any) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if d.w == nil {
+		return
+	}
+	d.seq++
+	switch m := msg.(type) {
+	case *response:
+		m.Seq = d.seq
+	case *event:
+		m.Seq = d.seq
+	}
+	writeMessage(d.w, msg)
+}
+
+func (d *Debugger) event(name string, body any) {
+	d.send(&event{Type: "event", Event: name, Body: body})
+}
+
+/* requests {{{ */
+
+var errNotStopped = errors.New("the script is not stopped")
+
+var handlers map[string]func(d *Debugger, args json.RawMessage) (any, error)
+
+func init() {
+	handlers = map[string]func(d *Debugger, args json.RawMessage) (any, error){
+		"initialize":              (*Debugger).initialize,
+		"launch":                  (*Debugger).launch,
+		"attach":                  (*Debugger).launch,
+		"setBreakpoints":          (*Debugger).setBreakpoints,
+		"setExceptionBreakpoints": (*Debugger).nothing,
+		"configurationDone":       (*Debugger).configurationDone,
+		"threads":                 (*Debugger).threads,
+		"stackTrace":              (*Debugger).stackTrace,
+		"scopes":                  (*Debugger).scopes,
+		"variables":               (*Debugger).variables,
+		"evaluate":                (*Debugger).evaluate,
+		"continue":                func(d *Debugger, args json.RawMessage) (any, error) { return d.resume(stepNone) },
+		"next":                    func(d *Debugger, args json.RawMessage) (any, error) { return d.resume(stepOver) },
+		"stepIn":                  func(d *Debugger, args json.RawMessage) (any, error) { return d.resume(stepIn) },
+		"stepOut":                 func(d *Debugger, args json.RawMessage) (any, error) { return d.resume(stepOut) },
+		"pause":                   (*Debugger).pause,
+		"disconnect":              (*Debugger).nothing,
+	}
+}
+
+// handle answers a request and reports whether the session has ended.
+func (d *Debugger) handle(req *request) bool {
+	resp := &response{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: true}
+	if h, ok := handlers[req.Command]; !ok {
+		resp.Success = false
+		resp.Message = fmt.Sprintf("unsupported request '%s'", req.Command)
+	} else if body, err := h(d, req.Arguments); err != nil {
+		resp.Success = false
+		resp.Message = err.Error()
+	} else {
+		resp.Body = body
+	}
+	d.send(resp)
+	switch req.Command {
+	case "initialize":
+		d.event("initialized", nil)
+	case "disconnect":
+		return true
+	}
+	return false
+}
+
+func (d *Debugger) nothing(args json.RawMessage) (any, error) {
+	return nil, nil
+}
+
+func (d *Debugger) initialize(args json.RawMessage) (any, error) {
+	return map[string]any{
+		"supportsConfigurationDoneRequest": true,
+		"supportsEvaluateForHovers":        true,
+	}, nil
+}
+
+func (d *Debugger) launch(args json.RawMessage) (any, error) {
+	var la launchArguments
+	if len(args) > 0 {
+		if err := json.Unmarshal(args, &la); err != nil {
+			return nil, err
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.program = la.Program
+	if la.StopOnEntry {
+		d.mode, d.entry = stepIn, true
+	}
+	return nil, nil
+}
+
+func (d *Debugger) setBreakpoints(args json.RawMessage) (any, error) {
+	var sa setBreakpointsArguments
+	if err := json.Unmarshal(args, &sa); err != nil {
+		return nil, err
+	}
+	path, err := filepath.Abs(sa.Source.Path)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for line := range d.breakpoints[path] {
+		if d.bplines[line]--; d.bplines[line] == 0 {
+			delete(d.bplines, line)
+		}
+	}
+	lines := make(map[int]bool)
+	bps := make([]breakpoint, 0, len(sa.Breakpoints))
+	for _, bp := range sa.Breakpoints {
+		if !lines[bp.Line] {
+			lines[bp.Line] = true
+			d.bplines[bp.Line]++
+		}
+		bps = append(bps, breakpoint{Verified: true, Line: bp.Line})
+	}
+	d.breakpoints[path] = lines
+	return map[string]any{"breakpoints": bps}, nil
+}
+
+func (d *Debugger) configurationDone(args json.RawMessage) (any, error) {
+	d.configure.Do(func() { close(d.configured) })
+	return nil, nil
+}
+
+func (d *Debugger) threads(args json.RawMessage) (any, error) {
+	return map[string]any{"threads": []map[string]any{{"id": 1, "name": "main"}}}, nil
+}
+
+func (d *Debugger) pause(args json.RawMessage) (any, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pauseReq = true
+	return nil, nil
+}
+
+// call runs fn on the goroutine of the stopped script.
+func (d *Debugger) call(fn func(s *stop)) error {
+	d.mu.Lock()
+	s := d.stopped
+	d.mu.Unlock()
+	if s == nil {
+		return errNotStopped
+	}
+	done := make(chan struct{})
+	s.calls <- func() {
+		defer close(done)
+		fn(s)
+	}
+	<-done
+	return nil
+}
+
+func (d *Debugger) resume(mode stepMode) (any, error) {
+	var depth int
+	err := d.call(func(s *stop) {
+		depth = len(frames(s.L))
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	s := d.stopped
+	d.stopped = nil
+	d.mode, d.stepThread, d.stepDepth = mode, s.L, depth
+	d.mu.Unlock()
+	close(s.resume)
+	return map[string]any{"allThreadsContinued": true}, nil
+}
+
+func (d *Debugger) stackTrace(args json.RawMessage) (any, error) {
+	var result []stackFrame
+	err := d.call(func(s *stop) {
+		for i, dbg := range s.frames {
+			sf := stackFrame{Id: i + 1, Name: dbg.Name, Line: dbg.CurrentLine, Column: 1}
+			if sf.Name == "" {
+				sf.Name = "?"
+				if dbg.What == "main" {
+					sf.Name = "main chunk"
+				}
+			}
+			if dbg.What != "G" {
+				sf.Source = &source{Name: filepath.Base(dbg.Source), Path: d.path(dbg.Source)}
+			}
+			result = append(result, sf)
+		}
+	})
+	return map[string]any{"stackFrames": result, "totalFrames": len(result)}, err
+}
+
+func (d *Debugger) frame(s *stop, id int) (*lua.Debug, error) {
+	if id < 1 || id > len(s.frames) {
+		return nil, fmt.Errorf("invalid frame id %d", id)
+	}
+	return s.frames[id-1], nil
+}
+
+func (d *Debugger) scopes(args json.RawMessage) (any, error) {
+	var fa frameArguments
+	if err := json.Unmarshal(args, &fa); err != nil {
+		return nil, err
+	}
+	var result []scope
+	var ferr error
+	err := d.call(func(s *stop) {
+		dbg, err := d.frame(s, fa.FrameId)
+		if err != nil {
+			ferr = err
+			return
+		}
+		result = []scope{
+			{Name: "Locals", VariablesReference: s.ref(func() []variable { return d.locals(s, dbg) })},
+			{Name: "Upvalues", VariablesReference: s.ref(func() []variable { return d.upvalues(s, dbg) })},
+		}
+	})
+	return map[string]any{"scopes": result}, errors.Join(err, ferr)
+}
+
+func (d *Debugger) variables(args json.RawMessage) (any, error) {
+	var va variablesArguments
+	if err := json.Unmarshal(args, &va); err != nil {
+		return nil, err
+	}
+	result := []variable{}
+	err := d.call(func(s *stop) {
+		if va.VariablesReference >= 1 && va.VariablesReference <= len(s.refs) {
+			result = s.refs[va.VariablesReference-1]()
+		}
+	})
+	return map[string]any{"variables": result}, err
+}
+
+func (d *Debugger) evaluate(args json.RawMessage) (any, error) {
+	var ea evaluateArguments
+	if err := json.Unmarshal(args, &ea); err != nil {
+		return nil, err
+	}
+	var result variable
+	var eerr error
+	err := d.call(func(s *stop) {
+		id := ea.FrameId
+		if id == 0 {
+			id = 1
+		}
+		dbg, err := d.frame(s, id)
+		if err != nil {
+			eerr = err
+			return
+		}
+		result, eerr = d.eval(s, dbg, ea.Expression)
+	})
+	if err = errors.Join(err, eerr); err != nil {
+		return nil, err
+	}
+	return map[string]any{"result": result.Value, "type": result.Type, "variablesReference": result.VariablesReference}, nil
+}
+
+/* }}} */
+
+/* hook {{{ */
+
+func (d *Debugger) hook(L *lua.LState, event lua.HookEvent, line int) {
+	d.mu.Lock()
+	if d.detached {
+		d.mu.Unlock()
+		L.SetHook(nil, 0, 0)
+		return
+	}
+	reason := d.stopReason(L, line)
+	if reason == "" {
+		d.mu.Unlock()
+		return
+	}
+	s := &stop{L: L, calls: make(chan func()), resume: make(chan struct{}), frames: frames(L)}
+	d.stopped = s
+	d.mode, d.entry, d.pauseReq = stepNone, false, false
+	d.mu.Unlock()
+
+	d.event("stopped", map[string]any{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+	for {
+		select {
+		case fn := <-s.calls:
+			fn()
+		case <-s.resume:
+			return
+		}
+	}
+}
+
+// stopReason returns why the script has to stop on line, or "" if it does
+// not. It is called with d.mu held.
+func (d *Debugger) stopReason(L *lua.LState, line int) string {
+	if d.pauseReq {
+		return "pause"
+	}
+	switch d.mode {
+	case stepIn:
+		if d.entry {
+			return "entry"
+		}
+		return "step"
+	case stepOver:
+		if L == d.stepThread && len(frames(L)) <= d.stepDepth {
+			return "step"
+		}
+	case stepOut:
+		if L == d.stepThread && len(frames(L)) < d.stepDepth {
+			return "step"
+		}
+	}
+	if d.bplines[line] == 0 {
+		return ""
+	}
+	dbg, ok := L.GetStack(0)
+	if !ok {
+		return ""
+	}
+	if _, err := L.GetInfo("S", dbg, lua.LNil); err != nil {
+		return ""
+	}
+	if d.breakpoints[d.path(dbg.Source)][line] {
+		return "breakpoint"
+	}
+	return ""
+}
+
+// path returns the absolute path of the file a chunk was loaded from.
+func (d *Debugger) path(chunkname string) string {
+	if p, ok := d.paths[chunkname]; ok {
+		return p
+	}
+	p, err := filepath.Abs(chunkname)
+	if err != nil || strings.HasPrefix(chunkname, "<") {
+		p = chunkname
+	}
+	d.paths[chunkname] = p
+	return p
+}
+
+// frames returns the active functions of L, innermost first.
+func frames(L *lua.LState) []*lua.Debug {
+	var result []*lua.Debug
+	for level := 0; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			break
+		}
+		if _, err := L.GetInfo("nSl", dbg, lua.LNil); err != nil {
+			break
+		}
+		result = append(result, dbg)
+	}
+	// the levels of functions removed by tail calls all refer to the main
+	// chunk
+	n := 0
+	for i, dbg := range result {
+		if dbg.What != "main" || i == len(result)-1 {
+			result[n] = dbg
+			n++
+		}
+	}
+	return result[:n]
+}
+
+/* }}} */
+
+/* variables {{{ */
+
+func (s *stop) ref(fn func() []variable) int {
+	s.refs = append(s.refs, fn)
+	return len(s.refs)
+}
+
+func (d *Debugger) variable(s *stop, name string, lv lua.LValue) variable {
+	v := variable{Name: name, Value: lv.String(), Type: lv.Type().String()}
+	switch lv.Type() {
+	case lua.LTString:
+		v.Value = fmt.Sprintf("%q", lv.String())
+	case lua.LTTable:
+		tb := lv.MustLTable()
+		v.VariablesReference = s.ref(func() []variable { return d.fields(s, tb) })
+	}
+	return v
+}
+
+func (d *Debugger) fields(s *stop, tb *lua.LTable) []variable {
+	var result []variable
+	tb.ForEach(func(key, value lua.LValue) {
+		name := key.String()
+		if key.Type() != lua.LTString {
+			name = "[" + name + "]"
+		}
+		result = append(result, d.variable(s, name, value))
+	})
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (d *Debugger) locals(s *stop, dbg *lua.Debug) []variable {
+	var result []variable
+	for n := 1; ; n++ {
+		name, value := s.L.GetLocal(dbg, n)
+		if name == "" {
+			break
+		}
+		if !strings.HasPrefix(name, "(") {
+			result = append(result, d.variable(s, name, value))
+		}
+	}
+	return result
+}
+
+func (d *Debugger) upvalues(s *stop, dbg *lua.Debug) []variable {
+	var result []variable
+	fn := function(s.L, dbg)
+	for n := 1; fn != nil; n++ {
+		name, value := s.L.GetUpvalue(fn, n)
+		if name == "" {
+			break
+		}
+		result = append(result, d.variable(s, name, value))
+	}
+	return result
+}
+
+func function(L *lua.LState, dbg *lua.Debug) *lua.LFunction {
+	lv, err := L.GetInfo("f", dbg, lua.LNil)
+	if err != nil {
+		return nil
+	}
+	fn, _ := lv.AsLFunction()
+	return fn
+}
+
+// eval evaluates an expression, or executes a statement, in the scope of a
+// frame. Locals and upvalues are visible but can not be assigned.
+func (d *Debugger) eval(s *stop, dbg *lua.Debug, expr string) (variable, error) {
+	L := s.L
+	chunk, err := L.LoadString("return " + expr)
+	if err != nil {
+		if chunk, err = L.LoadString(expr); err != nil {
+			return variable{}, err
+		}
+	}
+	// the globals of the frame are those of its _ENV variable in Lua 5.2 and
+	// later, and those of the environment of its function otherwise
+	env := L.NewTable()
+	globals := lua.LNil
+	if fn := function(L, dbg); fn != nil {
+		globals = L.GetFEnv(fn.AsLValue())
+		for n := 1; ; n++ {
+			name, value := L.GetUpvalue(fn, n)
+			if name == "" {
+				break
+			}
+			env.RawSetString(name, value)
+			if name == "_ENV" {
+				globals = value
+			}
+		}
+	}
+	for n := 1; ; n++ {
+		name, value := L.GetLocal(dbg, n)
+		if name == "" {
+			break
+		}
+		if !strings.HasPrefix(name, "(") {
+			env.RawSetString(name, value)
+			if name == "_ENV" {
+				globals = value
+			}
+		}
+	}
+	if !globals.EqualsLNil() {
+		mt := L.NewTable()
+		mt.RawSetString("__index", globals)
+		L.SetMetatable(env.AsLValue(), mt.AsLValue())
+	}
+	if name, _ := L.GetUpvalue(chunk, 1); name == "_ENV" {
+		L.SetUpvalue(chunk, 1, env.AsLValue())
+	} else {
+		L.SetFEnv(chunk.AsLValue(), env.AsLValue())
+	}
+
+	top := L.GetTop()
+	defer L.SetTop(top)
+	L.Push(chunk.AsLValue())
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		return variable{}, err
+	}
+	switch L.GetTop() - top {
+	case 0:
+		return variable{Value: "nil", Type: "nil"}, nil
+	case 1:
+		return d.variable(s, "", L.Get(top+1)), nil
+	}
+	var values []string
+	for i := top + 1; i <= L.GetTop(); i++ {
+		values = append(values, d.variable(s, "", L.Get(i)).Value)
+	}
+	return variable{Value: strings.Join(values, ", ")}, nil
+}
+
+/* }}} */
@@ -0,0 +1,334 @@
+package debugger
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	lua "github.com/hsfzxjy/gopher-lua"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+type message struct {
+	Type    string          `json:"type"`
+	Command string          `json:"command"`
+	Event   string          `json:"event"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Body    json.RawMessage `json:"body"`
+}
+
+func (c *client) read() message {
+	content, err := readMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var msg message
+	if err := json.Unmarshal(content, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// request sends a request and returns the body of its response, skipping
+// the events sent meanwhile.
+func (c *client) request(command string, args any, body any) {
+	c.seq++
+	if err := writeMessage(c.conn, map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": args}); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		msg := c.read()
+		if msg.Type != "response" {
+			continue
+		}
+		if !msg.Success {
+			c.t.Fatalf("%s failed: %s", command, msg.Message)
+		}
+		if body != nil {
+			if err := json.Unmarshal(msg.Body, body); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return
+	}
+}
+
+func (c *client) waitEvent(name string) message {
+	for {
+		if msg := c.read(); msg.Type == "event" && msg.Event == name {
+			return msg
+		}
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.lua")
+	err := os.WriteFile(path, []byte(`local function add(a, b)
+	local sum = a + b
+	return sum
+end
+local t = {x = 1}
+local r = add(t.x, 2)
+result = r
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	d := New(L)
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go d.Serve(server)
+	done := make(chan error, 1)
+	go func() {
+		<-d.Configured()
+		done <- L.DoFile(path)
+	}()
+
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.request("initialize", map[string]any{"adapterID": "glua"}, nil)
+	c.waitEvent("initialized")
+	c.request("launch", map[string]any{"program": path}, nil)
+	c.request("setBreakpoints", map[string]any{"source": map[string]any{"path": path}, "breakpoints": []map[string]any{{"line": 2}}}, nil)
+	c.request("configurationDone", nil, nil)
+
+	c.waitEvent("stopped")
+	var trace struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+	}
+	c.request("stackTrace", map[string]any{"threadId": 1}, &trace)
+	if len(trace.StackFrames) != 2 || trace.StackFrames[0].Name != "add" || trace.StackFrames[0].Line != 2 || trace.StackFrames[1].Line != 6 {
+		t.Fatalf("unexpected stack trace: %+v", trace.StackFrames)
+	}
+
+	var scopes struct {
+		Scopes []scope `json:"scopes"`
+	}
+	c.request("scopes", map[string]any{"frameId": 1}, &scopes)
+	var vars struct {
+		Variables []variable `json:"variables"`
+	}
+	c.request("variables", map[string]any{"variablesReference": scopes.Scopes[0].VariablesReference}, &vars)
+	if len(vars.Variables) != 2 || vars.Variables[0].Name != "a" || vars.Variables[1].Value != "2" {
+		t.Fatalf("unexpected locals: %+v", vars.Variables)
+	}
+
+	var eval struct {
+		Result string `json:"result"`
+	}
+	c.request("evaluate", map[string]any{"expression": "a * 10 + b", "frameId": 1}, &eval)
+	if eval.Result != "12" {
+		t.Fatalf("unexpected evaluation: %s", eval.Result)
+	}
+	c.request("evaluate", map[string]any{"expression": "t.x", "frameId": 2}, &eval)
+	if eval.Result != "1" {
+		t.Fatalf("unexpected evaluation: %s", eval.Result)
+	}
+
+	c.request("next", map[string]any{"threadId": 1}, nil)
+	c.waitEvent("stopped")
+	c.request("stackTrace", map[string]any{"threadId": 1}, &trace)
+	if trace.StackFrames[0].Line != 3 {
+		t.Fatalf("unexpected line after next: %d", trace.StackFrames[0].Line)
+	}
+	c.request("stepOut", map[string]any{"threadId": 1}, nil)
+	c.waitEvent("stopped")
+	c.request("stackTrace", map[string]any{"threadId": 1}, &trace)
+	if len(trace.StackFrames) != 1 || trace.StackFrames[0].Line != 7 {
+		t.Fatalf("unexpected stack trace after stepOut: %+v", trace.StackFrames)
+	}
+
+	c.request("continue", map[string]any{"threadId": 1}, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.request("disconnect", nil, nil)
+	if result, _ := L.GetGlobal("result").AsLNumber(); result != 3 {
+		t.Fatalf("unexpected result: %v", L.GetGlobal("result"))
+	}
+}
+
+func TestDebuggerEvaluateEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env.lua")
+	err := os.WriteFile(path, []byte(`g = 7
+local env = setmetatable({answer = 42}, {__index = _G})
+local function f()
+	local _ENV = env
+	local x = 1
+	return x
+end
+f()
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	L := lua.NewState(lua.Options{LanguageVersion: lua.Lua54})
+	defer L.Close()
+	d := New(L)
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go d.Serve(server)
+	done := make(chan error, 1)
+	go func() {
+		<-d.Configured()
+		done <- L.DoFile(path)
+	}()
+
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.request("initialize", map[string]any{"adapterID": "glua"}, nil)
+	c.waitEvent("initialized")
+	c.request("launch", map[string]any{"program": path}, nil)
+	c.request("setBreakpoints", map[string]any{"source": map[string]any{"path": path}, "breakpoints": []map[string]any{{"line": 6}}}, nil)
+	c.request("configurationDone", nil, nil)
+
+	c.waitEvent("stopped")
+	var eval struct {
+		Result string `json:"result"`
+	}
+	for _, e := range []struct {
+		expr   string
+		frame  int
+		result string
+	}{
+		{"x + answer", 1, "43"},
+		{"g + 1", 2, "8"},
+		{"answer", 2, "nil"},
+	} {
+		c.request("evaluate", map[string]any{"expression": e.expr, "frameId": e.frame}, &eval)
+		if eval.Result != e.result {
+			t.Fatalf("unexpected evaluation of %s: %s", e.expr, eval.Result)
+		}
+	}
+
+	c.request("continue", map[string]any{"threadId": 1}, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.request("disconnect", nil, nil)
+}
+
+func TestDebuggerAttachFromInterruptHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loop.lua")
+	err := os.WriteFile(path, []byte(`n = 0
+while running() do
+	n = n + 1
+end
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	var stopped atomic.Bool
+	L.SetGlobal("running", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(!stopped.Load()).AsLValue())
+		return 1
+	}).AsLValue())
+	attach := make(chan chan *Debugger, 1)
+	L.SetInterruptHook(100, func(L *lua.LState) lua.InterruptAction {
+		select {
+		case reply := <-attach:
+			L.SetInterruptHook(0, nil)
+			reply <- New(L)
+		default:
+		}
+		return lua.InterruptContinue
+	})
+	done := make(chan error, 1)
+	go func() { done <- L.DoFile(path) }()
+
+	reply := make(chan *Debugger)
+	attach <- reply
+	d := <-reply
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go d.Serve(server)
+
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.request("initialize", map[string]any{"adapterID": "glua"}, nil)
+	c.waitEvent("initialized")
+	c.request("attach", nil, nil)
+	c.request("setBreakpoints", map[string]any{"source": map[string]any{"path": path}, "breakpoints": []map[string]any{{"line": 3}}}, nil)
+	c.request("configurationDone", nil, nil)
+
+	c.waitEvent("stopped")
+	var eval struct {
+		Result string `json:"result"`
+	}
+	c.request("evaluate", map[string]any{"expression": "n > 0", "frameId": 1}, &eval)
+	if eval.Result != "true" {
+		t.Fatalf("unexpected evaluation: %s", eval.Result)
+	}
+	stopped.Store(true)
+	c.request("setBreakpoints", map[string]any{"source": map[string]any{"path": path}, "breakpoints": []map[string]any{}}, nil)
+	c.request("continue", map[string]any{"threadId": 1}, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.request("disconnect", nil, nil)
+}
+
+func TestDebuggerAttachFromAnotherGoroutine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loop.lua")
+	err := os.WriteFile(path, []byte(`n = 0
+while running() do
+	n = n + 1
+end
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	var stopped atomic.Bool
+	L.SetGlobal("running", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(!stopped.Load()).AsLValue())
+		return 1
+	}).AsLValue())
+	done := make(chan error, 1)
+	go func() { done <- L.DoFile(path) }()
+
+	d := Attach(L)
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go d.Serve(server)
+
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.request("initialize", map[string]any{"adapterID": "glua"}, nil)
+	c.waitEvent("initialized")
+	c.request("attach", nil, nil)
+	c.request("setBreakpoints", map[string]any{"source": map[string]any{"path": path}, "breakpoints": []map[string]any{{"line": 3}}}, nil)
+	c.request("configurationDone", nil, nil)
+
+	c.waitEvent("stopped")
+	var eval struct {
+		Result string `json:"result"`
+	}
+	c.request("evaluate", map[string]any{"expression": "n >= 0", "frameId": 1}, &eval)
+	if eval.Result != "true" {
+		t.Fatalf("unexpected evaluation: %s", eval.Result)
+	}
+	stopped.Store(true)
+	c.request("setBreakpoints", map[string]any{"source": map[string]any{"path": path}, "breakpoints": []map[string]any{}}, nil)
+	c.request("continue", map[string]any{"threadId": 1}, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.request("disconnect", nil, nil)
+}
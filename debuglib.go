@@ -13,11 +13,13 @@ func OpenDebug(L *LState) int {
 
 var debugFuncs = map[string]LGFunction{
 	"getfenv":      debugGetFEnv,
+	"gethook":      debugGetHook,
 	"getinfo":      debugGetInfo,
 	"getlocal":     debugGetLocal,
 	"getmetatable": debugGetMetatable,
 	"getupvalue":   debugGetUpvalue,
 	"setfenv":      debugSetFEnv,
+	"sethook":      debugSetHook,
 	"setlocal":     debugSetLocal,
 	"setmetatable": debugSetMetatable,
 	"setupvalue":   debugSetUpvalue,
@@ -88,6 +90,34 @@ func debugGetLocal(L *LState) int {
 	return 1
 }
 
+func debugGetHook(L *LState) int {
+	th := L
+	if l, ok := L.Get(1).AsLState(); ok {
+		th = l
+	}
+	fn, mask, count := th.GetHook()
+	if fn == nil {
+		L.Push(LNil)
+	} else if th.hook.luaFn != nil {
+		L.Push(th.hook.luaFn.AsLValue())
+	} else {
+		L.Push(LString("external hook").AsLValue())
+	}
+	smask := ""
+	if mask&HookMaskCall != 0 {
+		smask += "c"
+	}
+	if mask&HookMaskReturn != 0 {
+		smask += "r"
+	}
+	if mask&HookMaskLine != 0 {
+		smask += "l"
+	}
+	L.Push(LString(smask).AsLValue())
+	L.Push(LNumber(count).AsLValue())
+	return 3
+}
+
 func debugGetMetatable(L *LState) int {
 	L.Push(L.GetMetatable(L.CheckAny(1)))
 	return 1
@@ -111,6 +141,47 @@ func debugSetFEnv(L *LState) int {
 	return 0
 }
 
+func debugSetHook(L *LState) int {
+	th, base := L, 0
+	if l, ok := L.Get(1).AsLState(); ok {
+		th, base = l, 1
+	}
+	if L.Get(base+1).Type() == LTNil {
+		th.SetHook(nil, 0, 0)
+		return 0
+	}
+	fn := L.CheckFunction(base + 1)
+	smask := L.CheckString(base + 2)
+	count := L.OptInt(base+3, 0)
+	var mask HookMask
+	if strings.Contains(smask, "c") {
+		mask |= HookMaskCall
+	}
+	if strings.Contains(smask, "r") {
+		mask |= HookMaskReturn
+	}
+	if strings.Contains(smask, "l") {
+		mask |= HookMaskLine
+	}
+	if count > 0 {
+		mask |= HookMaskCount
+	}
+	th.SetHook(func(L *LState, event HookEvent, line int) {
+		L.Push(fn.AsLValue())
+		L.Push(LString(event.String()).AsLValue())
+		if event == HookLine {
+			L.Push(LNumber(line).AsLValue())
+		} else {
+			L.Push(LNil)
+		}
+		L.Call(2, 0)
+	}, mask, count)
+	if th.hook != nil {
+		th.hook.luaFn = fn
+	}
+	return 0
+}
+
 func debugSetLocal(L *LState) int {
 	level := L.CheckInt(1)
 	idx := L.CheckInt(2)
@@ -0,0 +1,219 @@
+package lua
+
+import (
+	"cmp"
+	"reflect"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+	"weak"
+)
+
+/* __gc finalizers {{{ */
+
+// Objects whose metatable has a __gc field when it is set are marked for
+// finalization, as in Lua 5.2: userdata through LState.SetMetatable, custom
+// data when it is allocated by CustomDataHelper.New. A Go finalizer is
+// attached to the object; when it fires, the object is resurrected into the
+// pending queue of its finalizerSet and its __gc metamethod is called later
+// on the goroutine of a state sharing that set, at a safe point.
+//
+// Each Global owns the finalizerSet of the objects marked by its states,
+// whether their custom data type is process-wide or state-local. Only objects
+// allocated by the state are marked, since a Go finalizer can only be
+// attached to the start of an allocation.
+
+type gcObject struct {
+	set  *finalizerSet
+	ptr  weak.Pointer[byte]
+	data uintptr
+	seq  uint64
+	done bool
+}
+
+// gcObjects indexes all marked objects by address. An object keeps its entry
+// until its Go finalizer has run, so it is never given a second one.
+var (
+	gcObjectsMu sync.Mutex
+	gcObjects   = make(map[uintptr]*gcObject)
+	gcObjectSeq uint64
+)
+
+type finalizerSet struct {
+	mu      sync.Mutex
+	objects map[*gcObject]struct{}
+	pending []LValue
+	npend   atomic.Int32
+	running bool
+}
+
+func newFinalizerSet() *finalizerSet {
+	return &finalizerSet{objects: make(map[*gcObject]struct{})}
+}
+
+func hasGCMetamethod(mt LValue) bool {
+	tb, ok := mt.AsLTable()
+	return ok && tb.RawGetString("__gc").Type() == LTFunction
+}
+
+// mark registers the object lv refers to with set. It returns false if the
+// object was already marked, in which case it must not be given a Go
+// finalizer again.
+func (set *finalizerSet) mark(lv LValue) bool {
+	gcObjectsMu.Lock()
+	defer gcObjectsMu.Unlock()
+	addr := uintptr(lv.dataptr)
+	if _, ok := gcObjects[addr]; ok {
+		return false
+	}
+	gcObjectSeq++
+	obj := &gcObject{set: set, ptr: weak.Make((*byte)(lv.dataptr)), data: lv.data, seq: gcObjectSeq}
+	gcObjects[addr] = obj
+	set.mu.Lock()
+	set.objects[obj] = struct{}{}
+	set.mu.Unlock()
+	return true
+}
+
+// finalizeObject is called by the Go finalizer of a marked object.
+func finalizeObject(ptr unsafe.Pointer) {
+	gcObjectsMu.Lock()
+	obj, ok := gcObjects[uintptr(ptr)]
+	delete(gcObjects, uintptr(ptr))
+	gcObjectsMu.Unlock()
+	if !ok {
+		return
+	}
+	set := obj.set
+	set.mu.Lock()
+	delete(set.objects, obj)
+	if !obj.done {
+		obj.done = true
+		set.pending = append(set.pending, LValue{dataptr: ptr, data: obj.data})
+		set.npend.Add(1)
+	}
+	set.mu.Unlock()
+}
+
+func markUserData(set *finalizerSet, ud *LUserData) {
+	if set.mark(ud.AsLValue()) {
+		runtime.SetFinalizer(ud, func(ud *LUserData) { finalizeObject(unsafe.Pointer(ud)) })
+	}
+}
+
+// markCustomData marks the custom data value lv, whose object obj is a
+// pointer to the start of an allocation made by the state.
+func markCustomData(set *finalizerSet, lv LValue, obj any) {
+	if set.mark(lv) {
+		runtime.SetFinalizer(obj, func(obj any) { finalizeObject(reflect.ValueOf(obj).UnsafePointer()) })
+	}
+}
+
+// take removes and returns the pending objects, or nil if the set is already
+// being drained further up the stack.
+func (set *finalizerSet) take() []LValue {
+	if set.npend.Load() == 0 {
+		return nil
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.running {
+		return nil
+	}
+	pending := set.pending
+	set.pending = nil
+	set.npend.Store(0)
+	return pending
+}
+
+// takeAll marks every live object of the set as finalized and returns them
+// along with the pending ones, most recently marked first.
+func (set *finalizerSet) takeAll() []LValue {
+	set.mu.Lock()
+	live := make([]*gcObject, 0, len(set.objects))
+	for obj := range set.objects {
+		if p := obj.ptr.Value(); p != nil && !obj.done {
+			obj.done = true
+			live = append(live, obj)
+		}
+	}
+	slices.SortFunc(live, func(a, b *gcObject) int { return cmp.Compare(b.seq, a.seq) })
+	values := make([]LValue, 0, len(live)+len(set.pending))
+	for _, obj := range live {
+		if p := obj.ptr.Value(); p != nil {
+			values = append(values, LValue{dataptr: unsafe.Pointer(p), data: obj.data})
+		}
+	}
+	values = append(values, set.pending...)
+	set.pending = nil
+	set.npend.Store(0)
+	set.objects = make(map[*gcObject]struct{})
+	set.mu.Unlock()
+	return values
+}
+
+// runFinalizers calls the __gc metamethods of the given objects in protected
+// mode and returns the first error raised by one of them.
+func (ls *LState) runFinalizers(set *finalizerSet, values []LValue) error {
+	if len(values) == 0 {
+		return nil
+	}
+	set.mu.Lock()
+	set.running = true
+	set.mu.Unlock()
+	defer func() {
+		set.mu.Lock()
+		set.running = false
+		set.mu.Unlock()
+	}()
+	var firstErr error
+	for _, lv := range values {
+		fn := ls.metaOp1(lv, "__gc")
+		if fn.Type() != LTFunction {
+			continue
+		}
+		ls.Push(fn)
+		ls.Push(lv)
+		if err := ls.PCall(1, 0, nil); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// finalizePending runs the finalizers of the objects collected since the
+// last safe point.
+func (ls *LState) finalizePending() error {
+	return ls.runFinalizers(ls.G.finalizers, ls.G.finalizers.take())
+}
+
+type finalizerSentinel struct{ _ *byte }
+
+// collectGarbage runs a full garbage collection and, if any object is marked
+// for finalization, waits until the Go finalizers it queued have run. The
+// finalizer goroutine takes its whole queue at once, so a sentinel queued by
+// a second collection runs only after the queue of the first one.
+func collectGarbage() {
+	runtime.GC()
+	gcObjectsMu.Lock()
+	n := len(gcObjects)
+	gcObjectsMu.Unlock()
+	if n == 0 {
+		return
+	}
+	for range 2 {
+		done := make(chan struct{})
+		runtime.SetFinalizer(new(finalizerSentinel), func(*finalizerSentinel) { close(done) })
+		runtime.GC()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			return
+		}
+	}
+}
+
+/* }}} */
@@ -0,0 +1,123 @@
+package lua
+
+import (
+	"testing"
+)
+
+type gcHandle struct {
+	name string
+	_    *byte
+}
+
+func TestUserDataFinalizer(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	mt := L.NewTable()
+	count := 0
+	mt.RawSetString("__gc", L.NewFunction(func(L *LState) int {
+		errorIfNotEqual(t, "handle", L.CheckUserData(1).Value)
+		count++
+		return 0
+	}).AsLValue())
+	L.SetGlobal("new", L.NewFunction(func(L *LState) int {
+		ud := L.NewUserData()
+		ud.Value = "handle"
+		L.SetMetatable(ud.AsLValue(), mt.AsLValue())
+		L.Push(ud.AsLValue())
+		return 1
+	}).AsLValue())
+	errorIfScriptFail(t, L, `
+	keep = new()
+	do
+		local u = new()
+	end
+	collectgarbage()
+	`)
+	errorIfNotEqual(t, 1, count)
+	errorIfScriptFail(t, L, `collectgarbage()`)
+	errorIfNotEqual(t, 1, count)
+
+	mt.RawSetString("__gc", L.NewFunction(func(L *LState) int {
+		L.RaiseError("boom")
+		return 0
+	}).AsLValue())
+	errorIfScriptNotFail(t, L, `
+	do
+		local u = new()
+	end
+	collectgarbage()
+	`, "error in __gc metamethod")
+}
+
+func TestCustomDataFinalizer(t *testing.T) {
+	L := NewState()
+	var helper *CustomDataHelper[gcHandle]
+	var closed []string
+	mt := L.NewTable()
+	mt.RawSetString("__gc", L.NewFunction(func(L *LState) int {
+		closed = append(closed, helper.Must(L.CheckAny(1)).name)
+		return 0
+	}).AsLValue())
+	helper = RegisterStateCustomData[gcHandle](L, mt)
+	L.SetGlobal("open", L.NewFunction(func(L *LState) int {
+		_, lv := helper.New(L, gcHandle{name: L.CheckString(1)})
+		L.Push(lv)
+		return 1
+	}).AsLValue())
+	errorIfScriptFail(t, L, `
+	a = open("a")
+	b = open("b")
+	do
+		local c = open("c")
+	end
+	collectgarbage()
+	`)
+	errorIfFalse(t, len(closed) == 1 && closed[0] == "c", "unexpected finalized handles: %v", closed)
+	L.Close()
+	errorIfFalse(t, len(closed) == 3 && closed[1] == "b" && closed[2] == "a", "unexpected finalized handles: %v", closed)
+}
+
+type sharedGCHandle struct {
+	name string
+	_    *byte
+}
+
+func TestCustomDataFinalizerOwner(t *testing.T) {
+	owner := NewState()
+	other := NewState()
+	defer other.Close()
+	var finalizedBy []*LState
+	mt := other.NewTable()
+	mt.RawSetString("__gc", other.NewFunction(func(L *LState) int {
+		finalizedBy = append(finalizedBy, L)
+		return 0
+	}).AsLValue())
+	helper := RegisterCustomData[sharedGCHandle](mt)
+	defer helper.Unregister()
+
+	func() {
+		_, lv := helper.New(owner, sharedGCHandle{name: "owned"})
+		owner.SetGlobal("h", lv)
+		owner.SetGlobal("h", LNil)
+	}()
+	errorIfScriptFail(t, other, `collectgarbage()`)
+	errorIfNotEqual(t, 0, len(finalizedBy))
+	errorIfScriptFail(t, owner, `collectgarbage()`)
+	errorIfFalse(t, len(finalizedBy) == 1 && finalizedBy[0] == owner, "unexpected finalizers: %v", finalizedBy)
+	owner.Close()
+}
+
+func TestCustomDataInteriorPointer(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	mt := L.NewTable()
+	mt.RawSetString("__gc", L.NewFunction(func(L *LState) int {
+		t.Error("interior pointer finalized")
+		return 0
+	}).AsLValue())
+	helper := RegisterStateCustomData[gcHandle](L, mt)
+	handles := make([]gcHandle, 2)
+	lv := helper.AsLValue(&handles[1])
+	errorIfFalse(t, helper.Must(lv) == &handles[1], "AsLValue changed the pointer")
+	errorIfScriptFail(t, L, `collectgarbage()`)
+}
@@ -40,6 +40,12 @@ type FunctionProto struct {
 	DbgUpvalues        []string
 }
 
+// hasEnvUpvalue reports whether the first upvalue of fp is _ENV, as in the
+// main function of a chunk compiled for Lua 5.2 or later.
+func (fp *FunctionProto) hasEnvUpvalue() bool {
+	return len(fp.DbgUpvalues) > 0 && fp.DbgUpvalues[0] == "_ENV"
+}
+
 func (fp *FunctionProto) stringConstant(idx int) string {
 	return string(fp.Constants[idx].mustLStringUnchecked())
 }
@@ -178,12 +184,15 @@ func (fn *LFunction) LocalName(regno, pc int) (string, bool) {
 	if fn.IsG {
 		return "", false
 	}
-	p := fn.Proto
-	for i := 0; i < len(p.DbgLocals) && p.DbgLocals[i].StartPc < pc; i++ {
-		if pc < p.DbgLocals[i].EndPc {
+	return fn.Proto.localName(regno, pc)
+}
+
+func (fp *FunctionProto) localName(regno, pc int) (string, bool) {
+	for i := 0; i < len(fp.DbgLocals) && fp.DbgLocals[i].StartPc <= pc; i++ {
+		if pc < fp.DbgLocals[i].EndPc {
 			regno--
 			if regno == 0 {
-				return p.DbgLocals[i].Name, true
+				return fp.DbgLocals[i].Name, true
 			}
 		}
 	}
@@ -0,0 +1,44 @@
+package lua
+
+import (
+	"weak"
+)
+
+/* Go errors {{{ */
+
+// goErrorSet associates the messages raised by RaiseGoError with their Go
+// errors, so that a message rethrown by Lua code still refers to the
+// original error. Messages are identified by the address of their bytes and
+// held weakly.
+type goErrorSet struct {
+	errs map[weak.Pointer[byte]]error
+	// entries after the last sweep
+	live int
+}
+
+func (s *goErrorSet) set(lv LValue, err error) {
+	if lv.Type() != LTString || lv.dataptr == nil {
+		return
+	}
+	if s.errs == nil {
+		s.errs = make(map[weak.Pointer[byte]]error)
+	}
+	if len(s.errs) >= 2*s.live+64 {
+		for ptr := range s.errs {
+			if ptr.Value() == nil {
+				delete(s.errs, ptr)
+			}
+		}
+		s.live = len(s.errs)
+	}
+	s.errs[weak.Make((*byte)(lv.dataptr))] = err
+}
+
+func (s *goErrorSet) get(lv LValue) error {
+	if s.errs == nil || lv.Type() != LTString || lv.dataptr == nil {
+		return nil
+	}
+	return s.errs[weak.Make((*byte)(lv.dataptr))]
+}
+
+/* }}} */
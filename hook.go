@@ -0,0 +1,228 @@
+package lua
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/* debug hooks {{{ */
+
+// HookEvent identifies the event a Hook is called for.
+type HookEvent int
+
+const (
+	// HookCall is fired when a function has been entered, before its first
+	// instruction.
+	HookCall HookEvent = iota
+	// HookReturn is fired when a function is about to return.
+	HookReturn
+	// HookLine is fired when the VM starts executing a new line of code, or
+	// jumps back in the code, even to the same line.
+	HookLine
+	// HookCount is fired every count instructions.
+	HookCount
+	// HookTailReturn is fired after HookReturn once for each function that
+	// was replaced by the returning one through a tail call.
+	HookTailReturn
+)
+
+var hookEventNames = [...]string{"call", "return", "line", "count", "tail return"}
+
+func (ev HookEvent) String() string {
+	return hookEventNames[ev]
+}
+
+// HookMask selects the events a Hook is called for.
+type HookMask int
+
+const (
+	HookMaskCall HookMask = 1 << iota
+	HookMaskReturn
+	HookMaskLine
+	HookMaskCount
+)
+
+// Hook is called on the thread that fires an event. line is the new line
+// for HookLine events and -1 otherwise. During the call level 0 of
+// LState.GetStack is the running function, and hooks are disabled.
+type Hook func(L *LState, event HookEvent, line int)
+
+type hookState struct {
+	fn    Hook
+	mask  HookMask
+	count int
+	luaFn *LFunction // the function set by debug.sethook, if any
+
+	countdown int
+	lines     lineTracker
+}
+
+// lineTracker detects when the VM starts executing a new line of code, or
+// jumps back in the code.
+type lineTracker struct {
+	lastPc    int
+	lastFrame *callFrame
+	lastProto *FunctionProto
+}
+
+// next is called before each instruction of cf is executed, with cf.Pc
+// pointing past it. It returns the line of the instruction and reports
+// whether it starts a new line.
+func (t *lineTracker) next(cf *callFrame) (int, bool) {
+	proto := cf.Fn.Proto
+	pc := cf.Pc - 1
+	oldpc := t.lastPc
+	if t.lastFrame != cf || t.lastProto != proto {
+		// the frame has just been entered or returned to; in the latter case
+		// the previous instruction is the call
+		oldpc = pc - 1
+	}
+	t.lastPc, t.lastFrame, t.lastProto = pc, cf, proto
+	if pc >= len(proto.DbgSourcePositions) {
+		return 0, false
+	}
+	line := proto.DbgSourcePositions[pc]
+	return line, pc == 0 || pc <= oldpc || oldpc < 0 || line != proto.DbgSourcePositions[oldpc]
+}
+
+// SetHook sets a hook called on the events selected by mask. The count
+// event is fired every count instructions and requires HookMaskCount. A nil
+// fn or an empty mask removes the hook. Hooks are per thread; a thread
+// created by NewThread inherits the hook of its creator.
+func (ls *LState) SetHook(fn Hook, mask HookMask, count int) {
+	if count <= 0 {
+		mask &^= HookMaskCount
+		count = 0
+	}
+	if fn == nil || mask == 0 {
+		ls.hook = nil
+	} else {
+		ls.hook = &hookState{fn: fn, mask: mask, count: count, countdown: count}
+	}
+	ls.reloadMainLoop()
+}
+
+// GetHook returns the current hook, its mask and its count.
+func (ls *LState) GetHook() (Hook, HookMask, int) {
+	if ls.hook == nil {
+		return nil, 0, 0
+	}
+	return ls.hook.fn, ls.hook.mask, ls.hook.count
+}
+
+// tracing reports whether the thread has to run in mainLoopWithHooks.
+func (ls *LState) tracing() bool {
+	return ls.hook != nil && ls.hook.mask&(HookMaskLine|HookMaskCount) != 0
+}
+
+func (ls *LState) callHook(event HookEvent, line int) {
+	if ls.inHook {
+		return
+	}
+	ls.inHook = true
+	defer func() { ls.inHook = false }()
+	ls.hook.fn(ls, event, line)
+}
+
+// hookCall is called when the current frame has been entered.
+func (ls *LState) hookCall() {
+	if ls.hook.mask&HookMaskCall != 0 {
+		ls.callHook(HookCall, -1)
+	}
+}
+
+// hookReturn is called when the current frame is about to return.
+func (ls *LState) hookReturn() {
+	if ls.hook.mask&HookMaskReturn == 0 {
+		return
+	}
+	ls.callHook(HookReturn, -1)
+	for i := 0; i < ls.currentFrame.TailCall && ls.hook != nil; i++ {
+		ls.callHook(HookTailReturn, -1)
+	}
+}
+
+// traceExec is called by mainLoopWithHooks before each instruction of cf is
+// executed, with cf.Pc pointing past it.
+func (ls *LState) traceExec(cf *callFrame) {
+	h := ls.hook
+	if ls.inHook {
+		return
+	}
+	if h.mask&HookMaskCount != 0 {
+		h.countdown--
+		if h.countdown <= 0 {
+			h.countdown = h.count
+			ls.callHook(HookCount, -1)
+			if ls.hook != h || h.mask&HookMaskLine == 0 {
+				return
+			}
+		}
+	}
+	if h.mask&HookMaskLine == 0 {
+		return
+	}
+	if line, ok := h.lines.next(cf); ok {
+		ls.callHook(HookLine, line)
+	}
+}
+
+// inheritHook gives thread a copy of the hook of ls.
+func (ls *LState) inheritHook(thread *LState) {
+	if ls.hook != nil {
+		thread.hook = &hookState{fn: ls.hook.fn, mask: ls.hook.mask, count: ls.hook.count,
+			luaFn: ls.hook.luaFn, countdown: ls.hook.count}
+	}
+}
+
+// reloadMainLoop selects the main loop after a change of the hooks or the
+// instruction budget, and makes a running loop switch to it at the next
+// call or return.
+func (ls *LState) reloadMainLoop() {
+	ls.updateMainLoop()
+	ls.mainLoopChanged = ls.isStarted()
+}
+
+/* }}} */
+
+/* posted calls {{{ */
+
+// postedCalls holds the functions passed to Post until the running thread
+// calls them.
+type postedCalls struct {
+	pending atomic.Bool
+	mu      sync.Mutex
+	fns     []func(*LState)
+}
+
+// Post arranges for fn to be called on the running thread of the state
+// before it executes its next instruction. Unlike the other methods of
+// LState it may be called from any goroutine, so that a host can for example
+// set a hook on a script that is already running. fn is not called while the
+// state is idle or runs a Go function; it waits for the next instruction.
+func (ls *LState) Post(fn func(L *LState)) {
+	p := &ls.G.posted
+	p.mu.Lock()
+	p.fns = append(p.fns, fn)
+	p.pending.Store(true)
+	p.mu.Unlock()
+}
+
+// runPosted is called by the main loops when functions have been posted. It
+// reports whether they have made the running loop switch to another one.
+func (ls *LState) runPosted() bool {
+	p := &ls.G.posted
+	p.mu.Lock()
+	fns := p.fns
+	p.fns = nil
+	p.pending.Store(false)
+	p.mu.Unlock()
+	for _, fn := range fns {
+		fn(ls)
+	}
+	changed := ls.mainLoopChanged
+	ls.mainLoopChanged = false
+	return changed
+}
+
+/* }}} */
@@ -0,0 +1,126 @@
+package lua
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHookCallReturn(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var events []string
+	L.SetHook(func(L *LState, event HookEvent, line int) {
+		dbg, ok := L.GetStack(0)
+		errorIfFalse(t, ok, "no running function on %v", event)
+		L.GetInfo("S", dbg, LNil)
+		events = append(events, fmt.Sprintf("%v %v %v", event, dbg.What, dbg.LineDefined))
+	}, HookMaskCall|HookMaskReturn, 0)
+	errorIfScriptFail(t, L, `
+	local function g() return string.sub("abc", 1, 1) end
+	local function f() return g() end
+	local x = f()
+	`)
+	L.SetHook(nil, 0, 0)
+	expected := []string{
+		"call main 0",
+		"call Lua 3",  // f
+		"call tail 2", // g, tail called by f
+		"call G 0",    // string.sub, on the IsFast path
+		"return G 0",
+		"return tail 2",
+		"tail return tail 2", // for f
+		"return main 0",
+	}
+	errorIfNotEqual(t, strings.Join(expected, "\n"), strings.Join(events, "\n"))
+}
+
+func TestHookLine(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local lines = {}
+	debug.sethook(function(event, line)
+		assert(event == "line")
+		lines[#lines+1] = line
+	end, "l")
+	local s = 0
+	for i = 1, 2 do
+		s = s + i
+	end
+	debug.sethook()
+	assert(table.concat(lines, " ") == "7 8 9 8 9 8 11", table.concat(lines, " "))
+	`)
+	fn, mask, count := L.GetHook()
+	errorIfFalse(t, fn == nil && mask == 0 && count == 0, "hook not removed")
+}
+
+func TestHookCount(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local n = 0
+	local hook = function(event)
+		assert(event == "count")
+		n = n + 1
+	end
+	debug.sethook(hook, "", 10)
+	for i = 1, 100 do end
+	local f, mask, count = debug.gethook()
+	debug.sethook()
+	assert(f == hook and mask == "" and count == 10)
+	assert(n >= 10, tostring(n))
+	`)
+}
+
+func TestHookCoroutine(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local calls = 0
+	local co = coroutine.create(function() coroutine.yield() end)
+	debug.sethook(co, function(event) calls = calls + 1 end, "c")
+	coroutine.resume(co)
+	assert(debug.gethook() == nil)
+	assert(calls == 2, calls) -- the body and yield
+	`)
+}
+
+func TestHookToggle(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("depth", L.NewFunction(func(L *LState) int {
+		L.Push(LInteger(runtime.Callers(0, make([]uintptr, 4096))).AsLValue())
+		return 1
+	}).AsLValue())
+	errorIfScriptFail(t, L, `
+	local function f() end
+	local base = depth()
+	for i = 1, 1000 do
+		debug.sethook(f, "c")
+		f()
+		debug.sethook()
+		f()
+	end
+	assert(depth() == base, "the Go stack grew from " .. base .. " to " .. depth())
+	`)
+}
+
+func TestPost(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	done := make(chan error, 1)
+	go func() { done <- L.DoString(`while not stop do end`) }()
+	L.Post(func(L *LState) { L.SetGlobal("stop", LTrue.AsLValue()) })
+	errorIfNotNil(t, <-done)
+
+	go func() { done <- L.DoString(`while true do end`) }()
+	L.Post(func(L *LState) {
+		L.SetHook(func(L *LState, event HookEvent, line int) {
+			L.RaiseError("stopped on line %d", line)
+		}, HookMaskLine, 0)
+	})
+	err := <-done
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "stopped on line 1"), "unexpected error: %v", err)
+}
@@ -238,7 +238,7 @@ func fileWriteAux(L *LState, file *lFile, idx int) int {
 	var err error
 	for i := idx; i <= top; i++ {
 		L.CheckTypes(i, LTNumber, LTString)
-		s := LVAsString(L.Get(i))
+		s := L.lvAsString(L.Get(i))
 		if _, err = out.Write(unsafeFastStringToReadOnlyBytes(s)); err != nil {
 			goto errreturn
 		}
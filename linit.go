@@ -21,6 +21,10 @@ const (
 	ChannelLibName = "channel"
 	// CoroutineLibName is the name of the coroutine Library.
 	CoroutineLibName = "coroutine"
+	// Utf8LibName is the name of the utf8 Library.
+	Utf8LibName = "utf8"
+	// AsyncLibName is the name of the async Library, which OpenLibs does not load.
+	AsyncLibName = "async"
 )
 
 type luaLib struct {
@@ -39,6 +43,7 @@ var luaLibs = []luaLib{
 	{DebugLibName, OpenDebug},
 	{ChannelLibName, OpenChannel},
 	{CoroutineLibName, OpenCoroutine},
+	{Utf8LibName, OpenUtf8},
 }
 
 // OpenLibs loads the built-in libraries. It is equivalent to running OpenLoad,
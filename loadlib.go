@@ -56,6 +56,9 @@ func OpenPackage(L *LState) int {
 		L.RawSetInt(loaders, i+1, L.NewFunction(loader).AsLValue())
 	}
 	L.SetField(packagemod, "loaders", loaders.AsLValue())
+	if L.Options.LanguageVersion >= Lua52 {
+		L.SetField(packagemod, "searchers", loaders.AsLValue())
+	}
 	L.SetField(L.Get(RegistryIndex), "_LOADERS", loaders.AsLValue())
 
 	loaded := L.NewTable()
@@ -104,6 +107,11 @@ func loLoaderLua(L *LState) int {
 		L.RaiseError(err1.Error())
 	}
 	L.Push(fn.AsLValue())
+	if L.Options.LanguageVersion >= Lua52 {
+		// the loader is called with the file name
+		L.Push(LString(path).AsLValue())
+		return 2
+	}
 	return 1
 }
 
@@ -0,0 +1,108 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hsfzxjy/gopher-lua/parse"
+)
+
+func TestLua52Env(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua52})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	assert(_VERSION == "Lua 5.2" and getfenv == nil and setfenv == nil)
+	x = 1
+	assert(_ENV.x == 1 and _ENV == _G)
+	local function f()
+		local _ENV = {y = 2}
+		z = 3
+		return y, z, _ENV
+	end
+	local y, z, env = f()
+	assert(y == 2 and z == 3 and env.z == 3 and _G.z == nil)
+	local function g(_ENV) return a end
+	assert(g({a = "a"}) == "a")
+	do
+		local assert, pcall, _ENV = assert, pcall, nil
+		assert(not pcall(function() return x end))
+	end
+	`)
+	errorIfScriptNotFail(t, L, `local _ENV = {} undefined()`, "global 'undefined'")
+
+	L51 := NewState()
+	defer L51.Close()
+	errorIfScriptFail(t, L51, `
+	assert(_VERSION == "Lua 5.1" and getfenv and rawlen == nil and table.pack == nil)
+	_ENV = 1
+	assert(_G._ENV == 1)
+	`)
+}
+
+func TestLua52Load(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua52})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local env = {v = 42}
+	local f = assert(load("w = v; return v", "chunk", "t", env))
+	assert(f() == 42 and env.w == 42 and w == nil)
+	f = assert(load("return ..."))
+	assert(select("#", f(1, 2)) == 2)
+	local f, err = load("return 1", "chunk", "b")
+	assert(f == nil and err:find("mode is 'b'"))
+	local parts = {"return ", "v"}
+	f = assert(load(function() return table.remove(parts, 1) end, "=fn", "bt", env))
+	assert(f() == 42)
+	`)
+
+	dir, err := os.MkdirTemp("", "glua")
+	errorIfNotNil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mod.lua")
+	errorIfNotNil(t, os.WriteFile(file, []byte(`return {name = ..., file = select(2, ...), v = v}`), 0644))
+	L.SetGlobal("file", LString(file).AsLValue())
+	L.SetGlobal("dir", LString(dir).AsLValue())
+	errorIfScriptFail(t, L, `
+	local f = assert(loadfile(file, "t", {v = 1, select = select}))
+	assert(f().v == 1)
+	package.path = dir .. "/?.lua"
+	local m = require("mod")
+	assert(m.name == "mod" and m.file == file)
+	assert(package.searchers == package.loaders)
+	`)
+}
+
+func TestLua52FunctionFromProto(t *testing.T) {
+	chunk, err := parse.Parse(strings.NewReader(`x = (x or 0) + 1; return x`), "chunk")
+	errorIfNotNil(t, err)
+	proto, err := CompileVersion(chunk, "chunk", Lua52)
+	errorIfNotNil(t, err)
+
+	L := NewState(Options{LanguageVersion: Lua52})
+	defer L.Close()
+	L.SetGlobal("x", LInteger(41).AsLValue())
+	L.Push(L.NewFunctionFromProto(proto).AsLValue())
+	errorIfNotNil(t, L.PCall(0, 1, nil))
+	errorIfNotEqual(t, LInteger(42).AsLValue(), L.Get(-1))
+	errorIfNotEqual(t, LInteger(42).AsLValue(), L.GetGlobal("x"))
+}
+
+func TestLua52Functions(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua52})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	assert(rawlen({1, 2, 3}) == 3 and rawlen("abcd") == 4)
+	assert(not pcall(rawlen, 1))
+	local t = setmetatable({1}, {__len = function() return 10 end})
+	assert(rawlen(t) == 1)
+	local p = table.pack(1, nil, 3)
+	assert(p.n == 3 and p[1] == 1 and p[3] == 3)
+	assert(select("#", table.unpack({1, 2, 3})) == 3)
+	local ok, a, b = xpcall(function(x, y) return x + y, y end, debug.traceback, 1, 2)
+	assert(ok and a == 3 and b == 2)
+	local ok, err = xpcall(function(x) error(x, 0) end, function(e) return "handled " .. e end, "boom")
+	assert(not ok and err == "handled boom")
+	`)
+}
@@ -0,0 +1,119 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLua53Bitwise(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua53})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	assert(_VERSION == "Lua 5.3")
+	local x, y = 0xF0, 0x3C
+	assert(x & y == 0x30 and x | y == 0xFC and x ~ y == 0xCC and ~x == -0xF1)
+	assert(x << 4 == 0xF00 and x >> 4 == 0xF and x << -4 == 0xF and x >> -4 == 0xF00)
+	assert(1 << 63 == math.mininteger and -1 >> 63 == 1 and 1 << 64 == 0 and -1 >> 64 == 0)
+	assert(3 | 1 & 2 == 3 and 1 << 1 + 1 == 4 and 5 ~ 3 & 1 == 4 and ~0 == -1 and - ~0 == 1)
+	assert("12" & 4 == 4 and 2^53 | 0 == 2^53 and math.type(2.0 | 0) == "integer")
+	local ok, err = pcall(function() return x | 1.5 end)
+	assert(not ok and err:find("number has no integer representation"))
+	ok, err = pcall(function() local z = {} return x & z end)
+	assert(not ok and err:find("cannot perform band operation between number and table %(local 'z'%)"))
+	ok, err = pcall(function() local s = "a" return ~s end)
+	assert(not ok and err:find("__bnot undefined %(local 's'%)"))
+	`)
+}
+
+func TestLua53FloorDivision(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua53})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local a, b = 7, 2
+	assert(a // b == 3 and -a // b == -4 and a // -b == -4 and math.type(a // b) == "integer")
+	assert(7.5 // 2 == 3 and math.type(7.5 // 2) == "float" and -7.5 // 2 == -4)
+	assert(a // 0.0 == 1/0 and -a // 0.0 == -1/0 and math.mininteger // -1 == math.mininteger)
+	assert(7 // 2 * 2 == 6 and "9" // 2 == 4)
+	assert(a % -b == -1 and math.mininteger % -1 == 0 and a % 0.0 ~= a % 0.0)
+	`)
+	errorIfScriptNotFail(t, L, `local a = 1; return a // 0`, `attempt to perform 'n//0'`)
+	errorIfScriptNotFail(t, L, `local a = 1; return a % 0`, `attempt to perform 'n%0'`)
+	errorIfScriptNotFail(t, L, `return 1 // 0`, `attempt to perform 'n//0'`)
+	errorIfScriptNotFail(t, L, `return 1 % 0`, `attempt to perform 'n%0'`)
+	errorIfScriptNotFail(t, L, `return "1" // 0`, `attempt to perform 'n//0'`)
+	errorIfScriptFail(t, L, `
+	local ok, err = pcall(function(a) return a // 0 end, 1)
+	assert(not ok and err:find("attempt to perform 'n//0'", 1, true))
+	`)
+}
+
+func TestLua53Integers(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua53})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local max, min = math.maxinteger, math.mininteger
+	assert(max + 1 == min and min - 1 == max and max * 2 == -2 and -min == min)
+	assert(9223372036854775807 + 1 == min and math.type(max + 1) == "integer")
+	assert(math.abs(min) == min and math.type(math.abs(min)) == "integer")
+	assert(tostring(3.0 // 2) == "1.0" and tostring(10 / 2) == "5.0" and tostring(-0.0) == "-0.0")
+	assert(tostring(3) == "3" and tostring(1.5) == "1.5" and tostring(1e100) == "1e+100")
+	assert(1.0 .. "" == "1.0" and table.concat({1.0, 2}, ",") == "1.0,2")
+	assert(string.format("%s %d %5.1f", 2.0, 3.0, 1) == "2.0 3   1.0")
+	local ok, err = pcall(string.format, "%d", 3.5)
+	assert(not ok and err:find("bad argument #2") and err:find("number has no integer representation"))
+	ok, err = pcall(string.format, "%s %x", "a", 0.5)
+	assert(not ok and err:find("bad argument #3"))
+	`)
+
+	L51 := NewState()
+	defer L51.Close()
+	errorIfScriptFail(t, L51, `
+	local max = math.maxinteger
+	assert(math.type(max + 1) == "float" and tostring(10 / 2) == "5")
+	assert(math.type(math.abs(math.mininteger)) == "float")
+	assert(string.format("%d", 3.5) == "3")
+	`)
+}
+
+func TestLua53Metamethods(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua53})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local log = {}
+	local mt = {}
+	for _, event in ipairs({"band", "bor", "bxor", "shl", "shr", "idiv", "bnot"}) do
+		mt["__" .. event] = function(a, b) table.insert(log, event) return event end
+	end
+	local v = setmetatable({}, mt)
+	assert((v & 1) == "band" and (1 | v) == "bor" and (v ~ v) == "bxor")
+	assert((v << 1) == "shl" and (v >> 1) == "shr" and (v // 2) == "idiv" and ~v == "bnot")
+	assert(#log == 7)
+	`)
+}
+
+func TestLua53ConstantFolding(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua53})
+	defer L.Close()
+	fn, err := L.LoadString(`return 1 << 4 | 3, ~0xF, 7 // 2`)
+	errorIfNotNil(t, err)
+	code := fn.Proto.String()
+	for _, op := range []string{"SHL", "BOR", "BNOT", "IDIV"} {
+		errorIfFalse(t, !strings.Contains(code, op), "%s not folded:\n%s", op, code)
+	}
+	// a number without integer representation is an error at run time
+	fn, err = L.LoadString(`return 1.5 | 0`)
+	errorIfNotNil(t, err)
+	code = fn.Proto.String()
+	errorIfFalse(t, strings.Contains(code, "BOR"), "1.5 | 0 folded:\n%s", code)
+}
+
+func TestLua53NotSupported(t *testing.T) {
+	for _, version := range []LanguageVersion{Lua51, Lua52} {
+		L := NewState(Options{LanguageVersion: version})
+		for _, src := range []string{"return 1 & 2", "return 1 // 2", "local x = 1 return 2 + ~x", "return 1 + (1 << 2)"} {
+			_, err := L.LoadString(src)
+			errorIfFalse(t, err != nil && strings.Contains(err.Error(), "is not supported by "+version.String()), "%s: unexpected error %v", src, err)
+		}
+		L.Close()
+	}
+}
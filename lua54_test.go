@@ -0,0 +1,186 @@
+package lua
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const closeLogScript = `
+log = {}
+function res(name)
+	return setmetatable({}, {__close = function(_, err)
+		table.insert(log, err == nil and name or name .. "!" .. tostring(err))
+	end})
+end
+function flush()
+	local s = table.concat(log, ",")
+	log = {}
+	return s
+end
+`
+
+func TestLua54Const(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua54})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	assert(_VERSION == "Lua 5.4")
+	local x <const>, y = 1, 2
+	y = 3
+	local function f() return x + y end
+	assert(f() == 4)
+	do local x = 10; x = 11; assert(x == 11) end
+	`)
+	cases := []string{
+		`local x <const> = 1; x = 2`,
+		`local x <const> = 1; local function f() x = 2 end`,
+		`local x <const> = 1; (function() return function() x = 2 end end)()`,
+		`local x <close> = nil; x = 2`,
+		`local x <const> = 1; function x() end`,
+	}
+	for _, src := range cases {
+		_, err := L.LoadString(src)
+		errorIfFalse(t, err != nil && strings.Contains(err.Error(), "attempt to assign to const variable 'x'"), "%s: unexpected error %v", src, err)
+	}
+	_, err := L.LoadString(`local x <close>, y <close> = nil, nil`)
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "multiple to-be-closed variables"), "unexpected error %v", err)
+	_, err = L.LoadString(`local x <other> = 1`)
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "unknown attribute 'other'"), "unexpected error %v", err)
+
+	L53 := NewState(Options{LanguageVersion: Lua53})
+	defer L53.Close()
+	_, err = L53.LoadString(`local x <const> = 1`)
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "attribute '<const>' is not supported by Lua 5.3"), "unexpected error %v", err)
+}
+
+func TestLua54Close(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua54})
+	defer L.Close()
+	errorIfScriptFail(t, L, closeLogScript)
+	errorIfScriptFail(t, L, `
+	do
+		local a <close> = res("a")
+		local b <close>, c = res("b"), res("c")
+		local n <close>, f = nil
+		local g <close> = false
+	end
+	assert(flush() == "b,a")
+
+	for i = 1, 3 do
+		local x <close> = res("x" .. i)
+		do
+			local y <close> = res("y" .. i)
+			if i == 2 then break end
+		end
+	end
+	assert(flush() == "y1,x1,y2,x2")
+
+	local i = 0
+	::again::
+	do
+		local g <close> = res("g" .. i)
+		i = i + 1
+		if i < 3 then goto again end
+	end
+	assert(flush() == "g0,g1,g2")
+
+	local function f(tail)
+		local v <close> = res("v")
+		if tail then return tail() end
+		return "ret"
+	end
+	assert(f() == "ret" and flush() == "v")
+	assert(f(function() return #log end) == 0 and flush() == "v")
+
+	local kept = setmetatable({}, {__close = function() table.insert(log, "kept") end})
+	local co = coroutine.wrap(function()
+		local k <close> = kept
+		coroutine.yield(1)
+		return 2
+	end)
+	assert(co() == 1 and flush() == "" and co() == 2 and flush() == "kept")
+	`)
+	errorIfScriptNotFail(t, L, `local bad <close> = {}`, "variable 'bad' got a non-closable value")
+}
+
+func TestLua54CloseOnError(t *testing.T) {
+	L := NewState(Options{LanguageVersion: Lua54})
+	defer L.Close()
+	errorIfScriptFail(t, L, closeLogScript)
+	errorIfScriptFail(t, L, `
+	local ok, err = pcall(function()
+		local a <close> = res("a")
+		local function inner()
+			local b <close> = res("b")
+			error("boom", 0)
+		end
+		inner()
+	end)
+	assert(not ok and err == "boom" and flush() == "b!boom,a!boom")
+
+	ok, err = pcall(function()
+		local a <close> = res("a")
+		local b <close> = setmetatable({}, {__close = function() error("in close", 0) end})
+		local c <close> = res("c")
+		error("boom", 0)
+	end)
+	assert(not ok and err == "in close" and flush() == "c!boom,a!in close")
+
+	ok, err = xpcall(function()
+		local a <close> = res("a")
+		error("boom", 0)
+	end, function(e) return "handled " .. e end)
+	assert(not ok and err == "handled boom" and flush() == "a!handled boom")
+	`)
+
+	errorIfScriptFail(t, L, `
+	local get
+	local co = coroutine.wrap(function()
+		local ok, e = pcall(function()
+			local z <close> = res("z")
+			local u = 1
+			get = function() return u end
+			coroutine.yield()
+			u = 2
+			error("x", 0)
+		end)
+		-- reuse the registers of the failed function
+		local function fill() local a, b, c, d, e, f, g, h = 9, 9, 9, 9, 9, 9, 9, 9 end
+		fill()
+		return ok, e, get()
+	end)
+	co()
+	local ok, e, u = co()
+	assert(not ok and e == "x" and u == 2)
+	assert(flush() == "z!x")
+	`)
+
+	err := L.DoString(`local a <close> = res("top") error("failed", 0)`)
+	errorIfFalse(t, err != nil && err.(*ApiError).Object.String() == "failed", "unexpected error %v", err)
+	errorIfScriptFail(t, L, `assert(flush() == "top!failed")`)
+}
+
+func TestLua54PersistClose(t *testing.T) {
+	src := NewState(Options{LanguageVersion: Lua54})
+	defer src.Close()
+	dst := NewState(Options{LanguageVersion: Lua54})
+	defer dst.Close()
+	errorIfScriptFail(t, dst, closeLogScript)
+	errorIfScriptFail(t, src, `
+	local mt = {__close = function(self) table.insert(log, self.name) end}
+	value = coroutine.create(function()
+		local r <close> = setmetatable({name = "r"}, mt)
+		coroutine.yield()
+	end)
+	coroutine.resume(value)
+	`)
+	var buf bytes.Buffer
+	errorIfNotNil(t, Persist(src, src.GetGlobal("value"), &buf, nil))
+	lv, err := Unpersist(dst, &buf, nil)
+	errorIfNotNil(t, err)
+	dst.SetGlobal("value", lv)
+	errorIfScriptFail(t, dst, `
+	assert(coroutine.resume(value))
+	assert(coroutine.status(value) == "dead" and flush() == "r")
+	`)
+}
@@ -0,0 +1,577 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Marshal & Unmarshal {{{ */
+
+// ConversionError is returned by Marshal and Unmarshal. Path locates the
+// offending value, e.g. "servers[3].port"; sequence indices are 1-based like
+// their Lua counterparts. Path is empty for the root value.
+type ConversionError struct {
+	Path string
+	Msg  string
+}
+
+func (e *ConversionError) Error() string {
+	if len(e.Path) == 0 {
+		return e.Msg
+	}
+	return e.Path + ": " + e.Msg
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+type luaTag struct {
+	name      string
+	omitEmpty bool
+}
+
+func parseLuaTag(field reflect.StructField) (luaTag, bool) {
+	tag := luaTag{name: field.Name}
+	str, ok := field.Tag.Lookup("lua")
+	if !ok {
+		return tag, true
+	}
+	name, opts, _ := strings.Cut(str, ",")
+	if name == "-" && len(opts) == 0 {
+		return tag, false
+	}
+	if len(name) > 0 {
+		tag.name = name
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "omitempty" {
+			tag.omitEmpty = true
+		}
+	}
+	return tag, true
+}
+
+func structFields(typ reflect.Type, cb func(field reflect.StructField, tag luaTag)) {
+	for _, field := range reflect.VisibleFields(typ) {
+		if !field.IsExported() || (field.Anonymous && field.Type.Kind() == reflect.Struct) {
+			continue
+		}
+		if tag, ok := parseLuaTag(field); ok {
+			cb(field, tag)
+		}
+	}
+}
+
+func joinPath(path, field string) string {
+	if len(path) == 0 {
+		return field
+	}
+	return path + "." + field
+}
+
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+func keyPath(path string, key reflect.Value) string {
+	if key.Kind() == reflect.String {
+		return joinPath(path, key.String())
+	}
+	return path + "[" + fmt.Sprint(key.Interface()) + "]"
+}
+
+// Marshal converts a Go value to an LValue. Structs and maps become tables
+// keyed by field names (honouring `lua:"name,omitempty"` tags) or map keys,
+// slices and arrays become sequences, pointers and interfaces are followed,
+// time.Duration becomes a number of seconds and LValues are passed through.
+// Pointers to custom data types visible to L become custom data. A pointer,
+// map or slice that contains itself is reported as a ConversionError.
+func Marshal(L *LState, v any) (LValue, error) {
+	m := marshaler{L: L, visiting: make(map[marshalRef]bool)}
+	return m.marshal("", reflect.ValueOf(v))
+}
+
+// marshalRef identifies the pointer, map or slice being converted, so that a
+// value reached again through itself is reported as a cycle.
+type marshalRef struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+type marshaler struct {
+	L        *LState
+	visiting map[marshalRef]bool
+}
+
+// enter marks the reference rv as being converted. It fails if rv is already
+// being converted by an enclosing call.
+func (m *marshaler) enter(path string, rv reflect.Value) (marshalRef, error) {
+	ref := marshalRef{ptr: rv.Pointer(), typ: rv.Type()}
+	if rv.Kind() == reflect.Slice {
+		ref.len = rv.Len()
+	}
+	if m.visiting[ref] {
+		return ref, &ConversionError{path, "encountered a cycle via " + rv.Type().String()}
+	}
+	m.visiting[ref] = true
+	return ref, nil
+}
+
+func (m *marshaler) marshal(path string, rv reflect.Value) (LValue, error) {
+	if !rv.IsValid() {
+		return LNil, nil
+	}
+	switch rv.Type() {
+	case lvalueType:
+		return rv.Interface().(LValue), nil
+	case ltablePtrType, lfuncPtrType, ludataPtrType, lstatePtrType, lgfuncType:
+		return reflectToLValue(m.L, rv), nil
+	case durationType:
+		return LNumber(time.Duration(rv.Int()).Seconds()).AsLValue(), nil
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return LBool(rv.Bool()).AsLValue(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return LInteger(rv.Int()).AsLValue(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return uintToLValue(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return LNumber(rv.Float()).AsLValue(), nil
+	case reflect.String:
+		return LString(rv.String()).AsLValue(), nil
+	case reflect.Interface:
+		return m.marshal(path, rv.Elem())
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return LNil, nil
+		}
+		if _, ok := m.L.customDataEntryOf(reflectTypInfo(rv.Type().Elem())); ok {
+			return reflectToLValue(m.L, rv), nil
+		}
+		ref, err := m.enter(path, rv)
+		if err != nil {
+			return LNil, err
+		}
+		defer delete(m.visiting, ref)
+		return m.marshal(path, rv.Elem())
+	case reflect.Struct:
+		tb := m.L.NewTable()
+		var err error
+		structFields(rv.Type(), func(field reflect.StructField, tag luaTag) {
+			if err != nil {
+				return
+			}
+			fv, ferr := rv.FieldByIndexErr(field.Index)
+			if ferr != nil || (tag.omitEmpty && fv.IsZero()) {
+				return
+			}
+			var lv LValue
+			if lv, err = m.marshal(joinPath(path, tag.name), fv); err == nil {
+				tb.RawSetString(tag.name, lv)
+			}
+		})
+		if err != nil {
+			return LNil, err
+		}
+		return tb.AsLValue(), nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return LNil, nil
+		}
+		ref, err := m.enter(path, rv)
+		if err != nil {
+			return LNil, err
+		}
+		defer delete(m.visiting, ref)
+		tb := m.L.CreateTable(0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			kpath := keyPath(path, iter.Key())
+			key, err := m.marshal(kpath, iter.Key())
+			if err != nil {
+				return LNil, err
+			}
+			switch key.Type() {
+			case LTNumber, LTString, LTBool:
+			default:
+				return LNil, &ConversionError{kpath, "unsupported map key type " + iter.Key().Type().String()}
+			}
+			value, err := m.marshal(kpath, iter.Value())
+			if err != nil {
+				return LNil, err
+			}
+			tb.RawSet(key, value)
+		}
+		return tb.AsLValue(), nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice {
+			if rv.IsNil() {
+				return LNil, nil
+			}
+			if rv.Type().Elem().Kind() == reflect.Uint8 {
+				return LString(rv.Bytes()).AsLValue(), nil
+			}
+			ref, err := m.enter(path, rv)
+			if err != nil {
+				return LNil, err
+			}
+			defer delete(m.visiting, ref)
+		}
+		tb := m.L.CreateTable(rv.Len(), 0)
+		for i := 0; i < rv.Len(); i++ {
+			lv, err := m.marshal(indexPath(path, i+1), rv.Index(i))
+			if err != nil {
+				return LNil, err
+			}
+			tb.RawSetInt(i+1, lv)
+		}
+		return tb.AsLValue(), nil
+	}
+	return LNil, &ConversionError{path, "unsupported type " + rv.Type().String()}
+}
+
+// Unmarshal stores the Lua value lv in the Go value pointed to by v, following
+// the rules of Marshal in reverse. Table fields that have no matching struct
+// field are ignored, and struct fields missing from the table are left
+// untouched. A time.Duration accepts a number of seconds or a string such as
+// "1m30s". Unmarshaling into an empty interface yields nil, bool, int64 or
+// float64, string, []any for sequences, map[string]any for other tables, or
+// the underlying Go value of other types. A table that contains itself is
+// reported as a ConversionError.
+func Unmarshal(lv LValue, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &ConversionError{"", "Unmarshal requires a non-nil pointer"}
+	}
+	u := unmarshaler{visiting: make(map[*LTable]bool)}
+	return u.unmarshal("", lv, rv.Elem())
+}
+
+type unmarshaler struct {
+	visiting map[*LTable]bool
+}
+
+// enter marks tb as being converted. It fails if tb is already being
+// converted by an enclosing call, that is if tb contains itself.
+func (u *unmarshaler) enter(path string, tb *LTable) error {
+	if u.visiting[tb] {
+		return &ConversionError{path, "encountered a cycle via table"}
+	}
+	u.visiting[tb] = true
+	return nil
+}
+
+func unmarshalTypeError(path string, expected string, lv LValue) error {
+	return &ConversionError{path, "expected " + expected + ", got " + lv.Type().String()}
+}
+
+func (u *unmarshaler) unmarshal(path string, lv LValue, rv reflect.Value) error {
+	typ := rv.Type()
+	switch typ {
+	case lvalueType:
+		rv.Set(reflect.ValueOf(lv))
+		return nil
+	case ltablePtrType:
+		if tb, ok := lv.AsLTable(); ok {
+			rv.Set(reflect.ValueOf(tb))
+			return nil
+		}
+		return unmarshalTypeError(path, "table", lv)
+	case lfuncPtrType:
+		if fn, ok := lv.AsLFunction(); ok {
+			rv.Set(reflect.ValueOf(fn))
+			return nil
+		}
+		return unmarshalTypeError(path, "function", lv)
+	case durationType:
+		if n, ok := lv.AsLNumber(); ok {
+			rv.SetInt(int64(float64(n) * float64(time.Second)))
+			return nil
+		}
+		if s, ok := lv.AsLString(); ok {
+			d, err := time.ParseDuration(string(s))
+			if err != nil {
+				return &ConversionError{path, err.Error()}
+			}
+			rv.SetInt(int64(d))
+			return nil
+		}
+		return unmarshalTypeError(path, "number or duration string", lv)
+	}
+
+	if entry, ok := lookupCustomDataEntry(lv.Type()); ok {
+		if typ.Kind() == reflect.Pointer && entry.typInfo == reflectTypInfo(typ.Elem()) {
+			rv.Set(reflect.NewAt(typ.Elem(), lv.dataptr))
+			return nil
+		}
+		if entry.typInfo == reflectTypInfo(typ) {
+			rv.Set(reflect.NewAt(typ, lv.dataptr).Elem())
+			return nil
+		}
+	}
+
+	switch typ.Kind() {
+	case reflect.Bool:
+		if b, ok := lv.AsLBool(); ok {
+			rv.SetBool(bool(b))
+			return nil
+		}
+		return unmarshalTypeError(path, "boolean", lv)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := lv.AsLInteger(); ok {
+			if rv.OverflowInt(int64(i)) {
+				return &ConversionError{path, fmt.Sprintf("number %v does not fit in %v", i, typ)}
+			}
+			rv.SetInt(int64(i))
+			return nil
+		}
+		n, ok := lv.AsLNumber()
+		if !ok {
+			return unmarshalTypeError(path, "number", lv)
+		}
+		if !isInteger(n) || rv.OverflowInt(int64(n)) {
+			return &ConversionError{path, fmt.Sprintf("number %v does not fit in %v", n, typ)}
+		}
+		rv.SetInt(int64(n))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, ok := lv.AsLInteger(); ok {
+			if i < 0 || rv.OverflowUint(uint64(i)) {
+				return &ConversionError{path, fmt.Sprintf("number %v does not fit in %v", i, typ)}
+			}
+			rv.SetUint(uint64(i))
+			return nil
+		}
+		n, ok := lv.AsLNumber()
+		if !ok {
+			return unmarshalTypeError(path, "number", lv)
+		}
+		if !isInteger(n) || n < 0 || rv.OverflowUint(uint64(n)) {
+			return &ConversionError{path, fmt.Sprintf("number %v does not fit in %v", n, typ)}
+		}
+		rv.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		n, ok := lv.AsLNumber()
+		if !ok {
+			return unmarshalTypeError(path, "number", lv)
+		}
+		if typ.Kind() == reflect.Float32 && !math.IsInf(float64(n), 0) && rv.OverflowFloat(float64(n)) {
+			return &ConversionError{path, fmt.Sprintf("number %v does not fit in %v", n, typ)}
+		}
+		rv.SetFloat(float64(n))
+		return nil
+	case reflect.String:
+		if s, ok := lv.AsLString(); ok {
+			rv.SetString(string(s))
+			return nil
+		}
+		return unmarshalTypeError(path, "string", lv)
+	case reflect.Interface:
+		if lv.EqualsLNil() {
+			rv.SetZero()
+			return nil
+		}
+		if typ.NumMethod() == 0 {
+			v, err := u.unmarshalAny(path, lv)
+			if err != nil {
+				return err
+			}
+			rv.Set(reflect.ValueOf(&v).Elem())
+			return nil
+		}
+		var v any = lv.AsAny()
+		if ud, ok := lv.AsLUserData(); ok {
+			v = ud.Value
+		}
+		if v != nil && reflect.TypeOf(v).Implements(typ) {
+			rv.Set(reflect.ValueOf(v))
+			return nil
+		}
+		return unmarshalTypeError(path, typ.String(), lv)
+	case reflect.Pointer:
+		if lv.EqualsLNil() {
+			rv.SetZero()
+			return nil
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.New(typ.Elem()))
+		}
+		return u.unmarshal(path, lv, rv.Elem())
+	case reflect.Struct:
+		tb, ok := lv.AsLTable()
+		if !ok {
+			return unmarshalTypeError(path, "table", lv)
+		}
+		if err := u.enter(path, tb); err != nil {
+			return err
+		}
+		defer delete(u.visiting, tb)
+		var err error
+		structFields(typ, func(field reflect.StructField, tag luaTag) {
+			if err != nil {
+				return
+			}
+			value := tb.RawGetString(tag.name)
+			if value.EqualsLNil() {
+				return
+			}
+			fv, ferr := rv.FieldByIndexErr(field.Index)
+			if ferr != nil {
+				// allocate embedded structs reached through nil pointers
+				fv = rv
+				for _, i := range field.Index {
+					if fv.Kind() == reflect.Pointer {
+						if fv.IsNil() {
+							fv.Set(reflect.New(fv.Type().Elem()))
+						}
+						fv = fv.Elem()
+					}
+					fv = fv.Field(i)
+				}
+			}
+			err = u.unmarshal(joinPath(path, tag.name), value, fv)
+		})
+		return err
+	case reflect.Map:
+		tb, ok := lv.AsLTable()
+		if !ok {
+			return unmarshalTypeError(path, "table", lv)
+		}
+		if err := u.enter(path, tb); err != nil {
+			return err
+		}
+		defer delete(u.visiting, tb)
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(typ))
+		}
+		var err error
+		tb.ForEach(func(key, value LValue) {
+			if err != nil {
+				return
+			}
+			kv := reflect.New(typ.Key()).Elem()
+			if err = u.unmarshal(path, key, kv); err != nil {
+				return
+			}
+			ev := reflect.New(typ.Elem()).Elem()
+			if err = u.unmarshal(keyPath(path, kv), value, ev); err == nil {
+				rv.SetMapIndex(kv, ev)
+			}
+		})
+		return err
+	case reflect.Slice:
+		if lv.EqualsLNil() {
+			rv.SetZero()
+			return nil
+		}
+		if typ.Elem().Kind() == reflect.Uint8 {
+			if s, ok := lv.AsLString(); ok {
+				rv.SetBytes([]byte(s))
+				return nil
+			}
+		}
+		tb, ok := lv.AsLTable()
+		if !ok {
+			return unmarshalTypeError(path, "table", lv)
+		}
+		if err := u.enter(path, tb); err != nil {
+			return err
+		}
+		defer delete(u.visiting, tb)
+		n := tb.Len()
+		slice := reflect.MakeSlice(typ, n, n)
+		for i := 0; i < n; i++ {
+			if err := u.unmarshal(indexPath(path, i+1), tb.RawGetInt(i+1), slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+		return nil
+	case reflect.Array:
+		tb, ok := lv.AsLTable()
+		if !ok {
+			return unmarshalTypeError(path, "table", lv)
+		}
+		if err := u.enter(path, tb); err != nil {
+			return err
+		}
+		defer delete(u.visiting, tb)
+		if n := tb.Len(); n != rv.Len() {
+			return &ConversionError{path, fmt.Sprintf("expected %v elements, got %v", rv.Len(), n)}
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := u.unmarshal(indexPath(path, i+1), tb.RawGetInt(i+1), rv.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return &ConversionError{path, "unsupported type " + typ.String()}
+}
+
+func (u *unmarshaler) unmarshalAny(path string, lv LValue) (any, error) {
+	switch lv.Type() {
+	case LTNil:
+		return nil, nil
+	case LTBool:
+		return bool(lv.MustLBool()), nil
+	case LTNumber:
+		if i, ok := lv.AsLInteger(); ok {
+			return int64(i), nil
+		}
+		return float64(lv.MustLNumber()), nil
+	case LTString:
+		return string(lv.MustLString()), nil
+	case LTTable:
+		tb := lv.MustLTable()
+		if err := u.enter(path, tb); err != nil {
+			return nil, err
+		}
+		defer delete(u.visiting, tb)
+		if n := tb.Len(); n > 0 && n == tb.MaxN() {
+			isSeq := true
+			tb.ForEach(func(key, _ LValue) {
+				if k, ok := key.AsLNumber(); !ok || !isInteger(k) || k < 1 || int(k) > n {
+					isSeq = false
+				}
+			})
+			if isSeq {
+				seq := make([]any, n)
+				for i := range seq {
+					v, err := u.unmarshalAny(indexPath(path, i+1), tb.RawGetInt(i+1))
+					if err != nil {
+						return nil, err
+					}
+					seq[i] = v
+				}
+				return seq, nil
+			}
+		}
+		m := make(map[string]any)
+		var err error
+		tb.ForEach(func(key, value LValue) {
+			if err != nil {
+				return
+			}
+			var v any
+			if v, err = u.unmarshalAny(joinPath(path, key.String()), value); err == nil {
+				m[key.String()] = v
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case LTUserData:
+		return lv.MustLUserData().Value, nil
+	}
+	return lv.AsAny(), nil
+}
+
+/* }}} */
@@ -0,0 +1,156 @@
+package lua
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type marshalServer struct {
+	Host    string        `lua:"host"`
+	Port    int           `lua:"port"`
+	Timeout time.Duration `lua:"timeout,omitempty"`
+	Tags    []string      `lua:"tags,omitempty"`
+}
+
+type marshalConfig struct {
+	Name    string            `lua:"name"`
+	Servers []*marshalServer  `lua:"servers"`
+	Env     map[string]string `lua:"env"`
+	Hook    LValue            `lua:"hook"`
+	Extra   any               `lua:"extra"`
+	Secret  string            `lua:"-"`
+}
+
+func TestMarshal(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	cfg := &marshalConfig{
+		Name: "prod",
+		Servers: []*marshalServer{
+			{Host: "a", Port: 80, Timeout: 1500 * time.Millisecond},
+			{Host: "b", Port: 81},
+		},
+		Env:    map[string]string{"k": "v"},
+		Hook:   L.NewFunction(func(L *LState) int { return 0 }).AsLValue(),
+		Secret: "s",
+	}
+	lv, err := Marshal(L, cfg)
+	errorIfNotNil(t, err)
+	L.SetGlobal("cfg", lv)
+	errorIfScriptFail(t, L, `
+	assert(cfg.name == "prod")
+	assert(#cfg.servers == 2)
+	assert(cfg.servers[1].host == "a" and cfg.servers[1].port == 80)
+	assert(cfg.servers[1].timeout == 1.5)
+	assert(cfg.servers[2].timeout == nil)
+	assert(cfg.servers[2].tags == nil)
+	assert(cfg.env.k == "v")
+	assert(type(cfg.hook) == "function")
+	assert(cfg.Secret == nil)
+	`)
+
+	type node struct{ Next *node }
+	n := &node{}
+	n.Next = n
+	_, err = Marshal(L, n)
+	errorIfNil(t, err)
+	m := map[string]any{}
+	m["self"] = m
+	_, err = Marshal(L, m)
+	errorIfNotEqual(t, "self: encountered a cycle via map[string]interface {}", err.Error())
+	s := []any{nil}
+	s[0] = s
+	_, err = Marshal(L, s)
+	errorIfNotEqual(t, "[1]: encountered a cycle via []interface {}", err.Error())
+	shared := []int{1}
+	_, err = Marshal(L, [][]int{shared, shared})
+	errorIfNotNil(t, err)
+	_, err = Marshal(L, map[string]any{"f": make(chan int)})
+	errorIfNotEqual(t, "f: unsupported type chan int", err.Error())
+}
+
+func TestUnmarshal(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	cfg = {
+		name = "prod",
+		servers = {
+			{host = "a", port = 80, timeout = 1.5, tags = {"x", "y"}},
+			{host = "b", port = 81, timeout = "2m"},
+		},
+		env = {k = "v"},
+		hook = print,
+		extra = {1, 2.5, {a = true}},
+		unknown = 1,
+	}
+	`)
+	var cfg marshalConfig
+	errorIfNotNil(t, Unmarshal(L.GetGlobal("cfg"), &cfg))
+	errorIfNotEqual(t, "prod", cfg.Name)
+	errorIfNotEqual(t, 2, len(cfg.Servers))
+	want := marshalServer{Host: "a", Port: 80, Timeout: 1500 * time.Millisecond, Tags: []string{"x", "y"}}
+	errorIfFalse(t, reflect.DeepEqual(want, *cfg.Servers[0]), "unexpected server: %v", *cfg.Servers[0])
+	errorIfNotEqual(t, 2*time.Minute, cfg.Servers[1].Timeout)
+	errorIfNotEqual(t, "v", cfg.Env["k"])
+	errorIfFalse(t, cfg.Hook.Type() == LTFunction, "hook should be a function")
+	errorIfFalse(t, reflect.DeepEqual([]any{int64(1), 2.5, map[string]any{"a": true}}, cfg.Extra), "unexpected extra: %v", cfg.Extra)
+
+	errorIfScriptFail(t, L, `cfg.servers[2].port = "x"`)
+	err := Unmarshal(L.GetGlobal("cfg"), &cfg)
+	errorIfNotEqual(t, "servers[2].port: expected number, got string", err.Error())
+	errorIfScriptFail(t, L, `cfg.servers[2].port = 1.5`)
+	err = Unmarshal(L.GetGlobal("cfg"), &cfg)
+	errorIfNotEqual(t, "servers[2].port: number 1.5 does not fit in int", err.Error())
+	errorIfScriptFail(t, L, `cfg.servers[2].port = 70000; cfg.env.k = 1`)
+	var small struct {
+		Env map[string]string `lua:"env"`
+	}
+	err = Unmarshal(L.GetGlobal("cfg"), &small)
+	errorIfNotEqual(t, "env.k: expected string, got number", err.Error())
+	errorIfNil(t, Unmarshal(L.GetGlobal("cfg"), nil))
+}
+
+func TestUnmarshalCycle(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	t = {name = "a", list = {}}
+	t.self = t
+	t.list[1] = t.list
+	shared = {1}
+	dag = {shared, shared}
+	`)
+	var v any
+	err := Unmarshal(L.GetGlobal("t"), &v)
+	errorIfFalse(t, err != nil && err.(*ConversionError).Msg == "encountered a cycle via table", "unexpected error: %v", err)
+
+	type node struct {
+		Name string `lua:"name"`
+		Self *node  `lua:"self"`
+	}
+	var n node
+	err = Unmarshal(L.GetGlobal("t"), &n)
+	errorIfNotEqual(t, "self: encountered a cycle via table", err.Error())
+	var lists struct {
+		List [][]any `lua:"list"`
+	}
+	err = Unmarshal(L.GetGlobal("t"), &lists)
+	errorIfNotEqual(t, "list[1]: encountered a cycle via table", err.Error())
+
+	var dag [][]int
+	errorIfNotNil(t, Unmarshal(L.GetGlobal("dag"), &dag))
+	errorIfFalse(t, reflect.DeepEqual([][]int{{1}, {1}}, dag), "unexpected value: %v", dag)
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	in := marshalServer{Host: "h", Port: 8080, Timeout: time.Second, Tags: []string{"a"}}
+	lv, err := Marshal(L, in)
+	errorIfNotNil(t, err)
+	var out marshalServer
+	errorIfNotNil(t, Unmarshal(lv, &out))
+	errorIfFalse(t, reflect.DeepEqual(in, out), "round trip mismatch: %v != %v", in, out)
+}
@@ -9,6 +9,8 @@ func OpenMath(L *LState) int {
 	mod := L.RegisterModule(MathLibName, mathFuncs).MustLTable()
 	mod.RawSetString("pi", LNumber(math.Pi).AsLValue())
 	mod.RawSetString("huge", LNumber(math.MaxFloat64).AsLValue())
+	mod.RawSetString("maxinteger", LInteger(math.MaxInt64).AsLValue())
+	mod.RawSetString("mininteger", LInteger(math.MinInt64).AsLValue())
 	L.Push(mod.AsLValue())
 	return 1
 }
@@ -43,10 +45,44 @@ var mathFuncs = map[string]LGFunction{
 	"sqrt":       mathSqrt,
 	"tan":        mathTan,
 	"tanh":       mathTanh,
+	"tointeger":  mathToInteger,
+	"type":       mathType,
+}
+
+// checkNumberValue is like CheckNumber but keeps the integer subtype.
+func checkNumberValue(L *LState, n int) LValue {
+	v := L.Get(n)
+	if v.isNumber() {
+		return v
+	}
+	if s, ok := v.AsLString(); ok {
+		if num, err := parseNumberValue(string(s)); err == nil {
+			return num
+		}
+	}
+	L.TypeError(n, LTNumber)
+	return LNil
+}
+
+// pushIntegral pushes f as an integer if it fits, otherwise as a float.
+func pushIntegral(L *LState, f float64) {
+	if i, ok := floatToInteger(f); ok {
+		L.Push(LInteger(i).AsLValue())
+	} else {
+		L.Push(LNumber(f).AsLValue())
+	}
 }
 
 func mathAbs(L *LState) int {
-	L.Push(LNumber(math.Abs(float64(L.CheckNumber(1)))).AsLValue())
+	v := checkNumberValue(L, 1)
+	if i, ok := v.AsLInteger(); ok && (i != math.MinInt64 || L.Options.LanguageVersion >= Lua53) {
+		if i < 0 {
+			i = -i
+		}
+		L.Push(i.AsLValue())
+		return 1
+	}
+	L.Push(LNumber(math.Abs(float64(LVAsNumber(v)))).AsLValue())
 	return 1
 }
 
@@ -71,7 +107,12 @@ func mathAtan2(L *LState) int {
 }
 
 func mathCeil(L *LState) int {
-	L.Push(LNumber(math.Ceil(float64(L.CheckNumber(1)))).AsLValue())
+	v := checkNumberValue(L, 1)
+	if v.isLInteger() {
+		L.Push(v)
+		return 1
+	}
+	pushIntegral(L, math.Ceil(float64(LVAsNumber(v))))
 	return 1
 }
 
@@ -96,7 +137,12 @@ func mathExp(L *LState) int {
 }
 
 func mathFloor(L *LState) int {
-	L.Push(LNumber(math.Floor(float64(L.CheckNumber(1)))).AsLValue())
+	v := checkNumberValue(L, 1)
+	if v.isLInteger() {
+		L.Push(v)
+		return 1
+	}
+	pushIntegral(L, math.Floor(float64(LVAsNumber(v))))
 	return 1
 }
 
@@ -131,15 +177,15 @@ func mathMax(L *LState) int {
 	if L.GetTop() == 0 {
 		L.RaiseError("wrong number of arguments")
 	}
-	max := L.CheckNumber(1)
+	max := checkNumberValue(L, 1)
 	top := L.GetTop()
 	for i := 2; i <= top; i++ {
-		v := L.CheckNumber(i)
-		if v > max {
+		v := checkNumberValue(L, i)
+		if numberLessThan(max, v) {
 			max = v
 		}
 	}
-	L.Push(max.AsLValue())
+	L.Push(max)
 	return 1
 }
 
@@ -147,22 +193,22 @@ func mathMin(L *LState) int {
 	if L.GetTop() == 0 {
 		L.RaiseError("wrong number of arguments")
 	}
-	min := L.CheckNumber(1)
+	min := checkNumberValue(L, 1)
 	top := L.GetTop()
 	for i := 2; i <= top; i++ {
-		v := L.CheckNumber(i)
-		if v < min {
+		v := checkNumberValue(L, i)
+		if numberLessThan(v, min) {
 			min = v
 		}
 	}
-	L.Push(min.AsLValue())
+	L.Push(min)
 	return 1
 }
 
 func mathMod(L *LState) int {
-	lhs := L.CheckNumber(1)
-	rhs := L.CheckNumber(2)
-	L.Push(luaModulo(lhs, rhs).AsLValue())
+	lhs := checkNumberValue(L, 1)
+	rhs := checkNumberValue(L, 2)
+	L.Push(numberArith(OP_MOD, lhs, rhs, L.Options.LanguageVersion >= Lua53))
 	return 1
 }
 
@@ -189,11 +235,11 @@ func mathRandom(L *LState) int {
 		L.Push(LNumber(rand.Float64()).AsLValue())
 	case 1:
 		n := L.CheckInt(1)
-		L.Push(LNumber(rand.Intn(n) + 1).AsLValue())
+		L.Push(LInteger(rand.Intn(n) + 1).AsLValue())
 	default:
 		min := L.CheckInt(1)
 		max := L.CheckInt(2) + 1
-		L.Push(LNumber(rand.Intn(max-min) + min).AsLValue())
+		L.Push(LInteger(rand.Intn(max-min) + min).AsLValue())
 	}
 	return 1
 }
@@ -228,4 +274,33 @@ func mathTanh(L *LState) int {
 	return 1
 }
 
+func mathToInteger(L *LState) int {
+	v := L.CheckAny(1)
+	if v.isLInteger() {
+		L.Push(v)
+	} else if n, ok := v.AsLNumber(); ok {
+		if i, ok := floatToInteger(float64(n)); ok {
+			L.Push(LInteger(i).AsLValue())
+		} else {
+			L.Push(LNil)
+		}
+	} else {
+		L.Push(LNil)
+	}
+	return 1
+}
+
+func mathType(L *LState) int {
+	v := L.CheckAny(1)
+	switch {
+	case v.isLInteger():
+		L.Push(LString("integer").AsLValue())
+	case v.isNumber():
+		L.Push(LString("float").AsLValue())
+	default:
+		L.Push(LNil)
+	}
+	return 1
+}
+
 //
@@ -0,0 +1,265 @@
+package lua
+
+import (
+	"unsafe"
+)
+
+/* memory quota {{{ */
+
+const errNotEnoughMemory = "not enough memory"
+
+// memMeasureRatio is the fraction of the limit, as a divisor, that must be
+// charged between two measurements triggered by the limit.
+const memMeasureRatio = 8
+
+// Estimated sizes, in bytes, charged to the memory quota of a state. They
+// approximate what the Go runtime allocates for each object, ignoring size
+// classes and map load factors.
+const (
+	memTableSize    = int(unsafe.Sizeof(LTable{}))
+	memArrayEntry   = int(unsafe.Sizeof(LValue{}))
+	memHashEntry    = int(unsafe.Sizeof(ltableSlot{})) + 2*int(unsafe.Sizeof(uintptr(0)))
+	memStringHeader = int(unsafe.Sizeof(""))
+	memFunctionSize = int(unsafe.Sizeof(LFunction{}))
+	memUpvalueSize  = int(unsafe.Sizeof(Upvalue{})) + int(unsafe.Sizeof(uintptr(0)))
+	memUserDataSize = int(unsafe.Sizeof(LUserData{}))
+	memThreadSize   = int(unsafe.Sizeof(LState{})) + int(unsafe.Sizeof(registry{}))
+)
+
+// memQuota accounts the memory allocated by the states sharing a Global.
+// Every allocation made by the VM and the standard libraries is charged to
+// it. As the Go garbage collector does not report what it frees, the usage
+// only grows until it is measured again by walking the objects reachable
+// from the state, which happens on collectgarbage() and when the limit is
+// exceeded.
+//
+// A measurement walks every live object, so once the limit has been exceeded
+// the next one only happens after a further limit/memMeasureRatio bytes have
+// been charged. Allocations over the limit fail in between, even if enough
+// garbage could be reclaimed, unless collectgarbage() is called. This keeps
+// the cost of the walks proportional to the amount allocated when a script
+// runs close to its limit.
+type memQuota struct {
+	g         *Global
+	used      int64
+	limit     int64
+	charged   int64 // bytes charged since the last measurement
+	measures  int   // number of measurements, for tests
+	measuring bool
+}
+
+// charge accounts n bytes, raising a "not enough memory" error if they do
+// not fit in the limit. The error is raised on the current thread like any
+// other Lua error: outside a protected call, such as when the host calls
+// LState.NewTable directly, it panics with an *ApiError.
+func (q *memQuota) charge(n int) {
+	if !q.reserve(n) {
+		q.g.CurrentThread.raiseError(0, errNotEnoughMemory)
+	}
+}
+
+func (q *memQuota) chargeString(n int) {
+	q.charge(n + memStringHeader)
+}
+
+// reserve accounts n bytes and reports whether they fit in the limit. If
+// they do not, nothing is accounted.
+func (q *memQuota) reserve(n int) bool {
+	q.used += int64(n)
+	q.charged += int64(n)
+	if q.limit <= 0 || q.used <= q.limit || q.measuring {
+		return true
+	}
+	if q.charged >= q.limit/memMeasureRatio {
+		q.remeasure()
+		q.used += int64(n)
+		if q.used <= q.limit {
+			return true
+		}
+	}
+	q.used -= int64(n)
+	return false
+}
+
+// remeasure sets the usage to the measured size of the live objects.
+func (q *memQuota) remeasure() {
+	q.used = q.measure()
+	q.charged = 0
+	q.measures++
+}
+
+// newTable creates a table whose growth is charged to q.
+func (q *memQuota) newTable(acap, hcap int) *LTable {
+	q.charge(memTableSize)
+	tb := newLTable(acap, hcap)
+	tb.mem = q
+	return tb
+}
+
+func (tb *LTable) chargeArray(n int) {
+	if tb.mem != nil {
+		tb.mem.charge(n * memArrayEntry)
+	}
+}
+
+func (tb *LTable) chargeHash() {
+	if tb.mem != nil {
+		tb.mem.charge(memHashEntry)
+	}
+}
+
+// measure returns the estimated size of the objects reachable from the
+// state.
+func (q *memQuota) measure() int64 {
+	q.measuring = true
+	defer func() { q.measuring = false }()
+	w := memWalker{seen: make(map[unsafe.Pointer]struct{})}
+	g := q.g
+	w.table(g.Registry)
+	w.table(g.Global)
+	for _, mt := range g.builtinMts {
+		w.value(mt)
+	}
+	if g.MainThread != nil {
+		w.thread(g.MainThread)
+	}
+	if g.CurrentThread != nil {
+		w.thread(g.CurrentThread)
+	}
+	return w.size
+}
+
+type memWalker struct {
+	seen map[unsafe.Pointer]struct{}
+	size int64
+}
+
+func (w *memWalker) visit(ptr unsafe.Pointer) bool {
+	if ptr == nil {
+		return false
+	}
+	if _, ok := w.seen[ptr]; ok {
+		return false
+	}
+	w.seen[ptr] = struct{}{}
+	return true
+}
+
+func (w *memWalker) value(lv LValue) {
+	if lv.isNumber() {
+		return
+	}
+	switch lv.Type() {
+	case LTString:
+		if w.visit(lv.dataptr) {
+			w.size += int64(lv.data) + int64(memStringHeader)
+		}
+	case LTTable:
+		w.table(lv.MustLTable())
+	case LTFunction:
+		w.function(lv.MustLFunction())
+	case LTUserData:
+		ud := lv.MustLUserData()
+		if w.visit(unsafe.Pointer(ud)) {
+			w.size += int64(memUserDataSize)
+			w.table(ud.Env)
+			w.value(ud.Metatable)
+		}
+	case LTThread:
+		w.thread(lv.MustLState())
+	}
+}
+
+func (w *memWalker) table(tb *LTable) {
+	if tb == nil || !w.visit(unsafe.Pointer(tb)) {
+		return
+	}
+	w.size += int64(memTableSize + len(tb.array)*memArrayEntry + (len(tb.strdict)+len(tb.dict))*memHashEntry)
+	w.value(tb.Metatable)
+	tb.ForEach(func(key, value LValue) {
+		w.value(key)
+		w.value(value)
+	})
+}
+
+func (w *memWalker) function(fn *LFunction) {
+	if fn == nil || !w.visit(unsafe.Pointer(fn)) {
+		return
+	}
+	w.size += int64(memFunctionSize + len(fn.Upvalues)*memUpvalueSize)
+	w.table(fn.Env)
+	for _, uv := range fn.Upvalues {
+		if uv != nil {
+			w.value(uv.Value())
+		}
+	}
+	w.proto(fn.Proto)
+}
+
+func (w *memWalker) proto(proto *FunctionProto) {
+	if proto == nil || !w.visit(unsafe.Pointer(proto)) {
+		return
+	}
+	w.size += int64(protoSize(proto))
+	for _, c := range proto.Constants {
+		w.value(c)
+	}
+	for _, p := range proto.FunctionPrototypes {
+		w.proto(p)
+	}
+}
+
+func (w *memWalker) thread(ls *LState) {
+	if !w.visit(unsafe.Pointer(ls)) {
+		return
+	}
+	w.size += int64(memThreadSize + len(ls.reg.array)*memArrayEntry)
+	w.table(ls.Env)
+	for _, lv := range ls.reg.array[:ls.reg.top] {
+		w.value(lv)
+	}
+	if ls.stack != nil {
+		for i := 0; i < ls.stack.Sp(); i++ {
+			w.function(ls.stack.At(i).Fn)
+		}
+	}
+}
+
+// protoSize returns the size of a compiled function without its constants
+// and nested functions.
+func protoSize(proto *FunctionProto) int {
+	return int(unsafe.Sizeof(*proto)) + len(proto.Code)*4 + len(proto.Constants)*memArrayEntry +
+		len(proto.DbgSourcePositions)*int(unsafe.Sizeof(0)) + len(proto.DbgLocals)*int(unsafe.Sizeof(DbgLocalInfo{})) +
+		len(proto.DbgCalls)*int(unsafe.Sizeof(DbgCall{}))
+}
+
+// chunkSize returns the size of a compiled chunk including its nested
+// functions.
+func chunkSize(proto *FunctionProto) int {
+	size := protoSize(proto)
+	for _, p := range proto.FunctionPrototypes {
+		size += chunkSize(p)
+	}
+	return size
+}
+
+// SetMemoryLimit sets the maximum number of bytes the states sharing this
+// state's Global may allocate. Allocations beyond it raise a "not enough
+// memory" error. A limit of 0 disables the quota.
+//
+// Allocations made by the host through the LState API are charged as well;
+// outside a protected call, the error panics with an *ApiError. Host code
+// that may run close to the limit should allocate from a Go function called
+// with PCall.
+func (ls *LState) SetMemoryLimit(limit int) {
+	ls.G.mem.limit = int64(limit)
+}
+
+// MemoryUsage returns the number of bytes the states sharing this state's
+// Global are accounted for. It includes garbage allocated since the last
+// collectgarbage().
+func (ls *LState) MemoryUsage() int {
+	return int(ls.G.mem.used)
+}
+
+/* }}} */
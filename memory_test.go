@@ -0,0 +1,92 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 4 << 20})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local ok, err = pcall(function()
+		local t = {}
+		for i = 1, 1e7 do t[i] = {} end
+	end)
+	assert(not ok and err == "not enough memory", err)
+	collectgarbage()
+
+	ok, err = pcall(string.rep, "x", 1e9)
+	assert(not ok and err == "not enough memory", err)
+
+	ok, err = pcall(function()
+		local s = "x"
+		while true do s = s .. s end
+	end)
+	assert(not ok and err == "not enough memory", err)
+
+	local t = {}
+	for i = 1, 1000 do t[i] = tostring(i) end
+	assert(#t == 1000)
+	`)
+
+	L.SetMemoryLimit(0)
+	errorIfScriptFail(t, L, `local s = string.rep("x", 8 * 1024 * 1024)`)
+}
+
+func TestMemoryUsage(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `collectgarbage()`)
+	base := L.MemoryUsage()
+	errorIfFalse(t, base > 0, "usage should be positive, got %d", base)
+	errorIfScriptFail(t, L, `
+	big = {}
+	for i = 1, 10000 do big[i] = {i} end
+	collectgarbage()
+	`)
+	errorIfFalse(t, L.MemoryUsage() > base+10000*memTableSize, "usage did not grow: %d", L.MemoryUsage())
+	errorIfScriptFail(t, L, `
+	local kb = collectgarbage("count")
+	big = nil
+	collectgarbage()
+	assert(collectgarbage("count") < kb)
+	`)
+	errorIfFalse(t, L.MemoryUsage() < base+10000*memTableSize, "usage did not shrink: %d", L.MemoryUsage())
+}
+
+func TestMemoryLimitMeasurements(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 1 << 20})
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	keep = {}
+	local ok = pcall(function()
+		for i = 1, 1e6 do keep[i] = {} end
+	end)
+	assert(not ok)
+	for i = #keep, #keep - 100, -1 do keep[i] = nil end
+	collectgarbage()
+	local f = function() local t = {} end
+	local succeeded = 0
+	for i = 1, 20000 do
+		if pcall(f) then succeeded = succeeded + 1 end
+	end
+	assert(succeeded > 0)
+	`)
+	errorIfFalse(t, L.G.mem.measures < 50, "too many measurements: %d", L.G.mem.measures)
+}
+
+func TestMemoryLimitHost(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 1 << 20})
+	defer L.Close()
+	L.Push(L.NewFunction(func(L *LState) int {
+		keep := L.NewTable()
+		L.SetGlobal("keep", keep.AsLValue())
+		for {
+			keep.Append(L.NewTable().AsLValue())
+		}
+	}).AsLValue())
+	err := L.PCall(0, 0, nil)
+	errorIfNil(t, err)
+	errorIfFalse(t, strings.Contains(err.Error(), "not enough memory"), "unexpected error: %v", err)
+}
@@ -67,6 +67,14 @@ const (
 	OP_NOT /*       A B     R(A) := not R(B)                                */
 	OP_LEN /*       A B     R(A) := length of R(B)                          */
 
+	OP_IDIV /*      A B C   R(A) := RK(B) // RK(C)                          */
+	OP_BAND /*      A B C   R(A) := RK(B) & RK(C)                           */
+	OP_BOR  /*      A B C   R(A) := RK(B) | RK(C)                           */
+	OP_BXOR /*      A B C   R(A) := RK(B) ~ RK(C)                           */
+	OP_SHL  /*      A B C   R(A) := RK(B) << RK(C)                          */
+	OP_SHR  /*      A B C   R(A) := RK(B) >> RK(C)                          */
+	OP_BNOT /*      A B     R(A) := ~R(B)                                   */
+
 	OP_CONCAT /*    A B C   R(A) := R(B).. ... ..R(C)                       */
 
 	OP_JMP /*       sBx     pc+=sBx                                 */
@@ -95,6 +103,8 @@ const (
 
 	OP_VARARG /*     A B     R(A) R(A+1) ... R(A+B-1) = vararg            */
 
+	OP_TBC /*        A       mark R(A) as a to-be-closed variable         */
+
 	OP_NOP /* NOP */
 )
 const opCodeMax = OP_NOP
@@ -150,6 +160,13 @@ var opProps = []opProp{
 	{"UNM", false, true, opArgModeR, opArgModeN, opTypeABC},
 	{"NOT", false, true, opArgModeR, opArgModeN, opTypeABC},
 	{"LEN", false, true, opArgModeR, opArgModeN, opTypeABC},
+	{"IDIV", false, true, opArgModeK, opArgModeK, opTypeABC},
+	{"BAND", false, true, opArgModeK, opArgModeK, opTypeABC},
+	{"BOR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	{"BXOR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	{"SHL", false, true, opArgModeK, opArgModeK, opTypeABC},
+	{"SHR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	{"BNOT", false, true, opArgModeR, opArgModeN, opTypeABC},
 	{"CONCAT", false, true, opArgModeR, opArgModeR, opTypeABC},
 	{"JMP", false, false, opArgModeR, opArgModeN, opTypeASbx},
 	{"EQ", true, false, opArgModeK, opArgModeK, opTypeABC},
@@ -167,6 +184,7 @@ var opProps = []opProp{
 	{"CLOSE", false, false, opArgModeN, opArgModeN, opTypeABC},
 	{"CLOSURE", false, true, opArgModeU, opArgModeN, opTypeABx},
 	{"VARARG", false, true, opArgModeU, opArgModeN, opTypeABC},
+	{"TBC", false, false, opArgModeN, opArgModeN, opTypeABC},
 	{"NOP", false, false, opArgModeR, opArgModeN, opTypeASbx},
 }
 
@@ -250,7 +268,6 @@ func opIsK(value int) bool {
 	return bool((value & opBitRk) != 0)
 }
 
-//lint:ignore U1000 Keep it
 func opIndexK(value int) int {
 	return value & ^opBitRk
 }
@@ -331,6 +348,20 @@ func opToString(inst uint32) string {
 		buf += fmt.Sprintf("; R(%v) := not R(%v)", arga, argb)
 	case OP_LEN:
 		buf += fmt.Sprintf("; R(%v) := length of R(%v)", arga, argb)
+	case OP_IDIV:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) // RK(%v)", arga, argb, argc)
+	case OP_BAND:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) & RK(%v)", arga, argb, argc)
+	case OP_BOR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) | RK(%v)", arga, argb, argc)
+	case OP_BXOR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) ~ RK(%v)", arga, argb, argc)
+	case OP_SHL:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) << RK(%v)", arga, argb, argc)
+	case OP_SHR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) >> RK(%v)", arga, argb, argc)
+	case OP_BNOT:
+		buf += fmt.Sprintf("; R(%v) := ~R(%v)", arga, argb)
 	case OP_CONCAT:
 		buf += fmt.Sprintf("; R(%v) := R(%v).. ... ..R(%v)", arga, argb, argc)
 	case OP_JMP:
@@ -365,6 +396,8 @@ func opToString(inst uint32) string {
 		buf += fmt.Sprintf("; R(%v) := closure(KPROTO[%v] R(%v) ... R(%v+n))", arga, argbx, arga, arga)
 	case OP_VARARG:
 		buf += fmt.Sprintf(";  R(%v) R(%v+1) ... R(%v+%v-1) = vararg", arga, arga, arga, argb)
+	case OP_TBC:
+		buf += fmt.Sprintf("; mark R(%v) as a to-be-closed variable", arga)
 	case OP_NOP:
 		/* nothing to do */
 	}
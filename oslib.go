@@ -121,15 +121,15 @@ func osDate(L *LState) int {
 		}
 		if strings.HasPrefix(cfmt, "*t") {
 			ret := L.NewTable()
-			ret.RawSetString("year", LNumber(t.Year()).AsLValue())
-			ret.RawSetString("month", LNumber(t.Month()).AsLValue())
-			ret.RawSetString("day", LNumber(t.Day()).AsLValue())
-			ret.RawSetString("hour", LNumber(t.Hour()).AsLValue())
-			ret.RawSetString("min", LNumber(t.Minute()).AsLValue())
-			ret.RawSetString("sec", LNumber(t.Second()).AsLValue())
-			ret.RawSetString("wday", LNumber(t.Weekday()+1).AsLValue())
+			ret.RawSetString("year", LInteger(t.Year()).AsLValue())
+			ret.RawSetString("month", LInteger(t.Month()).AsLValue())
+			ret.RawSetString("day", LInteger(t.Day()).AsLValue())
+			ret.RawSetString("hour", LInteger(t.Hour()).AsLValue())
+			ret.RawSetString("min", LInteger(t.Minute()).AsLValue())
+			ret.RawSetString("sec", LInteger(t.Second()).AsLValue())
+			ret.RawSetString("wday", LInteger(t.Weekday()+1).AsLValue())
 			// TODO yday & dst
-			ret.RawSetString("yday", LNumber(0).AsLValue())
+			ret.RawSetString("yday", LInteger(0).AsLValue())
 			ret.RawSetString("isdst", LFalse.AsLValue())
 			L.Push(ret.AsLValue())
 			return 1
@@ -193,11 +193,11 @@ func osSetEnv(L *LState) int {
 
 func osTime(L *LState) int {
 	if L.GetTop() == 0 {
-		L.Push(LNumber(time.Now().Unix()).AsLValue())
+		L.Push(LInteger(time.Now().Unix()).AsLValue())
 	} else {
 		lv := L.CheckAny(1)
 		if lv.EqualsLNil() {
-			L.Push(LNumber(time.Now().Unix()).AsLValue())
+			L.Push(LInteger(time.Now().Unix()).AsLValue())
 		} else {
 			tbl, ok := lv.AsLTable()
 			if !ok {
@@ -215,7 +215,7 @@ func osTime(L *LState) int {
 			if false {
 				print(isdst)
 			}
-			L.Push(LNumber(t.Unix()).AsLValue())
+			L.Push(LInteger(t.Unix()).AsLValue())
 		}
 	}
 	return 1
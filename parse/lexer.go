@@ -369,13 +369,18 @@ redo:
 				tok.Str = "~="
 				sc.Next()
 			} else {
-				err = sc.Error("~", "Invalid '~' token")
+				tok.Type = ch
+				tok.Str = string(rune(ch))
 			}
 		case '<':
 			if sc.Peek() == '=' {
 				tok.Type = TLte
 				tok.Str = "<="
 				sc.Next()
+			} else if sc.Peek() == '<' {
+				tok.Type = TShl
+				tok.Str = "<<"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(rune(ch))
@@ -385,6 +390,10 @@ redo:
 				tok.Type = TGte
 				tok.Str = ">="
 				sc.Next()
+			} else if sc.Peek() == '>' {
+				tok.Type = TShr
+				tok.Str = ">>"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(rune(ch))
@@ -418,7 +427,16 @@ redo:
 				tok.Type = ch
 				tok.Str = string(rune(ch))
 			}
-		case '+', '*', '/', '%', '^', '#', '(', ')', '{', '}', ']', ';', ',':
+		case '/':
+			if sc.Peek() == '/' {
+				tok.Type = TIdiv
+				tok.Str = "//"
+				sc.Next()
+			} else {
+				tok.Type = ch
+				tok.Str = string(rune(ch))
+			}
+		case '+', '*', '%', '^', '#', '&', '|', '(', ')', '{', '}', ']', ';', ',':
 			tok.Type = ch
 			tok.Str = string(rune(ch))
 		default:
@@ -16,6 +16,8 @@ import (
 %type<exprlist> varlist
 %type<expr> var
 %type<namelist> namelist
+%type<localstmt> attnamelist
+%type<attrib> attrib
 %type<exprlist> exprlist
 %type<expr> expr
 %type<expr> string
@@ -49,6 +51,9 @@ import (
 
   namelist []string
   parlist  *ast.ParList
+
+  localstmt *ast.LocalAssignStmt
+  attrib    string
 }
 
 /* Reserved words */
@@ -56,15 +61,20 @@ import (
 
 /* Literals */
 %token<token> TEqeq TNeq TLte TGte T2Comma T3Comma T2Colon TIdent TNumber TString '{' '('
+%token<token> TShl TShr TIdiv
 
 /* Operators */
 %left TOr
 %left TAnd
 %left '>' '<' TGte TLte TEqeq TNeq
+%left '|'
+%left '~'
+%left '&'
+%left TShl TShr
 %right T2Comma
 %left '+' '-'
-%left '*' '/' '%'
-%right UNARY /* not # -(unary) */
+%left '*' '/' TIdiv '%'
+%right UNARY /* not # -(unary) ~(unary) */
 %right '^'
 
 %%
@@ -180,12 +190,14 @@ stat:
             $$.SetLine($1.Pos.Line)
             $$.SetLastLine($4.LastLine())
         } | 
-        TLocal namelist '=' exprlist {
-            $$ = &ast.LocalAssignStmt{Names: $2, Exprs:$4}
+        TLocal attnamelist '=' exprlist {
+            $2.Exprs = $4
+            $$ = $2
             $$.SetLine($1.Pos.Line)
         } |
-        TLocal namelist {
-            $$ = &ast.LocalAssignStmt{Names: $2, Exprs:[]ast.Expr{}}
+        TLocal attnamelist {
+            $2.Exprs = []ast.Expr{}
+            $$ = $2
             $$.SetLine($1.Pos.Line)
         } |
         T2Colon TIdent T2Colon {
@@ -273,6 +285,27 @@ namelist:
             $$ = append($1, $3.Str)
         }
 
+attnamelist:
+        TIdent attrib {
+            $$ = &ast.LocalAssignStmt{Names: []string{$1.Str}, Attribs: []string{$2}}
+        } |
+        attnamelist ',' TIdent attrib {
+            $$ = $1
+            $$.Names = append($$.Names, $3.Str)
+            $$.Attribs = append($$.Attribs, $4)
+        }
+
+attrib:
+        {
+            $$ = ""
+        } |
+        '<' TIdent '>' {
+            if $2.Str != "const" && $2.Str != "close" {
+                yylex.(*Lexer).TokenError($2, "unknown attribute '" + $2.Str + "'")
+            }
+            $$ = $2.Str
+        }
+
 exprlist:
         expr {
             $$ = []ast.Expr{$1}
@@ -366,6 +399,10 @@ expr:
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "/", Rhs: $3}
             $$.SetLine($1.Line())
         } |
+        expr TIdiv expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "//", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
         expr '%' expr {
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "%", Rhs: $3}
             $$.SetLine($1.Line())
@@ -374,6 +411,26 @@ expr:
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "^", Rhs: $3}
             $$.SetLine($1.Line())
         } |
+        expr '&' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "&", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr '|' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "|", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr '~' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "~", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr TShl expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "<<", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
+        expr TShr expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: ">>", Rhs: $3}
+            $$.SetLine($1.Line())
+        } |
         '-' expr %prec UNARY {
             $$ = &ast.UnaryMinusOpExpr{Expr: $2}
             $$.SetLine($2.Line())
@@ -385,6 +442,10 @@ expr:
         '#' expr %prec UNARY {
             $$ = &ast.UnaryLenOpExpr{Expr: $2}
             $$.SetLine($2.Line())
+        } |
+        '~' expr %prec UNARY {
+            $$ = &ast.UnaryBNotOpExpr{Expr: $2}
+            $$.SetLine($2.Line())
         }
 
 string: 
@@ -0,0 +1,609 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+/* persistence {{{ */
+
+// persistMagic starts the data written by Persist; its last byte is the
+// version of the format.
+const persistMagic = "\x1bGLP\x01"
+
+const (
+	persistNil byte = iota
+	persistFalse
+	persistTrue
+	persistNumber
+	persistInteger
+	persistString
+	// an object already written, followed by its id
+	persistRef
+	// a value of the permanents table, followed by its key
+	persistPermanent
+	// the global table of the state
+	persistGlobals
+	persistTable
+	persistClosure
+	persistThread
+	persistProto
+	persistClosedUpvalue
+	persistOpenUpvalue
+)
+
+// Persist writes to w the value root and every value reachable from it:
+// tables with their metatables, Lua functions with their prototypes and
+// upvalues, upvalues shared by several functions being shared again by
+// Unpersist, and coroutines that are suspended or have not started, with
+// their call stacks. The global table of L is written as a reference to the
+// global table of the state that unpersists the data.
+//
+// Values that can not be written, such as Go functions, userdata and
+// channels, must be keys of the permanents table, which may be nil: such a
+// value is written as its value in permanents, which Unpersist looks up in
+// its own permanents table, the inverse of this one.
+func Persist(L *LState, root LValue, w io.Writer, permanents *LTable) (err error) {
+	p := &persister{L: L, w: bufio.NewWriter(w), permanents: permanents, ids: make(map[any]int)}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			perr, ok := rcv.(persistError)
+			if !ok {
+				panic(rcv)
+			}
+			err = perr.err
+		}
+	}()
+	p.w.WriteString(persistMagic)
+	p.writeValue(root)
+	return p.w.Flush()
+}
+
+// Unpersist reads a value written by Persist, creating its objects in L.
+// permanents maps the values of the permanents table given to Persist to the
+// values that replace them, and may be nil. The prototypes of functions are
+// not verified, so the data must come from a trusted source.
+func Unpersist(L *LState, r io.Reader, permanents *LTable) (lv LValue, err error) {
+	u := &unpersister{L: L, r: bufio.NewReader(r), permanents: permanents}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			perr, ok := rcv.(persistError)
+			if !ok {
+				panic(rcv)
+			}
+			lv, err = LNil, perr.err
+		}
+	}()
+	magic := make([]byte, len(persistMagic))
+	u.read(magic)
+	if string(magic) != persistMagic {
+		return LNil, errors.New("unpersist: not a persisted value or unsupported version")
+	}
+	return u.readValue(), nil
+}
+
+// persistError is panicked by the persister and unpersister to return err.
+type persistError struct {
+	err error
+}
+
+type persister struct {
+	L          *LState
+	w          *bufio.Writer
+	permanents *LTable
+	// ids of the objects written, keyed by LValue.asComparable() for values
+	ids map[any]int
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (p *persister) fail(format string, args ...any) {
+	panic(persistError{fmt.Errorf("persist: "+format, args...)})
+}
+
+func (p *persister) writeByte(b byte) {
+	p.w.WriteByte(b)
+}
+
+func (p *persister) writeInt(n int64) {
+	p.w.Write(binary.AppendVarint(p.buf[:0], n))
+}
+
+func (p *persister) writeUint(n uint64) {
+	p.w.Write(binary.AppendUvarint(p.buf[:0], n))
+}
+
+func (p *persister) writeString(s string) {
+	p.writeUint(uint64(len(s)))
+	p.w.WriteString(s)
+}
+
+// writeRef writes a reference to obj and returns true if it has already been
+// written, or assigns it an id otherwise.
+func (p *persister) writeRef(obj any) bool {
+	if id, ok := p.ids[obj]; ok {
+		p.writeByte(persistRef)
+		p.writeUint(uint64(id))
+		return true
+	}
+	p.ids[obj] = len(p.ids)
+	return false
+}
+
+func (p *persister) writeValue(lv LValue) {
+	switch lv.Type() {
+	case LTNil:
+		p.writeByte(persistNil)
+		return
+	case LTBool:
+		if LVAsBool(lv) {
+			p.writeByte(persistTrue)
+		} else {
+			p.writeByte(persistFalse)
+		}
+		return
+	case LTNumber:
+		if i, ok := lv.AsLInteger(); ok {
+			p.writeByte(persistInteger)
+			p.writeInt(int64(i))
+		} else {
+			p.writeByte(persistNumber)
+			p.w.Write(binary.LittleEndian.AppendUint64(p.buf[:0], math.Float64bits(float64(lv.MustLNumber()))))
+		}
+		return
+	case LTString:
+		p.writeByte(persistString)
+		p.writeString(string(lv.MustLString()))
+		return
+	}
+	if p.permanents != nil {
+		if key := p.permanents.RawGet(lv); !key.EqualsLNil() {
+			p.writeByte(persistPermanent)
+			p.writeValue(key)
+			return
+		}
+	}
+	if tb, ok := lv.AsLTable(); ok && tb == p.L.G.Global {
+		p.writeByte(persistGlobals)
+		return
+	}
+	if p.writeRef(lv.asComparable()) {
+		return
+	}
+	switch lv.Type() {
+	case LTTable:
+		p.writeTable(lv.MustLTable())
+	case LTFunction:
+		p.writeClosure(lv.MustLFunction())
+	case LTThread:
+		p.writeThread(lv.MustLThread())
+	default:
+		p.fail("can not persist a %s that is not in the permanents table", lv.Type().String())
+	}
+}
+
+func (p *persister) writeTable(tb *LTable) {
+	p.writeByte(persistTable)
+	for key, value := tb.Next(LNil); !key.EqualsLNil(); key, value = tb.Next(key) {
+		p.writeValue(key)
+		p.writeValue(value)
+	}
+	p.writeByte(persistNil)
+	p.writeValue(tb.Metatable)
+}
+
+func (p *persister) writeClosure(fn *LFunction) {
+	if fn.IsG {
+		p.fail("can not persist a Go function that is not in the permanents table")
+	}
+	p.writeByte(persistClosure)
+	p.writeProto(fn.Proto)
+	if fn.Env == nil {
+		p.writeValue(LNil)
+	} else {
+		p.writeValue(fn.Env.AsLValue())
+	}
+	p.writeUint(uint64(len(fn.Upvalues)))
+	for _, uv := range fn.Upvalues {
+		p.writeUpvalue(uv)
+	}
+}
+
+func (p *persister) writeUpvalue(uv *Upvalue) {
+	if uv == nil {
+		p.writeByte(persistNil)
+		return
+	}
+	if p.writeRef(uv) {
+		return
+	}
+	if !uv.IsClosed() {
+		// an upvalue of a running thread is saved with its current value
+		if th, ok := uv.reg.handler.(*LState); ok && p.isSuspended(th) {
+			p.writeByte(persistOpenUpvalue)
+			p.writeValue(th.AsLValue())
+			p.writeUint(uint64(uv.index))
+			return
+		}
+	}
+	p.writeByte(persistClosedUpvalue)
+	p.writeValue(uv.Value())
+}
+
+func (p *persister) writeProto(proto *FunctionProto) {
+	if p.writeRef(proto) {
+		return
+	}
+	p.writeByte(persistProto)
+	p.writeString(proto.SourceName)
+	p.writeInt(int64(proto.LineDefined))
+	p.writeInt(int64(proto.LastLineDefined))
+	p.w.Write([]byte{proto.NumUpvalues, proto.NumParameters, proto.IsVarArg, proto.NumUsedRegisters})
+	p.writeUint(uint64(len(proto.Code)))
+	for _, inst := range proto.Code {
+		p.writeUint(uint64(inst))
+	}
+	p.writeUint(uint64(len(proto.Constants)))
+	for _, k := range proto.Constants {
+		p.writeValue(k)
+	}
+	p.writeUint(uint64(len(proto.FunctionPrototypes)))
+	for _, child := range proto.FunctionPrototypes {
+		p.writeProto(child)
+	}
+	p.writeUint(uint64(len(proto.DbgSourcePositions)))
+	for _, line := range proto.DbgSourcePositions {
+		p.writeInt(int64(line))
+	}
+	p.writeUint(uint64(len(proto.DbgLocals)))
+	for _, local := range proto.DbgLocals {
+		p.writeString(local.Name)
+		p.writeInt(int64(local.StartPc))
+		p.writeInt(int64(local.EndPc))
+	}
+	p.writeUint(uint64(len(proto.DbgCalls)))
+	for _, call := range proto.DbgCalls {
+		p.writeString(call.Name)
+		p.writeInt(int64(call.Pc))
+	}
+	p.writeUint(uint64(len(proto.DbgUpvalues)))
+	for _, name := range proto.DbgUpvalues {
+		p.writeString(name)
+	}
+}
+
+// isSuspended returns true if th is a coroutine that is not running.
+func (p *persister) isSuspended(th *LState) bool {
+	return th != th.G.MainThread && th != th.G.CurrentThread && th.Parent == nil
+}
+
+func (p *persister) writeThread(th *LState) {
+	if !p.isSuspended(th) {
+		p.fail("can not persist a running thread")
+	}
+	p.writeByte(persistThread)
+	if th.Dead {
+		p.writeByte(persistTrue)
+		return
+	}
+	p.writeByte(persistFalse)
+	started := th.isStarted()
+	if started {
+		p.writeByte(persistTrue)
+	} else {
+		p.writeByte(persistFalse)
+	}
+	p.writeUint(uint64(th.stack.Sp()))
+	for i := 0; i < th.stack.Sp(); i++ {
+		cf := th.stack.At(i)
+		if started && cf.Fn.IsG {
+			p.fail("can not persist a thread suspended in a Go function")
+		}
+		p.writeValue(cf.Fn.AsLValue())
+		for _, n := range []int{cf.Pc, cf.Base, cf.LocalBase, cf.ReturnBase, cf.NArgs, cf.NRet, cf.TailCall} {
+			p.writeInt(int64(n))
+		}
+	}
+	p.writeUint(uint64(th.interruptTop))
+	p.writeUint(uint64(th.reg.Top()))
+	for i := 0; i < th.reg.Top(); i++ {
+		p.writeValue(th.reg.Get(i))
+	}
+	p.writeUint(uint64(len(th.tbcVars)))
+	for _, idx := range th.tbcVars {
+		p.writeUint(uint64(idx))
+	}
+}
+
+type unpersister struct {
+	L          *LState
+	r          *bufio.Reader
+	permanents *LTable
+	// objects read, indexed by their ids
+	objects []any
+}
+
+func (u *unpersister) fail(format string, args ...any) {
+	panic(persistError{fmt.Errorf("unpersist: "+format, args...)})
+}
+
+func (u *unpersister) check(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		panic(persistError{fmt.Errorf("unpersist: %w", err)})
+	}
+}
+
+func (u *unpersister) read(buf []byte) {
+	_, err := io.ReadFull(u.r, buf)
+	u.check(err)
+}
+
+func (u *unpersister) readByte() byte {
+	b, err := u.r.ReadByte()
+	u.check(err)
+	return b
+}
+
+func (u *unpersister) readInt() int {
+	n, err := binary.ReadVarint(u.r)
+	u.check(err)
+	return int(n)
+}
+
+func (u *unpersister) readUint() int {
+	n, err := binary.ReadUvarint(u.r)
+	u.check(err)
+	if n > math.MaxInt32 {
+		u.fail("invalid length %d", n)
+	}
+	return int(n)
+}
+
+func (u *unpersister) readString() string {
+	n := u.readUint()
+	// the length is not trusted to allocate the string
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, u.r, int64(n))
+	u.check(err)
+	return buf.String()
+}
+
+func (u *unpersister) register(obj any) {
+	u.objects = append(u.objects, obj)
+}
+
+func (u *unpersister) readRef() any {
+	id := u.readUint()
+	if id >= len(u.objects) {
+		u.fail("invalid reference %d", id)
+	}
+	return u.objects[id]
+}
+
+func (u *unpersister) readValue() LValue {
+	switch tag := u.readByte(); tag {
+	case persistNil:
+		return LNil
+	case persistFalse:
+		return LFalse.AsLValue()
+	case persistTrue:
+		return LTrue.AsLValue()
+	case persistNumber:
+		var buf [8]byte
+		u.read(buf[:])
+		return LNumber(math.Float64frombits(binary.LittleEndian.Uint64(buf[:]))).AsLValue()
+	case persistInteger:
+		n, err := binary.ReadVarint(u.r)
+		u.check(err)
+		return LInteger(n).AsLValue()
+	case persistString:
+		return LString(u.readString()).AsLValue()
+	case persistRef:
+		if lv, ok := u.readRef().(LValue); ok {
+			return lv
+		}
+		u.fail("invalid reference to a non-value")
+	case persistPermanent:
+		key := u.readValue()
+		var lv LValue
+		if u.permanents != nil {
+			lv = u.permanents.RawGet(key)
+		}
+		if lv.EqualsLNil() {
+			u.fail("permanent value %v not found", key)
+		}
+		return lv
+	case persistGlobals:
+		return u.L.G.Global.AsLValue()
+	case persistTable:
+		return u.readTable()
+	case persistClosure:
+		return u.readClosure()
+	case persistThread:
+		return u.readThread()
+	default:
+		u.fail("invalid tag %d", tag)
+	}
+	return LNil
+}
+
+func (u *unpersister) readTable() LValue {
+	tb := u.L.NewTable()
+	u.register(tb.AsLValue())
+	for {
+		key := u.readValue()
+		if key.EqualsLNil() {
+			break
+		}
+		tb.RawSet(key, u.readValue())
+	}
+	if mt := u.readValue(); !mt.EqualsLNil() {
+		if mt.Type() != LTTable {
+			u.fail("invalid metatable")
+		}
+		u.L.SetMetatable(tb.AsLValue(), mt)
+	}
+	return tb.AsLValue()
+}
+
+func (u *unpersister) readClosure() LValue {
+	// the id of the function is taken before its prototype is read, like
+	// Persist does, and the upvalues of the function may refer to it
+	id := len(u.objects)
+	u.register(nil)
+	proto := u.readProto()
+	fn := u.L.NewFunctionFromProto(proto)
+	u.objects[id] = fn.AsLValue()
+	env := u.readValue()
+	if tb, ok := env.AsLTable(); ok {
+		fn.Env = tb
+	} else if !env.EqualsLNil() {
+		u.fail("invalid function environment")
+	}
+	n := u.readUint()
+	if n != int(proto.NumUpvalues) {
+		u.fail("invalid number of upvalues")
+	}
+	for i := 0; i < n; i++ {
+		fn.Upvalues[i] = u.readUpvalue()
+	}
+	return fn.AsLValue()
+}
+
+func (u *unpersister) readUpvalue() *Upvalue {
+	switch tag := u.readByte(); tag {
+	case persistNil:
+		return nil
+	case persistRef:
+		if uv, ok := u.readRef().(*Upvalue); ok {
+			return uv
+		}
+		u.fail("invalid reference to a non-upvalue")
+	case persistClosedUpvalue:
+		uv := &Upvalue{}
+		uv.Close()
+		u.register(uv)
+		uv.SetValue(u.readValue())
+		return uv
+	case persistOpenUpvalue:
+		// the id is taken before reading the thread, which is written after
+		// the upvalue has been assigned its id
+		id := len(u.objects)
+		u.register(nil)
+		th, ok := u.readValue().AsLThread()
+		if !ok {
+			u.fail("invalid upvalue thread")
+		}
+		uv := th.findUpvalue(u.readUint())
+		u.objects[id] = uv
+		return uv
+	default:
+		u.fail("invalid upvalue tag %d", tag)
+	}
+	return nil
+}
+
+func (u *unpersister) readProto() *FunctionProto {
+	switch tag := u.readByte(); tag {
+	case persistRef:
+		if proto, ok := u.readRef().(*FunctionProto); ok {
+			return proto
+		}
+		u.fail("invalid reference to a non-prototype")
+	case persistProto:
+	default:
+		u.fail("invalid prototype tag %d", tag)
+	}
+	proto := &FunctionProto{}
+	u.register(proto)
+	proto.SourceName = u.readString()
+	proto.LineDefined = u.readInt()
+	proto.LastLineDefined = u.readInt()
+	var counts [4]byte
+	u.read(counts[:])
+	proto.NumUpvalues, proto.NumParameters, proto.IsVarArg, proto.NumUsedRegisters = counts[0], counts[1], counts[2], counts[3]
+	for n := u.readUint(); n > 0; n-- {
+		inst, err := binary.ReadUvarint(u.r)
+		u.check(err)
+		proto.Code = append(proto.Code, uint32(inst))
+	}
+	for n := u.readUint(); n > 0; n-- {
+		proto.Constants = append(proto.Constants, u.readValue())
+	}
+	for n := u.readUint(); n > 0; n-- {
+		proto.FunctionPrototypes = append(proto.FunctionPrototypes, u.readProto())
+	}
+	for n := u.readUint(); n > 0; n-- {
+		proto.DbgSourcePositions = append(proto.DbgSourcePositions, u.readInt())
+	}
+	for n := u.readUint(); n > 0; n-- {
+		local := &DbgLocalInfo{Name: u.readString()}
+		local.StartPc = u.readInt()
+		local.EndPc = u.readInt()
+		proto.DbgLocals = append(proto.DbgLocals, local)
+	}
+	for n := u.readUint(); n > 0; n-- {
+		call := DbgCall{Name: u.readString()}
+		call.Pc = u.readInt()
+		proto.DbgCalls = append(proto.DbgCalls, call)
+	}
+	for n := u.readUint(); n > 0; n-- {
+		proto.DbgUpvalues = append(proto.DbgUpvalues, u.readString())
+	}
+	return proto
+}
+
+func (u *unpersister) readThread() LValue {
+	th, _ := u.L.NewThread()
+	u.register(th.AsLValue())
+	if u.readByte() == persistTrue {
+		th.kill()
+		return th.AsLValue()
+	}
+	started := u.readByte() == persistTrue
+	n := u.readUint()
+	if n == 0 || n > th.Options.CallStackSize {
+		u.fail("invalid call stack size %d", n)
+	}
+	var parent *callFrame
+	for i := 0; i < n; i++ {
+		fn, ok := u.readValue().AsLFunction()
+		if !ok || (started && fn.IsG) {
+			u.fail("invalid call frame function")
+		}
+		cf := callFrame{Fn: fn, Parent: parent}
+		for _, field := range []*int{&cf.Pc, &cf.Base, &cf.LocalBase, &cf.ReturnBase, &cf.NArgs, &cf.NRet, &cf.TailCall} {
+			*field = u.readInt()
+		}
+		parent = th.stack.Push(cf)
+	}
+	th.interruptTop = u.readUint()
+	top := u.readUint()
+	if top > intMax(th.reg.maxSize, len(th.reg.array)) {
+		u.fail("invalid registry size %d", top)
+	}
+	for i := 0; i < top; i++ {
+		th.reg.Push(u.readValue())
+	}
+	for n := u.readUint(); n > 0; n-- {
+		idx := u.readUint()
+		if idx >= top {
+			u.fail("invalid to-be-closed variable %d", idx)
+		}
+		th.tbcVars = append(th.tbcVars, idx)
+	}
+	if started {
+		th.currentFrame = parent
+		th.Panic = panicWithoutTraceback
+	}
+	return th.AsLValue()
+}
+
+/* }}} */
@@ -0,0 +1,133 @@
+package lua
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// persistGlobal persists the global name of src and stores the unpersisted
+// value in the global name of dst.
+func persistGlobal(t *testing.T, src, dst *LState, name string, permanents, inverse *LTable) {
+	t.Helper()
+	var buf bytes.Buffer
+	errorIfNotNil(t, Persist(src, src.GetGlobal(name), &buf, permanents))
+	lv, err := Unpersist(dst, &buf, inverse)
+	errorIfNotNil(t, err)
+	dst.SetGlobal(name, lv)
+}
+
+func TestPersistValues(t *testing.T) {
+	src := NewState()
+	defer src.Close()
+	dst := NewState()
+	defer dst.Close()
+	errorIfScriptFail(t, src, `
+	local shared = {x = 1.5}
+	local mt = {__index = function(t, k) return k .. "?" end}
+	value = setmetatable({1, "two", 3, 2^53, -7, true, false, sub = shared, again = shared}, mt)
+	value.self = value
+	value[shared] = "key"
+	local weak = setmetatable({}, {__mode = "k"})
+	weak[shared] = 1
+	value.weak = weak
+	`)
+	persistGlobal(t, src, dst, "value", nil, nil)
+	errorIfScriptFail(t, dst, `
+	assert(value[1] == 1 and math.type(value[1]) == "integer" and value[2] == "two")
+	assert(value[4] == 2^53 and math.type(value[4]) == "float" and value[5] == -7)
+	assert(value[6] == true and value[7] == false and #value == 7)
+	assert(value.self == value and value.sub == value.again and value.sub.x == 1.5)
+	assert(value[value.sub] == "key" and value.missing == "missing?")
+	assert(getmetatable(value.weak).__mode == "k" and value.weak[value.sub] == 1)
+	`)
+}
+
+func TestPersistClosures(t *testing.T) {
+	src := NewState()
+	defer src.Close()
+	dst := NewState()
+	defer dst.Close()
+	errorIfScriptFail(t, src, `
+	local function counter(n)
+		local function inc() n = n + 1 return n end
+		local function get() return n end
+		return {inc = inc, get = get}
+	end
+	value = counter(10)
+	value.inc()
+	value.usesglobal = function() return answer end
+	value.fib = function(n)
+		local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+		return fib(n)
+	end
+	`)
+	persistGlobal(t, src, dst, "value", nil, nil)
+	errorIfScriptFail(t, dst, `
+	answer = 42
+	assert(value.get() == 11 and value.inc() == 12 and value.get() == 12)
+	assert(value.usesglobal() == 42 and value.fib(10) == 55)
+	`)
+	errorIfScriptFail(t, src, `assert(value.get() == 11)`)
+
+	errorIfScriptFail(t, src, `value.log = function(...) print(...) end; value.p = print`)
+	var buf bytes.Buffer
+	err := Persist(src, src.GetGlobal("value"), &buf, nil)
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "Go function"), "unexpected error %v", err)
+
+	permanents := src.NewTable()
+	permanents.RawSet(src.GetGlobal("print"), LString("print").AsLValue())
+	inverse := dst.NewTable()
+	inverse.RawSetString("print", dst.GetGlobal("print"))
+	persistGlobal(t, src, dst, "value", permanents, inverse)
+	errorIfScriptFail(t, dst, `assert(value.p == print)`)
+
+	buf.Reset()
+	errorIfNotNil(t, Persist(src, src.GetGlobal("value"), &buf, permanents))
+	_, err = Unpersist(dst, &buf, nil)
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), `permanent value print not found`), "unexpected error %v", err)
+	_, err = Unpersist(dst, strings.NewReader("garbage"), nil)
+	errorIfNil(t, err)
+	_, err = Unpersist(dst, bytes.NewReader([]byte(persistMagic+"\x09")), nil)
+	errorIfNil(t, err)
+}
+
+func TestPersistThreads(t *testing.T) {
+	src := NewState()
+	defer src.Close()
+	dst := NewState()
+	defer dst.Close()
+	errorIfScriptFail(t, src, `
+	local co = coroutine.create(function(a)
+		local sum = a
+		local function add(x) sum = sum + x end
+		while true do
+			local x = coroutine.yield(sum)
+			add(x)
+		end
+	end)
+	assert(select(2, coroutine.resume(co, 1)) == 1)
+	assert(select(2, coroutine.resume(co, 2)) == 3)
+	value = {
+		co = co,
+		fresh = coroutine.create(function(x) return x * 2 end),
+		dead = coroutine.create(function() end),
+	}
+	coroutine.resume(value.dead)
+	`)
+	persistGlobal(t, src, dst, "value", nil, nil)
+	errorIfScriptFail(t, dst, `
+	local ok, sum = coroutine.resume(value.co, 4)
+	assert(ok and sum == 7)
+	ok, sum = coroutine.resume(value.co, 10)
+	assert(ok and sum == 17)
+	local ok, v = coroutine.resume(value.fresh, 21)
+	assert(ok and v == 42 and coroutine.status(value.fresh) == "dead")
+	assert(coroutine.status(value.dead) == "dead")
+	`)
+	errorIfScriptFail(t, src, `assert(select(2, coroutine.resume(value.co, 4)) == 7)`)
+
+	var buf bytes.Buffer
+	err := Persist(src, src.AsLValue(), &buf, nil)
+	errorIfFalse(t, err != nil && strings.Contains(err.Error(), "running thread"), "unexpected error %v", err)
+}
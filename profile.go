@@ -0,0 +1,275 @@
+package lua
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+/* sampling profiler {{{ */
+
+const profilePeriod = 10 * time.Millisecond
+
+type profileFunction struct {
+	name   string
+	source string
+	line   int
+}
+
+type profileLocation struct {
+	fn   uint64
+	line int
+}
+
+// profiler samples the Lua call stacks of the threads of a Global. A ticker
+// goroutine counts the periods elapsed; the VM takes a sample weighted by
+// that count before the next instruction, so no state is read concurrently.
+//
+// As samples are only taken between two Lua instructions, the time spent in
+// a Go function is attributed to the Lua function that called it, at the
+// instruction following the call. Time the state spends idle, outside of any
+// call from the host, is not counted.
+type profiler struct {
+	w     io.Writer
+	start time.Time
+	ticks atomic.Int64 // periods elapsed since the last sample
+	done  chan struct{}
+
+	functions map[profileFunction]uint64
+	locations map[profileLocation]uint64
+	samples   map[string]*profileSample
+	order     []*profileSample
+}
+
+type profileSample struct {
+	locations []uint64
+	count     int64 // periods
+}
+
+// StartProfile starts sampling the Lua call stacks of the state and its
+// threads every 10ms. The profile is written to w in the pprof format when
+// StopProfile is called. Samples are taken between Lua instructions, so time
+// spent in Go functions is attributed to their Lua callers.
+func (ls *LState) StartProfile(w io.Writer) error {
+	if ls.G.profiler != nil {
+		return errors.New("profiling already in use")
+	}
+	p := &profiler{
+		w:         w,
+		start:     time.Now(),
+		done:      make(chan struct{}),
+		functions: make(map[profileFunction]uint64),
+		locations: make(map[profileLocation]uint64),
+		samples:   make(map[string]*profileSample),
+	}
+	ls.G.profiler = p
+	ls.reloadMainLoop()
+	go func() {
+		ticker := time.NewTicker(profilePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.ticks.Add(1)
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// StopProfile stops the profiler started by StartProfile and writes the
+// profile. It must not be called while the state is running on another
+// goroutine.
+func (ls *LState) StopProfile() error {
+	p := ls.G.profiler
+	if p == nil {
+		return errors.New("profiling not in use")
+	}
+	close(p.done)
+	ls.G.profiler = nil
+	ls.reloadMainLoop()
+	return p.write(time.Since(p.start))
+}
+
+// sample records the call stack of the running thread, weighted by the
+// periods elapsed since the last sample.
+func (p *profiler) sample(ls *LState) {
+	n := p.ticks.Swap(0)
+	var key []byte
+	var locations []uint64
+	for fr := ls.currentFrame; fr != nil; fr = fr.Parent {
+		name, _ := ls.frameFuncName(fr)
+		fn := profileFunction{name: name, source: "[G]"}
+		line := 0
+		if !fr.Fn.IsG {
+			proto := fr.Fn.Proto
+			fn.source, fn.line = proto.SourceName, proto.LineDefined
+			if pc := fr.Pc - 1; pc >= 0 && pc < len(proto.DbgSourcePositions) {
+				line = proto.DbgSourcePositions[pc]
+			}
+		}
+		fid, ok := p.functions[fn]
+		if !ok {
+			fid = uint64(len(p.functions) + 1)
+			p.functions[fn] = fid
+		}
+		loc := profileLocation{fn: fid, line: line}
+		lid, ok := p.locations[loc]
+		if !ok {
+			lid = uint64(len(p.locations) + 1)
+			p.locations[loc] = lid
+		}
+		locations = append(locations, lid)
+		key = binary.AppendUvarint(key, lid)
+	}
+	if len(locations) == 0 {
+		return
+	}
+	s, ok := p.samples[string(key)]
+	if !ok {
+		s = &profileSample{locations: locations}
+		p.samples[string(key)] = s
+		p.order = append(p.order, s)
+	}
+	s.count += n
+}
+
+// write encodes the profile as a gzipped profile.proto message.
+func (p *profiler) write(duration time.Duration) error {
+	var b protoBuffer
+	index := map[string]int64{"": 0}
+	stringTable := []string{""}
+	str := func(s string) int64 {
+		if i, ok := index[s]; ok {
+			return i
+		}
+		index[s] = int64(len(stringTable))
+		stringTable = append(stringTable, s)
+		return index[s]
+	}
+	valueType := func(field int, typ, unit string) {
+		var vt protoBuffer
+		vt.int64(1, str(typ))
+		vt.int64(2, str(unit))
+		b.message(field, &vt)
+	}
+
+	valueType(1, "samples", "count")
+	valueType(1, "cpu", "nanoseconds")
+	for _, s := range p.order {
+		var sb protoBuffer
+		sb.packedUint64(1, s.locations)
+		sb.packedInt64(2, []int64{s.count, s.count * int64(profilePeriod)})
+		b.message(2, &sb)
+	}
+	locations := make([]profileLocation, len(p.locations))
+	for loc, id := range p.locations {
+		locations[id-1] = loc
+	}
+	for i, loc := range locations {
+		var line, lb protoBuffer
+		line.uint64(1, loc.fn)
+		line.int64(2, int64(loc.line))
+		lb.uint64(1, uint64(i+1))
+		lb.message(4, &line)
+		b.message(4, &lb)
+	}
+	functions := make([]profileFunction, len(p.functions))
+	for fn, id := range p.functions {
+		functions[id-1] = fn
+	}
+	for i, fn := range functions {
+		var fb protoBuffer
+		fb.uint64(1, uint64(i+1))
+		fb.int64(2, str(fn.name))
+		fb.int64(3, str(fn.name))
+		fb.int64(4, str(fn.source))
+		fb.int64(5, int64(fn.line))
+		b.message(5, &fb)
+	}
+	var periodType protoBuffer
+	periodType.int64(1, str("cpu"))
+	periodType.int64(2, str("nanoseconds"))
+	for _, s := range stringTable {
+		b.string(6, s)
+	}
+	b.int64(9, p.start.UnixNano())
+	b.int64(10, int64(duration))
+	b.message(11, &periodType)
+	b.int64(12, int64(profilePeriod))
+
+	zw := gzip.NewWriter(p.w)
+	if _, err := zw.Write(b.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+/* }}} */
+
+/* protocol buffers {{{ */
+
+// protoBuffer encodes the protocol buffer wire format.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x != 0 {
+		b.key(field, 0)
+		b.varint(x)
+	}
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.data)
+}
+
+func (b *protoBuffer) packedUint64(field int, xs []uint64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(field, p.data)
+}
+
+func (b *protoBuffer) packedInt64(field int, xs []int64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(uint64(x))
+	}
+	b.bytes(field, p.data)
+}
+
+/* }}} */
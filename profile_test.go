@@ -0,0 +1,199 @@
+package lua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// decodedProfile holds the parts of a pprof profile checked by the tests.
+type decodedProfile struct {
+	sampleTypes []string
+	samples     []decodedSample
+	locations   map[uint64]uint64 // function ids by location id
+	functions   map[uint64][2]string
+}
+
+type decodedSample struct {
+	locations []uint64
+	values    []int64
+}
+
+// protoFields splits a protocol buffer message into its fields, keeping the
+// varints of wire type 0 and the payloads of wire type 2.
+func protoFields(t *testing.T, data []byte, fn func(field int, x uint64, payload []byte)) {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		errorIfFalse(t, n > 0, "bad key")
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			x, n := binary.Uvarint(data)
+			errorIfFalse(t, n > 0, "bad varint")
+			data = data[n:]
+			fn(int(key>>3), x, nil)
+		case 2:
+			l, n := binary.Uvarint(data)
+			errorIfFalse(t, n > 0 && uint64(len(data)-n) >= l, "bad length")
+			fn(int(key>>3), 0, data[n:n+int(l)])
+			data = data[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+}
+
+func packedVarints(t *testing.T, data []byte) []uint64 {
+	var xs []uint64
+	for len(data) > 0 {
+		x, n := binary.Uvarint(data)
+		errorIfFalse(t, n > 0, "bad packed varint")
+		xs = append(xs, x)
+		data = data[n:]
+	}
+	return xs
+}
+
+func decodeProfile(t *testing.T, r io.Reader) *decodedProfile {
+	zr, err := gzip.NewReader(r)
+	errorIfNotNil(t, err)
+	data, err := io.ReadAll(zr)
+	errorIfNotNil(t, err)
+
+	var strs []string
+	var sampleTypes [][2]uint64
+	var functions [][3]uint64
+	p := &decodedProfile{locations: make(map[uint64]uint64)}
+	protoFields(t, data, func(field int, x uint64, payload []byte) {
+		switch field {
+		case 1:
+			var vt [2]uint64
+			protoFields(t, payload, func(field int, x uint64, _ []byte) { vt[field-1] = x })
+			sampleTypes = append(sampleTypes, vt)
+		case 2:
+			var s decodedSample
+			protoFields(t, payload, func(field int, _ uint64, payload []byte) {
+				switch field {
+				case 1:
+					s.locations = packedVarints(t, payload)
+				case 2:
+					for _, v := range packedVarints(t, payload) {
+						s.values = append(s.values, int64(v))
+					}
+				}
+			})
+			p.samples = append(p.samples, s)
+		case 4:
+			var id, fid uint64
+			protoFields(t, payload, func(field int, x uint64, payload []byte) {
+				switch field {
+				case 1:
+					id = x
+				case 4:
+					protoFields(t, payload, func(field int, x uint64, _ []byte) {
+						if field == 1 {
+							fid = x
+						}
+					})
+				}
+			})
+			p.locations[id] = fid
+		case 5:
+			var fn [3]uint64
+			protoFields(t, payload, func(field int, x uint64, _ []byte) {
+				switch field {
+				case 1:
+					fn[0] = x
+				case 2:
+					fn[1] = x
+				case 4:
+					fn[2] = x
+				}
+			})
+			functions = append(functions, fn)
+		case 6:
+			strs = append(strs, string(payload))
+		}
+	})
+	for _, vt := range sampleTypes {
+		p.sampleTypes = append(p.sampleTypes, strs[vt[0]]+"/"+strs[vt[1]])
+	}
+	p.functions = make(map[uint64][2]string)
+	for _, fn := range functions {
+		p.functions[fn[0]] = [2]string{strs[fn[1]], strs[fn[2]]}
+	}
+	return p
+}
+
+// periods returns the number of periods of the samples whose stack contains
+// a function named name.
+func (p *decodedProfile) periods(name string) int64 {
+	var n int64
+	for _, s := range p.samples {
+		for _, loc := range s.locations {
+			if p.functions[p.locations[loc]][0] == name {
+				n += s.values[0]
+				break
+			}
+		}
+	}
+	return n
+}
+
+func TestProfile(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var buf bytes.Buffer
+	errorIfNotNil(t, L.StartProfile(&buf))
+	errorIfNil(t, L.StartProfile(&buf))
+	errorIfScriptFail(t, L, `
+	local function busy()
+		local t = os.clock()
+		while os.clock() - t < 0.1 do end
+	end
+	busy()
+	`)
+	errorIfNotNil(t, L.StopProfile())
+	errorIfNil(t, L.StopProfile())
+
+	p := decodeProfile(t, &buf)
+	errorIfFalse(t, len(p.sampleTypes) == 2 && p.sampleTypes[0] == "samples/count" && p.sampleTypes[1] == "cpu/nanoseconds",
+		"unexpected sample types: %v", p.sampleTypes)
+	errorIfFalse(t, len(p.samples) > 0, "no samples")
+	for _, s := range p.samples {
+		errorIfFalse(t, len(s.values) == 2 && s.values[1] == s.values[0]*int64(profilePeriod), "unexpected values: %v", s.values)
+		leaf := p.functions[p.locations[s.locations[0]]]
+		root := p.functions[p.locations[s.locations[len(s.locations)-1]]]
+		errorIfFalse(t, root[0] == "main chunk" && root[1] == "<string>", "unexpected root: %v", root)
+		errorIfFalse(t, leaf[0] == "busy" || leaf[0] == "main chunk" || leaf[1] == "[G]", "unexpected leaf: %v", leaf)
+	}
+	errorIfFalse(t, p.periods("busy") > 0, "busy not sampled")
+}
+
+func TestProfileGoFunction(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("sleep", L.NewFunction(func(L *LState) int {
+		time.Sleep(200 * time.Millisecond)
+		return 0
+	}).AsLValue())
+	var buf bytes.Buffer
+	errorIfNotNil(t, L.StartProfile(&buf))
+	time.Sleep(100 * time.Millisecond)
+	errorIfScriptFail(t, L, `
+	local function slow()
+		sleep()
+		return 1
+	end
+	slow()
+	`)
+	errorIfNotNil(t, L.StopProfile())
+
+	p := decodeProfile(t, &buf)
+	n := p.periods("slow")
+	errorIfFalse(t, n >= 10 && n <= 25, "the sleep should weigh about 20 periods, got %d", n)
+	errorIfFalse(t, p.periods("main chunk") <= n+5, "idle time counted: %d periods", p.periods("main chunk"))
+}
@@ -24,6 +24,7 @@ var gluaTests []string = []string{
 	"math.lua",
 	"strings.lua",
 	"goto.lua",
+	"utf8.lua",
 }
 
 var luaTests []string = []string{
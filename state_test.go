@@ -2,6 +2,8 @@ package lua
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -324,6 +326,88 @@ func TestPCall(t *testing.T) {
 	errorIfFalse(t, L.stack.Sp() == currentSp, "")
 }
 
+func TestApiErrorFrames(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.Register("fail", func(L *LState) int {
+		L.Error(L.NewTable().AsLValue(), 1)
+		return 0
+	})
+	err := L.DoString(`
+	local function inner()
+		fail()
+	end
+	function outer()
+		inner()
+	end
+	outer()
+	`)
+	errorIfNil(t, err)
+	aerr := err.(*ApiError)
+	errorIfNotEqual(t, LTTable, aerr.Object.Type())
+	errorIfNotEqual(t, 4, len(aerr.Frames))
+	expected := []StackFrame{
+		{Name: "fail", Source: "[G]", CurrentLine: -1, IsG: true},
+		{Name: "inner", Source: "<string>", CurrentLine: 3, LineDefined: 2},
+		{Name: "outer", Source: "<string>", CurrentLine: 6, LineDefined: 5},
+		{Name: "main chunk", Source: "<string>", CurrentLine: 8},
+	}
+	for i, frame := range expected {
+		errorIfNotEqual(t, frame, aerr.Frames[i])
+	}
+
+	L.Push(L.GetGlobal("outer"))
+	err = L.PCall(0, 0, L.NewFunction(func(L *LState) int {
+		L.Push(LString("handled").AsLValue())
+		return 1
+	}))
+	errorIfNotEqual(t, "handled", err.(*ApiError).Object.String())
+	errorIfNotEqual(t, 3, len(err.(*ApiError).Frames))
+}
+
+type testGoError struct{ code int }
+
+func (e *testGoError) Error() string { return fmt.Sprintf("code %d", e.code) }
+
+func TestRaiseGoError(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.Register("deadline", func(L *LState) int {
+		L.RaiseGoError(context.DeadlineExceeded)
+		return 0
+	})
+	L.Register("custom", func(L *LState) int {
+		L.RaiseGoError(&testGoError{42})
+		return 0
+	})
+
+	err := L.DoString(`deadline()`)
+	errorIfFalse(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	errorIfFalse(t, strings.Contains(err.Error(), "context deadline exceeded"), "unexpected message: %v", err)
+
+	err = L.DoString(`
+	local ok, msg = pcall(custom)
+	assert(not ok and msg:find("code 42"))
+	error(msg)
+	`)
+	var gerr *testGoError
+	errorIfFalse(t, errors.As(err, &gerr) && gerr.code == 42, "unexpected error: %v", err)
+
+	err = L.DoString(`
+	local ok, msg = pcall(deadline)
+	error("wrapped: " .. msg)
+	`)
+	errorIfFalse(t, err != nil && !errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+
+	fn := L.NewFunction(func(L *LState) int {
+		err := L.CallByParam(P{Fn: L.GetGlobal("custom"), Protect: true})
+		L.RaiseGoError(err)
+		return 0
+	})
+	err = L.CallByParam(P{Fn: fn.AsLValue(), Protect: true})
+	errorIfFalse(t, errors.As(err, &gerr) && gerr.code == 42, "unexpected error: %v", err)
+}
+
 func TestCoroutineApi1(t *testing.T) {
 	L := NewState()
 	defer L.Close()
@@ -492,6 +576,24 @@ func TestPCallAfterFail(t *testing.T) {
 	errorIfFalse(t, strings.Contains(err.Error(), "A New Error"), "error not propogated correctly")
 }
 
+func TestPCallClosesUpvalues(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local log = {}
+	local function add(x) table.insert(log, x) end
+	local get
+	assert(not pcall(function()
+		local v = 1
+		get = function() return v end
+		error("failed")
+	end))
+	log = {}
+	add(1)
+	assert(#log == 1 and get() == 1)
+	`)
+}
+
 func TestRegistryFixedOverflow(t *testing.T) {
 	state := NewState()
 	defer state.Close()
@@ -1,7 +1,9 @@
 package lua
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/hsfzxjy/gopher-lua/pm"
@@ -25,19 +27,22 @@ func OpenString(L *LState) int {
 }
 
 var strFuncs = map[string]LGFunctionSpec{
-	"byte":    {Fn: strByte},
-	"char":    {Fn: strChar},
-	"dump":    {Fn: strDump},
-	"find":    {Fn: strFind},
-	"format":  {Fn: strFormat},
-	"gsub":    {Fn: strGsub},
-	"len":     {Fn: strLen},
-	"lower":   {Fn: strLower},
-	"match":   {Fn: strMatch},
-	"rep":     {Fn: strRep},
-	"reverse": {Fn: strReverse},
-	"sub":     {Fn: strSub, IsFast: true},
-	"upper":   {Fn: strUpper},
+	"byte":     {Fn: strByte},
+	"char":     {Fn: strChar},
+	"dump":     {Fn: strDump},
+	"find":     {Fn: strFind},
+	"format":   {Fn: strFormat},
+	"gsub":     {Fn: strGsub},
+	"len":      {Fn: strLen},
+	"lower":    {Fn: strLower},
+	"match":    {Fn: strMatch},
+	"pack":     {Fn: strPack},
+	"packsize": {Fn: strPackSize},
+	"rep":      {Fn: strRep},
+	"reverse":  {Fn: strReverse},
+	"sub":      {Fn: strSub, IsFast: true},
+	"unpack":   {Fn: strUnpack},
+	"upper":    {Fn: strUpper},
 }
 
 func strByte(L *LState) int {
@@ -56,7 +61,7 @@ func strByte(L *LState) int {
 		if start < 0 || start >= l {
 			return 0
 		}
-		L.Push(LNumber(str[start]).AsLValue())
+		L.Push(LInteger(str[start]).AsLValue())
 		return 1
 	}
 
@@ -67,13 +72,14 @@ func strByte(L *LState) int {
 	}
 
 	for i := start; i < end; i++ {
-		L.Push(LNumber(str[i]).AsLValue())
+		L.Push(LInteger(str[i]).AsLValue())
 	}
 	return end - start
 }
 
 func strChar(L *LState) int {
 	top := L.GetTop()
+	L.G.mem.chargeString(top)
 	bytes := make([]byte, L.GetTop())
 	for i := 1; i <= top; i++ {
 		bytes[i-1] = uint8(L.CheckInt(i))
@@ -91,8 +97,8 @@ func strFind(L *LState) int {
 	str := L.CheckString(1)
 	pattern := L.CheckString(2)
 	if len(pattern) == 0 {
-		L.Push(LNumber(1).AsLValue())
-		L.Push(LNumber(0).AsLValue())
+		L.Push(LInteger(1).AsLValue())
+		L.Push(LInteger(0).AsLValue())
 		return 2
 	}
 	init := luaIndex2StringIndex(str, L.OptInt(3, 1), true)
@@ -107,8 +113,8 @@ func strFind(L *LState) int {
 			L.Push(LNil)
 			return 1
 		}
-		L.Push((LNumber(init+pos) + 1).AsLValue())
-		L.Push(LNumber(init + pos + len(pattern)).AsLValue())
+		L.Push(LInteger(init + pos + 1).AsLValue())
+		L.Push(LInteger(init + pos + len(pattern)).AsLValue())
 		return 2
 	}
 
@@ -121,11 +127,11 @@ func strFind(L *LState) int {
 		return 1
 	}
 	md := mds[0]
-	L.Push(LNumber(md.Capture(0) + 1).AsLValue())
-	L.Push(LNumber(md.Capture(1)).AsLValue())
+	L.Push(LInteger(md.Capture(0) + 1).AsLValue())
+	L.Push(LInteger(md.Capture(1)).AsLValue())
 	for i := 2; i < md.CaptureLength(); i += 2 {
 		if md.IsPosCapture(i) {
-			L.Push(LNumber(md.Capture(i)).AsLValue())
+			L.Push(LInteger(md.Capture(i)).AsLValue())
 		} else {
 			L.Push(LString(str[md.Capture(i):md.Capture(i+1)]).AsLValue())
 		}
@@ -140,11 +146,49 @@ func strFormat(L *LState) int {
 	for i := 2; i <= top; i++ {
 		args[i-2] = L.Get(i).AsAny()
 	}
+	if L.Options.LanguageVersion >= Lua53 {
+		formatArgs53(L, str, args)
+	}
 	npat := strings.Count(str, "%") - strings.Count(str, "%%")
-	L.Push(LString(fmt.Sprintf(str, args[:intMin(npat, len(args))]...)).AsLValue())
+	ret := fmt.Sprintf(str, args[:intMin(npat, len(args))]...)
+	L.G.mem.chargeString(len(ret))
+	L.Push(LString(ret).AsLValue())
 	return 1
 }
 
+// formatArgs53 applies the rules of Lua 5.3 to the arguments of
+// string.format: integer conversions reject floats that have no integer
+// value, and %s writes floats the way tostring does.
+func formatArgs53(L *LState, format string, args []interface{}) {
+	argn := 0
+	for i := 0; i < len(format) && argn < len(args); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i == len(format) || format[i] == '%' {
+			continue
+		}
+		lv := L.Get(argn + 2)
+		if lv.isNumber() {
+			switch format[i] {
+			case 'c', 'd', 'i', 'o', 'u', 'x', 'X':
+				if _, ok := lv.AsLInteger(); !ok {
+					if _, ok := floatToInteger(float64(lv.MustLNumber())); !ok {
+						L.ArgError(argn+2, "number has no integer representation")
+					}
+				}
+			case 'q', 's':
+				args[argn] = L.lvAsString(lv)
+			}
+		}
+		argn++
+	}
+}
+
 func strGsub(L *LState) int {
 	str := L.CheckString(1)
 	pat := L.CheckString(2)
@@ -158,18 +202,21 @@ func strGsub(L *LState) int {
 	}
 	if len(mds) == 0 {
 		L.SetTop(1)
-		L.Push(LNumber(0).AsLValue())
+		L.Push(LInteger(0).AsLValue())
 		return 2
 	}
+	var ret string
 	switch lv := repl; lv.Type() {
 	case LTString:
-		L.Push(LString(strGsubStr(L, str, string(lv.MustLString()), mds)).AsLValue())
+		ret = strGsubStr(L, str, string(lv.MustLString()), mds)
 	case LTTable:
-		L.Push(LString(strGsubTable(L, str, lv.MustLTable(), mds)).AsLValue())
+		ret = strGsubTable(L, str, lv.MustLTable(), mds)
 	case LTFunction:
-		L.Push(LString(strGsubFunc(L, str, lv.MustLFunction(), mds)).AsLValue())
+		ret = strGsubFunc(L, str, lv.MustLFunction(), mds)
 	}
-	L.Push(LNumber(len(mds)).AsLValue())
+	L.G.mem.chargeString(len(ret))
+	L.Push(LString(ret).AsLValue())
+	L.Push(LInteger(len(mds)).AsLValue())
 	return 2
 }
 
@@ -253,12 +300,12 @@ func strGsubTable(L *LState, str string, repl *LTable, matches []*pm.MatchData)
 		}
 		var value LValue
 		if match.IsPosCapture(idx) {
-			value = L.GetTable(repl.AsLValue(), LNumber(match.Capture(idx)).AsLValue())
+			value = L.GetTable(repl.AsLValue(), LInteger(match.Capture(idx)).AsLValue())
 		} else {
 			value = L.GetField(repl.AsLValue(), str[match.Capture(idx):match.Capture(idx+1)])
 		}
 		if !LVIsFalse(value) {
-			infoList = append(infoList, replaceInfo{[]int{match.Capture(0), match.Capture(1)}, LVAsString(value)})
+			infoList = append(infoList, replaceInfo{[]int{match.Capture(0), match.Capture(1)}, L.lvAsString(value)})
 		}
 	}
 	return strGsubDoReplace(str, infoList)
@@ -273,7 +320,7 @@ func strGsubFunc(L *LState, str string, repl *LFunction, matches []*pm.MatchData
 		if match.CaptureLength() > 2 { // has captures
 			for i := 2; i < match.CaptureLength(); i += 2 {
 				if match.IsPosCapture(i) {
-					L.Push(LNumber(match.Capture(i)).AsLValue())
+					L.Push(LInteger(match.Capture(i)).AsLValue())
 				} else {
 					L.Push(LString(capturedString(L, match, str, i)).AsLValue())
 				}
@@ -286,7 +333,7 @@ func strGsubFunc(L *LState, str string, repl *LFunction, matches []*pm.MatchData
 		L.Call(nargs, 1)
 		ret := L.reg.Pop()
 		if !LVIsFalse(ret) {
-			infoList = append(infoList, replaceInfo{[]int{start, end}, LVAsString(ret)})
+			infoList = append(infoList, replaceInfo{[]int{start, end}, L.lvAsString(ret)})
 		}
 	}
 	return strGsubDoReplace(str, infoList)
@@ -316,7 +363,7 @@ func strGmatchIter(L *LState) int {
 
 	for i := 2; i < match.CaptureLength(); i += 2 {
 		if match.IsPosCapture(i) {
-			L.Push(LNumber(match.Capture(i)).AsLValue())
+			L.Push(LInteger(match.Capture(i)).AsLValue())
 		} else {
 			L.Push(LString(str[match.Capture(i):match.Capture(i+1)]).AsLValue())
 		}
@@ -340,12 +387,13 @@ func strGmatch(L *LState) int {
 
 func strLen(L *LState) int {
 	str := L.CheckString(1)
-	L.Push(LNumber(len(str)).AsLValue())
+	L.Push(LInteger(len(str)).AsLValue())
 	return 1
 }
 
 func strLower(L *LState) int {
 	str := L.CheckString(1)
+	L.G.mem.chargeString(len(str))
 	L.Push(LString(strings.ToLower(str)).AsLValue())
 	return 1
 }
@@ -380,7 +428,7 @@ func strMatch(L *LState) int {
 	default:
 		for i := 2; i < md.CaptureLength(); i += 2 {
 			if md.IsPosCapture(i) {
-				L.Push(LNumber(md.Capture(i)).AsLValue())
+				L.Push(LInteger(md.Capture(i)).AsLValue())
 			} else {
 				L.Push(LString(str[md.Capture(i):md.Capture(i+1)]).AsLValue())
 			}
@@ -392,9 +440,13 @@ func strMatch(L *LState) int {
 func strRep(L *LState) int {
 	str := L.CheckString(1)
 	n := L.CheckInt(2)
-	if n < 0 {
+	if n <= 0 || len(str) == 0 {
 		L.Push(emptyLString.AsLValue())
 	} else {
+		if n > math.MaxInt/len(str) {
+			L.RaiseError("resulting string too large")
+		}
+		L.G.mem.chargeString(len(str) * n)
 		L.Push(LString(strings.Repeat(str, n)).AsLValue())
 	}
 	return 1
@@ -402,6 +454,7 @@ func strRep(L *LState) int {
 
 func strReverse(L *LState) int {
 	str := L.CheckString(1)
+	L.G.mem.chargeString(len(str))
 	bts := []byte(str)
 	out := make([]byte, len(bts))
 	for i, j := 0, len(bts)-1; j >= 0; i, j = i+1, j-1 {
@@ -426,10 +479,345 @@ func strSub(L *LState) int {
 
 func strUpper(L *LState) int {
 	str := L.CheckString(1)
+	L.G.mem.chargeString(len(str))
 	L.Push(LString(strings.ToUpper(str)).AsLValue())
 	return 1
 }
 
+/* string.pack and string.unpack {{{ */
+
+type packOption int
+
+const (
+	packOptInt       packOption = iota // signed integers
+	packOptUint                        // unsigned integers
+	packOptFloat                       // single-precision floats
+	packOptDouble                      // doubles and Lua numbers
+	packOptChar                        // fixed-size strings
+	packOptString                      // strings preceded by their length
+	packOptZstr                        // zero-terminated strings
+	packOptPadding                     // padding bytes
+	packOptPaddAlign                   // padding to the alignment of the next option
+	packOptNop                         // options that only change the header
+)
+
+const (
+	// packMaxIntSize is the largest size of integral options.
+	packMaxIntSize = 16
+	// packNativeAlign is the alignment used by a '!' option without a size.
+	packNativeAlign = 8
+	// packMaxSize is the largest size of a packed string.
+	packMaxSize = math.MaxInt32
+)
+
+var packNativeLittle = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// packHeader holds the state of a pack format string being parsed.
+type packHeader struct {
+	L        *LState
+	fmt      string
+	little   bool
+	maxAlign int
+}
+
+func newPackHeader(L *LState, fmt string) *packHeader {
+	return &packHeader{L: L, fmt: fmt, little: packNativeLittle, maxAlign: 1}
+}
+
+func (h *packHeader) done() bool {
+	return len(h.fmt) == 0
+}
+
+func (h *packHeader) readNum(df int) int {
+	if h.done() || h.fmt[0] < '0' || h.fmt[0] > '9' {
+		return df
+	}
+	n := 0
+	for {
+		n = n*10 + int(h.fmt[0]-'0')
+		h.fmt = h.fmt[1:]
+		if h.done() || h.fmt[0] < '0' || h.fmt[0] > '9' || n > (packMaxSize-9)/10 {
+			return n
+		}
+	}
+}
+
+func (h *packHeader) readNumLimit(df int) int {
+	size := h.readNum(df)
+	if size > packMaxIntSize || size <= 0 {
+		h.L.RaiseError("integral size (%d) out of limits [1,%d]", size, packMaxIntSize)
+	}
+	return size
+}
+
+// option reads the next option of the format and returns it with its size.
+func (h *packHeader) option() (packOption, int) {
+	opt := h.fmt[0]
+	h.fmt = h.fmt[1:]
+	switch opt {
+	case 'b':
+		return packOptInt, 1
+	case 'B':
+		return packOptUint, 1
+	case 'h':
+		return packOptInt, 2
+	case 'H':
+		return packOptUint, 2
+	case 'l', 'j':
+		return packOptInt, 8
+	case 'L', 'J', 'T':
+		return packOptUint, 8
+	case 'f':
+		return packOptFloat, 4
+	case 'd', 'n':
+		return packOptDouble, 8
+	case 'i':
+		return packOptInt, h.readNumLimit(4)
+	case 'I':
+		return packOptUint, h.readNumLimit(4)
+	case 's':
+		return packOptString, h.readNumLimit(8)
+	case 'c':
+		size := h.readNum(-1)
+		if size == -1 {
+			h.L.RaiseError("missing size for format option 'c'")
+		}
+		return packOptChar, size
+	case 'z':
+		return packOptZstr, 0
+	case 'x':
+		return packOptPadding, 1
+	case 'X':
+		return packOptPaddAlign, 0
+	case ' ':
+	case '<':
+		h.little = true
+	case '>':
+		h.little = false
+	case '=':
+		h.little = packNativeLittle
+	case '!':
+		h.maxAlign = h.readNumLimit(packNativeAlign)
+	default:
+		h.L.RaiseError("invalid format option '%c'", opt)
+	}
+	return packOptNop, 0
+}
+
+// details reads the next option and also returns the number of padding bytes
+// needed to align it, given the total size of the preceding options.
+func (h *packHeader) details(total int) (packOption, int, int) {
+	opt, size := h.option()
+	align := size
+	if opt == packOptPaddAlign {
+		next := packOptNop
+		if !h.done() {
+			next, align = h.option()
+		}
+		if next == packOptChar || align == 0 {
+			h.L.ArgError(1, "invalid next option for option 'X'")
+		}
+	}
+	if align <= 1 || opt == packOptChar {
+		return opt, size, 0
+	}
+	if align > h.maxAlign {
+		align = h.maxAlign
+	}
+	if align&(align-1) != 0 {
+		h.L.ArgError(1, "format asks for alignment not power of 2")
+	}
+	return opt, size, (align - total&(align-1)) & (align - 1)
+}
+
+func packInteger(buf []byte, n uint64, little bool, size int, neg bool) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, size)...)
+	for i := 0; i < size; i++ {
+		var b byte
+		if i < 8 {
+			b = byte(n >> (8 * i))
+		} else if neg {
+			b = 0xFF
+		}
+		if little {
+			buf[start+i] = b
+		} else {
+			buf[start+size-1-i] = b
+		}
+	}
+	return buf
+}
+
+func unpackInteger(L *LState, str string, little bool, size int, signed bool) int64 {
+	at := func(i int) byte {
+		if little {
+			return str[i]
+		}
+		return str[size-1-i]
+	}
+	var res uint64
+	limit := intMin(size, 8)
+	for i := limit - 1; i >= 0; i-- {
+		res = res<<8 | uint64(at(i))
+	}
+	if size < 8 {
+		if signed {
+			mask := uint64(1) << (size*8 - 1)
+			res = (res ^ mask) - mask
+		}
+	} else if size > 8 {
+		var mask byte
+		if signed && int64(res) < 0 {
+			mask = 0xFF
+		}
+		for i := limit; i < size; i++ {
+			if at(i) != mask {
+				L.RaiseError("%d-byte integer does not fit into Lua Integer", size)
+			}
+		}
+	}
+	return int64(res)
+}
+
+func strPack(L *LState) int {
+	h := newPackHeader(L, L.CheckString(1))
+	buf := []byte{}
+	arg := 1
+	for !h.done() {
+		opt, size, ntoalign := h.details(len(buf))
+		for ; ntoalign > 0; ntoalign-- {
+			buf = append(buf, 0)
+		}
+		arg++
+		switch opt {
+		case packOptInt:
+			n := L.checkInteger(arg)
+			if size < 8 {
+				lim := int64(1) << (size*8 - 1)
+				if n < -lim || n >= lim {
+					L.ArgError(arg, "integer overflow")
+				}
+			}
+			buf = packInteger(buf, uint64(n), h.little, size, n < 0)
+		case packOptUint:
+			n := L.checkInteger(arg)
+			if size < 8 && uint64(n) >= uint64(1)<<(size*8) {
+				L.ArgError(arg, "unsigned overflow")
+			}
+			buf = packInteger(buf, uint64(n), h.little, size, false)
+		case packOptFloat:
+			buf = packInteger(buf, uint64(math.Float32bits(float32(L.CheckNumber(arg)))), h.little, size, false)
+		case packOptDouble:
+			buf = packInteger(buf, math.Float64bits(float64(L.CheckNumber(arg))), h.little, size, false)
+		case packOptChar:
+			str := L.CheckString(arg)
+			if len(str) > size {
+				L.ArgError(arg, "string longer than given size")
+			}
+			buf = append(buf, str...)
+			buf = append(buf, make([]byte, size-len(str))...)
+		case packOptString:
+			str := L.CheckString(arg)
+			if size < 8 && uint64(len(str)) >= uint64(1)<<(size*8) {
+				L.ArgError(arg, "string length does not fit in given size")
+			}
+			buf = packInteger(buf, uint64(len(str)), h.little, size, false)
+			buf = append(buf, str...)
+		case packOptZstr:
+			str := L.CheckString(arg)
+			if strings.IndexByte(str, 0) >= 0 {
+				L.ArgError(arg, "string contains zeros")
+			}
+			buf = append(buf, str...)
+			buf = append(buf, 0)
+		case packOptPadding:
+			buf = append(buf, 0)
+			arg--
+		default:
+			arg--
+		}
+	}
+	L.G.mem.chargeString(len(buf))
+	L.Push(LString(string(buf)).AsLValue())
+	return 1
+}
+
+func strPackSize(L *LState) int {
+	h := newPackHeader(L, L.CheckString(1))
+	total := 0
+	for !h.done() {
+		opt, size, ntoalign := h.details(total)
+		if opt == packOptString || opt == packOptZstr {
+			L.ArgError(1, "variable-length format")
+		}
+		size += ntoalign
+		if total > packMaxSize-size {
+			L.ArgError(1, "format result too large")
+		}
+		total += size
+	}
+	L.Push(LInteger(total).AsLValue())
+	return 1
+}
+
+func strUnpack(L *LState) int {
+	h := newPackHeader(L, L.CheckString(1))
+	data := L.CheckString(2)
+	pos := L.OptInt(3, 1)
+	if pos < 0 {
+		pos = intMax(len(data)+pos+1, 1)
+	} else if pos == 0 {
+		pos = 1
+	}
+	pos--
+	if pos > len(data) {
+		L.ArgError(3, "initial position out of bounds")
+	}
+	n := 0
+	for !h.done() {
+		opt, size, ntoalign := h.details(pos)
+		if ntoalign+size > len(data)-pos {
+			L.ArgError(2, "data string too short")
+		}
+		pos += ntoalign
+		n++
+		switch opt {
+		case packOptInt, packOptUint:
+			L.Push(LInteger(unpackInteger(L, data[pos:], h.little, size, opt == packOptInt)).AsLValue())
+		case packOptFloat:
+			bits := unpackInteger(L, data[pos:], h.little, size, false)
+			L.Push(LNumber(math.Float32frombits(uint32(bits))).AsLValue())
+		case packOptDouble:
+			bits := unpackInteger(L, data[pos:], h.little, size, false)
+			L.Push(LNumber(math.Float64frombits(uint64(bits))).AsLValue())
+		case packOptChar:
+			L.Push(LString(data[pos : pos+size]).AsLValue())
+		case packOptString:
+			l := uint64(unpackInteger(L, data[pos:], h.little, size, false))
+			if l > uint64(len(data)-pos-size) {
+				L.ArgError(2, "data string too short")
+			}
+			L.Push(LString(data[pos+size : pos+size+int(l)]).AsLValue())
+			pos += int(l)
+		case packOptZstr:
+			l := strings.IndexByte(data[pos:], 0)
+			if l < 0 {
+				L.ArgError(2, "unfinished string for format 'z'")
+			}
+			L.Push(LString(data[pos : pos+l]).AsLValue())
+			pos += l + 1
+		default:
+			n--
+		}
+		pos += size
+	}
+	L.Push(LInteger(pos + 1).AsLValue())
+	return n + 1
+}
+
+/* }}} */
+
 func luaIndex2StringIndex(str string, i int, start bool) int {
 	if start && i != 0 {
 		i -= 1
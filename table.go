@@ -51,6 +51,9 @@ func newLTable(acap int, hcap int) *LTable {
 
 // Len returns length of this LTable without using __len.
 func (tb *LTable) Len() int {
+	if tb.weak != nil {
+		return tb.weakLen()
+	}
 	if tb.array == nil {
 		return 0
 	}
@@ -70,10 +73,15 @@ func (tb *LTable) Append(value LValue) {
 	if value.EqualsLNil() {
 		return
 	}
+	if tb.weak != nil {
+		tb.weakSet(LInteger(tb.weakLen()+1).AsLValue(), value)
+		return
+	}
 	if tb.array == nil {
 		tb.array = make([]LValue, 0, defaultArrayCap)
 	}
 	if len(tb.array) == 0 || !tb.array[len(tb.array)-1].EqualsLNil() {
+		tb.chargeArray(1)
 		tb.array = append(tb.array, value)
 	} else {
 		i := len(tb.array) - 2
@@ -88,6 +96,10 @@ func (tb *LTable) Append(value LValue) {
 
 // Insert inserts a given LValue at position `i` in this table.
 func (tb *LTable) Insert(i int, value LValue) {
+	if tb.weak != nil {
+		tb.weakInsert(i, value)
+		return
+	}
 	if tb.array == nil {
 		tb.array = make([]LValue, 0, defaultArrayCap)
 	}
@@ -96,10 +108,11 @@ func (tb *LTable) Insert(i int, value LValue) {
 		return
 	}
 	if i <= 0 {
-		tb.RawSet(LNumber(i).AsLValue(), value)
+		tb.RawSet(LInteger(i).AsLValue(), value)
 		return
 	}
 	i -= 1
+	tb.chargeArray(1)
 	tb.array = append(tb.array, LNil)
 	copy(tb.array[i+1:], tb.array[i:])
 	tb.array[i] = value
@@ -107,6 +120,9 @@ func (tb *LTable) Insert(i int, value LValue) {
 
 // MaxN returns a maximum number key that nil value does not exist before it.
 func (tb *LTable) MaxN() int {
+	if tb.weak != nil {
+		return tb.weakLen()
+	}
 	if tb.array == nil {
 		return 0
 	}
@@ -120,6 +136,9 @@ func (tb *LTable) MaxN() int {
 
 // Remove removes from this table the element at a given position.
 func (tb *LTable) Remove(pos int) LValue {
+	if tb.weak != nil {
+		return tb.weakRemove(pos)
+	}
 	if tb.array == nil {
 		return LValue{}
 	}
@@ -148,19 +167,24 @@ func (tb *LTable) Remove(pos int) LValue {
 // It is recommended to use `RawSetString` or `RawSetInt` for performance
 // if you already know the given LValue is a string or number.
 func (tb *LTable) RawSet(key LValue, value LValue) {
+	if tb.weak != nil {
+		tb.weakSet(key, value)
+		return
+	}
 	switch v := key; v.Type() {
 	case LTNumber:
-		v := v.mustLNumberUnchecked()
-		if isArrayKey(v) {
+		key = normalizeNumberKey(v)
+		if index, ok := arrayIndex(key); ok {
 			if tb.array == nil {
 				tb.array = make([]LValue, 0, defaultArrayCap)
 			}
-			index := int(v) - 1
 			alen := len(tb.array)
 			switch {
 			case index == alen:
+				tb.chargeArray(1)
 				tb.array = append(tb.array, value)
 			case index > alen:
+				tb.chargeArray(index - alen + 1)
 				for i := 0; i < (index - alen); i++ {
 					tb.array = append(tb.array, LNil)
 				}
@@ -181,8 +205,12 @@ func (tb *LTable) RawSet(key LValue, value LValue) {
 
 // RawSetInt sets a given LValue at a position `key` without the __newindex metamethod.
 func (tb *LTable) RawSetInt(key int, value LValue) {
+	if tb.weak != nil {
+		tb.weakSet(LInteger(key).AsLValue(), value)
+		return
+	}
 	if key < 1 || key >= MaxArrayIndex {
-		tb.RawSetH(LNumber(key).AsLValue(), value)
+		tb.RawSetH(LInteger(key).AsLValue(), value)
 		return
 	}
 	if tb.array == nil {
@@ -192,8 +220,10 @@ func (tb *LTable) RawSetInt(key int, value LValue) {
 	alen := len(tb.array)
 	switch {
 	case index == alen:
+		tb.chargeArray(1)
 		tb.array = append(tb.array, value)
 	case index > alen:
+		tb.chargeArray(index - alen + 1)
 		for i := 0; i < (index - alen); i++ {
 			tb.array = append(tb.array, LNil)
 		}
@@ -205,6 +235,10 @@ func (tb *LTable) RawSetInt(key int, value LValue) {
 
 // RawSetString sets a given LValue to a given string index without the __newindex metamethod.
 func (tb *LTable) RawSetString(key string, value LValue) {
+	if tb.weak != nil {
+		tb.weakSet(LString(key).AsLValue(), value)
+		return
+	}
 	if tb.strdict == nil {
 		tb.strdict = make(map[string]*ltableSlot, defaultHashCap)
 	}
@@ -216,12 +250,17 @@ func (tb *LTable) RawSetString(key string, value LValue) {
 	} else if slot != nil {
 		slot.value = value
 	} else {
+		tb.chargeHash()
 		tb.strdict[key] = tb.slots.Put(LString(key).AsLValue(), value)
 	}
 }
 
 // RawSetH sets a given LValue to a given index without the __newindex metamethod.
 func (tb *LTable) RawSetH(key LValue, value LValue) {
+	if tb.weak != nil {
+		tb.weakSet(key, value)
+		return
+	}
 	if s, ok := key.AsLString(); ok {
 		tb.RawSetString(string(s), value)
 		return
@@ -229,6 +268,7 @@ func (tb *LTable) RawSetH(key LValue, value LValue) {
 	if tb.dict == nil {
 		tb.dict = make(map[[2]uintptr]*ltableSlot, len(tb.strdict))
 	}
+	key = normalizeNumberKey(key)
 
 	ckey := key.asComparable()
 	slot := tb.dict[ckey]
@@ -238,21 +278,21 @@ func (tb *LTable) RawSetH(key LValue, value LValue) {
 	} else if slot != nil {
 		slot.value = value
 	} else {
+		tb.chargeHash()
 		tb.dict[ckey] = tb.slots.Put(key, value)
 	}
 }
 
 // RawGet returns an LValue associated with a given key without __index metamethod.
 func (tb *LTable) RawGet(key LValue) LValue {
+	if tb.weak != nil {
+		return tb.weakGet(key)
+	}
 	switch v := key; v.Type() {
 	case LTNumber:
-		v := v.mustLNumberUnchecked()
-		if isArrayKey(v) {
-			if tb.array == nil {
-				return LValue{}
-			}
-			index := int(v) - 1
-			if index >= len(tb.array) {
+		key = normalizeNumberKey(v)
+		if index, ok := arrayIndex(key); ok {
+			if tb.array == nil || index >= len(tb.array) {
 				return LValue{}
 			}
 			return tb.array[index]
@@ -277,11 +317,15 @@ func (tb *LTable) RawGet(key LValue) LValue {
 }
 
 func (tb *LTable) rawDelete(key LValue) (deleted bool) {
+	if tb.weak != nil {
+		deleted = !tb.weakGet(key).EqualsLNil()
+		tb.weakSet(key, LNil)
+		return deleted
+	}
 	switch v := key; v.Type() {
 	case LTNumber:
-		v := v.mustLNumberUnchecked()
-		if isArrayKey(v) {
-			index := int(v) - 1
+		key = normalizeNumberKey(v)
+		if index, ok := arrayIndex(key); ok {
 			alen := len(tb.array)
 			if index < alen {
 				deleted = !tb.array[index].EqualsLNil()
@@ -301,7 +345,7 @@ func (tb *LTable) rawDeleteH(key LValue) (deleted bool) {
 	if tb.dict == nil {
 		return false
 	}
-	ckey := key.asComparable()
+	ckey := normalizeNumberKey(key).asComparable()
 	if slot, ok := tb.dict[ckey]; ok {
 		deleted = !slot.value.EqualsLNil()
 		slot.value = LValue{}
@@ -326,16 +370,18 @@ func (tb *LTable) rawDeleteString(key string) (deleted bool) {
 	return false
 }
 
+// rawGetForSet returns the slot holding the value of key, or nil if there is
+// none. Weak tables store their values as weak references and have no slot to
+// give; see weakReplace.
 func (tb *LTable) rawGetForSet(key LValue) *LValue {
+	if tb.weak != nil {
+		return nil
+	}
 	switch v := key; v.Type() {
 	case LTNumber:
-		v := v.mustLNumberUnchecked()
-		if isArrayKey(v) {
-			if tb.array == nil {
-				return nil
-			}
-			index := int(v) - 1
-			if index >= len(tb.array) {
+		key = normalizeNumberKey(v)
+		if index, ok := arrayIndex(key); ok {
+			if tb.array == nil || index >= len(tb.array) {
 				return nil
 			}
 			return &tb.array[index]
@@ -361,6 +407,9 @@ func (tb *LTable) rawGetForSet(key LValue) *LValue {
 
 // RawGetInt returns an LValue at position `key` without __index metamethod.
 func (tb *LTable) RawGetInt(key int) LValue {
+	if tb.weak != nil {
+		return tb.weakGet(LInteger(key).AsLValue())
+	}
 	if tb.array == nil {
 		return LValue{}
 	}
@@ -373,6 +422,9 @@ func (tb *LTable) RawGetInt(key int) LValue {
 
 // RawGet returns an LValue associated with a given key without __index metamethod.
 func (tb *LTable) RawGetH(key LValue) LValue {
+	if tb.weak != nil {
+		return tb.weakGet(key)
+	}
 	if s, sok := key.AsLString(); sok {
 		if tb.strdict == nil {
 			return LValue{}
@@ -385,7 +437,7 @@ func (tb *LTable) RawGetH(key LValue) LValue {
 	if tb.dict == nil {
 		return LValue{}
 	}
-	if v, ok := tb.dict[key.asComparable()]; ok {
+	if v, ok := tb.dict[normalizeNumberKey(key).asComparable()]; ok {
 		return v.value
 	}
 	return LValue{}
@@ -393,6 +445,9 @@ func (tb *LTable) RawGetH(key LValue) LValue {
 
 // RawGetString returns an LValue associated with a given key without __index metamethod.
 func (tb *LTable) RawGetString(key string) LValue {
+	if tb.weak != nil {
+		return tb.weakGet(LString(key).AsLValue())
+	}
 	if tb.strdict == nil {
 		return LValue{}
 	}
@@ -404,10 +459,14 @@ func (tb *LTable) RawGetString(key string) LValue {
 
 // ForEach iterates over this table of elements, yielding each in turn to a given function.
 func (tb *LTable) ForEach(cb func(LValue, LValue)) {
+	if tb.weak != nil {
+		tb.weakForEach(cb)
+		return
+	}
 	if tb.array != nil {
 		for i, v := range tb.array {
 			if !v.EqualsLNil() {
-				cb(LNumber(i+1).AsLValue(), v)
+				cb(LInteger(i+1).AsLValue(), v)
 			}
 		}
 	}
@@ -420,19 +479,24 @@ func (tb *LTable) ForEach(cb func(LValue, LValue)) {
 
 // This function is equivalent to lua_next ( http://www.lua.org/manual/5.1/manual.html#lua_next ).
 func (tb *LTable) Next(key LValue) (LValue, LValue) {
+	if tb.weak != nil {
+		return tb.weakNext(key)
+	}
 	init := false
 	if key.EqualsLNil() {
-		key = LNumber(0).AsLValue()
+		key = LInteger(0).AsLValue()
 		init = true
+	} else {
+		key = normalizeNumberKey(key)
 	}
 
-	if init || !key.Equals(LNumber(0).AsLValue()) {
-		if kv, ok := key.AsLNumber(); ok && isInteger(kv) && int(kv) >= 0 && kv < LNumber(MaxArrayIndex) {
+	if init || !key.Equals(LInteger(0).AsLValue()) {
+		if kv, ok := key.AsLInteger(); ok && kv >= 0 && kv < LInteger(MaxArrayIndex) {
 			index := int(kv)
 			if tb.array != nil {
 				for ; index < len(tb.array); index++ {
 					if v := tb.array[index]; !v.EqualsLNil() {
-						return LNumber(index + 1).AsLValue(), v
+						return LInteger(index + 1).AsLValue(), v
 					}
 				}
 			}
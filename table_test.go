@@ -267,3 +267,57 @@ func TestTableGrow(t *testing.T) {
 	tbl.RawSetString(strconv.Itoa(1), LNil)
 	errorIfNotEqual(t, 1, len(tbl.slots.blocks))
 }
+
+func TestTableWeak(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `
+	local function count(t)
+		local n = 0
+		for _ in pairs(t) do n = n + 1 end
+		return n
+	end
+
+	local keep = {}
+	local wk = setmetatable({}, {__mode = "k"})
+	wk[keep] = 1
+	wk[{}] = 2
+	wk.name = {}
+	local wv = setmetatable({1, 2}, {__mode = "v"})
+	wv[3] = {}
+	wv[4] = keep
+	wv.fn = function() end
+	local eph = setmetatable({}, {__mode = "k"})
+	do
+		local k = {}
+		eph[k] = {k}
+	end
+	eph[keep] = {keep}
+	collectgarbage()
+	assert(count(wk) == 2 and wk[keep] == 1 and wk.name ~= nil)
+	assert(count(wv) == 3 and wv[3] == nil and wv[4] == keep and wv.fn == nil)
+	assert(#wv == 2)
+	assert(count(eph) == 1 and eph[keep][1] == keep)
+
+	local s = setmetatable({3, 1, 2}, {__mode = "kv"})
+	table.sort(s)
+	table.insert(s, 1, 0)
+	assert(table.remove(s) == 3)
+	assert(#s == 3 and s[1] == 0 and s[2] == 1 and s[3] == 2)
+
+	setmetatable(wk, nil)
+	wk[{}] = 3
+	collectgarbage()
+	assert(count(wk) == 3)
+
+	-- assigning an existing key does not call __newindex
+	local calls = 0
+	local mt = {__mode = "k", __newindex = function(t, k, v) calls = calls + 1; rawset(t, k, v) end}
+	local wn = setmetatable({}, mt)
+	wn[keep] = 1
+	wn.name = 1
+	wn[keep] = 2
+	wn.name = 2
+	assert(calls == 2 and wn[keep] == 2 and wn.name == 2)
+	`)
+}
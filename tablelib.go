@@ -6,6 +6,9 @@ import (
 
 func OpenTable(L *LState) int {
 	tabmod := L.RegisterModule(TabLibName, tableFuncs)
+	if L.Options.LanguageVersion >= Lua52 {
+		L.SetFuncs(tabmod.MustLTable(), tableFuncs52)
+	}
 	L.Push(tabmod)
 	return 1
 }
@@ -19,23 +22,52 @@ var tableFuncs = map[string]LGFunction{
 	"sort":   tableSort,
 }
 
+// tableFuncs52 are the table functions added by Lua 5.2.
+var tableFuncs52 = map[string]LGFunction{
+	"pack":   tablePack,
+	"unpack": baseUnpack,
+}
+
+func tablePack(L *LState) int {
+	n := L.GetTop()
+	tb := L.CreateTable(n, 1)
+	for i := 1; i <= n; i++ {
+		tb.RawSetInt(i, L.Get(i))
+	}
+	tb.RawSetString("n", LInteger(n).AsLValue())
+	L.Push(tb.AsLValue())
+	return 1
+}
+
 func tableSort(L *LState) int {
 	tbl := L.CheckTable(1)
-	sorter := lValueArraySorter{L, nil, tbl.array}
+	values := tbl.array
+	if tbl.weak != nil {
+		values = make([]LValue, tbl.Len())
+		for i := range values {
+			values[i] = tbl.RawGetInt(i + 1)
+		}
+	}
+	sorter := lValueArraySorter{L, nil, values}
 	if L.GetTop() != 1 {
 		sorter.Fn = L.CheckFunction(2)
 	}
 	sort.Sort(sorter)
+	if tbl.weak != nil {
+		for i, v := range values {
+			tbl.RawSetInt(i+1, v)
+		}
+	}
 	return 0
 }
 
 func tableGetN(L *LState) int {
-	L.Push(LNumber(L.CheckTable(1).Len()).AsLValue())
+	L.Push(LInteger(L.CheckTable(1).Len()).AsLValue())
 	return 1
 }
 
 func tableMaxN(L *LState) int {
-	L.Push(LNumber(L.CheckTable(1).MaxN()).AsLValue())
+	L.Push(LInteger(L.CheckTable(1).MaxN()).AsLValue())
 	return 1
 }
 
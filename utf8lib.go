@@ -0,0 +1,251 @@
+package lua
+
+const (
+	// utf8MaxCode is the largest code point accepted in lax mode.
+	utf8MaxCode = 0x7FFFFFFF
+	// utf8MaxUnicode is the largest code point accepted in strict mode.
+	utf8MaxUnicode = 0x10FFFF
+	// utf8CharPattern matches exactly one UTF-8 byte sequence.
+	utf8CharPattern = "[\x00-\x7F\xC2-\xFD][\x80-\xBF]*"
+)
+
+func OpenUtf8(L *LState) int {
+	mod := L.RegisterModule(Utf8LibName, utf8Funcs).MustLTable()
+	mod.RawSetString("charpattern", LString(utf8CharPattern).AsLValue())
+	mod.RawSetString("codes", L.NewClosure(utf8Codes, L.NewFunction(utf8CodesIter).AsLValue(), L.NewFunction(utf8CodesIterLax).AsLValue()).AsLValue())
+	L.Push(mod.AsLValue())
+	return 1
+}
+
+var utf8Funcs = map[string]LGFunction{
+	"char":      utf8Char,
+	"codepoint": utf8Codepoint,
+	"len":       utf8Len,
+	"offset":    utf8Offset,
+}
+
+/* helpers {{{ */
+
+func utf8IsCont(b byte) bool {
+	return b&0xC0 == 0x80
+}
+
+// utf8PosRelative converts a relative string position (negative means back
+// from the end) to an absolute one, returning 0 for positions before the start.
+func utf8PosRelative(pos, l int) int {
+	if pos >= 0 {
+		return pos
+	} else if -pos > l {
+		return 0
+	}
+	return l + pos + 1
+}
+
+// utf8Decode decodes the sequence at the start of s, returning the code point
+// and the length of the sequence, or a length of 0 if the sequence is invalid.
+// In strict mode, surrogates and code points beyond U+10FFFF are invalid.
+func utf8Decode(s string, strict bool) (int, int) {
+	limits := [...]int{^0, 0x80, 0x800, 0x10000, 0x200000, 0x4000000}
+	c := int(s[0])
+	if c < 0x80 {
+		return c, 1
+	}
+	res := 0
+	count := 0
+	for ; c&0x40 != 0; c <<= 1 {
+		count++
+		if count >= len(s) || !utf8IsCont(s[count]) {
+			return 0, 0
+		}
+		res = res<<6 | int(s[count]&0x3F)
+	}
+	if count > 5 || count == 0 {
+		return 0, 0
+	}
+	res |= (c & 0x7F) << (count * 5)
+	if res > utf8MaxCode || res < limits[count] {
+		return 0, 0
+	}
+	if strict && (res > utf8MaxUnicode || (0xD800 <= res && res <= 0xDFFF)) {
+		return 0, 0
+	}
+	return res, count + 1
+}
+
+// utf8Encode appends the (possibly lax) UTF-8 encoding of code to buf.
+func utf8Encode(buf []byte, code int) []byte {
+	if code < 0x80 {
+		return append(buf, byte(code))
+	}
+	var tmp [6]byte
+	n := len(tmp)
+	mfb := 0x3F // largest value that fits in the first byte
+	for code > mfb {
+		n--
+		tmp[n] = byte(0x80 | code&0x3F)
+		code >>= 6
+		mfb >>= 1
+	}
+	n--
+	tmp[n] = byte((^mfb << 1) | code)
+	return append(buf, tmp[n:]...)
+}
+
+/* }}} */
+
+func utf8Char(L *LState) int {
+	top := L.GetTop()
+	L.G.mem.chargeString(top)
+	buf := make([]byte, 0, top)
+	for i := 1; i <= top; i++ {
+		code := L.CheckInt64(i)
+		if code < 0 || code > utf8MaxCode {
+			L.ArgError(i, "value out of range")
+		}
+		buf = utf8Encode(buf, int(code))
+	}
+	L.Push(LString(string(buf)).AsLValue())
+	return 1
+}
+
+func utf8Codepoint(L *LState) int {
+	str := L.CheckString(1)
+	i := utf8PosRelative(L.OptInt(2, 1), len(str))
+	j := utf8PosRelative(L.OptInt(3, i), len(str))
+	strict := !L.OptBool(4, false)
+	if i < 1 {
+		L.ArgError(2, "out of bounds")
+	}
+	if j > len(str) {
+		L.ArgError(3, "out of bounds")
+	}
+	n := 0
+	for pos := i - 1; pos < j; {
+		code, size := utf8Decode(str[pos:], strict)
+		if size == 0 {
+			L.RaiseError("invalid UTF-8 code")
+		}
+		L.Push(LInteger(code).AsLValue())
+		pos += size
+		n++
+	}
+	return n
+}
+
+func utf8Len(L *LState) int {
+	str := L.CheckString(1)
+	i := utf8PosRelative(L.OptInt(2, 1), len(str))
+	j := utf8PosRelative(L.OptInt(3, -1), len(str))
+	strict := !L.OptBool(4, false)
+	if i < 1 || i > len(str)+1 {
+		L.ArgError(2, "initial position out of bounds")
+	}
+	if j > len(str) {
+		L.ArgError(3, "final position out of bounds")
+	}
+	n := 0
+	for pos := i - 1; pos < j; n++ {
+		_, size := utf8Decode(str[pos:], strict)
+		if size == 0 {
+			L.Push(LNil)
+			L.Push(LInteger(pos + 1).AsLValue())
+			return 2
+		}
+		pos += size
+	}
+	L.Push(LInteger(n).AsLValue())
+	return 1
+}
+
+func utf8Offset(L *LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+	defi := 1
+	if n < 0 {
+		defi = len(str) + 1
+	}
+	i := utf8PosRelative(L.OptInt(3, defi), len(str))
+	if i < 1 || i > len(str)+1 {
+		L.ArgError(3, "position out of bounds")
+	}
+	pos := i - 1
+	isCont := func(pos int) bool {
+		return pos < len(str) && utf8IsCont(str[pos])
+	}
+	if n == 0 {
+		// find the beginning of the current byte sequence
+		for pos > 0 && isCont(pos) {
+			pos--
+		}
+	} else {
+		if isCont(pos) {
+			L.RaiseError("initial position is a continuation byte")
+		}
+		if n < 0 {
+			for ; n < 0 && pos > 0; n++ {
+				pos--
+				for pos > 0 && isCont(pos) {
+					pos--
+				}
+			}
+		} else {
+			for n--; n > 0 && pos < len(str); n-- {
+				pos++
+				for isCont(pos) {
+					pos++
+				}
+			}
+		}
+	}
+	if n != 0 {
+		// did not find the given character
+		L.Push(LNil)
+		return 1
+	}
+	L.Push(LInteger(pos + 1).AsLValue())
+	return 1
+}
+
+func utf8Codes(L *LState) int {
+	str := L.CheckString(1)
+	iter := L.Get(UpvalueIndex(1))
+	if L.OptBool(2, false) {
+		iter = L.Get(UpvalueIndex(2))
+	}
+	if len(str) > 0 && utf8IsCont(str[0]) {
+		L.ArgError(1, "invalid UTF-8 code")
+	}
+	L.Push(iter)
+	L.Push(LString(str).AsLValue())
+	L.Push(LInteger(0).AsLValue())
+	return 3
+}
+
+func utf8CodesIter(L *LState) int {
+	return utf8CodesIterAux(L, true)
+}
+
+func utf8CodesIterLax(L *LState) int {
+	return utf8CodesIterAux(L, false)
+}
+
+func utf8CodesIterAux(L *LState, strict bool) int {
+	str := L.CheckString(1)
+	pos := L.CheckInt(2)
+	// skip the continuation bytes of the current sequence
+	if pos > 0 {
+		for pos < len(str) && utf8IsCont(str[pos]) {
+			pos++
+		}
+	}
+	if pos >= len(str) {
+		return 0
+	}
+	code, size := utf8Decode(str[pos:], strict)
+	if size == 0 || (pos+size < len(str) && utf8IsCont(str[pos+size])) {
+		L.RaiseError("invalid UTF-8 code")
+	}
+	L.Push(LInteger(pos + 1).AsLValue())
+	L.Push(LInteger(code).AsLValue())
+	return 2
+}
@@ -136,8 +136,53 @@ func isInteger(v LNumber) bool {
 	//return frac == 0.0
 }
 
-func isArrayKey(v LNumber) bool {
-	return isInteger(v) && v < LNumber(int((^uint(0))>>1)) && v > LNumber(0) && v < LNumber(MaxArrayIndex)
+// floatToInteger converts f to an integer if it has an exact integer
+// representation.
+func floatToInteger(f float64) (int64, bool) {
+	if f >= -(1<<63) && f < 1<<63 {
+		if i := int64(f); float64(i) == f {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// numberEquals compares two numbers by their mathematical values, so that an
+// integer and a float are equal only if the float is exactly that integer.
+func numberEquals(lhs, rhs LValue) bool {
+	i1, isInt1 := lhs.AsLInteger()
+	i2, isInt2 := rhs.AsLInteger()
+	switch {
+	case isInt1 && isInt2:
+		return i1 == i2
+	case isInt1:
+		i, ok := floatToInteger(float64(rhs.mustLNumberUnchecked()))
+		return ok && LInteger(i) == i1
+	case isInt2:
+		i, ok := floatToInteger(float64(lhs.mustLNumberUnchecked()))
+		return ok && LInteger(i) == i2
+	}
+	return lhs.mustLNumberUnchecked() == rhs.mustLNumberUnchecked()
+}
+
+// normalizeNumberKey converts a float table key with an exact integer value to
+// an integer, so that t[1] and t[1.0] refer to the same slot.
+func normalizeNumberKey(key LValue) LValue {
+	if key.dataptr == unsafe.Pointer(&ltSentinelNumber) {
+		if i, ok := floatToInteger(float64(key.mustLNumberUnchecked())); ok {
+			return LInteger(i).AsLValue()
+		}
+	}
+	return key
+}
+
+// arrayIndex returns the index into the array part of a table for a
+// normalized number key.
+func arrayIndex(key LValue) (int, bool) {
+	if i, ok := key.AsLInteger(); ok && i > 0 && i < LInteger(MaxArrayIndex) {
+		return int(i) - 1, true
+	}
+	return 0, false
 }
 
 func parseNumber(number string) (LNumber, error) {
@@ -155,6 +200,20 @@ func parseNumber(number string) (LNumber, error) {
 	return value, nil
 }
 
+// parseNumberValue is like parseNumber but returns an integer for numerals
+// that are integers and fit in an LInteger.
+func parseNumberValue(number string) (LValue, error) {
+	number = strings.Trim(number, " \t\n")
+	if v, err := strconv.ParseInt(number, 0, LNumberBit); err == nil {
+		return LInteger(v).AsLValue(), nil
+	}
+	v, err := strconv.ParseFloat(number, LNumberBit)
+	if err != nil {
+		return LNil, err
+	}
+	return LNumber(v).AsLValue(), nil
+}
+
 func popenArgs(arg string) (string, []string) {
 	cmd := "/bin/sh"
 	args := []string{"-c"}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"os"
 	"strconv"
+	"strings"
 	"unsafe"
 )
 
@@ -27,6 +28,12 @@ const (
 var lValueNames = [9]string{"nil", "boolean", "number", "string", "function", "userdata", "thread", "table", "channel"}
 
 func (vt LValueType) String() string {
+	if vt > LTUnknown {
+		return "userdata"
+	}
+	if vt == LTUnknown {
+		return "unknown"
+	}
 	return lValueNames[int(vt)]
 }
 
@@ -42,9 +49,10 @@ func (lv LValue) asComparable() [2]uintptr {
 }
 
 var (
-	ltSentinelNumber byte
-	ltSentinelTrue   byte
-	ltSentinelFalse  byte
+	ltSentinelNumber  byte
+	ltSentinelInteger byte
+	ltSentinelTrue    byte
+	ltSentinelFalse   byte
 )
 
 const maxUintptr = ^uintptr(0)>>1 + 1
@@ -59,8 +67,14 @@ func AnyEqual(v1, v2 any) bool {
 		return v11.Equals(v22)
 	}
 	if ok1 {
+		if v2, ok := v2.(interface{ AsLValue() LValue }); ok {
+			return v11.Equals(v2.AsLValue())
+		}
 		return v11.AsAny() == v2
 	}
+	if v1, ok := v1.(interface{ AsLValue() LValue }); ok {
+		return v1.AsLValue().Equals(v22)
+	}
 	return v1 == v22.AsAny()
 }
 
@@ -84,7 +98,10 @@ func (lv LValue) IsEmpty() bool {
 
 func (lv LValue) Equals(other LValue) bool {
 	if v2, ok2 := other.AsLString(); !ok2 {
-		return lv.dataptr == other.dataptr && lv.data == other.data
+		if lv.dataptr == other.dataptr {
+			return lv.data == other.data
+		}
+		return lv.isNumber() && other.isNumber() && numberEquals(lv, other)
 	} else if v1, ok1 := lv.AsLString(); !ok1 {
 		return false
 	} else {
@@ -112,6 +129,9 @@ func (lv LValue) String() string {
 		v, _ := lv.AsLBool()
 		return v.String()
 	case LTNumber:
+		if v, ok := lv.AsLInteger(); ok {
+			return v.String()
+		}
 		v, _ := lv.AsLNumber()
 		return v.String()
 	case LTString:
@@ -133,7 +153,7 @@ func (lv LValue) String() string {
 		v, _ := lv.AsLChannel()
 		return v.String()
 	default:
-		panic("unreachable")
+		return fmt.Sprintf("%v: %p", lv.Type().String(), lv.dataptr)
 	}
 }
 
@@ -146,6 +166,9 @@ func (lv LValue) AsAny() any {
 		v, _ := lv.AsLBool()
 		return v
 	case LTNumber:
+		if v, ok := lv.AsLInteger(); ok {
+			return v
+		}
 		v, _ := lv.AsLNumber()
 		return v
 	case LTString:
@@ -169,7 +192,7 @@ func (lv LValue) AsAny() any {
 	case LTUnknown:
 		return nil
 	default:
-		if entry, ok := cdr.Entry(t); ok {
+		if entry, ok := lookupCustomDataEntry(t); ok {
 			return entry.PackAny(lv.dataptr)
 		}
 		panic("unreachable")
@@ -182,7 +205,7 @@ func (lv LValue) Type() LValueType {
 	if lv.IsEmpty() {
 		return LTNil
 	}
-	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) {
+	if lv.isNumber() {
 		return LTNumber
 	}
 	if lv.data&maxUintptr == 0 {
@@ -192,7 +215,7 @@ func (lv LValue) Type() LValueType {
 	if typ < uintptr(LTUnknown) {
 		return LValueType(typ)
 	}
-	if _, ok := cdr.Entry(LValueType(typ)); ok {
+	if _, ok := lookupCustomDataEntry(LValueType(typ)); ok {
 		return LValueType(typ)
 	}
 	return LTUnknown
@@ -229,10 +252,22 @@ func (lv LValue) AsLBool() (LBool, bool) {
 	return LFalse, false
 }
 
+func (lv LValue) isNumber() bool {
+	return lv.dataptr == unsafe.Pointer(&ltSentinelNumber) || lv.dataptr == unsafe.Pointer(&ltSentinelInteger)
+}
+
+func (lv LValue) isLInteger() bool {
+	return lv.dataptr == unsafe.Pointer(&ltSentinelInteger)
+}
+
 func (lv LValue) mustLNumberUnchecked() LNumber {
 	return LNumber(math.Float64frombits(uint64(lv.data)))
 }
 
+func (lv LValue) mustLIntegerUnchecked() LInteger {
+	return LInteger(lv.data)
+}
+
 func (lv LValue) MustLNumber() LNumber {
 	if v, ok := lv.AsLNumber(); ok {
 		return v
@@ -240,13 +275,46 @@ func (lv LValue) MustLNumber() LNumber {
 	panic("not number")
 }
 
+// AsLNumber returns the value of a number as an LNumber. Integers are
+// converted to the nearest float.
 func (lv LValue) AsLNumber() (LNumber, bool) {
 	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) {
 		return LNumber(math.Float64frombits(uint64(lv.data))), true
 	}
+	if lv.dataptr == unsafe.Pointer(&ltSentinelInteger) {
+		return LNumber(LInteger(lv.data)), true
+	}
 	return LNumber(0), false
 }
 
+func (lv LValue) MustLInteger() LInteger {
+	if v, ok := lv.AsLInteger(); ok {
+		return v
+	}
+	panic("not integer")
+}
+
+// AsLInteger returns the value of a number of the integer subtype. Floats are
+// not converted, even if they have an integral value; see math.tointeger for
+// the Lua-level conversion.
+func (lv LValue) AsLInteger() (LInteger, bool) {
+	if lv.dataptr == unsafe.Pointer(&ltSentinelInteger) {
+		return LInteger(lv.data), true
+	}
+	return LInteger(0), false
+}
+
+// asInt64 returns the value of a number as an int64, truncating floats.
+func (lv LValue) asInt64() (int64, bool) {
+	if lv.dataptr == unsafe.Pointer(&ltSentinelInteger) {
+		return int64(lv.data), true
+	}
+	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) {
+		return int64(math.Float64frombits(uint64(lv.data))), true
+	}
+	return 0, false
+}
+
 func (lv LValue) mustLStringUnchecked() LString {
 	return LString(unsafe.String((*byte)(lv.dataptr), int(lv.data)))
 }
@@ -259,7 +327,7 @@ func (lv LValue) MustLString() LString {
 }
 
 func (lv LValue) AsLString() (LString, bool) {
-	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) || lv.IsEmpty() {
+	if lv.isNumber() || lv.IsEmpty() {
 		return "", false
 	}
 	if lv.data&maxUintptr == 0 {
@@ -277,7 +345,7 @@ func (lv LValue) MustLTable() *LTable {
 }
 
 func (lv LValue) AsLTable() (*LTable, bool) {
-	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) || lv.data != maxUintptr+uintptr(LTTable) {
+	if lv.isNumber() || lv.data != maxUintptr+uintptr(LTTable) {
 		return nil, false
 	}
 	return (*LTable)(lv.dataptr), true
@@ -291,7 +359,7 @@ func (lv LValue) MustLFunction() *LFunction {
 }
 
 func (lv LValue) AsLFunction() (*LFunction, bool) {
-	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) || lv.data != maxUintptr+uintptr(LTFunction) {
+	if lv.isNumber() || lv.data != maxUintptr+uintptr(LTFunction) {
 		return nil, false
 	}
 	return (*LFunction)(lv.dataptr), true
@@ -305,7 +373,7 @@ func (lv LValue) MustLUserData() *LUserData {
 }
 
 func (lv LValue) AsLUserData() (*LUserData, bool) {
-	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) || lv.data != maxUintptr+uintptr(LTUserData) {
+	if lv.isNumber() || lv.data != maxUintptr+uintptr(LTUserData) {
 		return nil, false
 	}
 	return (*LUserData)(lv.dataptr), true
@@ -319,7 +387,7 @@ func (lv LValue) MustLChannel() LChannel {
 }
 
 func (lv LValue) AsLChannel() (LChannel, bool) {
-	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) || lv.data != maxUintptr+uintptr(LTChannel) {
+	if lv.isNumber() || lv.data != maxUintptr+uintptr(LTChannel) {
 		return nil, false
 	}
 	return *(*LChannel)(unsafe.Pointer(&lv.dataptr)), true
@@ -333,7 +401,7 @@ func (lv LValue) MustLThread() *LState {
 }
 
 func (lv LValue) AsLThread() (*LState, bool) {
-	if lv.dataptr == unsafe.Pointer(&ltSentinelNumber) || lv.data != maxUintptr+uintptr(LTThread) {
+	if lv.isNumber() || lv.data != maxUintptr+uintptr(LTThread) {
 		return nil, false
 	}
 	return (*LState)(lv.dataptr), true
@@ -356,7 +424,9 @@ func LVAsBool(v LValue) bool { return !v.EqualsLNil() && v.dataptr != unsafe.Poi
 // LVAsString returns string representation of a given LValue
 // if the LValue is a string or number, otherwise an empty string.
 func LVAsString(v LValue) string {
-	if n, ok := v.AsLNumber(); ok {
+	if i, ok := v.AsLInteger(); ok {
+		return i.String()
+	} else if n, ok := v.AsLNumber(); ok {
 		return n.String()
 	} else if s, ok := v.AsLString(); ok {
 		return string(s)
@@ -364,6 +434,27 @@ func LVAsString(v LValue) string {
 	return ""
 }
 
+// lvAsString is LVAsString for the language version of ls: from Lua 5.3 on,
+// floats with an integral value are written with a trailing ".0".
+func (ls *LState) lvAsString(v LValue) string {
+	if ls.Options.LanguageVersion >= Lua53 && v.isNumber() {
+		if _, ok := v.AsLInteger(); !ok {
+			return floatString(v.MustLNumber())
+		}
+	}
+	return LVAsString(v)
+}
+
+// floatString formats nm as Lua 5.3 does, with 14 significant digits and a
+// trailing ".0" that keeps integral floats apart from integers.
+func floatString(nm LNumber) string {
+	str := strconv.FormatFloat(float64(nm), 'g', 14, 64)
+	if strings.IndexAny(str, ".eIN") < 0 {
+		str += ".0"
+	}
+	return str
+}
+
 // LVCanConvToString returns true if a given LValue is a string or number
 // otherwise false.
 func LVCanConvToString(v LValue) bool {
@@ -372,6 +463,7 @@ func LVCanConvToString(v LValue) bool {
 }
 
 // LVAsNumber tries to convert a given LValue to a number.
+// Integers are converted to the nearest float.
 func LVAsNumber(v LValue) LNumber {
 	if n, ok := v.AsLNumber(); ok {
 		return n
@@ -451,6 +543,30 @@ func (nm LNumber) AsLValue() LValue {
 	return LValue{dataptr: unsafe.Pointer(&ltSentinelNumber), data: uintptr(math.Float64bits(float64(nm)))}
 }
 
+// LInteger is the integer subtype of Lua numbers. Integers are stored in an
+// LValue without loss of precision; Type reports them as LTNumber like floats.
+type LInteger int64
+
+func (i LInteger) String() string   { return strconv.FormatInt(int64(i), 10) }
+func (i LInteger) Type() LValueType { return LTNumber }
+func (i LInteger) AsLValue() LValue {
+	return LValue{dataptr: unsafe.Pointer(&ltSentinelInteger), data: uintptr(i)}
+}
+
+// fmt.Formatter interface
+func (i LInteger) Format(f fmt.State, c rune) {
+	switch c {
+	case 'q', 's':
+		defaultFormat(i.String(), f, c)
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		defaultFormat(float64(i), f, c)
+	case 'i':
+		defaultFormat(int64(i), f, 'd')
+	default:
+		defaultFormat(int64(i), f, c)
+	}
+}
+
 // fmt.Formatter interface
 func (nm LNumber) Format(f fmt.State, c rune) {
 	switch c {
@@ -594,6 +710,10 @@ type LTable struct {
 	strdict map[string]*ltableSlot
 	dict    map[[2]uintptr]*ltableSlot
 	slots   ltableSlots
+
+	weak       *weakState
+	ephemerons ephemerons
+	mem        *memQuota
 }
 
 func (tb *LTable) String() string   { return fmt.Sprintf("table: %p", tb) }
@@ -609,6 +729,8 @@ type LFunction struct {
 	Proto     *FunctionProto
 	GFunction LGFunction
 	Upvalues  []*Upvalue
+
+	ephemerons ephemerons
 }
 type LGFunction func(*LState) int
 type LGFunctionSpec struct {
@@ -629,7 +751,17 @@ type Global struct {
 	Global        *LTable
 
 	builtinMts map[int]LValue
+	customData *customDataRegistry
+	finalizers *finalizerSet
+	mem        memQuota
+	budget     instructionBudget
+	posted     postedCalls
+	profiler   *profiler
+	coverage   *Coverage
 	tempFiles  []*os.File
+	weakTables weakTableSet
+	goErrors   goErrorSet
+	loop       *eventLoop
 }
 
 type LState struct {
@@ -646,12 +778,23 @@ type LState struct {
 	currentFrame *callFrame
 	wrapped      bool
 	uvcache      *Upvalue
-	hasErrorFunc bool
-	mainLoop     func(*LState, *callFrame)
+	mainLoop     func(*LState, *callFrame) bool
 	ctx          context.Context
 	ctxCancelFn  context.CancelFunc
 
 	fastCallLBase int
+	ephemerons    ephemerons
+	interruptTop  int
+
+	hook            *hookState
+	inHook          bool
+	mainLoopChanged bool
+	coverLines      lineTracker
+
+	// number of calls on the stack that a coroutine can not yield across
+	nonYieldableCalls int
+	// registers holding to-be-closed variables, in the order of declaration
+	tbcVars []int
 }
 
 func (ls *LState) String() string   { return fmt.Sprintf("thread: %p", ls) }
@@ -664,6 +807,8 @@ type LUserData struct {
 	Value     interface{}
 	Env       *LTable
 	Metatable LValue
+
+	ephemerons ephemerons
 }
 
 func (ud *LUserData) String() string   { return fmt.Sprintf("userdata: %p", ud) }
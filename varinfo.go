@@ -0,0 +1,131 @@
+package lua
+
+import (
+	"fmt"
+)
+
+/* variable names {{{ */
+
+// varInfo describes the variable that holds lv as an operand of the
+// instruction being executed by the running Lua function, as in
+// " (local 'x')", for runtime error messages. It returns "" if lv is not
+// such an operand or the variable has no name.
+func (ls *LState) varInfo(lv LValue) string {
+	cf := ls.currentFrame
+	if cf == nil || cf.Fn.IsG || cf.Pc == 0 {
+		return ""
+	}
+	proto := cf.Fn.Proto
+	pc := cf.Pc - 1
+	inst := proto.Code[pc]
+	A, B, C := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+	var regs []int
+	switch opGetOpCode(inst) {
+	case OP_GETTABLE, OP_GETTABLEKS, OP_SELF, OP_UNM, OP_BNOT:
+		regs = []int{B}
+	case OP_SETTABLE, OP_SETTABLEKS, OP_CALL, OP_TAILCALL, OP_TFORLOOP:
+		regs = []int{A}
+	case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		regs = []int{B, C}
+	case OP_CONCAT:
+		for reg := B; reg <= C; reg++ {
+			regs = append(regs, reg)
+		}
+	}
+	target := lv.asComparable()
+	for _, reg := range regs {
+		if opIsK(reg) || ls.reg.Get(cf.LocalBase+reg).asComparable() != target {
+			continue
+		}
+		if kind, name := proto.objectName(pc, reg); kind != "" {
+			return fmt.Sprintf(" (%s '%s')", kind, name)
+		}
+		return ""
+	}
+	return ""
+}
+
+// objectName returns the kind ("local", "global", "field", "upvalue" or
+// "method") and the name of the variable whose value register reg holds when
+// the instruction at lastpc is executed.
+func (fp *FunctionProto) objectName(lastpc, reg int) (string, string) {
+	if name, ok := fp.localName(reg+1, lastpc); ok {
+		return "local", name
+	}
+	pc := fp.findSetReg(lastpc, reg)
+	if pc < 0 {
+		return "", ""
+	}
+	inst := fp.Code[pc]
+	switch opGetOpCode(inst) {
+	case OP_MOVE, OP_MOVEN:
+		if B := opGetArgB(inst); B < opGetArgA(inst) {
+			return fp.objectName(pc, B)
+		}
+	case OP_GETGLOBAL:
+		return "global", fp.stringConstant(opGetArgBx(inst))
+	case OP_GETTABLE, OP_GETTABLEKS:
+		// in Lua 5.2 mode, globals are fields of the _ENV variable
+		if _, name := fp.objectName(pc, opGetArgB(inst)); name == "_ENV" {
+			return "global", fp.constantName(opGetArgC(inst))
+		}
+		return "field", fp.constantName(opGetArgC(inst))
+	case OP_GETUPVAL:
+		if B := opGetArgB(inst); B < len(fp.DbgUpvalues) {
+			return "upvalue", fp.DbgUpvalues[B]
+		}
+	case OP_SELF:
+		return "method", fp.constantName(opGetArgC(inst))
+	}
+	return "", ""
+}
+
+// constantName returns the name of the key rk if it is a string constant.
+func (fp *FunctionProto) constantName(rk int) string {
+	if opIsK(rk) {
+		if str, ok := fp.Constants[opIndexK(rk)].AsLString(); ok {
+			return string(str)
+		}
+	}
+	return "?"
+}
+
+// findSetReg returns the pc of the last instruction before lastpc that sets
+// register reg, or -1 if the register is set by conditional code or not at
+// all.
+func (fp *FunctionProto) findSetReg(lastpc, reg int) int {
+	setreg := -1
+	jmptarget := 0
+	for pc := 0; pc < lastpc; pc++ {
+		inst := fp.Code[pc]
+		op := opGetOpCode(inst)
+		A := opGetArgA(inst)
+		changed := false
+		switch op {
+		case OP_LOADNIL:
+			changed = A <= reg && reg <= opGetArgB(inst)
+		case OP_TFORLOOP:
+			changed = reg >= A+2
+		case OP_CALL, OP_TAILCALL:
+			changed = reg >= A
+		case OP_JMP:
+			// code skipped by a forward jump may or may not be executed
+			if dest := pc + 1 + opGetArgSbx(inst); pc < dest && dest <= lastpc && dest > jmptarget {
+				jmptarget = dest
+			}
+		default:
+			changed = opProps[op].SetRegA && reg == A
+		}
+		if changed {
+			if pc < jmptarget {
+				setreg = -1
+			} else {
+				setreg = pc
+			}
+		}
+	}
+	return setreg
+}
+
+/* }}} */
@@ -0,0 +1,39 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestVarInfo(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	errorIfScriptFail(t, L, `t = {}; up = nil`)
+	cases := []struct {
+		script  string
+		pattern string
+	}{
+		{`t.notfound()`, `non-function object \(field 'notfound'\)`},
+		{`undefinedfn()`, `non-function object \(global 'undefinedfn'\)`},
+		{`t:meth()`, `non-function object \(method 'meth'\)`},
+		{`local x; x.y = 1`, `with key 'y' \(local 'x'\)`},
+		{`local u; (function() return u.z end)()`, `with key 'z' \(upvalue 'u'\)`},
+		{`return t.a.b`, `with key 'b' \(field 'a'\)`},
+		{`return t[1][2]`, `with key '2' \(field '\?'\)`},
+		{`local a; return 1 + a`, `between number and nil \(local 'a'\)`},
+		{`local a = {}; return a * 2`, `between table and number \(local 'a'\)`},
+		{`local n = 1; (function() local a; return n - a end)()`, `between number and nil \(local 'a'\)`},
+		{`return "x" .. t.missing`, `between string and nil \(field 'missing'\)`},
+		{`local s; return -s`, `__unm undefined \(local 's'\)`},
+	}
+	for _, c := range cases {
+		errorIfScriptNotFail(t, L, c.script, c.pattern)
+	}
+
+	// values not held by an operand of the faulting instruction are not named
+	errorIfScriptNotFail(t, L, `local a = setmetatable({}, {__index = 1}); return a.x`, `with key 'x'\n`)
+	errorIfScriptNotFail(t, L, `tostring(1)()`, `non-function object\n`)
+	errorIfGFuncNotFail(t, L, func(L *LState) int {
+		L.GetField(LNil, "x")
+		return 0
+	}, `with key 'x'\n`)
+}
@@ -20,72 +20,97 @@ const (
 	retCFChanged
 )
 
-func mainLoop(L *LState, baseframe *callFrame) {
+// runMainLoop runs the main loop of L until baseframe returns. A loop returns
+// true when it stops to let L switch to the one selected by reloadMainLoop,
+// which is then entered from here rather than from the stopped loop, so that
+// switching does not grow the Go stack.
+func (ls *LState) runMainLoop(baseframe *callFrame) {
+	for ls.mainLoop(ls, baseframe) {
+	}
+}
+
+func mainLoop(L *LState, baseframe *callFrame) bool {
 	var inst uint32
 
 	if L.stack.IsEmpty() {
-		return
+		return false
 	}
 
 	L.currentFrame = L.stack.Last()
 	if L.currentFrame.Fn.IsG {
 		callGFunction(L, false)
-		return
+		return false
 	}
 
 	var (
-		cf   = L.currentFrame
-		code = cf.Fn.Proto.Code
-		ret  int
-		jt   = &jumpTable
+		cf     = L.currentFrame
+		code   = cf.Fn.Proto.Code
+		ret    int
+		jt     = &jumpTable
+		posted = &L.G.posted
 	)
 
 	for {
 		inst = code[cf.Pc]
 		cf.Pc++
+		if posted.pending.Load() && L.runPosted() {
+			// resume at the instruction that has not been executed
+			cf.Pc--
+			return true
+		}
 		ret = jt[int(inst>>26)](L, inst, baseframe)
 		if ret == retOK {
 			continue
 		}
 		switch ret {
 		case retFail:
-			return
+			return false
 		case retFnChanged:
 			code = cf.Fn.Proto.Code
 		case retCFChanged:
 			cf = L.currentFrame
 			code = cf.Fn.Proto.Code
 		}
+		if L.mainLoopChanged {
+			L.mainLoopChanged = false
+			return true
+		}
 	}
 }
 
-func mainLoopWithContext(L *LState, baseframe *callFrame) {
+func mainLoopWithContext(L *LState, baseframe *callFrame) bool {
 	var inst uint32
 
 	if L.stack.IsEmpty() {
-		return
+		return false
 	}
 
 	L.currentFrame = L.stack.Last()
 	if L.currentFrame.Fn.IsG {
 		callGFunction(L, false)
-		return
+		return false
 	}
 
 	var (
-		cf   = L.currentFrame
-		code = cf.Fn.Proto.Code
-		ret  int
-		jt   = &jumpTable
+		cf     = L.currentFrame
+		code   = cf.Fn.Proto.Code
+		ret    int
+		jt     = &jumpTable
+		posted = &L.G.posted
 	)
 
 	for {
 		inst = code[cf.Pc]
 		cf.Pc++
+		if posted.pending.Load() && L.runPosted() {
+			// resume at the instruction that has not been executed
+			cf.Pc--
+			return true
+		}
 		select {
 		case <-L.ctx.Done():
-			L.RaiseError(L.ctx.Err().Error())
-			return
+			L.RaiseGoError(L.ctx.Err())
+			return false
 		default:
 			ret = jt[int(inst>>26)](L, inst, baseframe)
 			if ret == retOK {
@@ -93,13 +118,92 @@ func mainLoopWithContext(L *LState, baseframe *callFrame) {
 			}
 			switch ret {
 			case retFail:
-				return
+				return false
 			case retFnChanged:
 				code = cf.Fn.Proto.Code
 			case retCFChanged:
 				cf = L.currentFrame
 				code = cf.Fn.Proto.Code
 			}
+			if L.mainLoopChanged {
+				L.mainLoopChanged = false
+				return true
+			}
+		}
+	}
+}
+
+func mainLoopWithHooks(L *LState, baseframe *callFrame) bool {
+	var inst uint32
+
+	if L.stack.IsEmpty() {
+		return false
+	}
+
+	L.currentFrame = L.stack.Last()
+	if L.currentFrame.Fn.IsG {
+		callGFunction(L, false)
+		return false
+	}
+
+	var (
+		cf     = L.currentFrame
+		code   = cf.Fn.Proto.Code
+		ret    int
+		jt     = &jumpTable
+		budget = &L.G.budget
+		posted = &L.G.posted
+	)
+
+	for {
+		inst = code[cf.Pc]
+		cf.Pc++
+		if posted.pending.Load() && L.runPosted() {
+			// resume at the instruction that has not been executed
+			cf.Pc--
+			return true
+		}
+		if budget.countdown <= 0 {
+			if L.interrupt() {
+				// resume at the instruction that has not been executed
+				cf.Pc--
+				return false
+			}
+		}
+		budget.countdown--
+		if L.tracing() {
+			L.traceExec(cf)
+		}
+		if p := L.G.profiler; p != nil && p.ticks.Load() != 0 {
+			p.sample(L)
+		}
+		if c := L.G.coverage; c != nil {
+			L.traceCoverage(c, cf)
+		}
+		if L.ctx != nil {
+			select {
+			case <-L.ctx.Done():
+				L.RaiseGoError(L.ctx.Err())
+				return false
+			default:
+			}
+		}
+		ret = jt[int(inst>>26)](L, inst, baseframe)
+		if ret == retOK {
+			continue
+		}
+		switch ret {
+		case retFail:
+			return false
+		case retFnChanged:
+			code = cf.Fn.Proto.Code
+		case retCFChanged:
+			cf = L.currentFrame
+			code = cf.Fn.Proto.Code
+		}
+		if L.mainLoopChanged {
+			L.mainLoopChanged = false
+			return true
 		}
 	}
 }
@@ -248,7 +352,25 @@ func switchToParentThread(L *LState, nargs int, haserror bool, kill bool) {
 
 func callGFunction(L *LState, tailcall bool) bool {
 	frame := L.currentFrame
-	gfnret := frame.Fn.GFunction(L)
+	return finishGFunction(L, frame, frame.Fn.GFunction(L), tailcall)
+}
+
+// finishGFunction returns the gfnret results of the Go function of frame, the
+// current frame, or yields them if gfnret is negative. It returns true if the
+// coroutine has yielded or returned.
+func finishGFunction(L *LState, frame *callFrame, gfnret int, tailcall bool) bool {
+	if gfnret < 0 && L.nonYieldableCalls > 0 && L.Parent != nil {
+		L.RaiseError("attempt to yield across a Go-call boundary")
+	}
+	if L.hook != nil && gfnret >= 0 {
+		L.hookReturn()
+		if tailcall {
+			// the Lua function replaced by this one returns as well
+			L.currentFrame = frame.Parent
+			L.hookReturn()
+			L.currentFrame = frame
+		}
+	}
 	if tailcall {
 		L.currentFrame = L.RemoveCallerFrame()
 	}
@@ -263,7 +385,7 @@ func callGFunction(L *LState, tailcall bool) bool {
 		wantret = gfnret
 	}
 
-	if tailcall && L.Parent != nil && L.stack.Sp() == 1 {
+	if L.Parent != nil && L.stack.Sp() == 1 {
 		switchToParentThread(L, wantret, false, true)
 		return true
 	}
@@ -384,6 +506,7 @@ func threadRun(L *LState) {
 
 	defer func() {
 		if rcv := recover(); rcv != nil {
+			L.fastCallLBase = 0
 			var lv LValue
 			if v, ok := rcv.(*ApiError); ok {
 				lv = v.Object
@@ -404,7 +527,53 @@ func threadRun(L *LState) {
 			}
 		}
 	}()
-	L.mainLoop(L, nil)
+	if L.interruptTop > 0 {
+		// discard the values passed to resume a thread suspended by an interrupt
+		L.reg.SetTop(L.interruptTop - 1)
+		L.interruptTop = 0
+	} else if L.hook != nil && L.stack.Sp() == 1 && L.currentFrame.Pc == 0 {
+		// the body of the coroutine is entered
+		L.hookCall()
+	}
+	L.updateMainLoop()
+	status := ResumeYield
+	for {
+		if !threadStep(L, status) {
+			return
+		}
+		status = ResumeError
+	}
+}
+
+// threadStep runs the thread from its last frame until it yields or returns.
+// The frame of a Go function whose Go stack has been discarded by a yield
+// is completed by calling its continuation with status. threadStep returns
+// true if an error has been caught by such a frame, whose continuation is
+// then to be called with ResumeError.
+func threadStep(L *LState, status ResumeState) (caught bool) {
+	nonYieldableCalls := L.nonYieldableCalls
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			if _, ok := rcv.(yieldUnwind); ok {
+				return
+			}
+			L.nonYieldableCalls = nonYieldableCalls
+			if !L.recoverContinuation(rcv) {
+				panic(rcv)
+			}
+			caught = true
+		}
+	}()
+	for L.Parent != nil && !L.stack.IsEmpty() {
+		L.currentFrame = L.stack.Last()
+		if L.currentFrame.cont != nil {
+			L.callContinuation(status)
+			status = ResumeYield
+		} else {
+			L.runMainLoop(nil)
+		}
+	}
+	return false
 }
 
 type instFunc func(*LState, uint32, *callFrame) int
@@ -805,7 +974,7 @@ func init() {
 			RA := lbase + A
 			B := int(inst & 0x1ff)    //GETB
 			C := int(inst>>9) & 0x1ff //GETC
-			v := newLTable(B, C)
+			v := L.G.mem.newTable(B, C)
 			// this section is inlined by go-inline
 			// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
 			{
@@ -894,7 +1063,29 @@ func init() {
 			RA := lbase + A
 			B := int(inst & 0x1ff) //GETB
 			unaryv := L.rkValue(B)
-			if nm, ok := unaryv.AsLNumber(); ok {
+			wrap := L.Options.LanguageVersion >= Lua53
+			if i, ok := unaryv.AsLInteger(); ok && (i != math.MinInt64 || wrap) {
+				// this section is inlined by go-inline
+				// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+				{
+					rg := reg
+					regi := RA
+					vali := -i
+					newSize := regi + 1
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+					{
+						requiredSize := newSize
+						if requiredSize > cap(rg.array) {
+							rg.resize(requiredSize)
+						}
+					}
+					*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+					if regi >= rg.top {
+						rg.top = regi + 1
+					}
+				}
+			} else if nm, ok := unaryv.AsLNumber(); ok {
 				// this section is inlined by go-inline
 				// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
 				{
@@ -942,32 +1133,55 @@ func init() {
 						}
 					}
 				} else if str, ok1 := unaryv.AsLString(); ok1 {
-					if num, err := parseNumber(string(str)); err == nil {
-						// this section is inlined by go-inline
-						// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
-						{
-							rg := reg
-							regi := RA
-							vali := -num
-							newSize := regi + 1
+					if num, err := parseNumberValue(string(str)); err == nil {
+						if i, ok := num.AsLInteger(); ok && (i != math.MinInt64 || wrap) {
 							// this section is inlined by go-inline
-							// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+							// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
 							{
-								requiredSize := newSize
-								if requiredSize > cap(rg.array) {
-									rg.resize(requiredSize)
+								rg := reg
+								regi := RA
+								vali := -i
+								newSize := regi + 1
+								// this section is inlined by go-inline
+								// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+								{
+									requiredSize := newSize
+									if requiredSize > cap(rg.array) {
+										rg.resize(requiredSize)
+									}
+								}
+								*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+								if regi >= rg.top {
+									rg.top = regi + 1
 								}
 							}
-							*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
-							if regi >= rg.top {
-								rg.top = regi + 1
+						} else {
+							// this section is inlined by go-inline
+							// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+							{
+								rg := reg
+								regi := RA
+								vali := -LVAsNumber(num)
+								newSize := regi + 1
+								// this section is inlined by go-inline
+								// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+								{
+									requiredSize := newSize
+									if requiredSize > cap(rg.array) {
+										rg.resize(requiredSize)
+									}
+								}
+								*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+								if regi >= rg.top {
+									rg.top = regi + 1
+								}
 							}
 						}
 					} else {
-						L.RaiseError("__unm undefined")
+						L.RaiseError("__unm undefined%s", L.varInfo(unaryv))
 					}
 				} else {
-					L.RaiseError("__unm undefined")
+					L.RaiseError("__unm undefined%s", L.varInfo(unaryv))
 				}
 			}
 			return 0
@@ -1035,11 +1249,11 @@ func init() {
 			case LTString:
 				lv := lv.MustLString()
 				// this section is inlined by go-inline
-				// source function is 'func (rg *registry) SetNumber(regi int, vali LNumber) ' in '_state.go'
+				// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
 				{
 					rg := reg
 					regi := RA
-					vali := LNumber(len(lv))
+					vali := LInteger(len(lv))
 					newSize := regi + 1
 					// this section is inlined by go-inline
 					// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
@@ -1061,57 +1275,100 @@ func init() {
 					reg.Push(lv)
 					L.Call(1, 1)
 					ret := reg.Pop()
-					if ret.Type() == LTNumber {
-						v, _ := ret.AsLNumber()
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+					{
+						rg := reg
+						regi := RA
+						vali := ret
+						newSize := regi + 1
 						// this section is inlined by go-inline
-						// source function is 'func (rg *registry) SetNumber(regi int, vali LNumber) ' in '_state.go'
+						// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
 						{
-							rg := reg
-							regi := RA
-							vali := v
-							newSize := regi + 1
-							// this section is inlined by go-inline
-							// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
-							{
-								requiredSize := newSize
-								if requiredSize > cap(rg.array) {
-									rg.resize(requiredSize)
-								}
-							}
-							*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
-							if regi >= rg.top {
-								rg.top = regi + 1
+							requiredSize := newSize
+							if requiredSize > cap(rg.array) {
+								rg.resize(requiredSize)
 							}
 						}
-					} else {
+						*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+						if regi >= rg.top {
+							rg.top = regi + 1
+						}
+					}
+				} else if lv.Type() == LTTable {
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+					{
+						rg := reg
+						regi := RA
+						vali := LInteger(lv.MustLTable().Len())
+						newSize := regi + 1
 						// this section is inlined by go-inline
-						// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+						// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
 						{
-							rg := reg
-							regi := RA
-							vali := ret
-							newSize := regi + 1
-							// this section is inlined by go-inline
-							// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
-							{
-								requiredSize := newSize
-								if requiredSize > cap(rg.array) {
-									rg.resize(requiredSize)
-								}
-							}
-							*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
-							if regi >= rg.top {
-								rg.top = regi + 1
+							requiredSize := newSize
+							if requiredSize > cap(rg.array) {
+								rg.resize(requiredSize)
 							}
 						}
+						*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+						if regi >= rg.top {
+							rg.top = regi + 1
+						}
 					}
-				} else if lv.Type() == LTTable {
+				} else {
+					L.RaiseError("__len undefined")
+				}
+			}
+			return 0
+		},
+		opArith,   // OP_IDIV
+		opBitwise, // OP_BAND
+		opBitwise, // OP_BOR
+		opBitwise, // OP_BXOR
+		opBitwise, // OP_SHL
+		opBitwise, // OP_SHR
+		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_BNOT
+			reg := L.reg
+			cf := L.currentFrame
+			lbase := cf.LocalBase
+			A := int(inst>>18) & 0xff //GETA
+			RA := lbase + A
+			B := int(inst & 0x1ff) //GETB
+			unaryv := L.rkValue(B)
+			if i, ok := bitwiseOperand(unaryv); ok {
+				// this section is inlined by go-inline
+				// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+				{
+					rg := reg
+					regi := RA
+					vali := ^i
+					newSize := regi + 1
 					// this section is inlined by go-inline
-					// source function is 'func (rg *registry) SetNumber(regi int, vali LNumber) ' in '_state.go'
+					// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+					{
+						requiredSize := newSize
+						if requiredSize > cap(rg.array) {
+							rg.resize(requiredSize)
+						}
+					}
+					*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+					if regi >= rg.top {
+						rg.top = regi + 1
+					}
+				}
+			} else {
+				op := L.metaOp1(unaryv, "__bnot")
+				if op.Type() == LTFunction {
+					reg.Push(op)
+					reg.Push(unaryv)
+					L.Call(1, 1)
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
 					{
 						rg := reg
 						regi := RA
-						vali := LNumber(lv.MustLTable().Len())
+						vali := reg.Pop()
 						newSize := regi + 1
 						// this section is inlined by go-inline
 						// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
@@ -1126,8 +1383,10 @@ func init() {
 							rg.top = regi + 1
 						}
 					}
+				} else if _, ok := arithOperand(unaryv); ok {
+					L.RaiseError("number has no integer representation%s", L.varInfo(unaryv))
 				} else {
-					L.RaiseError("__len undefined")
+					L.RaiseError("__bnot undefined%s", L.varInfo(unaryv))
 				}
 			}
 			return 0
@@ -1210,9 +1469,9 @@ func init() {
 			rhs := L.rkValue(C)
 			ret := false
 
-			if v1, ok1 := lhs.AsLNumber(); ok1 {
-				if v2, ok2 := rhs.AsLNumber(); ok2 {
-					ret = v1 <= v2
+			if lhs.isNumber() {
+				if rhs.isNumber() {
+					ret = numberLessEqual(lhs, rhs)
 				} else {
 					L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
 				}
@@ -1313,7 +1572,7 @@ func init() {
 				callable, meta = L.metaCall(lv)
 			}
 
-			if callable != nil && callable.IsFast {
+			if callable != nil && callable.IsFast && L.hook == nil {
 				if callFastGFunction(L, callable, RA, nret, false) {
 					return retFail
 				} else {
@@ -1327,9 +1586,10 @@ func init() {
 					L.RaiseError("stack overflow")
 				}
 				if callable == nil {
-					L.RaiseError("attempt to call a non-function object")
+					L.RaiseError("attempt to call a non-function object%s", L.varInfo(lv))
 				}
 				newcf := L.stack.PushEmpty()
+				newcf.cont = nil
 				newcf.Fn = callable
 				newcf.Pc = 0
 				newcf.Base = RA
@@ -1425,11 +1685,11 @@ func init() {
 							if CompatVarArg {
 								ls.reg.SetTop(cf.LocalBase + nargs + np + 1)
 								if (proto.IsVarArg & VarArgNeedsArg) != 0 {
-									argtb := newLTable(nvarargs, 0)
+									argtb := ls.G.mem.newTable(nvarargs, 0)
 									for i := 0; i < nvarargs; i++ {
 										argtb.RawSetInt(i+1, ls.reg.Get(cf.LocalBase+np+i))
 									}
-									argtb.RawSetString("n", LNumber(nvarargs).AsLValue())
+									argtb.RawSetString("n", LInteger(nvarargs).AsLValue())
 									//ls.reg.Set(cf.LocalBase+nargs+np, argtb)
 									ls.reg.array[cf.LocalBase+nargs+np] = argtb.AsLValue()
 								} else {
@@ -1443,10 +1703,15 @@ func init() {
 					}
 				}
 				L.currentFrame = newcf
+				if L.hook != nil {
+					L.hookCall()
+				}
 			}
 			if callable.IsG {
 				if callGFunction(L, false) {
 					return retFail
+				} else if L.mainLoopChanged {
+					return retCFChanged
 				} else {
 					return 0
 				}
@@ -1474,7 +1739,7 @@ func init() {
 				callable, meta = L.metaCall(lv)
 			}
 			if callable == nil {
-				L.RaiseError("attempt to call a non-function object")
+				L.RaiseError("attempt to call a non-function object%s", L.varInfo(lv))
 				return 0
 			}
 			// this section is inlined by go-inline
@@ -1611,11 +1876,11 @@ func init() {
 							if CompatVarArg {
 								ls.reg.SetTop(cf.LocalBase + nargs + np + 1)
 								if (proto.IsVarArg & VarArgNeedsArg) != 0 {
-									argtb := newLTable(nvarargs, 0)
+									argtb := ls.G.mem.newTable(nvarargs, 0)
 									for i := 0; i < nvarargs; i++ {
 										argtb.RawSetInt(i+1, ls.reg.Get(cf.LocalBase+np+i))
 									}
-									argtb.RawSetString("n", LNumber(nvarargs).AsLValue())
+									argtb.RawSetString("n", LInteger(nvarargs).AsLValue())
 									//ls.reg.Set(cf.LocalBase+nargs+np, argtb)
 									ls.reg.array[cf.LocalBase+nargs+np] = argtb.AsLValue()
 								} else {
@@ -1677,6 +1942,9 @@ func init() {
 				}
 				cf.Base = base
 				cf.LocalBase = base + (cf.LocalBase - lbase + 1)
+				if L.hook != nil {
+					L.hookCall()
+				}
 				return retFnChanged
 			}
 			return 0
@@ -1708,6 +1976,9 @@ func init() {
 					}
 				}
 			}
+			if n := len(L.tbcVars); n != 0 && L.tbcVars[n-1] >= lbase {
+				L.closeVars(lbase)
+			}
 			nret := B - 1
 			if B == 0 {
 				nret = reg.Top() - RA
@@ -1716,6 +1987,9 @@ func init() {
 			if cf.NRet == MultRet {
 				n = nret
 			}
+			if L.hook != nil {
+				L.hookReturn()
+			}
 
 			if L.Parent != nil && L.stack.Sp() == 1 {
 				// this section is inlined by go-inline
@@ -1960,7 +2234,59 @@ func init() {
 			lbase := cf.LocalBase
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
-			if init, ok1 := reg.Get(RA).AsLNumber(); ok1 {
+			if idx, ok1 := reg.Get(RA).AsLInteger(); ok1 {
+				// integer loops are set up by OP_FORPREP
+				limit := reg.Get(RA + 1).mustLIntegerUnchecked()
+				step := reg.Get(RA + 2).mustLIntegerUnchecked()
+				next := idx + step
+				if (step > 0 && next >= idx && next <= limit) || (step <= 0 && next <= idx && next >= limit) {
+					v := LInteger(next).AsLValue()
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+					{
+						rg := reg
+						regi := RA
+						vali := v
+						newSize := regi + 1
+						// this section is inlined by go-inline
+						// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+						{
+							requiredSize := newSize
+							if requiredSize > cap(rg.array) {
+								rg.resize(requiredSize)
+							}
+						}
+						*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+						if regi >= rg.top {
+							rg.top = regi + 1
+						}
+					}
+					Sbx := int(inst&0x3ffff) - opMaxArgSbx //GETSBX
+					cf.Pc += Sbx
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+					{
+						rg := reg
+						regi := RA + 3
+						vali := v
+						newSize := regi + 1
+						// this section is inlined by go-inline
+						// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+						{
+							requiredSize := newSize
+							if requiredSize > cap(rg.array) {
+								rg.resize(requiredSize)
+							}
+						}
+						*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+						if regi >= rg.top {
+							rg.top = regi + 1
+						}
+					}
+				} else {
+					reg.SetTop(RA + 1)
+				}
+			} else if init, ok1 := reg.Get(RA).AsLNumber(); ok1 {
 				if limit, ok2 := reg.Get(RA + 1).AsLNumber(); ok2 {
 					if step, ok3 := reg.Get(RA + 2).AsLNumber(); ok3 {
 						init += step
@@ -2062,7 +2388,48 @@ func init() {
 			A := int(inst>>18) & 0xff //GETA
 			RA := lbase + A
 			Sbx := int(inst&0x3ffff) - opMaxArgSbx //GETSBX
-			if init, ok1 := reg.Get(RA).AsLNumber(); ok1 {
+			if start, limit, step, ok := forPrepInteger(reg.Get(RA), reg.Get(RA+1), reg.Get(RA+2)); ok {
+				// this section is inlined by go-inline
+				// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+				{
+					rg := reg
+					regi := RA
+					vali := LInteger(start - step)
+					newSize := regi + 1
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+					{
+						requiredSize := newSize
+						if requiredSize > cap(rg.array) {
+							rg.resize(requiredSize)
+						}
+					}
+					*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+					if regi >= rg.top {
+						rg.top = regi + 1
+					}
+				}
+				// this section is inlined by go-inline
+				// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+				{
+					rg := reg
+					regi := RA + 1
+					vali := LInteger(limit)
+					newSize := regi + 1
+					// this section is inlined by go-inline
+					// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+					{
+						requiredSize := newSize
+						if requiredSize > cap(rg.array) {
+							rg.resize(requiredSize)
+						}
+					}
+					*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+					if regi >= rg.top {
+						rg.top = regi + 1
+					}
+				}
+			} else if init, ok1 := reg.Get(RA).AsLNumber(); ok1 {
 				if step, ok2 := reg.Get(RA + 2).AsLNumber(); ok2 {
 					// this section is inlined by go-inline
 					// source function is 'func (rg *registry) SetNumber(regi int, vali LNumber) ' in '_state.go'
@@ -2271,6 +2638,9 @@ func init() {
 					}
 				}
 			}
+			if n := len(L.tbcVars); n != 0 && L.tbcVars[n-1] >= RA {
+				L.closeVars(RA)
+			}
 			return 0
 		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_CLOSURE
@@ -2281,6 +2651,7 @@ func init() {
 			RA := lbase + A
 			Bx := int(inst & 0x3ffff) //GETBX
 			proto := cf.Fn.Proto.FunctionPrototypes[Bx]
+			L.G.mem.charge(memFunctionSize + int(proto.NumUpvalues)*memUpvalueSize)
 			closure := newLFunctionL(proto, cf.Fn.Env, int(proto.NumUpvalues))
 			// this section is inlined by go-inline
 			// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
@@ -2380,13 +2751,19 @@ func init() {
 			}
 			return 0
 		},
+		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_TBC
+			cf := L.currentFrame
+			A := int(inst>>18) & 0xff //GETA
+			L.markToBeClosed(cf.LocalBase + A)
+			return 0
+		},
 		func(L *LState, inst uint32, baseframe *callFrame) int { //OP_NOP
 			return 0
 		},
 	}
 }
 
-func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW
+func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV
 	reg := L.reg
 	cf := L.currentFrame
 	lbase := cf.LocalBase
@@ -2397,12 +2774,10 @@ func opArith(L *LState, inst uint32, baseframe *callFrame) int { //OP_ADD, OP_SU
 	C := int(inst>>9) & 0x1ff //GETC
 	lhs := L.rkValue(B)
 	rhs := L.rkValue(C)
-	v1, ok1 := lhs.AsLNumber()
-	v2, ok2 := rhs.AsLNumber()
-	if ok1 && ok2 {
-		v := numberArith(L, opcode, LNumber(v1), LNumber(v2))
+	if lhs.isNumber() && rhs.isNumber() {
+		v := L.arithNumbers(opcode, lhs, rhs)
 		// this section is inlined by go-inline
-		// source function is 'func (rg *registry) SetNumber(regi int, vali LNumber) ' in '_state.go'
+		// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
 		{
 			rg := reg
 			regi := RA
@@ -2457,7 +2832,89 @@ func luaModulo(lhs, rhs LNumber) LNumber {
 	return LNumber(v)
 }
 
-func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
+// arithNumbers performs an arithmetic operation on two numbers with the
+// semantics of the language version of L. In Lua 5.3 and later, an integer
+// floor division or modulo by zero is an error.
+func (L *LState) arithNumbers(opcode int, lhs, rhs LValue) LValue {
+	if L.Options.LanguageVersion < Lua53 {
+		return numberArith(opcode, lhs, rhs, false)
+	}
+	if integerDivisionByZero(opcode, lhs, rhs) {
+		if opcode == OP_IDIV {
+			L.RaiseError("attempt to perform 'n//0'")
+		}
+		L.RaiseError("attempt to perform 'n%0'")
+	}
+	return numberArith(opcode, lhs, rhs, true)
+}
+
+// integerDivisionByZero reports whether opcode is a floor division or a
+// modulo of two integers by zero.
+func integerDivisionByZero(opcode int, lhs, rhs LValue) bool {
+	if opcode != OP_IDIV && opcode != OP_MOD {
+		return false
+	}
+	_, ok := lhs.AsLInteger()
+	i, ok2 := rhs.AsLInteger()
+	return ok && ok2 && i == 0
+}
+
+// numberArith performs an arithmetic operation on two numbers. Operations on
+// two integers other than division and exponentiation produce an integer,
+// unless the result overflows or the operation is a floor division or modulo
+// by zero, in which case the float result is produced. If wrap is true, as in
+// Lua 5.3 and later, integer results wrap around on overflow instead; the
+// division by zero is then checked by arithNumbers.
+func numberArith(opcode int, lhs, rhs LValue, wrap bool) LValue {
+	if i1, ok1 := lhs.AsLInteger(); ok1 {
+		if i2, ok2 := rhs.AsLInteger(); ok2 {
+			if v, ok := integerArith(opcode, i1, i2, wrap); ok {
+				return v.AsLValue()
+			}
+		}
+	}
+	v1, _ := lhs.AsLNumber()
+	v2, _ := rhs.AsLNumber()
+	return floatArith(opcode, v1, v2).AsLValue()
+}
+
+func integerArith(opcode int, lhs, rhs LInteger, wrap bool) (LInteger, bool) {
+	switch opcode {
+	case OP_ADD:
+		v := lhs + rhs
+		return v, wrap || (v > lhs) == (rhs > 0)
+	case OP_SUB:
+		v := lhs - rhs
+		return v, wrap || (v < lhs) == (rhs > 0)
+	case OP_MUL:
+		if lhs == 0 || rhs == 0 {
+			return 0, true
+		}
+		v := lhs * rhs
+		return v, wrap || v/rhs == lhs && !(lhs == -1 && rhs == math.MinInt64) && !(rhs == -1 && lhs == math.MinInt64)
+	case OP_MOD:
+		if rhs == 0 {
+			return 0, false
+		}
+		v := lhs % rhs
+		if v != 0 && (v^rhs) < 0 {
+			v += rhs
+		}
+		return v, true
+	case OP_IDIV:
+		if rhs == 0 {
+			return 0, false
+		}
+		v := lhs / rhs
+		if lhs%rhs != 0 && (lhs^rhs) < 0 {
+			v--
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+func floatArith(opcode int, lhs, rhs LNumber) LNumber {
 	switch opcode {
 	case OP_ADD:
 		return lhs + rhs
@@ -2473,10 +2930,46 @@ func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
 		flhs := float64(lhs)
 		frhs := float64(rhs)
 		return LNumber(math.Pow(flhs, frhs))
+	case OP_IDIV:
+		return LNumber(math.Floor(float64(lhs / rhs)))
 	}
 	panic("should not reach here")
 }
 
+// forPrepInteger prepares an integer numeric for loop. It fails if the loop
+// has to run on floats, i.e. if init or step is not an integer, or if the
+// limit cannot be clamped to an integer.
+func forPrepInteger(init, limit, step LValue) (LInteger, LInteger, LInteger, bool) {
+	i, ok1 := init.AsLInteger()
+	s, ok2 := step.AsLInteger()
+	if !ok1 || !ok2 || !limit.isNumber() {
+		return 0, 0, 0, false
+	}
+	if (s > 0 && i < math.MinInt64+s) || (s < 0 && i > math.MaxInt64+s) {
+		// init-step would overflow
+		return 0, 0, 0, false
+	}
+	if l, ok := limit.AsLInteger(); ok {
+		return i, l, s, true
+	}
+	f := float64(limit.mustLNumberUnchecked())
+	if math.IsNaN(f) {
+		return 0, 0, 0, false
+	}
+	if s > 0 {
+		f = math.Floor(f)
+	} else {
+		f = math.Ceil(f)
+	}
+	switch {
+	case f >= 1<<63:
+		return i, math.MaxInt64, s, true
+	case f < -(1 << 63):
+		return i, math.MinInt64, s, true
+	}
+	return i, LInteger(f), s, true
+}
+
 func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 	event := ""
 	switch opcode {
@@ -2492,6 +2985,8 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		event = "__mod"
 	case OP_POW:
 		event = "__pow"
+	case OP_IDIV:
+		event = "__idiv"
 	}
 	op := L.metaOp2(lhs, rhs, event)
 	if _, ok := op.AsLFunction(); ok {
@@ -2501,23 +2996,192 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		L.Call(2, 1)
 		return L.reg.Pop()
 	}
+	operands := [2]LValue{lhs, rhs}
 	if str, ok := lhs.AsLString(); ok {
-		if lnum, err := parseNumber(string(str)); err == nil {
-			lhs = lnum.AsLValue()
+		if lnum, err := parseNumberValue(string(str)); err == nil {
+			lhs = lnum
 		}
 	}
 	if str, ok := rhs.AsLString(); ok {
-		if rnum, err := parseNumber(string(str)); err == nil {
-			rhs = rnum.AsLValue()
+		if rnum, err := parseNumberValue(string(str)); err == nil {
+			rhs = rnum
 		}
 	}
-	if v1, ok1 := lhs.AsLNumber(); ok1 {
-		if v2, ok2 := rhs.AsLNumber(); ok2 {
-			return numberArith(L, opcode, LNumber(v1), LNumber(v2)).AsLValue()
+	if lhs.isNumber() && rhs.isNumber() {
+		return L.arithNumbers(opcode, lhs, rhs)
+	}
+	culprit := operands[0]
+	if lhs.isNumber() {
+		culprit = operands[1]
+	}
+	L.RaiseError("cannot perform %v operation between %v and %v%s",
+		strings.TrimLeft(event, "_"), lhs.Type().String(), rhs.Type().String(), L.varInfo(culprit))
+
+	return LValue{}
+}
+
+func opBitwise(L *LState, inst uint32, baseframe *callFrame) int { //OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR
+	reg := L.reg
+	cf := L.currentFrame
+	lbase := cf.LocalBase
+	A := int(inst>>18) & 0xff //GETA
+	RA := lbase + A
+	opcode := int(inst >> 26) //GETOPCODE
+	B := int(inst & 0x1ff)    //GETB
+	C := int(inst>>9) & 0x1ff //GETC
+	lhs := L.rkValue(B)
+	rhs := L.rkValue(C)
+	if i1, ok1 := bitwiseOperand(lhs); ok1 {
+		if i2, ok2 := bitwiseOperand(rhs); ok2 {
+			v := integerBitwise(opcode, i1, i2)
+			// this section is inlined by go-inline
+			// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+			{
+				rg := reg
+				regi := RA
+				vali := v
+				newSize := regi + 1
+				// this section is inlined by go-inline
+				// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+				{
+					requiredSize := newSize
+					if requiredSize > cap(rg.array) {
+						rg.resize(requiredSize)
+					}
+				}
+				*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+				if regi >= rg.top {
+					rg.top = regi + 1
+				}
+			}
+			return 0
 		}
 	}
-	L.RaiseError(fmt.Sprintf("cannot perform %v operation between %v and %v",
-		strings.TrimLeft(event, "_"), lhs.Type().String(), rhs.Type().String()))
+	v := objectBitwise(L, opcode, lhs, rhs)
+	// this section is inlined by go-inline
+	// source function is 'func (rg *registry) Set(regi int, vali LValue) ' in '_state.go'
+	{
+		rg := reg
+		regi := RA
+		vali := v
+		newSize := regi + 1
+		// this section is inlined by go-inline
+		// source function is 'func (rg *registry) checkSize(requiredSize int) ' in '_state.go'
+		{
+			requiredSize := newSize
+			if requiredSize > cap(rg.array) {
+				rg.resize(requiredSize)
+			}
+		}
+		*(*LValue)(unsafe.Add(unsafe.Pointer(unsafe.SliceData(rg.array)), uintptr(regi)*unsafe.Sizeof(LValue{}))) = vali.AsLValue()
+		if regi >= rg.top {
+			rg.top = regi + 1
+		}
+	}
+	return 0
+}
+
+// arithOperand converts lv, a number or a string convertible to a number, to a
+// number.
+func arithOperand(lv LValue) (LValue, bool) {
+	if lv.isNumber() {
+		return lv, true
+	}
+	if str, ok := lv.AsLString(); ok {
+		if num, err := parseNumberValue(string(str)); err == nil {
+			return num, true
+		}
+	}
+	return LNil, false
+}
+
+// bitwiseOperand converts lv, a number or a string convertible to a number, to
+// the integer a bitwise operation operates on. It fails if the number has no
+// exact integer representation.
+func bitwiseOperand(lv LValue) (LInteger, bool) {
+	if i, ok := lv.AsLInteger(); ok {
+		return i, true
+	}
+	num, ok := arithOperand(lv)
+	if !ok {
+		return 0, false
+	}
+	if i, ok := num.AsLInteger(); ok {
+		return i, true
+	}
+	n, _ := num.AsLNumber()
+	f := float64(n)
+	if f != math.Floor(f) || f < -(1<<63) || f >= 1<<63 {
+		return 0, false
+	}
+	return LInteger(f), true
+}
+
+func integerBitwise(opcode int, lhs, rhs LInteger) LInteger {
+	switch opcode {
+	case OP_BAND:
+		return lhs & rhs
+	case OP_BOR:
+		return lhs | rhs
+	case OP_BXOR:
+		return lhs ^ rhs
+	case OP_SHL:
+		return shiftLeft(lhs, rhs)
+	case OP_SHR:
+		return shiftLeft(lhs, -rhs)
+	}
+	panic("should not reach here")
+}
+
+// shiftLeft shifts x left by n bits, or logically right by -n bits if n is
+// negative. Shifting by 64 bits or more produces 0.
+func shiftLeft(x, n LInteger) LInteger {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n >= 0:
+		return LInteger(uint64(x) << uint64(n))
+	}
+	return LInteger(uint64(x) >> uint64(-n))
+}
+
+func objectBitwise(L *LState, opcode int, lhs, rhs LValue) LValue {
+	event := ""
+	switch opcode {
+	case OP_BAND:
+		event = "__band"
+	case OP_BOR:
+		event = "__bor"
+	case OP_BXOR:
+		event = "__bxor"
+	case OP_SHL:
+		event = "__shl"
+	case OP_SHR:
+		event = "__shr"
+	}
+	op := L.metaOp2(lhs, rhs, event)
+	if _, ok := op.AsLFunction(); ok {
+		L.reg.Push(op)
+		L.reg.Push(lhs)
+		L.reg.Push(rhs)
+		L.Call(2, 1)
+		return L.reg.Pop()
+	}
+	_, lnum := arithOperand(lhs)
+	_, rnum := arithOperand(rhs)
+	if lnum && rnum {
+		culprit := lhs
+		if _, ok := bitwiseOperand(lhs); ok {
+			culprit = rhs
+		}
+		L.RaiseError("number has no integer representation%s", L.varInfo(culprit))
+	}
+	culprit := lhs
+	if lnum {
+		culprit = rhs
+	}
+	L.RaiseError("cannot perform %v operation between %v and %v%s",
+		strings.TrimLeft(event, "_"), lhs.Type().String(), rhs.Type().String(), L.varInfo(culprit))
 
 	return LValue{}
 }
@@ -2538,21 +3202,30 @@ func stringConcat(L *LState, total, last int) LValue {
 				total--
 				i--
 			} else {
-				L.RaiseError("cannot perform concat operation between %v and %v", lhs.Type().String(), rhs.Type().String())
+				culprit := lhs
+				if LVCanConvToString(lhs) {
+					culprit = rhs
+				}
+				L.RaiseError("cannot perform concat operation between %v and %v%s", lhs.Type().String(), rhs.Type().String(), L.varInfo(culprit))
 				return LValue{}
 			}
 		} else {
 			buf := make([]string, total+1)
-			buf[total] = LVAsString(rhs)
+			buf[total] = L.lvAsString(rhs)
 			for total > 0 {
 				lhs = L.reg.Get(i)
 				if !LVCanConvToString(lhs) {
 					break
 				}
-				buf[total-1] = LVAsString(lhs)
+				buf[total-1] = L.lvAsString(lhs)
 				i--
 				total--
 			}
+			n := 0
+			for _, s := range buf {
+				n += len(s)
+			}
+			L.G.mem.chargeString(n)
 			rhs = LString(strings.Join(buf, "")).AsLValue()
 		}
 	}
@@ -2561,9 +3234,9 @@ func stringConcat(L *LState, total, last int) LValue {
 
 func lessThan(L *LState, lhs, rhs LValue) bool {
 	// optimization for numbers
-	if v1, ok1 := lhs.AsLNumber(); ok1 {
-		if v2, ok2 := rhs.AsLNumber(); ok2 {
-			return v1 < v2
+	if lhs.isNumber() {
+		if rhs.isNumber() {
+			return numberLessThan(lhs, rhs)
 		}
 		L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
 	}
@@ -2581,6 +3254,57 @@ func lessThan(L *LState, lhs, rhs LValue) bool {
 	return ret
 }
 
+// numberLessThan compares two numbers by their mathematical values. Mixed
+// comparisons are exact, as in Lua 5.3.
+func numberLessThan(lhs, rhs LValue) bool {
+	i1, isInt1 := lhs.AsLInteger()
+	i2, isInt2 := rhs.AsLInteger()
+	switch {
+	case isInt1 && isInt2:
+		return i1 < i2
+	case isInt1:
+		// i < f <=> i < ceil(f)
+		f := float64(rhs.mustLNumberUnchecked())
+		if fi, ok := floatToInteger(math.Ceil(f)); ok {
+			return int64(i1) < fi
+		}
+		return f > 0
+	case isInt2:
+		// f < i <=> floor(f) < i
+		f := float64(lhs.mustLNumberUnchecked())
+		if fi, ok := floatToInteger(math.Floor(f)); ok {
+			return fi < int64(i2)
+		}
+		return f < 0
+	}
+	return lhs.mustLNumberUnchecked() < rhs.mustLNumberUnchecked()
+}
+
+// numberLessEqual is like numberLessThan for the <= operator.
+func numberLessEqual(lhs, rhs LValue) bool {
+	i1, isInt1 := lhs.AsLInteger()
+	i2, isInt2 := rhs.AsLInteger()
+	switch {
+	case isInt1 && isInt2:
+		return i1 <= i2
+	case isInt1:
+		// i <= f <=> i <= floor(f)
+		f := float64(rhs.mustLNumberUnchecked())
+		if fi, ok := floatToInteger(math.Floor(f)); ok {
+			return int64(i1) <= fi
+		}
+		return f > 0
+	case isInt2:
+		// f <= i <=> ceil(f) <= i
+		f := float64(lhs.mustLNumberUnchecked())
+		if fi, ok := floatToInteger(math.Ceil(f)); ok {
+			return fi <= int64(i2)
+		}
+		return f < 0
+	}
+	return lhs.mustLNumberUnchecked() <= rhs.mustLNumberUnchecked()
+}
+
 func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	lt := lhs.Type()
 	if lt != rhs.Type() {
@@ -2592,9 +3316,7 @@ func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	case LTNil:
 		ret = true
 	case LTNumber:
-		v1, _ := lhs.AsLNumber()
-		v2, _ := rhs.AsLNumber()
-		ret = v1 == v2
+		ret = numberEquals(lhs, rhs)
 	case LTBool:
 		ret = bool(lhs.MustLBool()) == bool(rhs.MustLBool())
 	case LTString:
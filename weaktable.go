@@ -0,0 +1,396 @@
+package lua
+
+import (
+	"strings"
+	"unsafe"
+	"weak"
+)
+
+/* weak tables {{{ */
+
+const (
+	weakKeys uint8 = 1 << iota
+	weakValues
+)
+
+// Weak tables keep all their entries in the hash part. A collectable key or
+// value is stored in its slot as a weak reference: an LValue whose data is
+// weakRefTag and whose dataptr points to a weakRef. Values of ephemeron
+// entries, i.e. collectable values under a collectable key in a table with
+// weak keys only, are stored in the ephemerons map of the key object and the
+// slot holds ephemeronMarker. These LValues never leave the table.
+const (
+	weakRefTag   = ^uintptr(0)
+	ephemeronTag = ^uintptr(0) - 1
+)
+
+var ephemeronMarker = LValue{data: ephemeronTag}
+
+func isEphemeronMarker(lv LValue) bool {
+	return lv.dataptr == nil && lv.data == ephemeronTag
+}
+
+type weakRef struct {
+	ptr  weak.Pointer[byte]
+	addr uintptr
+	data uintptr
+}
+
+type weakState struct {
+	mode uint8
+	self weak.Pointer[LTable]
+	// number of slots added since the last sweep, and live slots after it
+	added, live int
+}
+
+// weakTableSet holds the weak tables a Global sweeps after a collection.
+type weakTableSet map[weak.Pointer[LTable]]struct{}
+
+// ephemerons holds the values of ephemeron entries keyed by the object that
+// owns the map. The values are reachable exactly as long as the key is.
+type ephemerons map[weak.Pointer[LTable]]LValue
+
+func parseWeakMode(mode LValue) uint8 {
+	s, ok := mode.AsLString()
+	if !ok {
+		return 0
+	}
+	var m uint8
+	if strings.ContainsRune(string(s), 'k') {
+		m |= weakKeys
+	}
+	if strings.ContainsRune(string(s), 'v') {
+		m |= weakValues
+	}
+	return m
+}
+
+// isCollectable reports whether lv refers to an object that a weak table
+// holds weakly. Strings, numbers and booleans are values and are never
+// removed from weak tables. Channels and custom data are held strongly as
+// they may point to memory the garbage collector does not manage.
+func isCollectable(lv LValue) bool {
+	if lv.isNumber() {
+		return false
+	}
+	switch lv.data {
+	case maxUintptr + uintptr(LTTable), maxUintptr + uintptr(LTFunction),
+		maxUintptr + uintptr(LTUserData), maxUintptr + uintptr(LTThread):
+		return true
+	}
+	return false
+}
+
+func makeWeakRef(lv LValue) LValue {
+	ref := &weakRef{ptr: weak.Make((*byte)(lv.dataptr)), addr: uintptr(lv.dataptr), data: lv.data}
+	return LValue{dataptr: unsafe.Pointer(ref), data: weakRefTag}
+}
+
+// resolveWeakRef returns the value a slot key or value refers to, or LNil if
+// the object has been collected.
+func resolveWeakRef(lv LValue) LValue {
+	if lv.data != weakRefTag || lv.isNumber() {
+		return lv
+	}
+	ref := (*weakRef)(lv.dataptr)
+	p := ref.ptr.Value()
+	if p == nil {
+		return LNil
+	}
+	return LValue{dataptr: unsafe.Pointer(p), data: ref.data}
+}
+
+// slotComparable returns the dict key of a stored slot key, which stays
+// available after a weakly referenced key has been collected.
+func slotComparable(key LValue) [2]uintptr {
+	if key.data == weakRefTag && !key.isNumber() {
+		ref := (*weakRef)(key.dataptr)
+		return [2]uintptr{ref.addr, ref.data}
+	}
+	return key.asComparable()
+}
+
+func ephemeronsOf(key LValue) *ephemerons {
+	switch key.data {
+	case maxUintptr + uintptr(LTTable):
+		return &(*LTable)(key.dataptr).ephemerons
+	case maxUintptr + uintptr(LTFunction):
+		return &(*LFunction)(key.dataptr).ephemerons
+	case maxUintptr + uintptr(LTUserData):
+		return &(*LUserData)(key.dataptr).ephemerons
+	case maxUintptr + uintptr(LTThread):
+		return &(*LState)(key.dataptr).ephemerons
+	}
+	return nil
+}
+
+// weakModeOf returns the weak mode requested by the __mode field of mt.
+func weakModeOf(mt LValue) uint8 {
+	mtb, ok := mt.AsLTable()
+	if !ok {
+		return 0
+	}
+	return parseWeakMode(mtb.RawGetString("__mode"))
+}
+
+// setWeakMode switches the table between strong and weak storage. It reports
+// whether the table has just become weak, in which case the caller should
+// register it for sweeping.
+func (tb *LTable) setWeakMode(mode uint8) bool {
+	if tb.weak == nil && mode == 0 || tb.weak != nil && tb.weak.mode == mode {
+		return false
+	}
+	type entry struct{ key, value LValue }
+	entries := make([]entry, 0, len(tb.array)+len(tb.strdict)+len(tb.dict))
+	tb.ForEach(func(key, value LValue) {
+		entries = append(entries, entry{key, value})
+	})
+	wasWeak := tb.weak != nil
+	if wasWeak {
+		for slot := tb.slots.start; slot != nil; slot = slot.next {
+			tb.releaseEphemeron(slot)
+		}
+	}
+	tb.array = nil
+	tb.strdict = nil
+	tb.dict = nil
+	tb.slots = ltableSlots{}
+	tb.slots.Init(0)
+	tb.weak = nil
+	// the entries are already accounted for
+	mem := tb.mem
+	tb.mem = nil
+	defer func() { tb.mem = mem }()
+	if mode != 0 {
+		tb.weak = &weakState{mode: mode, self: weak.Make(tb)}
+	}
+	for _, e := range entries {
+		tb.RawSet(e.key, e.value)
+	}
+	if tb.weak != nil {
+		tb.weak.added = 0
+		tb.weak.live = len(entries)
+	}
+	return tb.weak != nil && !wasWeak
+}
+
+func (tb *LTable) weakLookup(key LValue) (*ltableSlot, bool) {
+	if s, ok := key.AsLString(); ok {
+		slot, found := tb.strdict[string(s)]
+		return slot, found
+	}
+	slot, found := tb.dict[normalizeNumberKey(key).asComparable()]
+	return slot, found
+}
+
+// weakValue returns the live value of a slot, or LNil if its key or value
+// has been collected.
+func (tb *LTable) weakValue(slot *ltableSlot) (LValue, LValue) {
+	key := resolveWeakRef(slot.key)
+	if key.EqualsLNil() {
+		return LNil, LNil
+	}
+	if isEphemeronMarker(slot.value) {
+		return key, (*ephemeronsOf(key))[tb.weak.self]
+	}
+	return key, resolveWeakRef(slot.value)
+}
+
+func (tb *LTable) weakGet(key LValue) LValue {
+	slot, ok := tb.weakLookup(key)
+	if !ok {
+		return LNil
+	}
+	_, value := tb.weakValue(slot)
+	return value
+}
+
+func (tb *LTable) releaseEphemeron(slot *ltableSlot) {
+	if !isEphemeronMarker(slot.value) {
+		return
+	}
+	if key := resolveWeakRef(slot.key); !key.EqualsLNil() {
+		delete(*ephemeronsOf(key), tb.weak.self)
+	}
+}
+
+func (tb *LTable) weakRelease(slot *ltableSlot) {
+	tb.releaseEphemeron(slot)
+	if s, ok := slot.key.AsLString(); ok {
+		delete(tb.strdict, string(s))
+	} else if ckey := slotComparable(slot.key); tb.dict[ckey] == slot {
+		delete(tb.dict, ckey)
+	}
+	tb.slots.Release(slot)
+}
+
+func (tb *LTable) weakSet(key, value LValue) {
+	if key.isNumber() {
+		key = normalizeNumberKey(key)
+	}
+	slot, ok := tb.weakLookup(key)
+	if ok && resolveWeakRef(slot.key).EqualsLNil() {
+		// a collected key whose address has been reused by key
+		tb.weakRelease(slot)
+		ok = false
+	}
+	if value.EqualsLNil() {
+		if ok {
+			tb.weakRelease(slot)
+		}
+		return
+	}
+
+	if !ok {
+		tb.chargeHash()
+	}
+	mode := tb.weak.mode
+	storedKey, storedValue := key, value
+	if mode&weakKeys != 0 && isCollectable(key) {
+		storedKey = makeWeakRef(key)
+		if mode&weakValues == 0 && isCollectable(value) {
+			if eph := ephemeronsOf(key); eph != nil {
+				if *eph == nil {
+					*eph = make(ephemerons)
+				}
+				for t := range *eph {
+					if t.Value() == nil {
+						delete(*eph, t)
+					}
+				}
+				(*eph)[tb.weak.self] = value
+				storedValue = ephemeronMarker
+			}
+		}
+	}
+	if mode&weakValues != 0 && isCollectable(value) {
+		storedValue = makeWeakRef(value)
+	}
+
+	if ok {
+		if !isEphemeronMarker(storedValue) {
+			tb.releaseEphemeron(slot)
+		}
+		slot.value = storedValue
+		return
+	}
+	slot = tb.slots.Put(storedKey, storedValue)
+	if s, isStr := key.AsLString(); isStr {
+		if tb.strdict == nil {
+			tb.strdict = make(map[string]*ltableSlot, defaultHashCap)
+		}
+		tb.strdict[string(s)] = slot
+	} else {
+		if tb.dict == nil {
+			tb.dict = make(map[[2]uintptr]*ltableSlot, defaultHashCap)
+		}
+		tb.dict[key.asComparable()] = slot
+	}
+	tb.weak.added++
+	if tb.weak.added > max(tb.weak.live, defaultHashCap) {
+		tb.sweepWeak()
+	}
+}
+
+// weakReplace sets the value of key if the table holds a live entry for it,
+// and reports whether it did. rawGetForSet has no slot to give for weak
+// tables, so the setters use it to assign existing keys without __newindex.
+func (tb *LTable) weakReplace(key, value LValue) bool {
+	if tb.weakGet(key).EqualsLNil() {
+		return false
+	}
+	tb.weakSet(key, value)
+	return true
+}
+
+// sweepWeak removes the entries whose key or value has been collected.
+func (tb *LTable) sweepWeak() {
+	live := 0
+	for slot := tb.slots.start; slot != nil; {
+		next := slot.next
+		if _, value := tb.weakValue(slot); value.EqualsLNil() {
+			tb.weakRelease(slot)
+		} else {
+			live++
+		}
+		slot = next
+	}
+	tb.weak.added = 0
+	tb.weak.live = live
+}
+
+func (tb *LTable) weakForEach(cb func(LValue, LValue)) {
+	for slot := tb.slots.start; slot != nil; slot = slot.next {
+		if key, value := tb.weakValue(slot); !value.EqualsLNil() {
+			cb(key, value)
+		}
+	}
+}
+
+func (tb *LTable) weakNext(key LValue) (LValue, LValue) {
+	slot := tb.slots.start
+	if !key.EqualsLNil() {
+		cur, ok := tb.weakLookup(key)
+		if !ok {
+			return LNil, LNil
+		}
+		slot = cur.next
+	}
+	for ; slot != nil; slot = slot.next {
+		if key, value := tb.weakValue(slot); !value.EqualsLNil() {
+			return key, value
+		}
+	}
+	return LNil, LNil
+}
+
+// weakLen returns a border of a weak table, which has no array part.
+func (tb *LTable) weakLen() int {
+	n := 0
+	for !tb.weakGet(LInteger(n + 1).AsLValue()).EqualsLNil() {
+		n++
+	}
+	return n
+}
+
+func (tb *LTable) weakInsert(i int, value LValue) {
+	n := tb.weakLen()
+	if i > n {
+		tb.RawSetInt(i, value)
+		return
+	}
+	for j := n; j >= i; j-- {
+		tb.RawSetInt(j+1, tb.RawGetInt(j))
+	}
+	tb.RawSetInt(i, value)
+}
+
+func (tb *LTable) weakRemove(pos int) LValue {
+	n := tb.weakLen()
+	if n == 0 || pos > n {
+		return LNil
+	}
+	if pos <= 0 {
+		pos = n
+	}
+	oldval := tb.RawGetInt(pos)
+	for j := pos; j < n; j++ {
+		tb.RawSetInt(j, tb.RawGetInt(j+1))
+	}
+	tb.RawSetInt(n, LNil)
+	return oldval
+}
+
+// sweepWeakTables removes collected entries from all weak tables created by
+// this state. It is meant to be called right after a garbage collection.
+func (g *Global) sweepWeakTables() {
+	for p := range g.weakTables {
+		if tb := p.Value(); tb != nil && tb.weak != nil {
+			tb.sweepWeak()
+		} else {
+			delete(g.weakTables, p)
+		}
+	}
+}
+
+/* }}} */
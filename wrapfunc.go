@@ -0,0 +1,268 @@
+package lua
+
+import (
+	"reflect"
+	"strconv"
+)
+
+/* typed function wrappers {{{ */
+
+// Optional marks an argument of a wrapped function as optional. Valid is false
+// if the argument is absent or nil, otherwise Value holds the converted
+// argument, checked the same way as a required argument of type T.
+type Optional[T any] struct {
+	Value T
+	Valid bool
+}
+
+// Or returns the argument value, or d if the argument was absent or nil.
+func (o Optional[T]) Or(d T) T {
+	if o.Valid {
+		return o.Value
+	}
+	return d
+}
+
+type argChecker interface {
+	checkArg(L *LState, n int)
+}
+
+func (o *Optional[T]) checkArg(L *LState, n int) {
+	if L.Get(n).EqualsLNil() {
+		return
+	}
+	o.Value, o.Valid = CheckArg[T](L, n), true
+}
+
+// CheckArg converts the n-th argument to T. Like the Check* functions it
+// raises an argument error if the argument cannot be converted. Types without
+// a Lua counterpart are converted as by BindCustomData.
+func CheckArg[T any](L *LState, n int) T {
+	var v T
+	switch p := any(&v).(type) {
+	case *LValue:
+		*p = L.Get(n)
+	case *bool:
+		*p = L.CheckBool(n)
+	case *int:
+		*p = L.CheckInt(n)
+	case *int64:
+		*p = L.CheckInt64(n)
+	case *int32:
+		*p = int32(L.checkSigned(n, 32))
+	case *uint:
+		*p = uint(L.checkUnsigned(n, strconv.IntSize))
+	case *uint64:
+		*p = L.checkUnsigned(n, 64)
+	case *uint32:
+		*p = uint32(L.checkUnsigned(n, 32))
+	case *float64:
+		*p = float64(L.CheckNumber(n))
+	case *float32:
+		*p = float32(L.CheckNumber(n))
+	case *LNumber:
+		*p = L.CheckNumber(n)
+	case *LInteger:
+		*p = LInteger(L.CheckInt64(n))
+	case *string:
+		*p = L.CheckString(n)
+	case *LString:
+		*p = LString(L.CheckString(n))
+	case **LTable:
+		*p = L.CheckTable(n)
+	case **LFunction:
+		*p = L.CheckFunction(n)
+	case **LUserData:
+		*p = L.CheckUserData(n)
+	case **LState:
+		*p = L.CheckThread(n)
+	case argChecker:
+		p.checkArg(L, n)
+	default:
+		reflect.ValueOf(&v).Elem().Set(checkReflectArg(L, n, reflect.TypeOf(&v).Elem()))
+	}
+	return v
+}
+
+// PushResult converts v to an LValue and pushes it onto the stack.
+func PushResult[T any](L *LState, v T) {
+	switch v := any(v).(type) {
+	case LValue:
+		L.Push(v)
+	case bool:
+		L.Push(LBool(v).AsLValue())
+	case int:
+		L.Push(LInteger(v).AsLValue())
+	case int64:
+		L.Push(LInteger(v).AsLValue())
+	case LInteger:
+		L.Push(v.AsLValue())
+	case float64:
+		L.Push(LNumber(v).AsLValue())
+	case LNumber:
+		L.Push(v.AsLValue())
+	case string:
+		L.Push(LString(v).AsLValue())
+	case LString:
+		L.Push(v.AsLValue())
+	default:
+		L.Push(reflectToLValue(L, reflect.ValueOf(&v).Elem()))
+	}
+}
+
+func raiseIfError(L *LState, err error) {
+	if err != nil {
+		L.RaiseGoError(err)
+	}
+}
+
+// Func0 wraps fn as a Lua function returning one value. A non-nil error is
+// raised as a Lua error. The wrapper never re-enters the VM, so it is called
+// through the IsFast path.
+func Func0[R any](fn func() (R, error)) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		r, err := fn()
+		raiseIfError(L, err)
+		PushResult(L, r)
+		return 1
+	}, IsFast: true}
+}
+
+// Func1 is like Func0 for functions taking one argument.
+func Func1[A, R any](fn func(A) (R, error)) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		a := CheckArg[A](L, 1)
+		r, err := fn(a)
+		raiseIfError(L, err)
+		PushResult(L, r)
+		return 1
+	}, IsFast: true}
+}
+
+// Func2 is like Func0 for functions taking two arguments.
+func Func2[A, B, R any](fn func(A, B) (R, error)) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		a := CheckArg[A](L, 1)
+		b := CheckArg[B](L, 2)
+		r, err := fn(a, b)
+		raiseIfError(L, err)
+		PushResult(L, r)
+		return 1
+	}, IsFast: true}
+}
+
+// Func3 is like Func0 for functions taking three arguments.
+func Func3[A, B, C, R any](fn func(A, B, C) (R, error)) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		a := CheckArg[A](L, 1)
+		b := CheckArg[B](L, 2)
+		c := CheckArg[C](L, 3)
+		r, err := fn(a, b, c)
+		raiseIfError(L, err)
+		PushResult(L, r)
+		return 1
+	}, IsFast: true}
+}
+
+// Func4 is like Func0 for functions taking four arguments.
+func Func4[A, B, C, D, R any](fn func(A, B, C, D) (R, error)) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		a := CheckArg[A](L, 1)
+		b := CheckArg[B](L, 2)
+		c := CheckArg[C](L, 3)
+		d := CheckArg[D](L, 4)
+		r, err := fn(a, b, c, d)
+		raiseIfError(L, err)
+		PushResult(L, r)
+		return 1
+	}, IsFast: true}
+}
+
+// Proc0 wraps fn as a Lua function returning no values. A non-nil error is
+// raised as a Lua error. Like Func0 it is called through the IsFast path.
+func Proc0(fn func() error) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		raiseIfError(L, fn())
+		return 0
+	}, IsFast: true}
+}
+
+// Proc1 is like Proc0 for functions taking one argument.
+func Proc1[A any](fn func(A) error) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		a := CheckArg[A](L, 1)
+		raiseIfError(L, fn(a))
+		return 0
+	}, IsFast: true}
+}
+
+// Proc2 is like Proc0 for functions taking two arguments.
+func Proc2[A, B any](fn func(A, B) error) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		a := CheckArg[A](L, 1)
+		b := CheckArg[B](L, 2)
+		raiseIfError(L, fn(a, b))
+		return 0
+	}, IsFast: true}
+}
+
+// Proc3 is like Proc0 for functions taking three arguments.
+func Proc3[A, B, C any](fn func(A, B, C) error) LGFunctionSpec {
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		a := CheckArg[A](L, 1)
+		b := CheckArg[B](L, 2)
+		c := CheckArg[C](L, 3)
+		raiseIfError(L, fn(a, b, c))
+		return 0
+	}, IsFast: true}
+}
+
+// WrapFunc wraps a Go function of any signature using reflection. Arguments
+// are checked as by CheckArg, a variadic last parameter takes the remaining
+// arguments, and all results are returned to Lua except a trailing error,
+// which is raised when non-nil. If the first parameter is an *LState, it
+// receives the calling state; such functions may re-enter the VM and are
+// therefore not called through the IsFast path.
+func WrapFunc(fn any) LGFunctionSpec {
+	fv := reflect.ValueOf(fn)
+	ftyp := fv.Type()
+	if ftyp.Kind() != reflect.Func {
+		panic("WrapFunc: " + ftyp.String() + " is not a function")
+	}
+	nin := ftyp.NumIn()
+	nout := ftyp.NumOut()
+	withState := nin > 0 && ftyp.In(0) == lstatePtrType
+	returnsError := nout > 0 && ftyp.Out(nout-1) == errorType
+	return LGFunctionSpec{Fn: func(L *LState) int {
+		args := make([]reflect.Value, 0, nin)
+		argn := 1
+		for i := 0; i < nin; i++ {
+			if i == 0 && withState {
+				args = append(args, reflect.ValueOf(L))
+				continue
+			}
+			if ftyp.IsVariadic() && i == nin-1 {
+				elem := ftyp.In(i).Elem()
+				for ; argn <= L.GetTop(); argn++ {
+					args = append(args, checkReflectArg(L, argn, elem))
+				}
+				break
+			}
+			args = append(args, checkReflectArg(L, argn, ftyp.In(i)))
+			argn++
+		}
+		rets := fv.Call(args)
+		if returnsError {
+			if err := rets[nout-1]; !err.IsNil() {
+				L.RaiseGoError(err.Interface().(error))
+			}
+			rets = rets[:nout-1]
+		}
+		for _, ret := range rets {
+			L.Push(reflectToLValue(L, ret))
+		}
+		return len(rets)
+	}, IsFast: !withState}
+}
+
+/* }}} */
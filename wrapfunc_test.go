@@ -0,0 +1,109 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFuncWrappers(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("add", L.NewFunctionSpec(Func2(func(a, b int) (int, error) {
+		return a + b, nil
+	})).AsLValue())
+	L.SetGlobal("repeat_", L.NewFunctionSpec(Func2(func(s string, n Optional[int]) (string, error) {
+		return strings.Repeat(s, n.Or(2)), nil
+	})).AsLValue())
+	L.SetGlobal("div", L.NewFunctionSpec(Func2(func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return a / b, nil
+	})).AsLValue())
+	var got []string
+	L.SetGlobal("record", L.NewFunctionSpec(Proc1(func(s string) error {
+		got = append(got, s)
+		return nil
+	})).AsLValue())
+	L.SetGlobal("keys", L.NewFunctionSpec(Func1(func(tb *LTable) (int, error) {
+		n := 0
+		tb.ForEach(func(LValue, LValue) { n++ })
+		return n, nil
+	})).AsLValue())
+	L.SetGlobal("succ", L.NewFunctionSpec(Func1(func(n uint64) (uint64, error) {
+		return n + 1, nil
+	})).AsLValue())
+	L.SetGlobal("join", L.NewFunctionSpec(WrapFunc(func(sep string, parts ...string) string {
+		return strings.Join(parts, sep)
+	})).AsLValue())
+
+	errorIfScriptFail(t, L, `
+	assert(add(1, 2) == 3)
+	assert(repeat_("ab") == "abab")
+	assert(repeat_("ab", 3) == "ababab")
+	assert(div(1, 4) == 0.25)
+	assert(keys({1, 2, a = 3}) == 3)
+	assert(join(",", "a", "b", "c") == "a,b,c")
+	assert(succ(9007199254740993) == 9007199254740994)
+	record("x")
+	record(1)
+	`)
+	errorIfNotEqual(t, "x,1", strings.Join(got, ","))
+
+	errorIfScriptNotFail(t, L, `local x = add(1, {})`, `bad argument #2 to add \(number expected, got table\)`)
+	errorIfScriptNotFail(t, L, `local x = repeat_("a", "b")`, `bad argument #2 to repeat_ \(number expected, got string\)`)
+	errorIfScriptNotFail(t, L, `local x = div(1, 0)`, `division by zero`)
+
+	errInvalid := errors.New("invalid")
+	L.SetGlobal("check", L.NewFunctionSpec(WrapFunc(func(ok bool) (bool, error) {
+		if !ok {
+			return false, errInvalid
+		}
+		return true, nil
+	})).AsLValue())
+	errorIfScriptFail(t, L, `assert(check(true))`)
+	err := L.DoString(`check(false)`)
+	errorIfFalse(t, errors.Is(err, errInvalid), "unexpected error: %v", err)
+
+	// an error on the fast path must not disturb later calls
+	errorIfScriptFail(t, L, `
+	local function f(a, b, c)
+		local ok, err = pcall(function(x, y) local z = add(x, y) end, 1, {})
+		assert(not ok)
+		assert(select("#", 1, 2, 3) == 3)
+		return add(a, b)
+	end
+	assert(f(1, 2) == 3)
+	`)
+}
+
+func TestCheckArgIntegerRange(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("i32", L.NewFunctionSpec(Func1(func(n int32) (int32, error) {
+		return n, nil
+	})).AsLValue())
+	L.SetGlobal("u", L.NewFunctionSpec(Func1(func(n uint) (uint, error) {
+		return n, nil
+	})).AsLValue())
+	L.SetGlobal("u32", L.NewFunctionSpec(Func1(func(n uint32) (uint32, error) {
+		return n, nil
+	})).AsLValue())
+	L.SetGlobal("u64", L.NewFunctionSpec(Func1(func(n uint64) (bool, error) {
+		return n == 1<<63, nil
+	})).AsLValue())
+
+	errorIfScriptFail(t, L, `
+	assert(i32(-2147483648) == -2147483648)
+	assert(i32(3.0) == 3)
+	assert(u32(4294967295) == 4294967295)
+	assert(u(0) == 0)
+	assert(u64(2^63))
+	`)
+	errorIfScriptNotFail(t, L, `i32(2^40 + 5)`, `bad argument #1 to i32 \(number out of range\)`)
+	errorIfScriptNotFail(t, L, `i32(1.5)`, `bad argument #1 to i32 \(number has no integer representation\)`)
+	errorIfScriptNotFail(t, L, `u(-1)`, `bad argument #1 to u \(number out of range\)`)
+	errorIfScriptNotFail(t, L, `u32(2^32)`, `bad argument #1 to u32 \(number out of range\)`)
+	errorIfScriptNotFail(t, L, `u64(-1)`, `bad argument #1 to u64 \(number out of range\)`)
+}